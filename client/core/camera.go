@@ -125,3 +125,27 @@ func (c *Camera) FollowPosition(targetPos mgl32.Vec3, maxDistance float32) {
   newPosition := targetPos.Sub(normalizedDirection.Mul(maxDistance))
   c.SetPosition(newPosition)
 }
+
+// keeps the ground out of the way between the followed target and the camera
+func (c *Camera) AvoidTerrain(target mgl32.Vec3, terrain *WorldState) {
+  if terrain == nil {
+    return
+  }
+  position := c.Position
+  if c.isMoving {
+    position = c.targetPosition
+  }
+  
+  toCamera := position.Sub(target)
+  distance := toCamera.Len()
+  hit, hitDistance, ok := terrain.Raycast(target, toCamera, distance)
+  if !ok {
+    return
+  }
+  
+  // stay a little in front of the hit and above the ground
+  c.Position = target.Add(toCamera.Normalize().Mul(max(0, hitDistance-0.5)))
+  c.Position[1] = max(c.Position[1], hit.Y()+0.5)
+  c.targetPosition = c.Position
+  c.isMoving = false
+}
@@ -1,10 +1,10 @@
 package core
 
 import (
-  "fmt"
+  "encoding/json"
   "net"
+  "sync"
   "time"
-  "strings"
 )
 
 type UDPClient struct {
@@ -12,6 +12,16 @@ type UDPClient struct {
   WorldState     *WorldState
   LocalUserID    string
   MessageHandler *MessageHandler
+  // sent with identify so the server restores the player, empty plays as
+  // a guest
+  PlayerID       string
+  
+  // token of the player session, it lets a client that changed address
+  // take its session over, and the player secret the server restores the
+  // player with
+  sessionMu sync.Mutex
+  session   string
+  secret    string
 }
 
 func NewUDPClient(addr string, worldState *WorldState) (*UDPClient, error) {
@@ -44,9 +54,26 @@ func (client *UDPClient) GetLocalUser() *User {
 }
 
 type ServerMessage struct {
-  Type    string        `json:"type"`
-  Users   []UserUpdate  `json:"users,omitempty"`
-  UserID  string        `json:"user_id,omitempty"`
+  Type     string        `json:"type"`
+  Users    []UserUpdate  `json:"users,omitempty"`
+  UserID   string        `json:"user_id,omitempty"`
+  // chunk_data
+  X        int32         `json:"x,omitempty"`
+  Z        int32         `json:"z,omitempty"`
+  Data     []byte        `json:"data,omitempty"`
+  // zone_change, map_info
+  Zone     string        `json:"zone,omitempty"`
+  MapID    string        `json:"map_id,omitempty"`
+  MapHash  string        `json:"map_hash,omitempty"`
+  Rotation []string      `json:"rotation,omitempty"`
+  // kicked, banned, broadcast, identify_refused
+  Message  string        `json:"message,omitempty"`
+  // session
+  Player   string        `json:"player,omitempty"`
+  Session  string        `json:"session,omitempty"`
+  Secret   string        `json:"secret,omitempty"`
+  // ping
+  Nonce    uint64        `json:"nonce,omitempty"`
 }
 
 type UserUpdate struct {
@@ -62,7 +89,7 @@ func (client *UDPClient) displayUserCount() {
   defer client.WorldState.mu.RUnlock()
 
   count := len(client.WorldState.Users)
-  fmt.Printf("+ User count: %d users\n", count)
+  worldLog.Debug("users", "count", count)
 }
 
 func (client *UDPClient) StartReceiving() {
@@ -76,19 +103,18 @@ func (client *UDPClient) StartReceiving() {
   }()
 
   go func() {
-    buffer := make([]byte, 4096)
+    // chunk_data messages are much larger than world updates
+    buffer := make([]byte, 65535)
     for {
       client.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
       n, err := client.Conn.Read(buffer)
       if err != nil {
         if ne, ok := err.(net.Error); ok && ne.Timeout() {
-          fmt.Println("UDP Read timeout: can't reach server")
+          netLog.Warn("read timeout, can't reach server")
           continue
         }
         
-        errMessage := err.Error()
-        formatted := strings.ReplaceAll(errMessage, ": ", "\n\t")
-        fmt.Println("Receive error:\n\t" + formatted)
+        netLog.Warn("receive failed", "err", err)
         continue
       }
       
@@ -97,20 +123,60 @@ func (client *UDPClient) StartReceiving() {
   }()
 }
 
+func (client *UDPClient) SendJSON(msg interface{}) error {
+  data, err := json.Marshal(msg)
+  if err != nil {
+    return err
+  }
+  _, err = client.Conn.Write(data)
+  return err
+}
+
+func (client *UDPClient) SetSession(session string) {
+  client.sessionMu.Lock()
+  defer client.sessionMu.Unlock()
+  client.session = session
+}
+
+func (client *UDPClient) Session() string {
+  client.sessionMu.Lock()
+  defer client.sessionMu.Unlock()
+  return client.session
+}
+
+func (client *UDPClient) SetSecret(secret string) {
+  client.sessionMu.Lock()
+  defer client.sessionMu.Unlock()
+  client.secret = secret
+}
+
+func (client *UDPClient) Secret() string {
+  client.sessionMu.Lock()
+  defer client.sessionMu.Unlock()
+  return client.secret
+}
+
+// identify doubles as keep alive, the server ignores it once the player is
+// known. Sending it first lets the server spawn the player where it left.
 func (client *UDPClient) StartSending() {
   go func() {
-    counter := 1
+    identify := struct {
+      Type    string `json:"type"`
+      Player  string `json:"player,omitempty"`
+      Session string `json:"session,omitempty"`
+      Secret  string `json:"secret,omitempty"`
+    }{Type: "identify", Player: client.PlayerID}
     ticker := time.NewTicker(2 * time.Second)
     defer ticker.Stop()
-    for range ticker.C {
-      message := fmt.Sprintf("Message %d", counter)
-      _, err := client.Conn.Write([]byte(message))
-      if err != nil {
-        fmt.Printf("Send error: %v\n", err)
-        continue
+    for {
+      identify.Session = client.Session()
+      identify.Secret = client.Secret()
+      if err := client.SendJSON(identify); err != nil {
+        netLog.Warn("send failed", "err", err)
+      } else {
+        netLog.Debug("sent", "type", identify.Type)
       }
-      fmt.Printf("- Sent: %s\n", message)
-      counter++
+      <-ticker.C
     }
   }()
 }
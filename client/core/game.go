@@ -35,7 +35,7 @@ func (g *Game) Draw(width, height int) {
       float32(localUser.Location.Y),
       float32(localUser.Location.Z),
     }
-    g.renderer.CameraFollowLocation(location);
+    g.renderer.CameraFollowLocation(location, worldState);
   }
   
   g.renderer.UpdateCamera()
@@ -44,6 +44,28 @@ func (g *Game) Draw(width, height int) {
   gridVerts := g.renderer.GetGridVertices(10)
   g.renderer.DrawVertices(gridVerts, [4]float32{0.235, 0.235, 0.314, 1.0}, rgl.LINES, mvp)
 
+  for _, chunk := range worldState.GetChunks() {
+    for biome, vertices := range chunk.Vertices() {
+      g.renderer.DrawVertices(vertices, BiomeColor(biome), rgl.LINES, mvp)
+    }
+  }
+
+  for _, chunk := range worldState.GetChunks() {
+    for _, object := range chunk.Objects {
+      pos := Vec3{X: float64(object.X), Y: float64(object.Y) + 0.5, Z: float64(object.Z)}
+      g.renderer.DrawVertices(g.renderer.GetCubeEdgesFromVertices(pos), GetColorForObjectKind(object.Kind), rgl.LINES, mvp)
+    }
+  }
+
+  // ground under the mouse
+  mouseX, mouseY := GetMousePosition()
+  if origin, direction, ok := g.renderer.ScreenRay(mouseX, mouseY, width, height); ok {
+    if hit, _, ok := worldState.Raycast(origin, direction, 100); ok {
+      pos := Vec3{X: float64(hit.X()), Y: float64(hit.Y()), Z: float64(hit.Z())}
+      g.renderer.DrawVertices(g.renderer.GetCubeEdgesFromVertices(pos), [4]float32{1.0, 1.0, 0.392, 1.0}, rgl.LINES, mvp)
+    }
+  }
+
   for _, user := range worldState.GetUsers() {
     if !user.IsActive {
       continue
@@ -153,6 +153,12 @@ func ProcessMouseMove(x, y float64) {
   inputMgr.mouseMoved = true
 }
 
+func GetMousePosition() (float64, float64) {
+  inputMgr.mu.Lock()
+  defer inputMgr.mu.Unlock()
+  return inputMgr.mouseX, inputMgr.mouseY
+}
+
 /**
  * mobile bindings functions
  */
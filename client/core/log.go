@@ -0,0 +1,223 @@
+package core
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// same levels and output formats as the server logger, the client has no
+// events component
+var logComponentNames = []string{"net", "world", "map"}
+
+type logComponent struct {
+  name  string
+  level slog.LevelVar
+}
+
+var logComponents = func() map[string]*logComponent {
+  components := make(map[string]*logComponent)
+  for _, name := range logComponentNames {
+    components[name] = &logComponent{name: name}
+  }
+  return components
+}()
+
+var (
+  netLog   = newComponentLogger("net")
+  worldLog = newComponentLogger("world")
+  mapLog   = newComponentLogger("map")
+)
+
+var logOutput atomic.Pointer[slog.Handler]
+
+var logLimiter = &rateLimiter{}
+
+func init() {
+  var handler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+  logOutput.Store(&handler)
+}
+
+type LogConfig struct {
+  Level     string
+  Levels    map[string]string
+  Format    string
+  RateLimit int
+}
+
+func DefaultLogConfig() LogConfig {
+  return LogConfig{Level: "info", Format: "text", RateLimit: 20}
+}
+
+// RTGS_LOG_LEVEL, RTGS_LOG_LEVELS (net=debug,map=warn), RTGS_LOG_FORMAT
+// (text or json) and RTGS_LOG_RATE_LIMIT, like the server flags
+func LogConfigFromEnv() (LogConfig, error) {
+  config := DefaultLogConfig()
+  if value, ok := os.LookupEnv("RTGS_LOG_LEVEL"); ok {
+    config.Level = value
+  }
+  if value, ok := os.LookupEnv("RTGS_LOG_FORMAT"); ok {
+    config.Format = value
+  }
+  if value, ok := os.LookupEnv("RTGS_LOG_RATE_LIMIT"); ok {
+    limit, err := strconv.Atoi(value)
+    if err != nil {
+      return config, fmt.Errorf("invalid RTGS_LOG_RATE_LIMIT: %v", err)
+    }
+    config.RateLimit = limit
+  }
+  if value, ok := os.LookupEnv("RTGS_LOG_LEVELS"); ok {
+    config.Levels = make(map[string]string)
+    for _, item := range strings.Split(value, ",") {
+      if item = strings.TrimSpace(item); item == "" {
+        continue
+      }
+      name, level, ok := strings.Cut(item, "=")
+      if !ok {
+        return config, fmt.Errorf("invalid RTGS_LOG_LEVELS: expected component=level, got %q", item)
+      }
+      config.Levels[strings.TrimSpace(name)] = strings.TrimSpace(level)
+    }
+  }
+  return config, nil
+}
+
+func SetupLogging(w io.Writer, config LogConfig) error {
+  options := &slog.HandlerOptions{Level: slog.LevelDebug}
+  var handler slog.Handler
+  switch config.Format {
+  case "json":
+    handler = slog.NewJSONHandler(w, options)
+  case "text", "":
+    handler = slog.NewTextHandler(w, options)
+  default:
+    return fmt.Errorf("unknown log format %q", config.Format)
+  }
+  if config.RateLimit < 0 {
+    return fmt.Errorf("log rate limit must not be negative")
+  }
+
+  for name := range config.Levels {
+    if _, ok := logComponents[name]; !ok {
+      return fmt.Errorf("unknown log component %q", name)
+    }
+  }
+  for _, name := range logComponentNames {
+    value := config.Level
+    if componentLevel, ok := config.Levels[name]; ok {
+      value = componentLevel
+    }
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(value)); err != nil {
+      return fmt.Errorf("unknown log level %q for %s", value, name)
+    }
+    logComponents[name].level.Set(level)
+  }
+
+  logOutput.Store(&handler)
+  logLimiter.setLimit(config.RateLimit)
+  return nil
+}
+
+func newComponentLogger(name string) *slog.Logger {
+  return slog.New(&componentHandler{component: logComponents[name]})
+}
+
+type componentHandler struct {
+  component *logComponent
+  wrap      []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+  return level >= h.component.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+  allowed, suppressed := logLimiter.allow(h.component.name, record.Message)
+  if !allowed {
+    return nil
+  }
+  if suppressed > 0 {
+    record = record.Clone()
+    record.AddAttrs(slog.Int("suppressed", suppressed))
+  }
+
+  handler := (*logOutput.Load()).WithAttrs([]slog.Attr{slog.String("component", h.component.name)})
+  for _, wrap := range h.wrap {
+    handler = wrap(handler)
+  }
+  return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) with(wrap func(slog.Handler) slog.Handler) *componentHandler {
+  return &componentHandler{
+    component: h.component,
+    wrap:      append(append([]func(slog.Handler) slog.Handler(nil), h.wrap...), wrap),
+  }
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+  return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// at most limit records per component and message each second
+type rateLimiter struct {
+  mu      sync.Mutex
+  limit   int
+  windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+  start      time.Time
+  count      int
+  suppressed int
+}
+
+func (limiter *rateLimiter) setLimit(limit int) {
+  limiter.mu.Lock()
+  defer limiter.mu.Unlock()
+  limiter.limit = limit
+  limiter.windows = nil
+}
+
+func (limiter *rateLimiter) allow(component, message string) (bool, int) {
+  limiter.mu.Lock()
+  defer limiter.mu.Unlock()
+  if limiter.limit <= 0 {
+    return true, 0
+  }
+  if limiter.windows == nil {
+    limiter.windows = make(map[string]*rateWindow)
+  }
+
+  now := time.Now()
+  key := component + "\x00" + message
+  window, ok := limiter.windows[key]
+  if !ok {
+    window = &rateWindow{start: now}
+    limiter.windows[key] = window
+  }
+
+  suppressed := 0
+  if now.Sub(window.start) >= time.Second {
+    suppressed = window.suppressed
+    window.start, window.count, window.suppressed = now, 0, 0
+  }
+  if window.count >= limiter.limit {
+    window.suppressed++
+    return false, 0
+  }
+  window.count++
+  return true, suppressed
+}
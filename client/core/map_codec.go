@@ -0,0 +1,175 @@
+package core
+
+import (
+  "bytes"
+  "compress/flate"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "io"
+)
+
+// decoder for the server map format, see server/map_format.go
+const (
+  mapMagic = "RTGM"
+  // newest version decoded
+  mapVersion = 3
+  
+  // the server sends chunks of (ChunkSize+1)² samples and terrain deltas
+  // of edits of at most maxEditRadius, see server/terrain_edit.go
+  maxEditRadius = 32
+  maxMapSide    = 2*maxEditRadius + 2
+)
+
+type mapHeader struct {
+  Version      uint16
+  Width        int32
+  Height       int32
+  MaxVal       int32
+  Quantization uint8
+  Compression  uint8
+  Scale        float32
+  Offset       float32
+}
+
+// static entity of the map, see server/map_objects.go
+type MapObject struct {
+  Kind     string  `json:"kind"`
+  X        float32 `json:"x"`
+  Y        float32 `json:"y"`
+  Z        float32 `json:"z"`
+  Radius   float32 `json:"radius"`
+  Rotation float32 `json:"rotation"`
+}
+
+// only the parts of the server metadata the client uses
+type MapMeta struct {
+  Objects []MapObject `json:"objects,omitempty"`
+}
+
+// per cell layers, see server/map_layers.go
+type CellLayers struct {
+  Moisture    uint8
+  Temperature uint8
+  Biome       uint8
+  Material    uint8
+}
+
+type DecodedMap struct {
+  Width   int
+  Height  int
+  Heights []float32
+  // nil when the map has no layers
+  Layers []CellLayers
+  Meta   MapMeta
+}
+
+func DecodeHeights(data []byte) (width, height int, heights []float32, err error) {
+  decoded, err := DecodeMap(data)
+  if err != nil {
+    return 0, 0, nil, err
+  }
+  return decoded.Width, decoded.Height, decoded.Heights, nil
+}
+
+func DecodeMap(data []byte) (*DecodedMap, error) {
+  if len(data) < len(mapMagic) || string(data[:len(mapMagic)]) != mapMagic {
+    return nil, fmt.Errorf("not a map blob")
+  }
+  reader := bytes.NewReader(data[len(mapMagic):])
+  
+  var header mapHeader
+  if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+    return nil, err
+  }
+  if header.Version > mapVersion {
+    return nil, fmt.Errorf("unsupported map version: %d", header.Version)
+  }
+  if header.Width < 0 || header.Height < 0 || header.Width > maxMapSide || header.Height > maxMapSide {
+    return nil, fmt.Errorf("invalid map size: %dx%d", header.Width, header.Height)
+  }
+  
+  var payload io.Reader = reader
+  var decompressor io.ReadCloser
+  switch header.Compression {
+  case 0:
+  case 1:
+    decompressor = flate.NewReader(reader)
+    defer decompressor.Close()
+    payload = decompressor
+  default:
+    return nil, fmt.Errorf("unsupported compression: %d", header.Compression)
+  }
+  
+  var err error
+  count := int(header.Width) * int(header.Height)
+  decoded := &DecodedMap{
+    Width:   int(header.Width),
+    Height:  int(header.Height),
+    Heights: make([]float32, count),
+  }
+  switch header.Quantization {
+  case 0:
+    err = binary.Read(payload, binary.LittleEndian, decoded.Heights)
+  case 8:
+    q := make([]uint8, count)
+    if err = binary.Read(payload, binary.LittleEndian, q); err == nil {
+      for i, v := range q {
+        decoded.Heights[i] = header.Offset + float32(v)*header.Scale
+      }
+    }
+  case 16:
+    q := make([]uint16, count)
+    if err = binary.Read(payload, binary.LittleEndian, q); err == nil {
+      for i, v := range q {
+        decoded.Heights[i] = header.Offset + float32(v)*header.Scale
+      }
+    }
+  default:
+    err = fmt.Errorf("unsupported quantization: %d bits", header.Quantization)
+  }
+  if err != nil {
+    return nil, err
+  }
+  
+  // layers follow the heights in the same stream
+  if header.Version >= 3 {
+    var flag uint8
+    if err := binary.Read(payload, binary.LittleEndian, &flag); err != nil {
+      return nil, err
+    }
+    if flag != 0 {
+      decoded.Layers = make([]CellLayers, count)
+      if err := binary.Read(payload, binary.LittleEndian, decoded.Layers); err != nil {
+        return nil, err
+      }
+    }
+  }
+  
+  // the metadata follows the compressed heights
+  if header.Version >= 2 {
+    if decompressor != nil {
+      if _, err := io.Copy(io.Discard, decompressor); err != nil {
+        return nil, err
+      }
+    }
+    var length uint32
+    if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+      return nil, err
+    }
+    if int64(length) > int64(reader.Len()) {
+      return nil, fmt.Errorf("invalid metadata length: %d", length)
+    }
+    raw := make([]byte, length)
+    if _, err := io.ReadFull(reader, raw); err != nil {
+      return nil, err
+    }
+    if length > 0 {
+      if err := json.Unmarshal(raw, &decoded.Meta); err != nil {
+        return nil, err
+      }
+    }
+  }
+  
+  return decoded, nil
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/hex"
+  "math"
+  "testing"
+)
+
+// a 3x2 map with layers and a rock written by the server as q8+deflate
+const serverMapQ8Deflate = "5254474d03000300000002000000200000000801c1c0c03c0000000004c0010d" +
+  "00100004c0fb61a68a3ef2e82389569cb9f67921a1167a8301973f0049000000" +
+  "7b226f626a65637473223a5b7b226b696e64223a22726f636b222c2278223a31" +
+  "2c2279223a342c227a223a312c22726164697573223a302e352c22726f746174" +
+  "696f6e223a307d5d7d"
+
+var testHeights = []float32{0, 1, 2, 3, 4, 6}
+
+// the same map as float32 without compression
+func rawTestMap(version uint16) []byte {
+  var buffer bytes.Buffer
+  buffer.WriteString(mapMagic)
+  binary.Write(&buffer, binary.LittleEndian, mapHeader{Version: version, Width: 3, Height: 2, MaxVal: 32, Scale: 1})
+  binary.Write(&buffer, binary.LittleEndian, testHeights)
+  if version >= 3 {
+    buffer.WriteByte(1)
+    binary.Write(&buffer, binary.LittleEndian, []CellLayers{
+      {Biome: 1, Material: 1}, {Biome: 4, Material: 3}, {Biome: 7, Material: 5},
+      {}, {Moisture: 9}, {Temperature: 200},
+    })
+  }
+  if version >= 2 {
+    meta := []byte(`{"objects":[{"kind":"rock","x":1,"y":4,"z":1,"radius":0.5}]}`)
+    binary.Write(&buffer, binary.LittleEndian, uint32(len(meta)))
+    buffer.Write(meta)
+  }
+  return buffer.Bytes()
+}
+
+func checkTestMap(t *testing.T, decoded *DecodedMap, tolerance float64) {
+  t.Helper()
+  if decoded.Width != 3 || decoded.Height != 2 {
+    t.Fatalf("decoded a %dx%d map, expected 3x2", decoded.Width, decoded.Height)
+  }
+  for i, height := range testHeights {
+    if math.Abs(float64(decoded.Heights[i]-height)) > tolerance {
+      t.Fatalf("height %d is %.3f, expected %.3f", i, decoded.Heights[i], height)
+    }
+  }
+  if decoded.Layers == nil || decoded.Layers[2] != (CellLayers{Biome: 7, Material: 5}) || decoded.Layers[5].Temperature != 200 {
+    t.Fatalf("unexpected layers %v", decoded.Layers)
+  }
+  if len(decoded.Meta.Objects) != 1 || decoded.Meta.Objects[0].Kind != "rock" || decoded.Meta.Objects[0].Radius != 0.5 {
+    t.Fatalf("unexpected objects %v", decoded.Meta.Objects)
+  }
+}
+
+func TestDecodeServerMap(t *testing.T) {
+  data, err := hex.DecodeString(serverMapQ8Deflate)
+  if err != nil {
+    t.Fatal(err)
+  }
+  decoded, err := DecodeMap(data)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // one 8 bit step of the 0..6 range
+  checkTestMap(t, decoded, 6.0/255)
+}
+
+func TestDecodeRawMap(t *testing.T) {
+  decoded, err := DecodeMap(rawTestMap(3))
+  if err != nil {
+    t.Fatal(err)
+  }
+  checkTestMap(t, decoded, 0)
+
+  // version 1 maps have no layers nor metadata
+  decoded, err = DecodeMap(rawTestMap(1))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if decoded.Layers != nil || len(decoded.Meta.Objects) != 0 || decoded.Heights[5] != 6 {
+    t.Fatalf("unexpected version 1 map %+v", decoded)
+  }
+}
+
+func TestDecodeInvalidMap(t *testing.T) {
+  if _, err := DecodeMap([]byte("RTG")); err == nil {
+    t.Fatal("short blob decoded")
+  }
+  if _, err := DecodeMap(rawTestMap(mapVersion + 1)); err == nil {
+    t.Fatal("map of a newer version decoded")
+  }
+  var huge bytes.Buffer
+  huge.WriteString(mapMagic)
+  binary.Write(&huge, binary.LittleEndian, mapHeader{Version: mapVersion, Width: 1 << 20, Height: 1 << 20, Scale: 1})
+  if _, err := DecodeMap(huge.Bytes()); err == nil {
+    t.Fatal("oversized map decoded")
+  }
+  truncated := rawTestMap(3)
+  if _, err := DecodeMap(truncated[:len(truncated)-10]); err == nil {
+    t.Fatal("truncated map decoded")
+  }
+}
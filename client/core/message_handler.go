@@ -2,7 +2,6 @@ package core
 
 import (
   "encoding/json"
-  "fmt"
   "time"
 )
 
@@ -19,7 +18,7 @@ func NewMessageHandler(client *UDPClient) *MessageHandler {
 func (h *MessageHandler) HandleMessage(buffer []byte, n int) {
   var msg ServerMessage
   if err := json.Unmarshal(buffer[:n], &msg); err != nil {
-    fmt.Printf("Parse error: %v\n", err)
+    netLog.Warn("message not parsed", "err", err)
     return
   }
   
@@ -28,14 +27,50 @@ func (h *MessageHandler) HandleMessage(buffer []byte, n int) {
     h.handleConnectionConfirm(&msg)
   case "world_update":
     h.handleWorldUpdate(&msg)
+  case "chunk_data":
+    h.handleChunkData(&msg)
+  case "zone_change":
+    h.handleZoneChange(&msg)
+  case "terrain_delta":
+    h.handleTerrainDelta(&msg)
+  case "map_info":
+    mapLog.Info("map info", "zone", msg.Zone, "map", msg.MapID, "hash", msg.MapHash, "rotation", msg.Rotation)
+  case "broadcast":
+    netLog.Info("server message", "message", msg.Message)
+  case "kicked", "banned":
+    netLog.Warn(msg.Type+" by the server", "message", msg.Message)
+  case "session":
+    h.client.SetSession(msg.Session)
+    netLog.Debug("player session", "player", msg.Player)
+    if msg.Secret != "" {
+      h.client.SetSecret(msg.Secret)
+      if err := SavePlayerSecret(msg.Player, msg.Secret); err != nil {
+        netLog.Warn("player secret not saved, the player is lost on exit", "player", msg.Player, "err", err)
+      }
+    }
+  case "identify_refused":
+    netLog.Warn("identify refused, retrying", "message", msg.Message)
+  case "ping":
+    h.handlePing(&msg)
   default:
-    fmt.Printf("Unknown message type: %s\n", msg.Type)
+    netLog.Debug("unknown message type", "type", msg.Type)
+  }
+}
+
+// the server measures the round trip with it
+func (h *MessageHandler) handlePing(msg *ServerMessage) {
+  pong := struct {
+    Type  string `json:"type"`
+    Nonce uint64 `json:"nonce"`
+  }{"pong", msg.Nonce}
+  if err := h.client.SendJSON(pong); err != nil {
+    netLog.Warn("pong not sent", "err", err)
   }
 }
 
 func (h *MessageHandler) handleConnectionConfirm(msg *ServerMessage) {
   h.client.LocalUserID = msg.UserID
-  fmt.Printf("+ Connected as user: %s\n", h.client.LocalUserID)
+  netLog.Info("connected", "user", h.client.LocalUserID)
 }
 
 func (h *MessageHandler) handleWorldUpdate(msg *ServerMessage) {
@@ -62,7 +97,61 @@ func (h *MessageHandler) handleWorldUpdate(msg *ServerMessage) {
   for id := range h.client.WorldState.Users {
     if !receivedIDs[id] {
       delete(h.client.WorldState.Users, id)
-      fmt.Printf("- User removed: %s\n", id)
+      worldLog.Debug("user removed", "user", id)
     }
   }
 }
+
+func (h *MessageHandler) handleChunkData(msg *ServerMessage) {
+  decoded, err := DecodeMap(msg.Data)
+  if err != nil {
+    mapLog.Warn("invalid chunk", "x", msg.X, "z", msg.Z, "err", err)
+    return
+  }
+  if decoded.Width > ChunkSize+1 || decoded.Height > ChunkSize+1 {
+    mapLog.Warn("invalid chunk", "x", msg.X, "z", msg.Z, "width", decoded.Width, "height", decoded.Height)
+    return
+  }
+  
+  h.client.WorldState.UpdateChunk(&TerrainChunk{
+    Coord:   ChunkCoord{X: msg.X, Z: msg.Z},
+    Width:   decoded.Width,
+    Height:  decoded.Height,
+    Heights: decoded.Heights,
+    Layers:  decoded.Layers,
+    Objects: decoded.Meta.Objects,
+  })
+  h.ackChunk(msg.X, msg.Z)
+  
+  if localUser := h.client.GetLocalUser(); localUser != nil {
+    h.client.WorldState.DropChunksAround(localUser.Location, ChunkViewRange+1)
+  }
+}
+
+// chunks not acknowledged are sent again by the server
+func (h *MessageHandler) ackChunk(x, z int32) {
+  ack := struct {
+    Type string `json:"type"`
+    X    int32  `json:"x"`
+    Z    int32  `json:"z"`
+  }{"chunk_ack", x, z}
+  if err := h.client.SendJSON(ack); err != nil {
+    netLog.Warn("chunk ack not sent", "err", err)
+  }
+}
+
+func (h *MessageHandler) handleZoneChange(msg *ServerMessage) {
+  h.client.WorldState.SetZone(msg.Zone, msg.MapID, msg.MapHash)
+  worldLog.Info("entered zone", "zone", msg.Zone, "map", msg.MapID, "hash", msg.MapHash)
+}
+
+func (h *MessageHandler) handleTerrainDelta(msg *ServerMessage) {
+  width, height, heights, err := DecodeHeights(msg.Data)
+  if err != nil {
+    mapLog.Warn("invalid terrain delta", "err", err)
+    return
+  }
+  
+  // x and z are world cells for deltas
+  h.client.WorldState.ApplyTerrainDelta(int(msg.X), int(msg.Z), width, height, heights)
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// identity the server saves the player state under, RTGS_PLAYER or a random
+// one kept in the user config directory. It is the only proof of identity,
+// keep it private.
+func LoadPlayerID() (string, error) {
+  if id := os.Getenv("RTGS_PLAYER"); id != "" {
+    return id, nil
+  }
+  dir, err := os.UserConfigDir()
+  if err != nil {
+    return "", err
+  }
+  filename := filepath.Join(dir, "rtgs", "player")
+  if data, err := os.ReadFile(filename); err == nil {
+    if id := strings.TrimSpace(string(data)); id != "" {
+      return id, nil
+    }
+  }
+
+  buf := make([]byte, 16)
+  if _, err := rand.Read(buf); err != nil {
+    return "", err
+  }
+  id := hex.EncodeToString(buf)
+  if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+    return "", err
+  }
+  if err := os.WriteFile(filename, []byte(id+"\n"), 0600); err != nil {
+    return "", err
+  }
+  return id, nil
+}
+
+// the secret the server gave the player with its first session, one file per
+// player next to the player file. Empty when the player never played.
+func LoadPlayerSecret(player string) (string, error) {
+  filename, err := playerSecretFile(player)
+  if err != nil {
+    return "", err
+  }
+  data, err := os.ReadFile(filename)
+  if errors.Is(err, os.ErrNotExist) {
+    return "", nil
+  }
+  if err != nil {
+    return "", err
+  }
+  return strings.TrimSpace(string(data)), nil
+}
+
+// without it the server no longer restores the player, keep it private
+func SavePlayerSecret(player, secret string) error {
+  filename, err := playerSecretFile(player)
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+    return err
+  }
+  return os.WriteFile(filename, []byte(secret+"\n"), 0600)
+}
+
+func playerSecretFile(player string) (string, error) {
+  dir, err := os.UserConfigDir()
+  if err != nil {
+    return "", err
+  }
+  sum := sha256.Sum256([]byte(player))
+  return filepath.Join(dir, "rtgs", "secrets", hex.EncodeToString(sum[:16])), nil
+}
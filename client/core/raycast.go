@@ -0,0 +1,185 @@
+package core
+
+import (
+  "math"
+  "github.com/go-gl/mathgl/mgl32"
+)
+
+// must match server/raycast.go
+const (
+  UserRadius    = 0.4
+  UserHeight    = 1.0
+  UserEyeHeight = 0.8
+
+  raycastStep       = 0.25
+  raycastRefinement = 12
+)
+
+// bilinear sample over the loaded chunks, false where no chunk is loaded
+func (w *WorldState) HeightAt(x, z float32) (float32, bool) {
+  w.mu.RLock()
+  chunk := w.Chunks[ChunkCoordAt(Vec3{X: float64(x), Z: float64(z)})]
+  w.mu.RUnlock()
+  if chunk == nil {
+    return 0, false
+  }
+
+  localX := x - float32(chunk.Coord.X)*ChunkSize
+  localZ := z - float32(chunk.Coord.Z)*ChunkSize
+  if localX < 0 || localZ < 0 || localX > float32(chunk.Width-1) || localZ > float32(chunk.Height-1) {
+    return 0, false
+  }
+
+  x0 := int(localX)
+  z0 := int(localZ)
+  x1 := min(x0+1, chunk.Width-1)
+  z1 := min(z0+1, chunk.Height-1)
+  tx := localX - float32(x0)
+  tz := localZ - float32(z0)
+
+  top := chunk.HeightAtCell(x0, z0) + (chunk.HeightAtCell(x1, z0)-chunk.HeightAtCell(x0, z0))*tx
+  bottom := chunk.HeightAtCell(x0, z1) + (chunk.HeightAtCell(x1, z1)-chunk.HeightAtCell(x0, z1))*tx
+  return top + (bottom-top)*tz, true
+}
+
+// nearest cell layers of the loaded chunks
+func (w *WorldState) LayersAt(x, z float32) (CellLayers, bool) {
+  w.mu.RLock()
+  chunk := w.Chunks[ChunkCoordAt(Vec3{X: float64(x), Z: float64(z)})]
+  w.mu.RUnlock()
+  if chunk == nil {
+    return CellLayers{}, false
+  }
+  
+  localX := int(math.Round(float64(x - float32(chunk.Coord.X)*ChunkSize)))
+  localZ := int(math.Round(float64(z - float32(chunk.Coord.Z)*ChunkSize)))
+  if localX < 0 || localZ < 0 || localX >= chunk.Width || localZ >= chunk.Height {
+    return CellLayers{}, false
+  }
+  return chunk.LayersAtCell(localX, localZ)
+}
+
+// speed multiplier of the ground, for client side prediction
+func (w *WorldState) MovementSpeedAt(x, z float32) float32 {
+  if layers, ok := w.LayersAt(x, z); ok {
+    return MaterialSpeed(layers.Material)
+  }
+  return 1
+}
+
+func (w *WorldState) heightAbove(point mgl32.Vec3) (float32, bool) {
+  ground, ok := w.HeightAt(point.X(), point.Z())
+  if !ok {
+    return 0, false
+  }
+  return point.Y() - ground, true
+}
+
+// same marching and bisection as the server so both agree on hits
+func (w *WorldState) Raycast(origin, direction mgl32.Vec3, maxDistance float32) (mgl32.Vec3, float32, bool) {
+  if direction.Len() == 0 || maxDistance <= 0 {
+    return mgl32.Vec3{}, 0, false
+  }
+  direction = direction.Normalize()
+
+  above, ok := w.heightAbove(origin)
+  if !ok {
+    return mgl32.Vec3{}, 0, false
+  }
+  if above <= 0 {
+    return origin, 0, true
+  }
+
+  steps := int(math.Ceil(float64(maxDistance / raycastStep)))
+  prev := float32(0)
+  for i := 1; i <= steps; i++ {
+    dist := min(float32(i)*raycastStep, maxDistance)
+    above, ok := w.heightAbove(origin.Add(direction.Mul(dist)))
+    if !ok {
+      return mgl32.Vec3{}, 0, false
+    }
+    if above > 0 {
+      prev = dist
+      continue
+    }
+
+    low, high := prev, dist
+    for j := 0; j < raycastRefinement; j++ {
+      mid := (low + high) / 2
+      if above, ok := w.heightAbove(origin.Add(direction.Mul(mid))); ok && above > 0 {
+        low = mid
+      } else {
+        high = mid
+      }
+    }
+    return origin.Add(direction.Mul(high)), high, true
+  }
+  return mgl32.Vec3{}, 0, false
+}
+
+func (w *WorldState) LineOfSight(from, to mgl32.Vec3) bool {
+  dist := to.Sub(from).Len()
+  if dist == 0 {
+    return true
+  }
+  _, _, hit := w.Raycast(from, to.Sub(from), dist)
+  return !hit
+}
+
+// slab test, returns the fraction of the segment where it enters the box
+func SegmentHitsBox(from, to, boxMin, boxMax mgl32.Vec3) (float32, bool) {
+  delta := to.Sub(from)
+  enter, exit := float32(0), float32(1)
+
+  for axis := 0; axis < 3; axis++ {
+    if delta[axis] == 0 {
+      if from[axis] < boxMin[axis] || from[axis] > boxMax[axis] {
+        return 0, false
+      }
+      continue
+    }
+    t0 := (boxMin[axis] - from[axis]) / delta[axis]
+    t1 := (boxMax[axis] - from[axis]) / delta[axis]
+    if t0 > t1 {
+      t0, t1 = t1, t0
+    }
+    enter = max(enter, t0)
+    exit = min(exit, t1)
+    if enter > exit {
+      return 0, false
+    }
+  }
+  return enter, true
+}
+
+func UserBox(user *User) (mgl32.Vec3, mgl32.Vec3) {
+  x, y, z := float32(user.Location.X), float32(user.Location.Y), float32(user.Location.Z)
+  return mgl32.Vec3{x - UserRadius, y, z - UserRadius},
+    mgl32.Vec3{x + UserRadius, y + UserHeight, z + UserRadius}
+}
+
+// first active user hit by the ray before the ground
+func (w *WorldState) PickUser(origin, direction mgl32.Vec3, maxDistance float32) (*User, bool) {
+  if direction.Len() == 0 {
+    return nil, false
+  }
+  direction = direction.Normalize()
+  if _, dist, hit := w.Raycast(origin, direction, maxDistance); hit {
+    maxDistance = dist
+  }
+  end := origin.Add(direction.Mul(maxDistance))
+
+  var closest *User
+  closestT := float32(math.MaxFloat32)
+  for _, user := range w.GetUsers() {
+    if !user.IsActive {
+      continue
+    }
+    boxMin, boxMax := UserBox(user)
+    if t, ok := SegmentHitsBox(origin, end, boxMin, boxMax); ok && t < closestT {
+      closest = user
+      closestT = t
+    }
+  }
+  return closest, closest != nil
+}
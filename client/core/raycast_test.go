@@ -0,0 +1,88 @@
+package core
+
+import (
+  "math"
+  "testing"
+  "github.com/go-gl/mathgl/mgl32"
+)
+
+// a world of a single chunk at the origin, heights by cell
+func chunkWorld(height func(x, z int) float32) *WorldState {
+  size := ChunkSize + 1
+  chunk := &TerrainChunk{Width: size, Height: size, Heights: make([]float32, size*size)}
+  for z := 0; z < size; z++ {
+    for x := 0; x < size; x++ {
+      chunk.Heights[z*size+x] = height(x, z)
+    }
+  }
+  world := NewWorldState()
+  world.UpdateChunk(chunk)
+  return world
+}
+
+func near(a, b, tolerance float32) bool {
+  return math.Abs(float64(a-b)) <= float64(tolerance)
+}
+
+// the same cases as server/raycast_test.go, both sides must agree
+func TestRaycastHitsSlope(t *testing.T) {
+  world := chunkWorld(func(x, z int) float32 { return float32(x) })
+
+  point, dist, hit := world.Raycast(mgl32.Vec3{1, 5, 8}, mgl32.Vec3{1, 0, 0}, 10)
+  if !hit {
+    t.Fatal("ray along the slope missed")
+  }
+  if !near(point.X(), 5, 0.01) || !near(dist, 4, 0.01) {
+    t.Fatalf("hit at x %.3f distance %.3f, expected x 5 distance 4", point.X(), dist)
+  }
+}
+
+func TestRaycastMissesFlatGround(t *testing.T) {
+  world := chunkWorld(func(x, z int) float32 { return 2 })
+
+  if _, _, hit := world.Raycast(mgl32.Vec3{2, 3, 2}, mgl32.Vec3{1, 0, 1}, 10); hit {
+    t.Fatal("level ray above flat ground hit")
+  }
+  if !world.LineOfSight(mgl32.Vec3{1, 3, 1}, mgl32.Vec3{30, 3, 30}) {
+    t.Fatal("no line of sight over flat ground")
+  }
+}
+
+func TestRaycastLeavingLoadedChunks(t *testing.T) {
+  world := chunkWorld(func(x, z int) float32 { return 0 })
+
+  if _, _, hit := world.Raycast(mgl32.Vec3{28, 1, 8}, mgl32.Vec3{1, 0, 0}, 100); hit {
+    t.Fatal("ray leaving the loaded chunks hit")
+  }
+}
+
+func TestRaycastHitsObstacleCell(t *testing.T) {
+  world := chunkWorld(func(x, z int) float32 {
+    if x == 10 && z == 8 {
+      return 5
+    }
+    return 0
+  })
+
+  point, dist, hit := world.Raycast(mgl32.Vec3{2, 1, 8}, mgl32.Vec3{1, 0, 0}, 12)
+  if !hit {
+    t.Fatal("ray through the raised cell missed")
+  }
+  if !near(point.X(), 9.2, 0.01) || !near(dist, 7.2, 0.01) {
+    t.Fatalf("hit at x %.3f distance %.3f, expected x 9.2 distance 7.2", point.X(), dist)
+  }
+  if !world.LineOfSight(mgl32.Vec3{2, 1, 12}, mgl32.Vec3{14, 1, 12}) {
+    t.Fatal("no line of sight beside the raised cell")
+  }
+}
+
+func TestPickUser(t *testing.T) {
+  world := chunkWorld(func(x, z int) float32 { return 0 })
+  world.Users["near"] = &User{ID: "near", IsActive: true, Location: Vec3{X: 6, Z: 4}}
+  world.Users["far"] = &User{ID: "far", IsActive: true, Location: Vec3{X: 12, Z: 4}}
+
+  user, hit := world.PickUser(mgl32.Vec3{1, 0.5, 4}, mgl32.Vec3{1, 0, 0}, 20)
+  if !hit || user.ID != "near" {
+    t.Fatalf("picked %v, expected the nearest user", user)
+  }
+}
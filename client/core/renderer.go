@@ -184,9 +184,29 @@ func compileShader(source string, shaderType uint32) (uint32, error) {
   return shader, nil
 }
 
-func (r *Renderer) CameraFollowLocation(location mgl32.Vec3) {
+func (r *Renderer) CameraFollowLocation(location mgl32.Vec3, terrain *WorldState) {
   // max distance tmp
   r.camera.FollowPosition(location, 10.0);
+  r.camera.AvoidTerrain(location.Add(mgl32.Vec3{0, UserHeight, 0}), terrain)
+}
+
+// world ray under a window position, for picking
+func (r *Renderer) ScreenRay(x, y float64, width, height int) (mgl32.Vec3, mgl32.Vec3, bool) {
+  aspect := float32(width) / float32(height)
+  proj := mgl32.Perspective(mgl32.DegToRad(45), aspect, 0.1, 100.0)
+  view := r.camera.GetViewMatrix()
+  
+  winX := float32(x)
+  winY := float32(height) - float32(y)
+  near, err := mgl32.UnProject(mgl32.Vec3{winX, winY, 0}, view, proj, 0, 0, width, height)
+  if err != nil {
+    return mgl32.Vec3{}, mgl32.Vec3{}, false
+  }
+  far, err := mgl32.UnProject(mgl32.Vec3{winX, winY, 1}, view, proj, 0, 0, width, height)
+  if err != nil {
+    return mgl32.Vec3{}, mgl32.Vec3{}, false
+  }
+  return near, far.Sub(near).Normalize(), true
 }
 
 func (r *Renderer) UpdateCamera() {
@@ -0,0 +1,139 @@
+package core
+
+import (
+  "math"
+)
+
+// must match the server chunk layout
+const (
+  ChunkSize      = 32
+  ChunkViewRange = 2
+)
+
+type ChunkCoord struct {
+  X int32
+  Z int32
+}
+
+// biome ids and materials, must match server/map_layers.go
+const (
+  BiomeNone uint8 = iota
+  BiomeWater
+  BiomeBeach
+  BiomeDesert
+  BiomeGrassland
+  BiomeForest
+  BiomeTundra
+  BiomeMountain
+  BiomeSnow
+)
+
+const (
+  MaterialNone uint8 = iota
+  MaterialWater
+  MaterialSand
+  MaterialGrass
+  MaterialDirt
+  MaterialRock
+  MaterialSnow
+)
+
+var materialSpeed = []float32{1, 0.5, 0.8, 1, 1, 0.9, 0.7}
+
+type TerrainChunk struct {
+  Coord   ChunkCoord
+  Width   int
+  Height  int
+  Heights []float32
+  // nil when the map has no layers
+  Layers  []CellLayers
+  Objects []MapObject
+  
+  // line vertices per biome, built once on first draw
+  vertices map[uint8][]float32
+}
+
+func ChunkCoordAt(location Vec3) ChunkCoord {
+  return ChunkCoord{
+    X: int32(math.Floor(location.X / ChunkSize)),
+    Z: int32(math.Floor(location.Z / ChunkSize)),
+  }
+}
+
+func (chunk *TerrainChunk) HeightAtCell(x, z int) float32 {
+  return chunk.Heights[z*chunk.Width+x]
+}
+
+func (chunk *TerrainChunk) LayersAtCell(x, z int) (CellLayers, bool) {
+  if chunk.Layers == nil {
+    return CellLayers{}, false
+  }
+  return chunk.Layers[z*chunk.Width+x], true
+}
+
+func MaterialSpeed(material uint8) float32 {
+  if int(material) < len(materialSpeed) {
+    return materialSpeed[material]
+  }
+  return 1
+}
+
+func BiomeColor(biome uint8) [4]float32 {
+  switch biome {
+  case BiomeWater:
+    return [4]float32{0.157, 0.275, 0.627, 1.0}
+  case BiomeBeach:
+    return [4]float32{0.824, 0.784, 0.549, 1.0}
+  case BiomeDesert:
+    return [4]float32{0.863, 0.706, 0.392, 1.0}
+  case BiomeGrassland:
+    return [4]float32{0.353, 0.627, 0.275, 1.0}
+  case BiomeForest:
+    return [4]float32{0.157, 0.431, 0.196, 1.0}
+  case BiomeTundra:
+    return [4]float32{0.549, 0.588, 0.510, 1.0}
+  case BiomeMountain:
+    return [4]float32{0.471, 0.431, 0.392, 1.0}
+  case BiomeSnow:
+    return [4]float32{0.941, 0.941, 0.961, 1.0}
+  default:
+    return [4]float32{0.314, 0.471, 0.314, 1.0}
+  }
+}
+
+// each segment takes the biome of its first cell
+func (chunk *TerrainChunk) Vertices() map[uint8][]float32 {
+  if chunk.vertices != nil {
+    return chunk.vertices
+  }
+  
+  originX := float32(chunk.Coord.X) * ChunkSize
+  originZ := float32(chunk.Coord.Z) * ChunkSize
+  
+  batches := make(map[uint8][]float32)
+  for z := 0; z < chunk.Height; z++ {
+    for x := 0; x < chunk.Width; x++ {
+      biome := BiomeNone
+      if layers, ok := chunk.LayersAtCell(x, z); ok {
+        biome = layers.Biome
+      }
+      lines := batches[biome]
+      h := chunk.HeightAtCell(x, z)
+      if x+1 < chunk.Width {
+        lines = append(lines,
+          originX+float32(x), h, originZ+float32(z),
+          originX+float32(x+1), chunk.HeightAtCell(x+1, z), originZ+float32(z),
+        )
+      }
+      if z+1 < chunk.Height {
+        lines = append(lines,
+          originX+float32(x), h, originZ+float32(z),
+          originX+float32(x), chunk.HeightAtCell(x, z+1), originZ+float32(z+1),
+        )
+      }
+      batches[biome] = lines
+    }
+  }
+  chunk.vertices = batches
+  return batches
+}
@@ -31,11 +31,102 @@ type User struct {
 type WorldState struct {
   mu  sync.RWMutex
   Users map[string]*User
+  Chunks map[ChunkCoord]*TerrainChunk
+  Zone    string
+  MapID   string
+  MapHash string
 }
 
 func NewWorldState() *WorldState {
   return &WorldState{
     Users: make(map[string]*User),
+    Chunks: make(map[ChunkCoord]*TerrainChunk),
+  }
+}
+
+func (w *WorldState) UpdateChunk(chunk *TerrainChunk) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.Chunks[chunk.Coord] = chunk
+}
+
+// the terrain of the previous zone is dropped, the server streams the new one
+func (w *WorldState) SetZone(zone, mapID, mapHash string) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.Zone = zone
+  w.MapID = mapID
+  w.MapHash = mapHash
+  w.Chunks = make(map[ChunkCoord]*TerrainChunk)
+}
+
+// chunks are replaced by edited copies, the renderer may still hold the old ones
+func (w *WorldState) ApplyTerrainDelta(x0, z0, width, height int, heights []float32) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  
+  for coord, chunk := range w.Chunks {
+    originX := int(coord.X) * ChunkSize
+    originZ := int(coord.Z) * ChunkSize
+    
+    var edited *TerrainChunk
+    for z := 0; z < chunk.Height; z++ {
+      for x := 0; x < chunk.Width; x++ {
+        dx := originX + x - x0
+        dz := originZ + z - z0
+        if dx < 0 || dz < 0 || dx >= width || dz >= height {
+          continue
+        }
+        if edited == nil {
+          edited = &TerrainChunk{
+            Coord:   chunk.Coord,
+            Width:   chunk.Width,
+            Height:  chunk.Height,
+            Heights: append([]float32(nil), chunk.Heights...),
+            Layers:  chunk.Layers,
+            Objects: append([]MapObject(nil), chunk.Objects...),
+          }
+        }
+        edited.Heights[z*chunk.Width+x] = heights[dz*width+dx]
+      }
+    }
+    if edited != nil {
+      // keep objects on the edited ground
+      for i := range edited.Objects {
+        object := &edited.Objects[i]
+        x := int(object.X - float32(originX) + 0.5)
+        z := int(object.Z - float32(originZ) + 0.5)
+        if x >= 0 && z >= 0 && x < edited.Width && z < edited.Height {
+          object.Y = edited.HeightAtCell(x, z)
+        }
+      }
+      w.Chunks[coord] = edited
+    }
+  }
+}
+
+func (w *WorldState) GetChunks() []*TerrainChunk {
+  w.mu.RLock()
+  defer w.mu.RUnlock()
+  
+  chunks := make([]*TerrainChunk, 0, len(w.Chunks))
+  for _, c := range w.Chunks {
+    chunks = append(chunks, c)
+  }
+  return chunks
+}
+
+func (w *WorldState) DropChunksAround(location Vec3, keepRange int32) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  
+  center := ChunkCoordAt(location)
+  for coord := range w.Chunks {
+    dx := coord.X - center.X
+    dz := coord.Z - center.Z
+    if dx < -keepRange || dx > keepRange || dz < -keepRange || dz > keepRange {
+      delete(w.Chunks, coord)
+    }
   }
 }
 
@@ -88,6 +179,19 @@ func GetColorForUserType(userType UserType) [3]uint8 {
   }
 }
 
+func GetColorForObjectKind(kind string) [4]float32 {
+  switch kind {
+  case "tree":
+    return [4]float32{0.196, 0.627, 0.235, 1.0}
+  case "rock":
+    return [4]float32{0.549, 0.549, 0.549, 1.0}
+  case "structure":
+    return [4]float32{0.784, 0.588, 0.314, 1.0}
+  default:
+    return [4]float32{1.0, 1.0, 1.0, 1.0}
+  }
+}
+
 func (w *WorldState) GetUser(id string) *User {
   w.mu.RLock()
   defer w.mu.RUnlock()
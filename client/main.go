@@ -4,6 +4,7 @@ package main
 
 import (
   "log"
+  "os"
   "runtime"
   "rtgs-client/rgl"
   "rtgs-client/core"
@@ -46,6 +47,14 @@ func cursorPosCallback(w *glfw.Window, xpos, ypos float64) {
 }
 
 func main() {
+  logConfig, err := core.LogConfigFromEnv()
+  if err != nil {
+    log.Fatalln(err)
+  }
+  if err := core.SetupLogging(os.Stdout, logConfig); err != nil {
+    log.Fatalln("Cannot setup logging:", err)
+  }
+
   worldState := core.NewWorldState()
 
   // Start UDP client
@@ -54,6 +63,13 @@ func main() {
     log.Fatalf("Cannot create UDP client: %v", err)
   }
   defer client.Conn.Close()
+  if client.PlayerID, err = core.LoadPlayerID(); err != nil {
+    log.Printf("No player identity, playing as a guest: %v", err)
+  } else if secret, err := core.LoadPlayerSecret(client.PlayerID); err != nil {
+    log.Printf("No player secret, the server will not restore the player: %v", err)
+  } else {
+    client.SetSecret(secret)
+  }
   client.StartReceiving()
   client.StartSending()
 
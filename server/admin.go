@@ -0,0 +1,448 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// server operations of the admin console and the admin api, they take the
+// server lock themselves and must not be called with it held
+
+var (
+  errNoClient    = errors.New("no client")
+  errNoBan       = errors.New("no ban for")
+  errNoFixedMap  = errors.New("the main zone has no fixed map")
+  errOutsideZone = errors.New("outside of zone")
+  errBanBot      = errors.New("bots cannot be banned")
+  errNotBot      = errors.New("only bots walk")
+  errMapName     = errors.New("not a map file name")
+)
+
+// time a kicked address is ignored, so the datagrams it has in flight do
+// not spawn it again
+const kickCooldown = 10 * time.Second
+
+type ServerStatus struct {
+  Uptime   string   `json:"uptime"`
+  Players  int      `json:"players"`
+  Bots     int      `json:"bots"`
+  Zones    []string `json:"zones"`
+  World    string   `json:"world"`
+  Map      string   `json:"map"`
+  MapHash  string   `json:"map_hash,omitempty"`
+  Rotation []string `json:"rotation,omitempty"`
+  // received and sent datagrams
+  Packets [2]uint64 `json:"packets"`
+}
+
+type ClientInfo struct {
+  ID          string     `json:"id"`
+  Player      string     `json:"player,omitempty"`
+  Zone        string     `json:"zone"`
+  Type        UserType   `json:"type"`
+  Location    [3]float32 `json:"location"`
+  Orientation float32    `json:"orientation"`
+  Active      bool       `json:"active"`
+  Idle        string     `json:"idle"`
+  // round trip of the last answered ping, 0 before the first one and for bots
+  PingMs float64 `json:"ping_ms"`
+}
+
+// a nil Until bans until the server restarts
+type Ban struct {
+  IP     string     `json:"ip"`
+  Reason string     `json:"reason,omitempty"`
+  Until  *time.Time `json:"until,omitempty"`
+}
+
+type MapState struct {
+  Zone     string    `json:"zone"`
+  World    string    `json:"world"`
+  MapID    string    `json:"map_id"`
+  MapHash  string    `json:"map_hash,omitempty"`
+  Name     string    `json:"name,omitempty"`
+  Seed     int64     `json:"seed,omitempty"`
+  Width    int       `json:"width,omitempty"`
+  Height   int       `json:"height,omitempty"`
+  Stats    *MapStats `json:"stats,omitempty"`
+  Rotation []string  `json:"rotation,omitempty"`
+}
+
+func (server *Server) Status() ServerStatus {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  status := ServerStatus{
+    Uptime:  time.Since(server.startedAt).Round(time.Second).String(),
+    World:   server.config.World,
+    Packets: [2]uint64{packetsIn.value.Load(), packetsOut.value.Load()},
+  }
+  for _, client := range server.clients {
+    if client.addr == nil {
+      status.Bots++
+    } else {
+      status.Players++
+    }
+  }
+  status.Zones = sortedKeys(server.zones)
+  if zone, ok := server.zones[defaultZoneName]; ok {
+    status.Map = zone.mapID()
+    status.MapHash = zone.mapHash()
+  }
+  if server.rotation != nil {
+    status.Rotation = server.rotation.Names()
+  }
+  return status
+}
+
+func (server *Server) Clients() []ClientInfo {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  infos := make([]ClientInfo, 0, len(server.clients))
+  for key, client := range server.clients {
+    user := client.user
+    infos = append(infos, ClientInfo{
+      ID:          key,
+      Player:      client.player,
+      Zone:        client.zone.name,
+      Type:        user.userType,
+      Location:    [3]float32{user.location.x, user.location.y, user.location.z},
+      Orientation: user.orientation,
+      Active:      user.isActive,
+      Idle:        server.clock.Now().Sub(client.lastSeen).Round(time.Second).String(),
+      PingMs:      float64(client.rtt.Microseconds()) / 1000,
+    })
+  }
+  sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+  return infos
+}
+
+// ids of the connected clients, for completion
+func (server *Server) clientIDs() []string {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+  return sortedKeys(server.clients)
+}
+
+// the client is told and removed. Its address is ignored for kickCooldown,
+// it reconnects as a new client if it keeps sending after that.
+func (server *Server) Kick(id string) error {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  client, ok := server.clients[id]
+  if !ok {
+    return fmt.Errorf("%w %s", errNoClient, id)
+  }
+  server.recordAdmin(adminChange{Op: "kick", ID: id})
+  server.sendJSON(client.addr, AdminNotice{Type: "kicked", Message: "kicked by an admin"})
+  server.removeClient(id, client)
+  if client.addr != nil {
+    server.kicked[id] = server.clock.Now().Add(kickCooldown)
+  }
+  netLog.Info("client kicked", "id", id)
+  return nil
+}
+
+// must be called with server.mu held
+func (server *Server) removeClient(id string, client *Client) {
+  server.savePlayer(client)
+  server.exitTriggers(client)
+  delete(server.clients, id)
+  delete(client.zone.clients, id)
+}
+
+// kicks the client and ignores its ip for duration, 0 bans until restart
+func (server *Server) Ban(id string, duration time.Duration, reason string) (Ban, error) {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  client, ok := server.clients[id]
+  if !ok {
+    return Ban{}, fmt.Errorf("%w %s", errNoClient, id)
+  }
+  if client.addr == nil {
+    return Ban{}, fmt.Errorf("%w, kick %s instead", errBanBot, id)
+  }
+  server.recordAdmin(adminChange{Op: "ban", ID: id, Duration: Duration(duration), Reason: reason})
+  ban := Ban{IP: client.addr.IP.String(), Reason: reason}
+  if duration > 0 {
+    until := server.clock.Now().Add(duration).Round(time.Second)
+    ban.Until = &until
+  }
+  server.bans[ban.IP] = ban
+
+  message := "banned by an admin"
+  if reason != "" {
+    message += ": " + reason
+  }
+  // every client of the ip goes
+  for key, other := range server.clients {
+    if other.addr != nil && other.addr.IP.Equal(client.addr.IP) {
+      server.sendJSON(other.addr, AdminNotice{Type: "banned", Message: message})
+      server.removeClient(key, other)
+    }
+  }
+  netLog.Info("client banned", "id", id, "ip", ban.IP, "until", ban.Until, "reason", reason)
+  return ban, nil
+}
+
+func (server *Server) Unban(ip string) error {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  if _, ok := server.activeBan(ip); !ok {
+    return fmt.Errorf("%w %s", errNoBan, ip)
+  }
+  server.recordAdmin(adminChange{Op: "unban", IP: ip})
+  delete(server.bans, ip)
+  netLog.Info("ban lifted", "ip", ip)
+  return nil
+}
+
+func (server *Server) Bans() []Ban {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  bans := make([]Ban, 0, len(server.bans))
+  for _, ip := range sortedKeys(server.bans) {
+    if ban, ok := server.activeBan(ip); ok {
+      bans = append(bans, ban)
+    }
+  }
+  return bans
+}
+
+// expired bans are dropped here, must be called with server.mu held
+func (server *Server) activeBan(ip string) (Ban, bool) {
+  ban, ok := server.bans[ip]
+  if ok && ban.Until != nil && server.clock.Now().After(*ban.Until) {
+    delete(server.bans, ip)
+    return Ban{}, false
+  }
+  return ban, ok
+}
+
+// moves a user inside its zone, it is lifted to the ground when the target
+// is below it
+func (server *Server) Teleport(id string, location Vector3) error {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  client, ok := server.clients[id]
+  if !ok {
+    return fmt.Errorf("%w %s", errNoClient, id)
+  }
+  client.zone.loadTerrainAt(location)
+  if terrain := client.zone.terrain(); terrain != nil {
+    ground, ok := terrain.HeightAt(location.x, location.z)
+    if !ok {
+      return fmt.Errorf("(%.2f, %.2f) is %w %s", location.x, location.z, errOutsideZone, client.zone.name)
+    }
+    location.y = max(location.y, ground)
+  }
+  target := location.Array()
+  server.recordAdmin(adminChange{Op: "teleport", ID: id, Location: &target})
+  from := client.user.location
+  client.user.updatePosition(location)
+  server.dispatchUserMoved(client, from, "teleport")
+  worldLog.Info("user teleported", "id", id, "zone", client.zone.name,
+    "location", [3]float32{location.x, location.y, location.z})
+  return nil
+}
+
+// bots are users without an address, they stand where they spawn until
+// they walk and never time out
+func (server *Server) SpawnBot() string {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  server.recordAdmin(adminChange{Op: "spawn_bot"})
+  server.botCount++
+  id := fmt.Sprintf("bot-%d", server.botCount)
+  client := server.spawnClient(nil, id, UserTypeBot, nil)
+  user := client.user
+  worldLog.Info("bot spawned", "id", id, "zone", client.zone.name,
+    "location", [3]float32{user.location.x, user.location.y, user.location.z})
+  return id
+}
+
+// the bot walks the path to location, one waypoint per few ticks. The path
+// is searched without the server lock, again with it if the bot moved
+// meanwhile so replays find the same path.
+func (server *Server) WalkBot(id string, location Vector3) error {
+  server.mu.RLock()
+  client, ok := server.clients[id]
+  var zone *Zone
+  var from Vector3
+  bot := false
+  if ok {
+    zone, from, bot = client.zone, client.user.location, client.user.userType == UserTypeBot
+  }
+  server.mu.RUnlock()
+  if !ok {
+    return fmt.Errorf("%w %s", errNoClient, id)
+  }
+  if !bot {
+    return fmt.Errorf("%w, %s is not a bot", errNotBot, id)
+  }
+  path, err := zone.FindPath(from, location, 0)
+
+  server.mu.Lock()
+  defer server.mu.Unlock()
+  if server.clients[id] != client {
+    return fmt.Errorf("%w %s", errNoClient, id)
+  }
+  if client.zone != zone || client.user.location != from {
+    path, err = client.zone.FindPath(client.user.location, location, 0)
+  }
+  if err != nil {
+    return err
+  }
+  target := location.Array()
+  server.recordAdmin(adminChange{Op: "walk", ID: id, Location: &target})
+  client.path = path
+  worldLog.Info("bot walking", "id", id, "zone", client.zone.name, "waypoints", len(path),
+    "location", [3]float32{location.x, location.y, location.z})
+  return nil
+}
+
+func (server *Server) mainMapZone() (*Zone, error) {
+  server.mu.RLock()
+  zone := server.zones[defaultZoneName]
+  server.mu.RUnlock()
+  if zone == nil || zone.mapGenerator == nil {
+    return nil, errNoFixedMap
+  }
+  return zone, nil
+}
+
+func (server *Server) MapState() MapState {
+  server.mu.RLock()
+  zone := server.zones[defaultZoneName]
+  state := MapState{Zone: defaultZoneName, World: server.config.World}
+  if server.rotation != nil {
+    state.Rotation = server.rotation.Names()
+  }
+  server.mu.RUnlock()
+  if zone == nil {
+    return state
+  }
+
+  state.MapID = zone.mapID()
+  meta := zone.meta()
+  state.Name, state.Seed = meta.Name, meta.Seed
+  if zone.chunks != nil {
+    state.Seed = zone.chunks.Seed()
+    return state
+  }
+  if mapData, err := zone.mapGenerator.GetMapData(); err == nil {
+    stats := mapData.Stats()
+    state.MapHash = mapData.Hash()
+    state.Width, state.Height = mapData.Width, mapData.Height
+    state.Stats = &stats
+  }
+  return state
+}
+
+// new map of the same size for the main zone, saved over its file. The
+// chunked world switches to the chunks of seed instead.
+func (server *Server) RegenerateMap(seed int64) error {
+  server.mu.RLock()
+  main := server.zones[defaultZoneName]
+  server.mu.RUnlock()
+  if main != nil && main.chunks != nil {
+    main.chunks.Reseed(seed)
+    mapLog.Info("chunked world reseeded", "seed", seed)
+    server.refreshZone(main, adminChange{Op: "map_regenerate", Seed: seed})
+    return nil
+  }
+
+  zone, err := server.mainMapZone()
+  if err != nil {
+    return err
+  }
+  if err := zone.mapGenerator.Regenerate(seed); err != nil {
+    return err
+  }
+  server.refreshZone(zone, adminChange{Op: "map_regenerate", Seed: seed})
+  return nil
+}
+
+// replaces the map of the main zone with a map file of map_dir. Edits are
+// saved back to the file, so name must be a plain file name.
+func (server *Server) LoadMap(name string) error {
+  if name == "" || name == "." || strings.Contains(name, "..") ||
+    strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+    return fmt.Errorf("%w: %q", errMapName, name)
+  }
+  zone, err := server.mainMapZone()
+  if err != nil {
+    return err
+  }
+  filename := filepath.Join(server.config.MapDir, name)
+  if err := zone.mapGenerator.LoadFromFile(filename); err != nil {
+    return err
+  }
+  mapLog.Info("map loaded", "file", filename)
+  server.refreshZone(zone, adminChange{Op: "map_load", File: name})
+  return nil
+}
+
+// clients of the zone stay in place and get the terrain of its new map,
+// change is the map change recorded
+func (server *Server) refreshZone(zone *Zone, change adminChange) {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+  server.recordAdmin(change)
+  zone.invalidatePaths()
+  for _, client := range zone.clients {
+    client.sentChunks = make(map[ChunkCoord]time.Time)
+    client.path = nil
+    if client.user != nil {
+      client.user.updatePosition(snapToGround(zone.terrain(), client.user.location))
+    }
+    server.sendZoneChange(client)
+  }
+}
+
+// returns the number of clients the message was sent to
+func (server *Server) Broadcast(message string) int {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  sent := 0
+  for _, client := range server.clients {
+    if client.addr == nil {
+      continue
+    }
+    server.sendJSON(client.addr, AdminNotice{Type: "broadcast", Message: message})
+    sent++
+  }
+  netLog.Info("message broadcast", "clients", sent, "message", message)
+  return sent
+}
+
+// stops the read loop, Start returns once it is stopped. Handlers of
+// EventServerStopping run first.
+func (server *Server) Shutdown() {
+  server.shutdownOnce.Do(func() {
+    netLog.Info("server shutting down")
+    server.eventManager.Dispatch(Event{
+      Type: EventServerStopping,
+      Data: ServerData{
+        Port:   server.conn.LocalAddr().(*net.UDPAddr).Port,
+        World:  server.config.World,
+        Uptime: time.Since(server.startedAt),
+      },
+    })
+    close(server.done)
+    server.conn.Close()
+  })
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestKickedClientIgnored(t *testing.T) {
+  server := newTestServer(t)
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  if err := server.Kick(addr.String()); err != nil {
+    t.Fatal(err)
+  }
+  server.handleDatagram(addr, []byte(`{"type":"move","location":[1,0,1]}`))
+  if _, ok := server.clients[addr.String()]; ok {
+    t.Fatal("kicked client spawned again by its next datagram")
+  }
+
+  clock.Set(clock.Now().Add(kickCooldown))
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  if _, ok := server.clients[addr.String()]; !ok {
+    t.Fatal("kicked client still ignored after the cooldown")
+  }
+}
+
+func TestRegenerateChunkedWorld(t *testing.T) {
+  server := newTestWorld(t, WorldChunked)
+  zone := server.zones[defaultZoneName]
+  before, err := zone.chunks.Chunk(ChunkCoord{0, 0})
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  client := server.clients[addr.String()]
+  client.sentChunks[ChunkCoord{0, 0}] = time.Time{}
+
+  if err := server.RegenerateMap(server.config.Seed + 1); err != nil {
+    t.Fatal(err)
+  }
+  if seed := zone.chunks.Seed(); seed != server.config.Seed+1 {
+    t.Fatalf("chunked world seed %d after the regeneration", seed)
+  }
+  if len(client.sentChunks) != 0 {
+    t.Fatal("chunks of the previous seed still marked as sent")
+  }
+  after, err := zone.chunks.Chunk(ChunkCoord{0, 0})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if after == before || after.Hash() == before.Hash() {
+    t.Fatal("chunk of the previous seed kept")
+  }
+  chunkFile := filepath.Join(server.config.ChunkDir, fmt.Sprint(server.config.Seed+1), "0_0.bin")
+  if _, err := LoadMapFromFile(chunkFile); err != nil {
+    t.Fatalf("chunk of the new seed not saved: %v", err)
+  }
+
+  if err := server.LoadMap(filepath.Base(chunkFile)); err != errNoFixedMap {
+    t.Fatalf("map load in the chunked world: %v", err)
+  }
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+  "context"
+  "crypto/subtle"
+  _ "embed"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// json admin api over http, backed by the same operations as the console.
+// Every request needs the api_token as a bearer token. The routes are
+// described in openapi.json, which is checked against apiRoutes when the
+// api starts.
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type apiRoute struct {
+  method string
+  path   string
+  // status of a successful response
+  status int
+  // a nil value is sent as an empty body
+  handle func(server *Server, r *http.Request) (interface{}, error)
+}
+
+type apiIDResponse struct {
+  ID string `json:"id"`
+}
+
+type apiBroadcastResponse struct {
+  Clients int `json:"clients"`
+}
+
+type apiStatusResponse struct {
+  Status string `json:"status"`
+}
+
+type apiErrorResponse struct {
+  Error string `json:"error"`
+}
+
+// an error with its http status, other errors are mapped by apiStatus
+type apiError struct {
+  status  int
+  message string
+}
+
+func (err apiError) Error() string {
+  return err.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+  return apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+var apiRoutes = []apiRoute{
+  {"GET", "/api/status", http.StatusOK, apiGetStatus},
+  {"GET", "/api/clients", http.StatusOK, apiGetClients},
+  {"POST", "/api/clients/{id}/kick", http.StatusOK, apiKick},
+  {"POST", "/api/clients/{id}/ban", http.StatusCreated, apiBan},
+  {"POST", "/api/clients/{id}/teleport", http.StatusOK, apiTeleport},
+  {"POST", "/api/clients/{id}/walk", http.StatusOK, apiWalkBot},
+  {"POST", "/api/bots", http.StatusCreated, apiSpawnBot},
+  {"GET", "/api/bans", http.StatusOK, apiGetBans},
+  {"DELETE", "/api/bans/{ip}", http.StatusNoContent, apiUnban},
+  {"GET", "/api/map", http.StatusOK, apiGetMap},
+  {"POST", "/api/map/regenerate", http.StatusOK, apiRegenerateMap},
+  {"POST", "/api/map/load", http.StatusOK, apiLoadMap},
+  {"POST", "/api/map/rotate", http.StatusOK, apiRotateMap},
+  {"POST", "/api/broadcast", http.StatusOK, apiBroadcast},
+  {"GET", "/api/config", http.StatusOK, apiGetConfig},
+  {"POST", "/api/shutdown", http.StatusAccepted, apiShutdown},
+  {"GET", "/api/openapi.json", http.StatusOK, apiGetSpec},
+}
+
+func apiGetStatus(server *Server, r *http.Request) (interface{}, error) {
+  return server.Status(), nil
+}
+
+func apiGetClients(server *Server, r *http.Request) (interface{}, error) {
+  return server.Clients(), nil
+}
+
+func apiKick(server *Server, r *http.Request) (interface{}, error) {
+  id := r.PathValue("id")
+  if err := server.Kick(id); err != nil {
+    return nil, err
+  }
+  return apiIDResponse{id}, nil
+}
+
+func apiBan(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    // 0 or missing bans until the server restarts
+    Duration Duration `json:"duration"`
+    Reason   string   `json:"reason"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if request.Duration < 0 {
+    return nil, badRequest("duration must not be negative")
+  }
+  return server.Ban(r.PathValue("id"), request.Duration.Std(), request.Reason)
+}
+
+func apiTeleport(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    Location *[3]float32 `json:"location"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if request.Location == nil {
+    return nil, badRequest("location is required")
+  }
+  id := r.PathValue("id")
+  location := Vector3{x: request.Location[0], y: request.Location[1], z: request.Location[2]}
+  if err := server.Teleport(id, location); err != nil {
+    return nil, err
+  }
+  return apiIDResponse{id}, nil
+}
+
+func apiWalkBot(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    Location *[3]float32 `json:"location"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if request.Location == nil {
+    return nil, badRequest("location is required")
+  }
+  id := r.PathValue("id")
+  if err := server.WalkBot(id, vector3(*request.Location)); err != nil {
+    return nil, err
+  }
+  return apiIDResponse{id}, nil
+}
+
+func apiSpawnBot(server *Server, r *http.Request) (interface{}, error) {
+  return apiIDResponse{server.SpawnBot()}, nil
+}
+
+func apiGetBans(server *Server, r *http.Request) (interface{}, error) {
+  return server.Bans(), nil
+}
+
+func apiUnban(server *Server, r *http.Request) (interface{}, error) {
+  return nil, server.Unban(r.PathValue("ip"))
+}
+
+func apiGetMap(server *Server, r *http.Request) (interface{}, error) {
+  return server.MapState(), nil
+}
+
+func apiRegenerateMap(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    Seed *int64 `json:"seed"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if request.Seed == nil {
+    return nil, badRequest("seed is required")
+  }
+  if err := server.RegenerateMap(*request.Seed); err != nil {
+    return nil, err
+  }
+  return server.MapState(), nil
+}
+
+func apiLoadMap(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    File string `json:"file"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if request.File == "" {
+    return nil, badRequest("file is required")
+  }
+  if err := server.LoadMap(request.File); err != nil {
+    return nil, err
+  }
+  return server.MapState(), nil
+}
+
+func apiRotateMap(server *Server, r *http.Request) (interface{}, error) {
+  if err := server.RotateMap(); err != nil {
+    return nil, err
+  }
+  return server.MapState(), nil
+}
+
+func apiBroadcast(server *Server, r *http.Request) (interface{}, error) {
+  var request struct {
+    Message string `json:"message"`
+  }
+  if err := decodeAPIBody(r, &request); err != nil {
+    return nil, err
+  }
+  if strings.TrimSpace(request.Message) == "" {
+    return nil, badRequest("message is required")
+  }
+  return apiBroadcastResponse{server.Broadcast(request.Message)}, nil
+}
+
+func apiGetConfig(server *Server, r *http.Request) (interface{}, error) {
+  return server.config.Redacted(), nil
+}
+
+// the response is still sent, stopAPI waits for it
+func apiShutdown(server *Server, r *http.Request) (interface{}, error) {
+  server.Shutdown()
+  return apiStatusResponse{"shutting down"}, nil
+}
+
+func apiGetSpec(server *Server, r *http.Request) (interface{}, error) {
+  return json.RawMessage(openAPISpec), nil
+}
+
+// an empty body leaves value as it is
+func decodeAPIBody(r *http.Request, value interface{}) error {
+  decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<16))
+  decoder.DisallowUnknownFields()
+  if err := decoder.Decode(value); err != nil && err != io.EOF {
+    return badRequest("invalid body: %v", err)
+  }
+  return nil
+}
+
+func apiStatus(err error) int {
+  var apiErr apiError
+  switch {
+  case errors.As(err, &apiErr):
+    return apiErr.status
+  case errors.Is(err, errNoClient), errors.Is(err, errNoBan), errors.Is(err, os.ErrNotExist):
+    return http.StatusNotFound
+  case errors.Is(err, errNoFixedMap), errors.Is(err, errNoRotation), errors.Is(err, errNoPathfinding):
+    return http.StatusConflict
+  case errors.Is(err, errOutsideZone), errors.Is(err, errBanBot), errors.Is(err, errNotBot),
+    errors.Is(err, errMapName), errors.Is(err, ErrOutOfMap), errors.Is(err, ErrNoPath), errors.Is(err, ErrPathTooLong):
+    return http.StatusBadRequest
+  }
+  return http.StatusInternalServerError
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, value interface{}) {
+  data, err := json.Marshal(value)
+  if err != nil {
+    netLog.Error("api response not encoded", "err", err)
+    status, data = http.StatusInternalServerError, []byte(`{"error":"response not encoded"}`)
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  w.Write(append(data, '\n'))
+}
+
+func (server *Server) authorizedAPI(r *http.Request) bool {
+  token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+  return ok && subtle.ConstantTimeCompare([]byte(token), []byte(server.config.APIToken)) == 1
+}
+
+func (server *Server) apiHandler(route apiRoute) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if !server.authorizedAPI(r) {
+      netLog.Warn("api request refused", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+      w.Header().Set("WWW-Authenticate", `Bearer realm="rtgs"`)
+      writeAPIJSON(w, http.StatusUnauthorized, apiErrorResponse{"missing or wrong bearer token"})
+      return
+    }
+
+    value, err := route.handle(server, r)
+    status := route.status
+    if err != nil {
+      status = apiStatus(err)
+      value = apiErrorResponse{err.Error()}
+    }
+    // reads are frequent, changes are worth keeping
+    level := slog.LevelInfo
+    if r.Method == http.MethodGet && err == nil {
+      level = slog.LevelDebug
+    }
+    netLog.Log(r.Context(), level, "api request", "method", r.Method, "path", r.URL.Path,
+      "status", status, "remote", r.RemoteAddr)
+
+    if value == nil {
+      w.WriteHeader(status)
+      return
+    }
+    writeAPIJSON(w, status, value)
+  }
+}
+
+// operations of an openapi path item, its other keys (parameters, summary,
+// servers...) are not operations
+var apiSpecMethods = map[string]bool{
+  "get": true, "put": true, "post": true, "delete": true,
+  "options": true, "head": true, "patch": true, "trace": true,
+}
+
+// differences between apiRoutes and openapi.json: routes missing on either
+// side and success statuses that are not described
+func checkAPISpec() []string {
+  var spec struct {
+    Paths map[string]map[string]json.RawMessage `json:"paths"`
+  }
+  if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+    return []string{fmt.Sprintf("openapi.json is not valid: %v", err)}
+  }
+
+  var problems []string
+  served := make(map[string]bool)
+  for _, route := range apiRoutes {
+    key := route.method + " " + route.path
+    served[key] = true
+    raw, ok := spec.Paths[route.path][strings.ToLower(route.method)]
+    if !ok {
+      problems = append(problems, key+" is not described")
+      continue
+    }
+    var operation struct {
+      Responses map[string]json.RawMessage `json:"responses"`
+    }
+    if err := json.Unmarshal(raw, &operation); err != nil {
+      problems = append(problems, fmt.Sprintf("%s: invalid operation: %v", key, err))
+      continue
+    }
+    if _, ok := operation.Responses[strconv.Itoa(route.status)]; !ok {
+      problems = append(problems, fmt.Sprintf("%s: response %d is not described", key, route.status))
+    }
+  }
+  for path, item := range spec.Paths {
+    for method := range item {
+      if !apiSpecMethods[method] {
+        continue
+      }
+      if key := strings.ToUpper(method) + " " + path; !served[key] {
+        problems = append(problems, key+" is described but not served")
+      }
+    }
+  }
+  sort.Strings(problems)
+  return problems
+}
+
+func (server *Server) apiMux() *http.ServeMux {
+  mux := http.NewServeMux()
+  for _, route := range apiRoutes {
+    mux.HandleFunc(route.method+" "+route.path, server.apiHandler(route))
+  }
+  return mux
+}
+
+// serves the api on the configured address, an empty address disables it
+func (server *Server) startAPI() {
+  if server.config.APIAddress == "" {
+    return
+  }
+  for _, problem := range checkAPISpec() {
+    netLog.Warn("api and openapi.json differ", "problem", problem)
+  }
+
+  listener, err := net.Listen("tcp", server.config.APIAddress)
+  if err != nil {
+    netLog.Error("api listener not started", "addr", server.config.APIAddress, "err", err)
+    return
+  }
+  server.api = &http.Server{Handler: server.apiMux(), ReadHeaderTimeout: 5 * time.Second}
+  netLog.Info("api listening", "addr", listener.Addr().String())
+
+  api := server.api
+  go func() {
+    if err := api.Serve(listener); err != http.ErrServerClosed {
+      netLog.Error("api listener stopped", "err", err)
+    }
+  }()
+}
+
+// requests in flight, like a shutdown request, are answered first
+func (server *Server) stopAPI() {
+  if server.api == nil {
+    return
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+  if err := server.api.Shutdown(ctx); err != nil {
+    netLog.Warn("api not stopped cleanly", "err", err)
+  }
+}
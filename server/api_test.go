@@ -0,0 +1,314 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+const testAPIToken = "secret"
+
+// a server of the maps world in a temporary directory on a fake socket,
+// nothing is started
+func newTestServer(t *testing.T) *Server {
+  t.Helper()
+  return newTestWorld(t, WorldMaps)
+}
+
+func newTestWorld(t *testing.T, world string) *Server {
+  t.Helper()
+  SetupLogging(io.Discard, DefaultConfig())
+  config := DefaultConfig()
+  config.World = world
+  config.MapDir = t.TempDir()
+  config.ChunkDir = filepath.Join(config.MapDir, "chunks")
+  config.MapWidth, config.MapHeight = 33, 33
+  config.ZoneDir = filepath.Join(config.MapDir, "zones")
+  config.PlayerDir = ""
+  config.WorldFile = ""
+  config.Console = false
+  config.APIToken = testAPIToken
+
+  server, err := newServer(config, NewReplaySocket(config.Port))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := server.LoadWorld(); err != nil {
+    t.Fatal(err)
+  }
+  server.prepareZones()
+  t.Cleanup(func() { server.eventManager.Close(time.Second) })
+  return server
+}
+
+func TestAPISpecMatchesRoutes(t *testing.T) {
+  for _, problem := range checkAPISpec() {
+    t.Error(problem)
+  }
+}
+
+func TestAPISpecSkipsPathItemKeys(t *testing.T) {
+  var spec map[string]interface{}
+  if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+    t.Fatal(err)
+  }
+  item := spec["paths"].(map[string]interface{})["/api/clients/{id}/kick"].(map[string]interface{})
+  item["parameters"] = []interface{}{map[string]interface{}{"$ref": "#/components/parameters/ClientID"}}
+  item["summary"] = "kicks"
+
+  original := openAPISpec
+  defer func() { openAPISpec = original }()
+  var err error
+  if openAPISpec, err = json.Marshal(spec); err != nil {
+    t.Fatal(err)
+  }
+  for _, problem := range checkAPISpec() {
+    t.Error(problem)
+  }
+}
+
+// the parts of openapi.json the responses are checked against
+type apiSpec struct {
+  Paths      map[string]map[string]json.RawMessage `json:"paths"`
+  Components struct {
+    Responses map[string]apiSpecResponse `json:"responses"`
+    Schemas   map[string]apiSchema       `json:"schemas"`
+  } `json:"components"`
+}
+
+type apiSpecResponse struct {
+  Ref     string `json:"$ref"`
+  Content map[string]struct {
+    Schema *apiSchema `json:"schema"`
+  } `json:"content"`
+}
+
+type apiSchema struct {
+  Ref        string               `json:"$ref"`
+  Type       string               `json:"type"`
+  Properties map[string]apiSchema `json:"properties"`
+  Items      *apiSchema           `json:"items"`
+  Enum       []string             `json:"enum"`
+}
+
+func loadAPISpec(t *testing.T) apiSpec {
+  t.Helper()
+  var spec apiSpec
+  if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+    t.Fatal(err)
+  }
+  return spec
+}
+
+// the schema of the response, nil for a response without a body
+func (spec apiSpec) responseSchema(t *testing.T, method, path string, status int) *apiSchema {
+  t.Helper()
+  var operation struct {
+    Responses map[string]apiSpecResponse `json:"responses"`
+  }
+  if err := json.Unmarshal(spec.Paths[path][strings.ToLower(method)], &operation); err != nil {
+    t.Fatalf("%s %s: %v", method, path, err)
+  }
+  response, ok := operation.Responses[strconv.Itoa(status)]
+  if !ok {
+    t.Fatalf("%s %s: response %d is not described", method, path, status)
+  }
+  if response.Ref != "" {
+    response = spec.Components.Responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+  }
+  content, ok := response.Content["application/json"]
+  if !ok {
+    return nil
+  }
+  return content.Schema
+}
+
+// properties of objects must be described when the schema lists them
+func (spec apiSpec) check(schema apiSchema, value interface{}, at string) error {
+  if schema.Ref != "" {
+    return spec.check(spec.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], value, at)
+  }
+  switch schema.Type {
+  case "object":
+    object, ok := value.(map[string]interface{})
+    if !ok {
+      return fmt.Errorf("%s: %v is not an object", at, value)
+    }
+    if schema.Properties == nil {
+      return nil
+    }
+    for key, property := range object {
+      described, ok := schema.Properties[key]
+      if !ok {
+        return fmt.Errorf("%s.%s is not described", at, key)
+      }
+      if err := spec.check(described, property, at+"."+key); err != nil {
+        return err
+      }
+    }
+  case "array":
+    array, ok := value.([]interface{})
+    if !ok {
+      return fmt.Errorf("%s: %v is not an array", at, value)
+    }
+    for i, item := range array {
+      if err := spec.check(*schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+        return err
+      }
+    }
+  case "string":
+    text, ok := value.(string)
+    if !ok {
+      return fmt.Errorf("%s: %v is not a string", at, value)
+    }
+    if len(schema.Enum) > 0 && !strings.Contains(","+strings.Join(schema.Enum, ",")+",", ","+text+",") {
+      return fmt.Errorf("%s: %q is not one of %v", at, text, schema.Enum)
+    }
+  case "number":
+    if _, ok := value.(float64); !ok {
+      return fmt.Errorf("%s: %v is not a number", at, value)
+    }
+  case "integer":
+    if number, ok := value.(float64); !ok || number != float64(int64(number)) {
+      return fmt.Errorf("%s: %v is not an integer", at, value)
+    }
+  case "boolean":
+    if _, ok := value.(bool); !ok {
+      return fmt.Errorf("%s: %v is not a boolean", at, value)
+    }
+  }
+  return nil
+}
+
+func TestAPIRoutes(t *testing.T) {
+  server := newTestServer(t)
+  spec := loadAPISpec(t)
+  handler := server.apiMux()
+
+  // a player to ban, the bots come from the api
+  player := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(player, []byte(`{"type":"map_info"}`))
+  mapFile := filepath.Join(server.config.MapDir, defaultMapName+".bin")
+
+  cases := []struct {
+    method, path, body string
+    status             int
+  }{
+    {"GET", "/api/status", "", http.StatusOK},
+    {"POST", "/api/bots", "", http.StatusCreated},
+    {"POST", "/api/bots", "", http.StatusCreated},
+    {"GET", "/api/clients", "", http.StatusOK},
+    {"POST", "/api/clients/bot-1/teleport", `{"location":[4,0,4]}`, http.StatusOK},
+    {"POST", "/api/clients/bot-1/teleport", `{}`, http.StatusBadRequest},
+    {"POST", "/api/clients/bot-1/teleport", `{"location":[-100,0,4]}`, http.StatusBadRequest},
+    {"POST", "/api/clients/bot-1/walk", `{"location":[4,0,4]}`, http.StatusOK},
+    {"POST", "/api/clients/bot-1/walk", `{"location":[-100,0,4]}`, http.StatusBadRequest},
+    {"POST", "/api/clients/" + player.String() + "/walk", `{"location":[20,0,20]}`, http.StatusBadRequest},
+    {"POST", "/api/clients/bot-1/kick", "", http.StatusOK},
+    {"POST", "/api/clients/bot-1/kick", "", http.StatusNotFound},
+    {"POST", "/api/clients/bot-2/ban", "", http.StatusBadRequest},
+    {"POST", "/api/clients/" + player.String() + "/ban", `{"duration":"1h","reason":"test"}`, http.StatusCreated},
+    {"POST", "/api/clients/" + player.String() + "/ban", `{"unknown":1}`, http.StatusBadRequest},
+    {"GET", "/api/bans", "", http.StatusOK},
+    {"DELETE", "/api/bans/127.0.0.1", "", http.StatusNoContent},
+    {"DELETE", "/api/bans/127.0.0.1", "", http.StatusNotFound},
+    {"GET", "/api/map", "", http.StatusOK},
+    {"POST", "/api/map/regenerate", `{"seed":7}`, http.StatusOK},
+    {"POST", "/api/map/regenerate", `{}`, http.StatusBadRequest},
+    {"POST", "/api/map/load", `{"file":"` + filepath.Base(mapFile) + `"}`, http.StatusOK},
+    {"POST", "/api/map/load", `{"file":"missing.bin"}`, http.StatusNotFound},
+    {"POST", "/api/map/load", `{"file":"` + filepath.ToSlash(mapFile) + `"}`, http.StatusBadRequest},
+    {"POST", "/api/map/load", `{"file":"../main.bin"}`, http.StatusBadRequest},
+    {"POST", "/api/map/rotate", "", http.StatusOK},
+    {"POST", "/api/broadcast", `{"message":"hello"}`, http.StatusOK},
+    {"POST", "/api/broadcast", `{"message":" "}`, http.StatusBadRequest},
+    {"GET", "/api/config", "", http.StatusOK},
+    {"GET", "/api/openapi.json", "", http.StatusOK},
+    {"POST", "/api/shutdown", "", http.StatusAccepted},
+  }
+
+  succeeded := make(map[string]bool)
+  for _, c := range cases {
+    name := c.method + " " + c.path
+    pattern := ""
+    for _, route := range apiRoutes {
+      request := httptest.NewRequest(c.method, c.path, nil)
+      if routeServes(route, request) {
+        pattern = route.path
+        if c.status == route.status {
+          succeeded[route.method+" "+route.path] = true
+        }
+      }
+    }
+    if pattern == "" {
+      t.Fatalf("%s: no route", name)
+    }
+
+    for _, token := range []string{"", "Bearer wrong", "Basic " + testAPIToken} {
+      request := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+      if token != "" {
+        request.Header.Set("Authorization", token)
+      }
+      recorder := httptest.NewRecorder()
+      handler.ServeHTTP(recorder, request)
+      if recorder.Code != http.StatusUnauthorized {
+        t.Fatalf("%s with %q: status %d, expected 401", name, token, recorder.Code)
+      }
+      if recorder.Header().Get("WWW-Authenticate") == "" {
+        t.Errorf("%s with %q: no WWW-Authenticate header", name, token)
+      }
+      checkAPIResponse(t, spec, name, c.method, pattern, recorder)
+    }
+
+    request := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+    request.Header.Set("Authorization", "Bearer "+testAPIToken)
+    recorder := httptest.NewRecorder()
+    handler.ServeHTTP(recorder, request)
+    if recorder.Code != c.status {
+      t.Fatalf("%s: status %d, expected %d: %s", name, recorder.Code, c.status, recorder.Body)
+    }
+    checkAPIResponse(t, spec, name, c.method, pattern, recorder)
+  }
+
+  for _, route := range apiRoutes {
+    if key := route.method + " " + route.path; !succeeded[key] {
+      t.Errorf("%s was not tested", key)
+    }
+  }
+}
+
+func routeServes(route apiRoute, request *http.Request) bool {
+  mux := http.NewServeMux()
+  mux.HandleFunc(route.method+" "+route.path, func(http.ResponseWriter, *http.Request) {})
+  _, pattern := mux.Handler(request)
+  return pattern != ""
+}
+
+func checkAPIResponse(t *testing.T, spec apiSpec, name, method, path string, recorder *httptest.ResponseRecorder) {
+  t.Helper()
+  schema := spec.responseSchema(t, method, path, recorder.Code)
+  if schema == nil {
+    if recorder.Body.Len() != 0 {
+      t.Errorf("%s: %d has no body in the spec, got %s", name, recorder.Code, recorder.Body)
+    }
+    return
+  }
+  if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+    t.Errorf("%s: content type %q", name, contentType)
+  }
+  var value interface{}
+  if err := json.Unmarshal(recorder.Body.Bytes(), &value); err != nil {
+    t.Fatalf("%s: invalid json %s: %v", name, recorder.Body, err)
+  }
+  if err := spec.check(*schema, value, "response"); err != nil {
+    t.Errorf("%s %d: %v", name, recorder.Code, err)
+  }
+}
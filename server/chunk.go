@@ -0,0 +1,331 @@
+package main
+
+import (
+  "container/list"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+const (
+  ChunkSize      = 32
+  chunkMaxVal    = 32
+  chunkViewRange = 2
+)
+
+type ChunkCoord struct {
+  X int32
+  Z int32
+}
+
+type ChunkSource interface {
+  Chunk(coord ChunkCoord) (*MapData, error)
+}
+
+func chunkCoordAt(x, z float32) ChunkCoord {
+  return ChunkCoord{
+    X: int32(math.Floor(float64(x) / ChunkSize)),
+    Z: int32(math.Floor(float64(z) / ChunkSize)),
+  }
+}
+
+// nearest rings first so the chunk under the user is always sent first
+func chunksAround(x, z float32, radius int32) []ChunkCoord {
+  center := chunkCoordAt(x, z)
+  coords := make([]ChunkCoord, 0, (2*radius+1)*(2*radius+1))
+  for ring := int32(0); ring <= radius; ring++ {
+    for dz := -ring; dz <= ring; dz++ {
+      for dx := -ring; dx <= ring; dx++ {
+        if max(abs32(dx), abs32(dz)) == ring {
+          coords = append(coords, ChunkCoord{X: center.X + dx, Z: center.Z + dz})
+        }
+      }
+    }
+  }
+  return coords
+}
+
+func abs32(v int32) int32 {
+  if v < 0 {
+    return -v
+  }
+  return v
+}
+
+func (coord ChunkCoord) distance(other ChunkCoord) int32 {
+  return max(abs32(coord.X-other.X), abs32(coord.Z-other.Z))
+}
+
+// slices a bounded map into chunks so fixed maps stream like chunked worlds
+func (mapData *MapData) Chunk(coord ChunkCoord) (*MapData, error) {
+  originX := int(coord.X) * ChunkSize
+  originZ := int(coord.Z) * ChunkSize
+  if originX < 0 || originZ < 0 || originX >= mapData.Width || originZ >= mapData.Height {
+    return nil, fmt.Errorf("chunk %d,%d is outside of the map", coord.X, coord.Z)
+  }
+
+  width := min(ChunkSize+1, mapData.Width-originX)
+  height := min(ChunkSize+1, mapData.Height-originZ)
+
+  data := make([][]float32, height)
+  for y := 0; y < height; y++ {
+    data[y] = make([]float32, width)
+    copy(data[y], mapData.Data[originZ+y][originX:originX+width])
+  }
+
+  chunk := &MapData{
+    Width:  width,
+    Height: height,
+    MaxVal: mapData.MaxVal,
+    Data:   data,
+  }
+  if mapData.Layers != nil {
+    chunk.Layers = make([][]CellLayers, height)
+    for y := 0; y < height; y++ {
+      chunk.Layers[y] = append([]CellLayers(nil), mapData.Layers[originZ+y][originX:originX+width]...)
+    }
+  }
+  for _, object := range mapData.Meta.Objects {
+    if chunkCoordAt(object.X, object.Z) == coord {
+      chunk.Meta.Objects = append(chunk.Meta.Objects, object)
+    }
+  }
+  return chunk, nil
+}
+
+type chunkEntry struct {
+  coord ChunkCoord
+  data  *MapData
+}
+
+// a chunk being read or generated, others asking for it wait on done
+type chunkLoad struct {
+  done chan struct{}
+  data *MapData
+  err  error
+}
+
+type ChunkManager struct {
+  generator *MapGenerator
+  // the chunks of each seed live in a directory of root
+  root      string
+  capacity  int
+
+  mu      sync.Mutex
+  seed    int64
+  dir     string
+  // bumped by Reseed, loads of an older seed are not kept
+  generation int
+  entries map[ChunkCoord]*list.Element
+  lru     *list.List
+  meta    *MapMeta
+  loading map[ChunkCoord]*chunkLoad
+  // edits hold it so the chunks they read stay current while cm.mu is
+  // released for loading
+  editMu sync.Mutex
+}
+
+func NewChunkManager(generator *MapGenerator, seed int64, dir string, capacity int) *ChunkManager {
+  return &ChunkManager{
+    generator: generator,
+    root:      dir,
+    seed:      seed,
+    dir:       filepath.Join(dir, fmt.Sprintf("%d", seed)),
+    capacity:  capacity,
+    entries:   make(map[ChunkCoord]*list.Element),
+    lru:       list.New(),
+    loading:   make(map[ChunkCoord]*chunkLoad),
+  }
+}
+
+func (cm *ChunkManager) Seed() int64 {
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+  return cm.seed
+}
+
+// switches to the chunks of seed, saved in a directory of their own. The
+// cached chunks and metadata are dropped.
+func (cm *ChunkManager) Reseed(seed int64) {
+  cm.editMu.Lock()
+  defer cm.editMu.Unlock()
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+
+  cm.seed = seed
+  cm.dir = filepath.Join(cm.root, fmt.Sprintf("%d", seed))
+  cm.generation++
+  cm.entries = make(map[ChunkCoord]*list.Element)
+  cm.lru.Init()
+  cm.meta = nil
+}
+
+// world wide metadata (portals...) lives in world.json next to the chunks
+func (cm *ChunkManager) Meta() MapMeta {
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+  
+  if cm.meta == nil {
+    cm.meta = &MapMeta{}
+    raw, err := os.ReadFile(filepath.Join(cm.dir, "world.json"))
+    if err == nil {
+      if err := json.Unmarshal(raw, cm.meta); err != nil {
+        mapLog.Error("invalid world metadata", "err", err)
+      }
+    } else if !errors.Is(err, os.ErrNotExist) {
+      mapLog.Error("world metadata unreadable", "err", err)
+    }
+  }
+  return *cm.meta
+}
+
+// must be called with cm.mu held
+func (cm *ChunkManager) chunkFilename(coord ChunkCoord) string {
+  return filepath.Join(cm.dir, fmt.Sprintf("%d_%d.bin", coord.X, coord.Z))
+}
+
+// returns the chunk from memory, then disk, and generates it as a last resort
+func (cm *ChunkManager) Chunk(coord ChunkCoord) (*MapData, error) {
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+  return cm.chunkLocked(coord)
+}
+
+// must be called with cm.mu held, it is released while the chunk is read
+// or generated so other chunks are served meanwhile
+func (cm *ChunkManager) chunkLocked(coord ChunkCoord) (*MapData, error) {
+  for {
+    if elem, ok := cm.entries[coord]; ok {
+      cm.lru.MoveToFront(elem)
+      return elem.Value.(*chunkEntry).data, nil
+    }
+    load, ok := cm.loading[coord]
+    if !ok {
+      break
+    }
+    cm.mu.Unlock()
+    <-load.done
+    cm.mu.Lock()
+    if load.err != nil {
+      return nil, load.err
+    }
+  }
+
+  load := &chunkLoad{done: make(chan struct{})}
+  cm.loading[coord] = load
+  seed, filename, generation := cm.seed, cm.chunkFilename(coord), cm.generation
+  cm.mu.Unlock()
+  load.data, load.err = cm.load(seed, filename, coord)
+  cm.mu.Lock()
+  delete(cm.loading, coord)
+  close(load.done)
+
+  if load.err != nil {
+    return nil, load.err
+  }
+  if generation == cm.generation {
+    cm.storeLocked(coord, load.data)
+  }
+  return load.data, nil
+}
+
+func (cm *ChunkManager) load(seed int64, filename string, coord ChunkCoord) (*MapData, error) {
+  mapData, err := cm.generator.readFile(filename)
+  if err == nil {
+    return mapData, nil
+  }
+  if !errors.Is(err, os.ErrNotExist) {
+    mapLog.Warn("chunk unreadable, regenerating", "x", coord.X, "z", coord.Z, "err", err)
+  }
+  mapData = cm.generator.GenerateChunk(seed, coord, chunkMaxVal)
+  if err := cm.generator.SaveToFile(mapData, filename); err != nil {
+    return nil, err
+  }
+  return mapData, nil
+}
+
+// must be called with cm.mu held
+func (cm *ChunkManager) storeLocked(coord ChunkCoord, mapData *MapData) {
+  if elem, ok := cm.entries[coord]; ok {
+    elem.Value.(*chunkEntry).data = mapData
+    cm.lru.MoveToFront(elem)
+    return
+  }
+  cm.entries[coord] = cm.lru.PushFront(&chunkEntry{coord: coord, data: mapData})
+  cm.evict()
+}
+
+// must be called with cm.mu held
+func (cm *ChunkManager) evict() {
+  for cm.lru.Len() > cm.capacity {
+    oldest := cm.lru.Back()
+    cm.lru.Remove(oldest)
+    delete(cm.entries, oldest.Value.(*chunkEntry).coord)
+  }
+}
+
+func (cm *ChunkManager) Loaded() int {
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+  return cm.lru.Len()
+}
+
+// the chunk when it is in memory. Terrain queries never load chunks, so a
+// move far from the streamed chunks cannot make the server generate them.
+func (cm *ChunkManager) cached(coord ChunkCoord) (*MapData, bool) {
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+  elem, ok := cm.entries[coord]
+  if !ok {
+    return nil, false
+  }
+  cm.lru.MoveToFront(elem)
+  return elem.Value.(*chunkEntry).data, true
+}
+
+// loads the chunk under a position the server chose
+func (cm *ChunkManager) LoadAt(x, z float32) {
+  coord := chunkCoordAt(x, z)
+  if _, err := cm.Chunk(coord); err != nil {
+    mapLog.Warn("chunk not loaded", "x", coord.X, "z", coord.Z, "err", err)
+  }
+}
+
+func (cm *ChunkManager) HeightAt(x, z float32) (float32, bool) {
+  coord := chunkCoordAt(x, z)
+  chunk, ok := cm.cached(coord)
+  if !ok {
+    return 0, false
+  }
+  return chunk.HeightAt(x-float32(coord.X)*ChunkSize, z-float32(coord.Z)*ChunkSize)
+}
+
+func (cm *ChunkManager) LayersAt(x, z float32) (CellLayers, bool) {
+  coord := chunkCoordAt(x, z)
+  chunk, ok := cm.cached(coord)
+  if !ok {
+    return CellLayers{}, false
+  }
+  return chunk.LayersAt(x-float32(coord.X)*ChunkSize, z-float32(coord.Z)*ChunkSize)
+}
+
+// objects near chunk borders may overlap a neighbour chunk
+func (cm *ChunkManager) ObstacleAt(x, z, radius float32) bool {
+  reach := radius + maxObjectRadius
+  checked := map[ChunkCoord]bool{}
+  for _, corner := range [4][2]float32{{x - reach, z - reach}, {x + reach, z - reach}, {x - reach, z + reach}, {x + reach, z + reach}} {
+    coord := chunkCoordAt(corner[0], corner[1])
+    if checked[coord] {
+      continue
+    }
+    checked[coord] = true
+    if chunk, ok := cm.cached(coord); ok && chunk.ObstacleAt(x, z, radius) {
+      return true
+    }
+  }
+  return false
+}
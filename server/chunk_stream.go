@@ -0,0 +1,105 @@
+package main
+
+import (
+  "encoding/json"
+  "net"
+  "time"
+)
+
+// caps the burst sent to one client per streaming pass
+const maxChunksPerPass = 4
+
+// chunks are only generated around users, and at most this many per pass
+// for all of them so generating never stalls the server
+const maxChunkLoadsPerPass = 8
+
+// chunks travel over udp, the ones not acknowledged by then are sent again
+const chunkAckTimeout = 2 * time.Second
+
+type chunkRequest struct {
+  addr   *net.UDPAddr
+  coord  ChunkCoord
+  source ChunkSource
+}
+
+func (server *Server) streamChunks() {
+  var requests []chunkRequest
+  
+  server.mu.Lock()
+  now := server.clock.Now()
+  loads := 0
+  for _, client := range server.clients {
+    // bots have no address and need no terrain
+    if client.user == nil || client.addr == nil {
+      continue
+    }
+    source := client.zone.chunkSource()
+    if source == nil {
+      continue
+    }
+    center := chunkCoordAt(client.user.location.x, client.user.location.z)
+    
+    // forget chunks the client left behind so they are sent again on return
+    for coord := range client.sentChunks {
+      if coord.distance(center) > chunkViewRange+1 {
+        delete(client.sentChunks, coord)
+      }
+    }
+    
+    pending := 0
+    for _, coord := range chunksAround(client.user.location.x, client.user.location.z, chunkViewRange) {
+      if pending >= maxChunksPerPass {
+        break
+      }
+      if sentAt, sent := client.sentChunks[coord]; sent && (sentAt.IsZero() || now.Sub(sentAt) < chunkAckTimeout) {
+        continue
+      }
+      if chunks, ok := source.(*ChunkManager); ok {
+        if _, cached := chunks.cached(coord); !cached {
+          if loads >= maxChunkLoadsPerPass {
+            continue
+          }
+          loads++
+        }
+      }
+      client.sentChunks[coord] = now
+      requests = append(requests, chunkRequest{addr: client.addr, coord: coord, source: source})
+      pending++
+    }
+  }
+  server.mu.Unlock()
+  
+  for _, request := range requests {
+    chunk, err := request.source.Chunk(request.coord)
+    if err != nil {
+      // outside of a bounded map, nothing to send
+      continue
+    }
+    server.sendChunk(request.addr, request.coord, chunk)
+  }
+}
+
+func (server *Server) sendChunk(addr *net.UDPAddr, coord ChunkCoord, chunk *MapData) {
+  encoded, err := EncodeMapBytes(chunk, EncodingCompressed)
+  if err != nil {
+    mapLog.Error("chunk encoding failed", "x", coord.X, "z", coord.Z, "err", err)
+    return
+  }
+  
+  update := ChunkUpdate{
+    Type: "chunk_data",
+    X:    coord.X,
+    Z:    coord.Z,
+    Data: encoded,
+  }
+  
+  data, err := json.Marshal(update)
+  if err != nil {
+    netLog.Error("json marshal failed", "type", update.Type, "err", err)
+    return
+  }
+  
+  if err := server.writeTo(data, addr); err != nil {
+    netLog.Warn("send failed", "type", update.Type, "x", coord.X, "z", coord.Z, "addr", addr.String(), "err", err)
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestChunksResentUntilAcknowledged(t *testing.T) {
+  server := newTestServer(t)
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  client := server.clients[addr.String()]
+  server.streamChunks()
+  coord := chunkCoordAt(client.user.location.x, client.user.location.z)
+  if sentAt, sent := client.sentChunks[coord]; !sent || sentAt.IsZero() {
+    t.Fatalf("chunk %v under the user not sent", coord)
+  }
+
+  // lost on the way, sent again once the ack is late
+  clock.Set(clock.Now().Add(chunkAckTimeout))
+  server.streamChunks()
+  if sentAt := client.sentChunks[coord]; !sentAt.Equal(clock.Now()) {
+    t.Fatalf("chunk %v not sent again, last sent at %v", coord, sentAt)
+  }
+
+  server.handleDatagram(addr, []byte(fmt.Sprintf(`{"type":"chunk_ack","x":%d,"z":%d}`, coord.X, coord.Z)))
+  clock.Set(clock.Now().Add(chunkAckTimeout))
+  server.streamChunks()
+  if sentAt := client.sentChunks[coord]; !sentAt.IsZero() {
+    t.Fatalf("acknowledged chunk %v sent again", coord)
+  }
+}
+
+func TestChunkLoadedOnce(t *testing.T) {
+  SetupLogging(io.Discard, DefaultConfig())
+  cm := NewChunkManager(NewMapGenerator(nil), 7, t.TempDir(), 16)
+
+  var wg sync.WaitGroup
+  chunks := make([]*MapData, 8)
+  for i := range chunks {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      chunk, err := cm.Chunk(ChunkCoord{1, 2})
+      if err != nil {
+        t.Error(err)
+      }
+      chunks[i] = chunk
+    }()
+  }
+  wg.Wait()
+  for _, chunk := range chunks {
+    if chunk != chunks[0] {
+      t.Fatal("concurrent requests loaded the chunk more than once")
+    }
+  }
+  if len(cm.loading) != 0 {
+    t.Fatalf("%d loads left in flight", len(cm.loading))
+  }
+}
+
+func TestMoveIntoUnloadedChunkRefused(t *testing.T) {
+  server := newTestWorld(t, WorldChunked)
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  client := server.clients[addr.String()]
+  chunks := client.zone.chunks
+  from := client.user.location
+
+  far := ChunkCoord{X: 1000, Z: 1000}
+  server.handleDatagram(addr, []byte(`{"type":"move","location":[32000,0,32000]}`))
+  if client.user.location != from {
+    t.Fatalf("move into an unloaded chunk accepted, user at %v", client.user.location)
+  }
+  chunks.mu.Lock()
+  filename := chunks.chunkFilename(far)
+  chunks.mu.Unlock()
+  if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+    t.Fatalf("chunk %v generated for a move, stat err %v", far, err)
+  }
+}
+
+func TestChunkLoadsCappedPerPass(t *testing.T) {
+  server := newTestWorld(t, WorldChunked)
+  for port := 40000; port < 40010; port++ {
+    addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+    server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+    server.Teleport(server.clients[addr.String()].user.id, Vector3{x: float32(port-40000) * 10 * ChunkSize, z: 0})
+  }
+  chunks := server.zones[defaultZoneName].chunks
+  before := chunkFiles(t, chunks)
+  server.streamChunks()
+  if loaded := chunkFiles(t, chunks) - before; loaded > maxChunkLoadsPerPass {
+    t.Fatalf("%d chunks generated in one pass, at most %d expected", loaded, maxChunkLoadsPerPass)
+  }
+}
+
+func chunkFiles(t *testing.T, chunks *ChunkManager) int {
+  t.Helper()
+  chunks.mu.Lock()
+  dir := chunks.dir
+  chunks.mu.Unlock()
+  files, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return len(files)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "net"
+  "os"
+  "slices"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  defaultConfigFile = "rtgs.json"
+
+  WorldChunked   = "chunked"
+  WorldMaps      = "maps"
+  WorldHeightmap = "heightmap"
+)
+
+// time.Duration written as "100ms" or "10s" in config files
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+  return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+  return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+  var raw string
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return fmt.Errorf("duration must be a string like \"10s\": %s", data)
+  }
+  parsed, err := time.ParseDuration(raw)
+  if err != nil {
+    return err
+  }
+  *d = Duration(parsed)
+  return nil
+}
+
+type HeightmapConfig struct {
+  File     string  `json:"file"`
+  MaxVal   int     `json:"max_val"`
+  Scale    float64 `json:"scale"`
+  SeaLevel float64 `json:"sea_level"`
+  Width    int     `json:"width"`
+  Height   int     `json:"height"`
+}
+
+// rates are per second, a zero max_clients means no limit
+type Config struct {
+  BindAddress string `json:"bind_address"`
+  Port        int    `json:"port"`
+  AdminToken  string `json:"admin_token"`
+  MaxClients  int    `json:"max_clients"`
+  LogLevel    string `json:"log_level"`
+  // per component levels overriding log_level
+  LogLevels    map[string]string `json:"log_levels,omitempty"`
+  LogFormat    string            `json:"log_format"`
+  LogRateLimit int               `json:"log_rate_limit"`
+  // host:port of the /metrics http listener, empty disables it
+  MetricsAddress string `json:"metrics_address"`
+  // admin console on stdin and on a unix socket, an empty path disables it
+  Console       bool   `json:"console"`
+  ConsoleSocket string `json:"console_socket"`
+  // host:port of the http admin api, it requires api_token
+  APIAddress string `json:"api_address"`
+  APIToken   string `json:"api_token"`
+  // asynchronous event delivery, the listed event types are handled in order
+  EventWorkers   int      `json:"event_workers"`
+  EventQueueSize int      `json:"event_queue_size"`
+  OrderedEvents  []string `json:"ordered_events"`
+  // identified players are saved there, empty disables persistence
+  PlayerDir       string   `json:"player_dir"`
+  PlayerSaveEvery Duration `json:"player_save_interval"`
+  // snapshot of the whole world, saved every world_save_interval and on
+  // shutdown, loaded at startup with restore_world. Empty disables it.
+  WorldFile      string   `json:"world_file"`
+  WorldSaveEvery Duration `json:"world_save_interval"`
+  RestoreWorld   bool     `json:"restore_world"`
+  // inbound traffic recording for rtgs-replay, empty disables it
+  RecordFile string `json:"record_file"`
+
+  TickRate       int      `json:"tick_rate"`
+  SnapshotRate   int      `json:"snapshot_rate"`
+  StreamInterval Duration `json:"stream_interval"`
+  ClientTimeout  Duration `json:"client_timeout"`
+  CleanupEvery   Duration `json:"cleanup_interval"`
+  ListEvery      Duration `json:"list_interval"`
+
+  World          string          `json:"world"`
+  Seed           int64           `json:"seed"`
+  ChunkDir       string          `json:"chunk_dir"`
+  ChunkCacheSize int             `json:"chunk_cache_size"`
+  MapDir         string          `json:"map_dir"`
+  Maps           []string        `json:"maps"`
+  RegenerateMap  bool            `json:"regenerate_map"`
+  RotateEvery    Duration        `json:"rotate_every"`
+  MapWidth       int             `json:"map_width"`
+  MapHeight      int             `json:"map_height"`
+  MapMaxVal      int             `json:"map_max_val"`
+  Heightmap      HeightmapConfig `json:"heightmap"`
+  ZoneDir        string          `json:"zone_dir"`
+}
+
+func DefaultConfig() Config {
+  return Config{
+    BindAddress: "0.0.0.0",
+    Port:        8888,
+    MaxClients:  0,
+    LogLevel:    "info",
+    LogFormat:   LogText,
+    // per component and message, per second
+    LogRateLimit: 20,
+    Console:      true,
+    EventWorkers:   defaultEventWorkers,
+    EventQueueSize: defaultEventQueueSize,
+    // terrain deltas must reach the clients in edit order
+    OrderedEvents: []string{string(EventTerrainEdited), string(EventUserMoved)},
+
+    TickRate:       10,
+    SnapshotRate:   10,
+    StreamInterval: Duration(500 * time.Millisecond),
+    ClientTimeout:  Duration(10 * time.Second),
+    CleanupEvery:   Duration(time.Second),
+    ListEvery:      Duration(15 * time.Second),
+
+    World:          WorldChunked,
+    Seed:           1,
+    ChunkDir:       "data/chunks",
+    ChunkCacheSize: 256,
+    MapDir:         defaultMapDir,
+    MapWidth:       generatedMapSize,
+    MapHeight:      generatedMapSize,
+    MapMaxVal:      generatedMapMaxVal,
+    Heightmap:      HeightmapConfig{MaxVal: generatedMapMaxVal},
+    ZoneDir:        "data/zones",
+    PlayerDir:       "data/players",
+    PlayerSaveEvery: Duration(30 * time.Second),
+    WorldFile:       "data/world.json",
+    WorldSaveEvery:  Duration(time.Minute),
+  }
+}
+
+func (config Config) TickInterval() time.Duration {
+  return time.Second / time.Duration(config.TickRate)
+}
+
+func (config Config) SnapshotInterval() time.Duration {
+  return time.Second / time.Duration(config.SnapshotRate)
+}
+
+type configOption struct {
+  name  string
+  usage string
+  set   func(config *Config, value string) error
+}
+
+func stringOption(field func(*Config) *string) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    *field(config) = value
+    return nil
+  }
+}
+
+func intOption(field func(*Config) *int) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    parsed, err := strconv.Atoi(value)
+    if err != nil {
+      return err
+    }
+    *field(config) = parsed
+    return nil
+  }
+}
+
+func int64Option(field func(*Config) *int64) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    parsed, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+      return err
+    }
+    *field(config) = parsed
+    return nil
+  }
+}
+
+func floatOption(field func(*Config) *float64) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    parsed, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+      return err
+    }
+    *field(config) = parsed
+    return nil
+  }
+}
+
+func boolOption(field func(*Config) *bool) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    parsed, err := strconv.ParseBool(value)
+    if err != nil {
+      return err
+    }
+    *field(config) = parsed
+    return nil
+  }
+}
+
+func durationOption(field func(*Config) *Duration) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+      return err
+    }
+    *field(config) = Duration(parsed)
+    return nil
+  }
+}
+
+func listOption(field func(*Config) *[]string) func(*Config, string) error {
+  return func(config *Config, value string) error {
+    var list []string
+    for _, item := range strings.Split(value, ",") {
+      if item = strings.TrimSpace(item); item != "" {
+        list = append(list, item)
+      }
+    }
+    *field(config) = list
+    return nil
+  }
+}
+
+// every option is a flag and an RTGS_ environment variable named after it,
+// e.g. -snapshot-rate and RTGS_SNAPSHOT_RATE
+var configOptions = []configOption{
+  {"bind", "bind address", stringOption(func(c *Config) *string { return &c.BindAddress })},
+  {"port", "udp port", intOption(func(c *Config) *int { return &c.Port })},
+  {"admin-token", "admin login token, empty disables admin logins", stringOption(func(c *Config) *string { return &c.AdminToken })},
+  {"max-clients", "maximum connected clients, 0 for no limit", intOption(func(c *Config) *int { return &c.MaxClients })},
+  {"log-level", "debug, info, warn or error", stringOption(func(c *Config) *string { return &c.LogLevel })},
+  {"log-levels", "per component levels, e.g. net=debug,map=warn", func(c *Config, value string) error {
+    levels, err := parseComponentLevels(value)
+    c.LogLevels = levels
+    return err
+  }},
+  {"log-format", "text or json", stringOption(func(c *Config) *string { return &c.LogFormat })},
+  {"log-rate-limit", "same log records let through per second, 0 for no limit", intOption(func(c *Config) *int { return &c.LogRateLimit })},
+  {"metrics-addr", "address of the prometheus /metrics listener, e.g. :9100", stringOption(func(c *Config) *string { return &c.MetricsAddress })},
+  {"console", "admin console on stdin", boolOption(func(c *Config) *bool { return &c.Console })},
+  {"console-socket", "unix socket path of the admin console", stringOption(func(c *Config) *string { return &c.ConsoleSocket })},
+  {"api-addr", "address of the http admin api, e.g. 127.0.0.1:8080", stringOption(func(c *Config) *string { return &c.APIAddress })},
+  {"api-token", "bearer token of the http admin api", stringOption(func(c *Config) *string { return &c.APIToken })},
+  {"event-workers", "workers handling asynchronous events", intOption(func(c *Config) *int { return &c.EventWorkers })},
+  {"event-queue", "queued events per worker before events are dropped", intOption(func(c *Config) *int { return &c.EventQueueSize })},
+  {"ordered-events", "comma separated event types handled in dispatch order", listOption(func(c *Config) *[]string { return &c.OrderedEvents })},
+  {"tick-rate", "game ticks per second (portals, triggers)", intOption(func(c *Config) *int { return &c.TickRate })},
+  {"snapshot-rate", "world updates sent per second", intOption(func(c *Config) *int { return &c.SnapshotRate })},
+  {"stream-interval", "interval between chunk streaming passes", durationOption(func(c *Config) *Duration { return &c.StreamInterval })},
+  {"client-timeout", "inactivity before a client is removed", durationOption(func(c *Config) *Duration { return &c.ClientTimeout })},
+  {"cleanup-interval", "interval between inactive client checks", durationOption(func(c *Config) *Duration { return &c.CleanupEvery })},
+  {"list-interval", "interval between client list prints", durationOption(func(c *Config) *Duration { return &c.ListEvery })},
+  {"world", "main zone world: chunked, maps or heightmap", stringOption(func(c *Config) *string { return &c.World })},
+  {"seed", "world seed", int64Option(func(c *Config) *int64 { return &c.Seed })},
+  {"chunk-dir", "chunk cache directory", stringOption(func(c *Config) *string { return &c.ChunkDir })},
+  {"chunk-cache", "chunks kept in memory", intOption(func(c *Config) *int { return &c.ChunkCacheSize })},
+  {"map-dir", "directory of the named maps", stringOption(func(c *Config) *string { return &c.MapDir })},
+  {"maps", "comma separated map rotation, every map of map-dir when empty", listOption(func(c *Config) *[]string { return &c.Maps })},
+  {"regenerate-map", "regenerate the first map instead of loading it", boolOption(func(c *Config) *bool { return &c.RegenerateMap })},
+  {"rotate-every", "map rotation interval, 0 rotates on admin request only", durationOption(func(c *Config) *Duration { return &c.RotateEvery })},
+  {"map-width", "width of maps generated when missing", intOption(func(c *Config) *int { return &c.MapWidth })},
+  {"map-height", "height of maps generated when missing", intOption(func(c *Config) *int { return &c.MapHeight })},
+  {"map-max", "maximum height of generated maps", intOption(func(c *Config) *int { return &c.MapMaxVal })},
+  {"heightmap", "png or pgm image of the heightmap world", stringOption(func(c *Config) *string { return &c.Heightmap.File })},
+  {"heightmap-max", "maximum height of the imported map", intOption(func(c *Config) *int { return &c.Heightmap.MaxVal })},
+  {"heightmap-scale", "height of a white pixel, defaults to the maximum height", floatOption(func(c *Config) *float64 { return &c.Heightmap.Scale })},
+  {"sea-level", "imported cells below this height become water", floatOption(func(c *Config) *float64 { return &c.Heightmap.SeaLevel })},
+  {"heightmap-width", "resample the imported map to this width", intOption(func(c *Config) *int { return &c.Heightmap.Width })},
+  {"heightmap-height", "resample the imported map to this height", intOption(func(c *Config) *int { return &c.Heightmap.Height })},
+  {"zone-dir", "directory of the extra zone maps", stringOption(func(c *Config) *string { return &c.ZoneDir })},
+  {"player-dir", "directory of the saved player states, empty disables persistence", stringOption(func(c *Config) *string { return &c.PlayerDir })},
+  {"player-save-interval", "interval between saves of the connected players", durationOption(func(c *Config) *Duration { return &c.PlayerSaveEvery })},
+  {"world-file", "world snapshot file, empty disables snapshots", stringOption(func(c *Config) *string { return &c.WorldFile })},
+  {"world-save-interval", "interval between world snapshots", durationOption(func(c *Config) *Duration { return &c.WorldSaveEvery })},
+  {"restore", "restore the world snapshot at startup", boolOption(func(c *Config) *bool { return &c.RestoreWorld })},
+  {"record", "file recording the inbound traffic for rtgs-replay", stringOption(func(c *Config) *string { return &c.RecordFile })},
+}
+
+func (option configOption) env() string {
+  return "RTGS_" + strings.ToUpper(strings.ReplaceAll(option.name, "-", "_"))
+}
+
+// bool options take true and false, every other option refuses one of them
+// or takes a number
+func (option configOption) isBool() bool {
+  var config Config
+  return option.set(&config, "true") == nil && option.set(&config, "false") == nil && option.set(&config, "2") != nil
+}
+
+// defaults < config file < environment < flags. The file is -config,
+// RTGS_CONFIG or rtgs.json when it exists.
+func LoadConfig(args []string) (Config, error) {
+  config := DefaultConfig()
+
+  type flagValue struct {
+    option configOption
+    value  string
+  }
+  var flagValues []flagValue
+  flags := flag.NewFlagSet("rtgs-server", flag.ContinueOnError)
+  configFile := flags.String("config", "", "json config file (env RTGS_CONFIG, default "+defaultConfigFile+")")
+  for _, option := range configOptions {
+    option := option
+    usage := fmt.Sprintf("%s (env %s)", option.usage, option.env())
+    setFlag := func(value string) error {
+      flagValues = append(flagValues, flagValue{option, value})
+      return nil
+    }
+    // -restore alone means -restore=true
+    if option.isBool() {
+      flags.BoolFunc(option.name, usage, setFlag)
+    } else {
+      flags.Func(option.name, usage, setFlag)
+    }
+  }
+  if err := flags.Parse(args); err != nil {
+    return config, err
+  }
+
+  filename, explicit := *configFile, true
+  if filename == "" {
+    filename = os.Getenv("RTGS_CONFIG")
+  }
+  if filename == "" {
+    filename, explicit = defaultConfigFile, false
+  }
+  if err := config.loadFile(filename); err != nil {
+    if explicit || !errors.Is(err, os.ErrNotExist) {
+      return config, err
+    }
+  }
+
+  for _, option := range configOptions {
+    if value, ok := os.LookupEnv(option.env()); ok {
+      if err := option.set(&config, value); err != nil {
+        return config, fmt.Errorf("invalid %s: %v", option.env(), err)
+      }
+    }
+  }
+
+  for _, fv := range flagValues {
+    if err := fv.option.set(&config, fv.value); err != nil {
+      return config, fmt.Errorf("invalid -%s: %v", fv.option.name, err)
+    }
+  }
+
+  return config, config.Validate()
+}
+
+func (config *Config) loadFile(filename string) error {
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    return fmt.Errorf("error reading config: %w", err)
+  }
+  decoder := json.NewDecoder(strings.NewReader(string(data)))
+  decoder.DisallowUnknownFields()
+  if err := decoder.Decode(config); err != nil {
+    return fmt.Errorf("invalid config %s: %v", filename, err)
+  }
+  return nil
+}
+
+func (config Config) Validate() error {
+  var problems []string
+  check := func(ok bool, format string, args ...interface{}) {
+    if !ok {
+      problems = append(problems, fmt.Sprintf(format, args...))
+    }
+  }
+
+  check(config.BindAddress == "" || net.ParseIP(config.BindAddress) != nil, "bind_address %q is not an ip address", config.BindAddress)
+  check(config.Port > 0 && config.Port <= 65535, "port must be in [1, 65535]")
+  check(config.MaxClients >= 0, "max_clients must not be negative")
+  problems = append(problems, validateLogConfig(config.LogFormat, config.LogLevel, config.LogLevels)...)
+  check(config.LogRateLimit >= 0, "log_rate_limit must not be negative")
+  check(config.APIAddress == "" || config.APIToken != "", "api_token is required when api_address is set")
+  check(config.EventWorkers > 0, "event_workers must be positive")
+  check(config.EventQueueSize > 0, "event_queue_size must be positive")
+  for _, name := range config.OrderedEvents {
+    check(slices.Contains(eventTypes, EventType(name)), "ordered_events: unknown event type %q", name)
+  }
+  check(config.TickRate > 0 && config.TickRate <= 1000, "tick_rate must be in [1, 1000]")
+  check(config.SnapshotRate > 0 && config.SnapshotRate <= 1000, "snapshot_rate must be in [1, 1000]")
+  check(config.StreamInterval > 0, "stream_interval must be positive")
+  check(config.ClientTimeout > 0, "client_timeout must be positive")
+  check(config.CleanupEvery > 0, "cleanup_interval must be positive")
+  check(config.ListEvery > 0, "list_interval must be positive")
+  check(config.PlayerSaveEvery > 0, "player_save_interval must be positive")
+  check(config.WorldSaveEvery > 0, "world_save_interval must be positive")
+  check(!config.RestoreWorld || config.WorldFile != "", "world_file is required by restore_world")
+  check(config.RotateEvery >= 0, "rotate_every must not be negative")
+  check(config.ChunkCacheSize > 0, "chunk_cache_size must be positive")
+  check(config.MapWidth > 1 && config.MapHeight > 1, "map_width and map_height must be greater than 1")
+  check(int64(config.MapWidth)*int64(config.MapHeight) <= maxMapCells, "map_width x map_height must be at most %d cells", maxMapCells)
+  check(config.MapMaxVal > 0, "map_max_val must be positive")
+
+  switch config.World {
+  case WorldChunked, WorldMaps:
+  case WorldHeightmap:
+    check(config.Heightmap.File != "", "heightmap.file is required for the heightmap world")
+    check(config.Heightmap.MaxVal > 0, "heightmap.max_val must be positive")
+    check(config.Heightmap.Width >= 0 && config.Heightmap.Height >= 0, "heightmap size must not be negative")
+    check(int64(config.Heightmap.Width)*int64(config.Heightmap.Height) <= maxMapCells, "heightmap size must be at most %d cells", maxMapCells)
+  default:
+    check(false, "world must be %s, %s or %s", WorldChunked, WorldMaps, WorldHeightmap)
+  }
+
+  if len(problems) > 0 {
+    return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+  }
+  return nil
+}
+
+// stands for a secret in printed configs and recordings
+const redactedSecret = "***"
+
+// the config without its secrets
+func (config Config) Redacted() Config {
+  if config.AdminToken != "" {
+    config.AdminToken = redactedSecret
+  }
+  if config.APIToken != "" {
+    config.APIToken = redactedSecret
+  }
+  return config
+}
+
+func (config Config) Print() {
+  data, err := json.Marshal(config.Redacted())
+  if err != nil {
+    worldLog.Error("config not printable", "err", err)
+    return
+  }
+  worldLog.Info("effective config", "config", json.RawMessage(data))
+}
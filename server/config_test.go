@@ -0,0 +1,70 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func writeConfig(t *testing.T, json string) string {
+  t.Helper()
+  filename := filepath.Join(t.TempDir(), "rtgs.json")
+  if err := os.WriteFile(filename, []byte(json), 0600); err != nil {
+    t.Fatal(err)
+  }
+  return filename
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+  filename := writeConfig(t, `{"port": 9000, "tick_rate": 30, "snapshot_rate": 15, "client_timeout": "30s", "seed": 5}`)
+  t.Setenv("RTGS_TICK_RATE", "40")
+  t.Setenv("RTGS_SNAPSHOT_RATE", "25")
+
+  config, err := LoadConfig([]string{"-config", filename, "-snapshot-rate", "50", "-restore", "-world-file", "world.json"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  defaults := DefaultConfig()
+  if config.Port != 9000 || config.Seed != 5 || config.ClientTimeout.Std() != 30*time.Second {
+    t.Errorf("file values not loaded: port %d seed %d timeout %v", config.Port, config.Seed, config.ClientTimeout.Std())
+  }
+  if config.TickRate != 40 {
+    t.Errorf("tick rate %d, the environment should override the file", config.TickRate)
+  }
+  if config.SnapshotRate != 50 {
+    t.Errorf("snapshot rate %d, the flag should override the environment", config.SnapshotRate)
+  }
+  if !config.RestoreWorld || config.WorldFile != "world.json" {
+    t.Errorf("restore %v from %q, -restore alone should enable it", config.RestoreWorld, config.WorldFile)
+  }
+  if config.MapDir != defaults.MapDir || config.EventWorkers != defaults.EventWorkers {
+    t.Errorf("unset options lost their defaults")
+  }
+}
+
+func TestLoadConfigRejectsInvalid(t *testing.T) {
+  for _, test := range []struct {
+    json    string
+    args    []string
+    problem string
+  }{
+    {`{"prot": 9000}`, nil, "unknown field"},
+    {`{}`, []string{"-port", "http"}, "invalid -port"},
+    {`{"port": 70000}`, nil, "port must be in"},
+    {`{"restore_world": true, "world_file": ""}`, nil, "world_file is required"},
+    {`{"world": "flat"}`, nil, "world must be"},
+    {`{"api_address": "127.0.0.1:8080"}`, nil, "api_token is required"},
+    {`{"ordered_events": ["user_jumped"]}`, nil, "unknown event type"},
+  } {
+    _, err := LoadConfig(append([]string{"-config", writeConfig(t, test.json)}, test.args...))
+    if err == nil || !strings.Contains(err.Error(), test.problem) {
+      t.Errorf("config %s %v: error %v, expected %q", test.json, test.args, err, test.problem)
+    }
+  }
+
+  if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+    t.Error("missing config file given with -config accepted")
+  }
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const consolePrompt = "rtgs> "
+
+type consoleCommand struct {
+  name  string
+  usage string
+  help  string
+  run   func(server *Server, args []string, out io.Writer) error
+  // candidates for the argument at index len(args)-1
+  complete func(server *Server, args []string) []string
+}
+
+var errConsoleUsage = errors.New("wrong arguments")
+
+// filled in init, help lists the table itself
+var consoleCommands []consoleCommand
+
+func init() {
+  consoleCommands = []consoleCommand{
+    {name: "help", usage: "help [command]", help: "list the commands or show the help of one", run: runHelp,
+      complete: func(server *Server, args []string) []string {
+        if len(args) == 1 {
+          return consoleCommandNames()
+        }
+        return nil
+      }},
+    {name: "status", usage: "status", help: "uptime, clients, zones and map of the main zone", run: runStatus},
+    {name: "clients", usage: "clients", help: "list the connected clients and bots with their ping", run: runClients},
+    {name: "kick", usage: "kick <id>", help: "disconnect a client or remove a bot", run: runKick, complete: completeClientID},
+    {name: "ban", usage: "ban <id> [duration] [reason]", help: "kick the clients of an ip and refuse it, until restart without duration", run: runBan, complete: completeClientID},
+    {name: "unban", usage: "unban <ip>", help: "lift a ban", run: runUnban, complete: completeBannedIP},
+    {name: "bans", usage: "bans", help: "list the active bans", run: runBans},
+    {name: "teleport", usage: "teleport <id> <x> <y> <z>", help: "move a user inside its zone, never below the ground", run: runTeleport, complete: completeClientID},
+    {name: "walk", usage: "walk <id> <x> <z>", help: "make a bot walk to a location of its zone", run: runWalk, complete: completeClientID},
+    {name: "spawnbot", usage: "spawnbot", help: "add a bot to the main zone", run: runSpawnBot},
+    {name: "map", usage: "map regen <seed>|load <name>|rotate", help: "regenerate, replace or rotate the map of the main zone, load takes a file of map_dir, regen reseeds the chunked world", run: runMap, complete: completeMap},
+    {name: "broadcast", usage: "broadcast <message>", help: "send a message to every client", run: runBroadcast},
+    {name: "shutdown", usage: "shutdown", help: "stop the server", run: runShutdown},
+  }
+}
+
+func consoleCommandNames() []string {
+  names := make([]string, len(consoleCommands))
+  for i, command := range consoleCommands {
+    names[i] = command.name
+  }
+  return names
+}
+
+func findConsoleCommand(name string) (consoleCommand, bool) {
+  for _, command := range consoleCommands {
+    if command.name == name {
+      return command, true
+    }
+  }
+  return consoleCommand{}, false
+}
+
+// runs one console line, errors are written to out
+func (server *Server) ExecuteCommand(line string, out io.Writer) {
+  fields := strings.Fields(line)
+  if len(fields) == 0 {
+    return
+  }
+  command, ok := findConsoleCommand(fields[0])
+  if !ok {
+    fmt.Fprintf(out, "unknown command %s, try help\n", fields[0])
+    return
+  }
+  if err := command.run(server, fields[1:], out); err != nil {
+    if errors.Is(err, errConsoleUsage) {
+      fmt.Fprintf(out, "usage: %s\n", command.usage)
+    } else {
+      fmt.Fprintf(out, "error: %v\n", err)
+    }
+  }
+}
+
+// candidates for the last word of line
+func (server *Server) CompleteCommand(line string) []string {
+  fields := strings.Fields(line)
+  if len(fields) == 0 || strings.HasSuffix(line, " ") {
+    fields = append(fields, "")
+  }
+  word := fields[len(fields)-1]
+
+  var candidates []string
+  if len(fields) == 1 {
+    candidates = consoleCommandNames()
+  } else if command, ok := findConsoleCommand(fields[0]); ok && command.complete != nil {
+    candidates = command.complete(server, fields[1:])
+  }
+
+  var matches []string
+  for _, candidate := range candidates {
+    if strings.HasPrefix(candidate, word) {
+      matches = append(matches, candidate)
+    }
+  }
+  return matches
+}
+
+func completeClientID(server *Server, args []string) []string {
+  if len(args) == 1 {
+    return server.clientIDs()
+  }
+  return nil
+}
+
+func completeBannedIP(server *Server, args []string) []string {
+  if len(args) != 1 {
+    return nil
+  }
+  var ips []string
+  for _, ban := range server.Bans() {
+    ips = append(ips, ban.IP)
+  }
+  return ips
+}
+
+func completeMap(server *Server, args []string) []string {
+  switch {
+  case len(args) == 1:
+    return []string{"regen", "load", "rotate"}
+  case len(args) == 2 && args[0] == "load":
+    files, _ := filepath.Glob(filepath.Join(server.config.MapDir, "*.bin"))
+    var names []string
+    for _, file := range files {
+      if name := filepath.Base(file); strings.HasPrefix(name, args[1]) {
+        names = append(names, name)
+      }
+    }
+    return names
+  }
+  return nil
+}
+
+func runHelp(server *Server, args []string, out io.Writer) error {
+  if len(args) == 1 {
+    command, ok := findConsoleCommand(args[0])
+    if !ok {
+      return fmt.Errorf("unknown command %s", args[0])
+    }
+    fmt.Fprintf(out, "%s\n  %s\n", command.usage, command.help)
+    return nil
+  }
+  for _, command := range consoleCommands {
+    fmt.Fprintf(out, "  %-36s %s\n", command.usage, command.help)
+  }
+  return nil
+}
+
+func runStatus(server *Server, args []string, out io.Writer) error {
+  status := server.Status()
+  fmt.Fprintf(out, "uptime:   %s\n", status.Uptime)
+  fmt.Fprintf(out, "clients:  %d players, %d bots\n", status.Players, status.Bots)
+  fmt.Fprintf(out, "zones:    %s\n", strings.Join(status.Zones, ", "))
+  fmt.Fprintf(out, "world:    %s, map %s %s\n", status.World, status.Map, status.MapHash)
+  if len(status.Rotation) > 0 {
+    fmt.Fprintf(out, "rotation: %s\n", strings.Join(status.Rotation, ", "))
+  }
+  fmt.Fprintf(out, "packets:  %d in, %d out\n", status.Packets[0], status.Packets[1])
+  return nil
+}
+
+func runClients(server *Server, args []string, out io.Writer) error {
+  clients := server.Clients()
+  if len(clients) == 0 {
+    fmt.Fprintln(out, "no connected client")
+    return nil
+  }
+  for _, client := range clients {
+    fmt.Fprintf(out, "%-22s %-6s %-8s (%.2f, %.2f, %.2f) idle %s ping %.1fms\n", client.ID, client.Type, client.Zone,
+      client.Location[0], client.Location[1], client.Location[2], client.Idle, client.PingMs)
+  }
+  return nil
+}
+
+func runKick(server *Server, args []string, out io.Writer) error {
+  if len(args) != 1 {
+    return errConsoleUsage
+  }
+  if err := server.Kick(args[0]); err != nil {
+    return err
+  }
+  fmt.Fprintf(out, "%s kicked\n", args[0])
+  return nil
+}
+
+func runBan(server *Server, args []string, out io.Writer) error {
+  if len(args) == 0 {
+    return errConsoleUsage
+  }
+  var duration time.Duration
+  reason := args[1:]
+  if len(args) > 1 {
+    if parsed, err := time.ParseDuration(args[1]); err == nil {
+      duration, reason = parsed, args[2:]
+    }
+  }
+  ban, err := server.Ban(args[0], duration, strings.Join(reason, " "))
+  if err != nil {
+    return err
+  }
+  fmt.Fprintf(out, "%s banned %s\n", ban.IP, banExpiry(ban))
+  return nil
+}
+
+func banExpiry(ban Ban) string {
+  if ban.Until == nil {
+    return "until restart"
+  }
+  return "until " + ban.Until.Format(time.DateTime)
+}
+
+func runUnban(server *Server, args []string, out io.Writer) error {
+  if len(args) != 1 {
+    return errConsoleUsage
+  }
+  if err := server.Unban(args[0]); err != nil {
+    return err
+  }
+  fmt.Fprintf(out, "%s unbanned\n", args[0])
+  return nil
+}
+
+func runBans(server *Server, args []string, out io.Writer) error {
+  bans := server.Bans()
+  if len(bans) == 0 {
+    fmt.Fprintln(out, "no active ban")
+    return nil
+  }
+  for _, ban := range bans {
+    fmt.Fprintf(out, "%-22s %s %s\n", ban.IP, banExpiry(ban), ban.Reason)
+  }
+  return nil
+}
+
+func runTeleport(server *Server, args []string, out io.Writer) error {
+  if len(args) != 4 {
+    return errConsoleUsage
+  }
+  var coords [3]float32
+  for i, arg := range args[1:] {
+    value, err := strconv.ParseFloat(arg, 32)
+    if err != nil {
+      return errConsoleUsage
+    }
+    coords[i] = float32(value)
+  }
+  if err := server.Teleport(args[0], Vector3{x: coords[0], y: coords[1], z: coords[2]}); err != nil {
+    return err
+  }
+  fmt.Fprintf(out, "%s teleported\n", args[0])
+  return nil
+}
+
+func runWalk(server *Server, args []string, out io.Writer) error {
+  if len(args) != 3 {
+    return errConsoleUsage
+  }
+  var coords [2]float32
+  for i, arg := range args[1:] {
+    value, err := strconv.ParseFloat(arg, 32)
+    if err != nil {
+      return errConsoleUsage
+    }
+    coords[i] = float32(value)
+  }
+  if err := server.WalkBot(args[0], Vector3{x: coords[0], z: coords[1]}); err != nil {
+    return err
+  }
+  fmt.Fprintf(out, "%s walking\n", args[0])
+  return nil
+}
+
+func runSpawnBot(server *Server, args []string, out io.Writer) error {
+  fmt.Fprintf(out, "%s spawned\n", server.SpawnBot())
+  return nil
+}
+
+func runMap(server *Server, args []string, out io.Writer) error {
+  switch {
+  case len(args) == 2 && args[0] == "regen":
+    seed, err := strconv.ParseInt(args[1], 10, 64)
+    if err != nil {
+      return errConsoleUsage
+    }
+    if err := server.RegenerateMap(seed); err != nil {
+      return err
+    }
+  case len(args) == 2 && args[0] == "load":
+    if err := server.LoadMap(args[1]); err != nil {
+      return err
+    }
+  case len(args) == 1 && args[0] == "rotate":
+    if err := server.RotateMap(); err != nil {
+      return err
+    }
+  default:
+    return errConsoleUsage
+  }
+  status := server.Status()
+  fmt.Fprintf(out, "map %s %s\n", status.Map, status.MapHash)
+  return nil
+}
+
+func runBroadcast(server *Server, args []string, out io.Writer) error {
+  if len(args) == 0 {
+    return errConsoleUsage
+  }
+  fmt.Fprintf(out, "sent to %d clients\n", server.Broadcast(strings.Join(args, " ")))
+  return nil
+}
+
+func runShutdown(server *Server, args []string, out io.Writer) error {
+  server.Shutdown()
+  return nil
+}
+
+// the stdin console (when enabled and stdin is open) and the unix socket
+// console (when a path is configured)
+func (server *Server) startConsoles() {
+  if server.config.Console {
+    go server.runStdinConsole()
+  }
+  if server.config.ConsoleSocket != "" {
+    if err := server.listenConsoleSocket(server.config.ConsoleSocket); err != nil {
+      netLog.Error("console socket not started", "path", server.config.ConsoleSocket, "err", err)
+    }
+  }
+}
+
+func (server *Server) stopConsoles() {
+  server.mu.Lock()
+  consoles := server.consoles
+  server.consoles = nil
+  conns := server.consoleConns
+  server.consoleConns = nil
+  server.mu.Unlock()
+  for _, console := range consoles {
+    console.Close()
+  }
+  for conn := range conns {
+    conn.Close()
+  }
+}
+
+func (server *Server) addConsole(console io.Closer) {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+  server.consoles = append(server.consoles, console)
+}
+
+// line editing with tab completion on terminals, plain lines otherwise
+func (server *Server) runStdinConsole() {
+  restore, err := enableCbreak(os.Stdin)
+  if err != nil {
+    scanner := bufio.NewScanner(os.Stdin)
+    for scanner.Scan() {
+      server.ExecuteCommand(scanner.Text(), os.Stdout)
+    }
+    return
+  }
+  server.addConsole(closerFunc(restore))
+  defer restore()
+
+  editor := &lineEditor{in: bufio.NewReader(os.Stdin), out: os.Stdout, complete: server.CompleteCommand}
+  for {
+    line, err := editor.readLine(consolePrompt)
+    if err != nil {
+      return
+    }
+    server.ExecuteCommand(line, os.Stdout)
+  }
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+  f()
+  return nil
+}
+
+// the socket is made in a directory only the server may enter and moved
+// to path once it is 0600, it is never reachable with the umask permissions
+func (server *Server) listenConsoleSocket(path string) error {
+  // a socket file left by a previous run
+  if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+    os.Remove(path)
+  }
+  dir, err := os.MkdirTemp(filepath.Dir(path), ".console-")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(dir)
+  private := filepath.Join(dir, "console.sock")
+  listener, err := net.Listen("unix", private)
+  if err != nil {
+    return err
+  }
+  listener.(*net.UnixListener).SetUnlinkOnClose(false)
+  if err = os.Chmod(private, 0600); err == nil {
+    err = os.Rename(private, path)
+  }
+  if err != nil {
+    listener.Close()
+    return err
+  }
+  server.addConsole(closerFunc(func() {
+    listener.Close()
+    os.Remove(path)
+  }))
+  netLog.Info("console socket listening", "path", path)
+
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go server.serveConsole(conn)
+    }
+  }()
+  return nil
+}
+
+// one command per line. A line ending with a tab lists its completions as
+// a json array instead of running it.
+func (server *Server) serveConsole(conn net.Conn) {
+  defer conn.Close()
+  server.mu.Lock()
+  if server.consoleConns == nil {
+    // the consoles stopped while it connected
+    server.mu.Unlock()
+    return
+  }
+  server.consoleConns[conn] = true
+  server.mu.Unlock()
+  defer func() {
+    server.mu.Lock()
+    delete(server.consoleConns, conn)
+    server.mu.Unlock()
+  }()
+  scanner := bufio.NewScanner(conn)
+  fmt.Fprint(conn, consolePrompt)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if strings.HasSuffix(line, "\t") {
+      matches := server.CompleteCommand(strings.TrimSuffix(line, "\t"))
+      sort.Strings(matches)
+      data, _ := json.Marshal(matches)
+      fmt.Fprintf(conn, "%s\n", data)
+    } else {
+      server.ExecuteCommand(line, conn)
+    }
+    fmt.Fprint(conn, consolePrompt)
+  }
+}
+
+// minimal line editor for a terminal in cbreak mode: printable characters,
+// backspace, tab completion, ctrl-d on an empty line closes it
+type lineEditor struct {
+  in       *bufio.Reader
+  out      io.Writer
+  complete func(line string) []string
+}
+
+func (editor *lineEditor) readLine(prompt string) (string, error) {
+  fmt.Fprint(editor.out, prompt)
+  var line []byte
+  for {
+    b, err := editor.in.ReadByte()
+    if err != nil {
+      return "", err
+    }
+    switch {
+    case b == '\r' || b == '\n':
+      fmt.Fprint(editor.out, "\n")
+      return string(line), nil
+    case b == 4:
+      if len(line) == 0 {
+        fmt.Fprint(editor.out, "\n")
+        return "", io.EOF
+      }
+    case b == 127 || b == 8:
+      if len(line) > 0 {
+        line = line[:len(line)-1]
+        fmt.Fprint(editor.out, "\b \b")
+      }
+    case b == '\t':
+      line = editor.completeLine(prompt, line)
+    case b == 27:
+      // arrow keys and other escape sequences are ignored
+      if next, err := editor.in.ReadByte(); err == nil && next == '[' {
+        editor.in.ReadByte()
+      }
+    case b >= 32 && b < 127:
+      line = append(line, b)
+      editor.out.Write([]byte{b})
+    }
+  }
+}
+
+func (editor *lineEditor) completeLine(prompt string, line []byte) []byte {
+  matches := editor.complete(string(line))
+  if len(matches) == 0 {
+    return line
+  }
+
+  start := strings.LastIndexByte(string(line), ' ') + 1
+  word := string(line[start:])
+  prefix := commonPrefix(matches)
+  if len(matches) == 1 {
+    prefix += " "
+  }
+  if len(prefix) > len(word) {
+    fmt.Fprint(editor.out, prefix[len(word):])
+    return append(line[:start], prefix...)
+  }
+
+  // nothing to add, show the candidates and redraw the line
+  fmt.Fprintf(editor.out, "\n%s\n%s%s", strings.Join(matches, "  "), prompt, line)
+  return line
+}
+
+func commonPrefix(values []string) string {
+  prefix := values[0]
+  for _, value := range values[1:] {
+    for !strings.HasPrefix(value, prefix) {
+      prefix = prefix[:len(prefix)-1]
+    }
+  }
+  return prefix
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+// turns off line buffering and echo so the console can complete on tab,
+// signals and output processing stay as they are. Fails when file is not a
+// terminal.
+func enableCbreak(file *os.File) (func(), error) {
+  fd := file.Fd()
+  var saved syscall.Termios
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&saved))); errno != 0 {
+    return nil, errno
+  }
+
+  cbreak := saved
+  cbreak.Lflag &^= syscall.ICANON | syscall.ECHO
+  cbreak.Cc[syscall.VMIN] = 1
+  cbreak.Cc[syscall.VTIME] = 0
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&cbreak))); errno != 0 {
+    return nil, errno
+  }
+
+  return func() {
+    syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&saved)))
+  }, nil
+}
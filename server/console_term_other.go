@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+  "errors"
+  "os"
+)
+
+// other systems read plain lines, without completion
+func enableCbreak(file *os.File) (func(), error) {
+  return nil, errors.New("no terminal support")
+}
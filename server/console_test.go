@@ -0,0 +1,51 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestConsoleSocket(t *testing.T) {
+  server := newTestServer(t)
+  dir := t.TempDir()
+  path := filepath.Join(dir, "console.sock")
+  if err := server.listenConsoleSocket(path); err != nil {
+    t.Fatal(err)
+  }
+  info, err := os.Stat(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if perm := info.Mode().Perm(); perm != 0600 {
+    t.Fatalf("console socket mode %o", perm)
+  }
+  if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+    t.Fatalf("%d files next to the console socket", len(entries))
+  }
+
+  conn, err := net.Dial("unix", path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  reader := bufio.NewReader(conn)
+  if _, err := reader.ReadString(' '); err != nil {
+    t.Fatalf("no prompt: %v", err)
+  }
+
+  // open connections are closed with the consoles
+  server.stopConsoles()
+  conn.SetReadDeadline(time.Now().Add(time.Second))
+  if _, err := reader.ReadByte(); err != io.EOF {
+    t.Fatalf("console connection still open: %v", err)
+  }
+  if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+    t.Fatalf("console socket left after stop: %v", err)
+  }
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestOrderedEventsKeepOrder(t *testing.T) {
+  SetupLogging(io.Discard, DefaultConfig())
+  em := NewEventManager()
+  em.SetPool(4, 256)
+  em.SetDelivery(EventUserMoved, DeliveryOrdered)
+
+  var moves []string
+  moved := make(chan struct{})
+  On(em, EventUserMoved, func(data UserMovedData) {
+    moves = append(moves, data.ID)
+    if len(moves) == 100 {
+      close(moved)
+    }
+  })
+  for i := 0; i < 100; i++ {
+    em.DispatchAsync(Event{Type: EventUserMoved, Data: UserMovedData{ID: string(rune('a' + i%26))}})
+  }
+  select {
+  case <-moved:
+  case <-time.After(time.Second):
+    t.Fatalf("%d of 100 moves handled", len(moves))
+  }
+  for i, id := range moves {
+    if id != string(rune('a'+i%26)) {
+      t.Fatalf("move %d handled out of order", i)
+    }
+  }
+  em.Close(time.Second)
+}
+
+func TestOrderedEventsBounded(t *testing.T) {
+  SetupLogging(io.Discard, DefaultConfig())
+  em := NewEventManager()
+  em.SetPool(1, 2)
+  em.SetDelivery(EventTerrainEdited, DeliveryOrdered)
+
+  started, release := make(chan struct{}, 10), make(chan struct{})
+  On(em, EventTerrainEdited, func(data TerrainEditedData) {
+    started <- struct{}{}
+    <-release
+  })
+
+  dropped := eventsDropped.With(string(EventTerrainEdited))
+  before := dropped.value.Load()
+  em.DispatchAsync(Event{Type: EventTerrainEdited, Data: TerrainEditedData{}})
+  <-started
+
+  // a stuck handler fills the queue of its worker, later edits are dropped
+  for i := 0; i < 9; i++ {
+    em.DispatchAsync(Event{Type: EventTerrainEdited, Data: TerrainEditedData{}})
+  }
+  if depth := em.QueueDepths()["0"]; depth != 2 {
+    t.Fatalf("%d terrain edits queued, expected 2", depth)
+  }
+  if n := dropped.value.Load() - before; n != 7 {
+    t.Fatalf("%d terrain edits dropped, expected 7", n)
+  }
+
+  close(release)
+  em.Close(time.Second)
+  if depth := em.QueueDepths()["0"]; depth != 0 {
+    t.Fatalf("%d terrain edits left after close", depth)
+  }
+}
+
+func TestEventHandlersByPriority(t *testing.T) {
+  SetupLogging(io.Discard, DefaultConfig())
+  em := NewEventManager()
+  defer em.Close(time.Second)
+
+  var calls []string
+  record := func(name string) func(data ClientData) {
+    return func(data ClientData) { calls = append(calls, name) }
+  }
+  On(em, EventClientConnected, record("default"))
+  On(em, EventClientConnected, record("late"), Priority(-1))
+  On(em, EventClientConnected, record("first"), Priority(10))
+  On(em, EventClientConnected, func(data ClientData) { panic("broken handler") }, Priority(5))
+  second := On(em, EventClientConnected, record("second"), Priority(5))
+  On(em, EventClientConnected, func(data UserMovedData) { calls = append(calls, "wrong payload") })
+
+  panics := eventHandlerPanics.With(string(EventClientConnected))
+  before := panics.value.Load()
+  em.Dispatch(Event{Type: EventClientConnected, Data: ClientData{ID: "a"}})
+  want := "first second default late"
+  if got := strings.Join(calls, " "); got != want {
+    t.Fatalf("handlers called as %q, expected %q", got, want)
+  }
+  if n := panics.value.Load() - before; n != 1 {
+    t.Fatalf("%d panics counted, expected 1", n)
+  }
+
+  // unsubscribed handlers are not called again
+  calls = nil
+  second.Unsubscribe()
+  second.Unsubscribe()
+  em.Dispatch(Event{Type: EventClientConnected, Data: ClientData{ID: "b"}})
+  if got := strings.Join(calls, " "); got != "first default late" {
+    t.Fatalf("handlers called as %q after the unsubscription", got)
+  }
+}
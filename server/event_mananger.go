@@ -1,57 +1,371 @@
 package main
 
 import (
+  "fmt"
+  "hash/fnv"
+  "runtime/debug"
+  "sort"
+  "strconv"
   "sync"
+  "sync/atomic"
+  "time"
 )
 
 type EventType string
 
 const (
-  EventMapGenerated EventType = "map_generated"
+  EventMapGenerated    EventType = "map_generated"
+  EventTerrainEdited   EventType = "terrain_edited"
+  EventTriggerEnter    EventType = "trigger_enter"
+  EventTriggerExit     EventType = "trigger_exit"
+  EventClientConnected EventType = "client_connected"
+  EventClientTimedOut  EventType = "client_timed_out"
+  EventUserSpawned     EventType = "user_spawned"
+  EventUserMoved       EventType = "user_moved"
+  EventServerStarted   EventType = "server_started"
+  EventServerStopping  EventType = "server_stopping"
 )
 
+var eventTypes = []EventType{
+  EventMapGenerated, EventTerrainEdited, EventTriggerEnter, EventTriggerExit, EventClientConnected,
+  EventClientTimedOut, EventUserSpawned, EventUserMoved, EventServerStarted, EventServerStopping,
+}
+
+type EventDelivery int
+
+const (
+  // any worker handles the events of the type, possibly out of order.
+  // They are dropped when every worker queue is full.
+  DeliveryParallel EventDelivery = iota
+  // the same worker handles every event of the type, in dispatch order.
+  // They are dropped when its queue is full.
+  DeliveryOrdered
+)
+
+const (
+  defaultEventWorkers   = 4
+  defaultEventQueueSize = 256
+)
+
+// Data holds the payload type of its event type, see the Data types below
 type Event struct {
   Type EventType
   Data interface{}
 }
 
+// EventMapGenerated, Source is the image of imported maps
+type MapGeneratedData struct {
+  Filename string
+  Source   string
+  Seed     int64
+  Width    int
+  Height   int
+  MaxVal   int
+}
+
+// EventTerrainEdited, Delta holds the heights of Region after the edit
+type TerrainEditedData struct {
+  Zone   string
+  User   string
+  Edit   TerrainEdit
+  Region MapRegion
+  Delta  *MapData
+}
+
+// EventTriggerEnter and EventTriggerExit
+type TriggerData struct {
+  Zone     string
+  User     string
+  Trigger  Trigger
+  Location Vector3
+}
+
+// EventClientConnected and EventClientTimedOut
+type ClientData struct {
+  ID   string
+  Zone string
+}
+
+// EventUserSpawned, for players and bots
+type UserSpawnedData struct {
+  ID       string
+  Type     UserType
+  Zone     string
+  Location Vector3
+}
+
+// EventUserMoved, Cause is move, teleport, walk, portal or restore. Zone is the
+// zone after the move.
+type UserMovedData struct {
+  ID    string
+  Zone  string
+  From  Vector3
+  To    Vector3
+  Cause string
+}
+
+// EventServerStarted and EventServerStopping
+type ServerData struct {
+  Port   int
+  World  string
+  Uptime time.Duration
+}
+
 type EventHandler func(event Event)
 
+type subscriber struct {
+  id       uint64
+  handler  EventHandler
+  priority int
+}
+
+type SubscribeOption func(*subscriber)
+
+// handlers of a higher priority run before the lower ones, handlers of the
+// same priority in subscription order. The default is 0.
+func Priority(priority int) SubscribeOption {
+  return func(sub *subscriber) {
+    sub.priority = priority
+  }
+}
+
+type Subscription struct {
+  manager   *EventManager
+  eventType EventType
+  id        uint64
+}
+
+// removes the handler, events being dispatched may still reach it
+func (sub *Subscription) Unsubscribe() {
+  em := sub.manager
+  em.mu.Lock()
+  defer em.mu.Unlock()
+
+  subscribers := em.handlers[sub.eventType]
+  for i, other := range subscribers {
+    if other.id == sub.id {
+      em.handlers[sub.eventType] = append(subscribers[:i:i], subscribers[i+1:]...)
+      return
+    }
+  }
+}
+
+// events go through a bounded queue per worker, an event finding no room
+// is dropped rather than blocking the caller. Each ordered event type is
+// pinned to a worker chosen by a hash of the type.
 type EventManager struct {
-  handlers map[EventType][]EventHandler
+  // sorted by priority, then subscription order
+  handlers map[EventType][]*subscriber
+  nextID   uint64
   mu       sync.RWMutex
+
+  workers   int
+  queueSize int
+  delivery  map[EventType]EventDelivery
+  // one per worker, made by the first asynchronous event
+  queues    []chan Event
+  // worker of each ordered event type
+  ordered   map[EventType]int
+  startOnce sync.Once
+  // round robin of the parallel events
+  next      atomic.Uint64
+  closed    bool
+  running   sync.WaitGroup
 }
 
 func NewEventManager() *EventManager {
   return &EventManager{
-    handlers: make(map[EventType][]EventHandler),
+    handlers:  make(map[EventType][]*subscriber),
+    workers:   defaultEventWorkers,
+    queueSize: defaultEventQueueSize,
+    delivery:  make(map[EventType]EventDelivery),
   }
 }
 
-func (em *EventManager) Subscribe(eventType EventType, handler EventHandler) {
+// must be called before the first asynchronous event
+func (em *EventManager) SetPool(workers, queueSize int) {
   em.mu.Lock()
   defer em.mu.Unlock()
-  
-  em.handlers[eventType] = append(em.handlers[eventType], handler)
+  em.workers, em.queueSize = workers, queueSize
 }
 
+// must be called before the first asynchronous event
+func (em *EventManager) SetDelivery(eventType EventType, delivery EventDelivery) {
+  em.mu.Lock()
+  defer em.mu.Unlock()
+  em.delivery[eventType] = delivery
+}
+
+func (em *EventManager) Subscribe(eventType EventType, handler EventHandler, options ...SubscribeOption) *Subscription {
+  em.mu.Lock()
+  defer em.mu.Unlock()
+
+  em.nextID++
+  sub := &subscriber{id: em.nextID, handler: handler}
+  for _, option := range options {
+    option(sub)
+  }
+  // dispatches read the slice without the lock, it is never changed in place
+  subscribers := append(append([]*subscriber(nil), em.handlers[eventType]...), sub)
+  sort.SliceStable(subscribers, func(i, j int) bool { return subscribers[i].priority > subscribers[j].priority })
+  em.handlers[eventType] = subscribers
+  return &Subscription{manager: em, eventType: eventType, id: sub.id}
+}
+
+// subscribes a handler of the payload type of eventType, payloads of
+// another type are logged and dropped
+func On[T any](em *EventManager, eventType EventType, handler func(data T), options ...SubscribeOption) *Subscription {
+  return em.Subscribe(eventType, func(event Event) {
+    data, ok := event.Data.(T)
+    if !ok {
+      eventsLog.Error("unexpected event payload", "type", event.Type, "payload", fmt.Sprintf("%T", event.Data))
+      return
+    }
+    handler(data)
+  }, options...)
+}
+
+func (em *EventManager) hasSubscribers(eventType EventType) bool {
+  em.mu.RLock()
+  defer em.mu.RUnlock()
+  return len(em.handlers[eventType]) > 0
+}
+
+// runs the handlers in the calling goroutine, in priority order
 func (em *EventManager) Dispatch(event Event) {
+  eventsDispatched.With(string(event.Type)).Inc()
+
   em.mu.RLock()
-  handlers := em.handlers[event.Type]
+  subscribers := em.handlers[event.Type]
   em.mu.RUnlock()
-  
-  var wg sync.WaitGroup
-  for _, handler := range handlers {
-    wg.Add(1)
-    go func(h EventHandler) {
-      defer wg.Done()
-      h(event)
-    }(handler)
+
+  for _, sub := range subscribers {
+    sub.call(event)
   }
-  wg.Wait()
 }
 
+// queues the event for the workers, never blocks. Events are dropped when
+// the queues they may go to are full.
 func (em *EventManager) DispatchAsync(event Event) {
-  go em.Dispatch(event)
+  // frequent events like user moves cost nothing without subscribers
+  if !em.hasSubscribers(event.Type) {
+    eventsDispatched.With(string(event.Type)).Inc()
+    return
+  }
+  em.start()
+
+  em.mu.RLock()
+  defer em.mu.RUnlock()
+  if em.closed {
+    eventsDropped.With(string(event.Type)).Inc()
+    return
+  }
+
+  if worker, ok := em.ordered[event.Type]; ok {
+    if !em.enqueue(worker, event) {
+      eventsDropped.With(string(event.Type)).Inc()
+      eventsLog.Warn("ordered event queue full, event dropped", "type", event.Type, "worker", worker)
+    }
+    return
+  }
+  first := int(em.next.Add(1) % uint64(len(em.queues)))
+  for i := range em.queues {
+    if em.enqueue((first+i)%len(em.queues), event) {
+      return
+    }
+  }
+  eventsDropped.With(string(event.Type)).Inc()
+  eventsLog.Warn("event queue full, event dropped", "type", event.Type)
+}
+
+func (em *EventManager) enqueue(worker int, event Event) bool {
+  select {
+  case em.queues[worker] <- event:
+    return true
+  default:
+    return false
+  }
 }
 
+func (em *EventManager) start() {
+  em.startOnce.Do(func() {
+    em.mu.Lock()
+    defer em.mu.Unlock()
+    if em.closed {
+      return
+    }
+    em.queues = make([]chan Event, max(em.workers, 1))
+    for i := range em.queues {
+      queue := make(chan Event, max(em.queueSize, 1))
+      em.queues[i] = queue
+      em.running.Add(1)
+      go func() {
+        defer em.running.Done()
+        for event := range queue {
+          em.Dispatch(event)
+        }
+      }()
+    }
+    em.ordered = make(map[EventType]int)
+    for eventType, delivery := range em.delivery {
+      if delivery == DeliveryOrdered {
+        hash := fnv.New32a()
+        hash.Write([]byte(eventType))
+        em.ordered[eventType] = int(hash.Sum32() % uint32(len(em.queues)))
+      }
+    }
+  })
+}
+
+// events waiting in each queue, by worker number
+func (em *EventManager) QueueDepths() map[string]int {
+  em.mu.RLock()
+  defer em.mu.RUnlock()
+  depths := make(map[string]int, len(em.queues))
+  for i, queue := range em.queues {
+    depths[strconv.Itoa(i)] = len(queue)
+  }
+  return depths
+}
+
+// stops the asynchronous delivery. Queued events are still handled for at
+// most timeout, later events are dropped.
+func (em *EventManager) Close(timeout time.Duration) {
+  em.mu.Lock()
+  if em.closed {
+    em.mu.Unlock()
+    return
+  }
+  em.closed = true
+  for _, queue := range em.queues {
+    close(queue)
+  }
+  em.mu.Unlock()
+
+  drained := make(chan struct{})
+  go func() {
+    em.running.Wait()
+    close(drained)
+  }()
+  select {
+  case <-drained:
+  case <-time.After(timeout):
+    pending := 0
+    for _, depth := range em.QueueDepths() {
+      pending += depth
+    }
+    eventsLog.Warn("event queues not drained", "pending", pending)
+  }
+}
+
+// a panicking handler is logged, the other handlers and the server go on
+func (sub *subscriber) call(event Event) {
+  defer func() {
+    if r := recover(); r != nil {
+      eventHandlerPanics.With(string(event.Type)).Inc()
+      eventsLog.Error("event handler panicked", "type", event.Type, "subscription", sub.id,
+        "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+    }
+  }()
+  sub.handler(event)
+}
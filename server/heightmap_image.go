@@ -0,0 +1,335 @@
+package main
+
+import (
+  "bufio"
+  "encoding/binary"
+  "fmt"
+  "image"
+  "image/color"
+  "image/png"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+func normalizedHeight(mapData *MapData, val float32) float64 {
+  if mapData.MaxVal <= 0 {
+    return 0
+  }
+  n := float64(val) / float64(mapData.MaxVal)
+  return max(0, min(1, n))
+}
+
+func heightColor(n float64) color.RGBA {
+  switch {
+  case n < 0.25:
+    return color.RGBA{40, 70, 160, 255}
+  case n < 0.32:
+    return color.RGBA{210, 200, 140, 255}
+  case n < 0.6:
+    return color.RGBA{70, 140, 60, 255}
+  case n < 0.8:
+    return color.RGBA{120, 110, 100, 255}
+  default:
+    return color.RGBA{240, 240, 245, 255}
+  }
+}
+
+var biomeColors = map[uint8]color.RGBA{
+  BiomeWater:     {40, 70, 160, 255},
+  BiomeBeach:     {210, 200, 140, 255},
+  BiomeDesert:    {220, 180, 100, 255},
+  BiomeGrassland: {90, 160, 70, 255},
+  BiomeForest:    {40, 110, 50, 255},
+  BiomeTundra:    {140, 150, 130, 255},
+  BiomeMountain:  {120, 110, 100, 255},
+  BiomeSnow:      {240, 240, 245, 255},
+}
+
+func (mapData *MapData) GrayImage() *image.Gray16 {
+  img := image.NewGray16(image.Rect(0, 0, mapData.Width, mapData.Height))
+  for y := 0; y < mapData.Height; y++ {
+    for x := 0; x < mapData.Width; x++ {
+      n := normalizedHeight(mapData, mapData.Data[y][x])
+      img.SetGray16(x, y, color.Gray16{Y: uint16(n * 65535)})
+    }
+  }
+  return img
+}
+
+func (mapData *MapData) ColorImage() *image.RGBA {
+  img := image.NewRGBA(image.Rect(0, 0, mapData.Width, mapData.Height))
+  for y := 0; y < mapData.Height; y++ {
+    for x := 0; x < mapData.Width; x++ {
+      n := normalizedHeight(mapData, mapData.Data[y][x])
+      c := heightColor(n)
+      if mapData.Layers != nil {
+        if biome, ok := biomeColors[mapData.Layers[y][x].Biome]; ok {
+          c = biome
+        }
+      }
+      // shade by height so flat areas keep some relief
+      shade := 0.6 + 0.4*n
+      img.SetRGBA(x, y, color.RGBA{
+        R: uint8(float64(c.R) * shade),
+        G: uint8(float64(c.G) * shade),
+        B: uint8(float64(c.B) * shade),
+        A: 255,
+      })
+    }
+  }
+  return img
+}
+
+func SaveHeightmapImage(mapData *MapData, filename string, colored bool) error {
+  if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+    return fmt.Errorf("error while creating folder: %v", err)
+  }
+
+  file, err := os.Create(filename)
+  if err != nil {
+    return fmt.Errorf("error while creating file: %v", err)
+  }
+  defer file.Close()
+
+  switch strings.ToLower(filepath.Ext(filename)) {
+  case ".png":
+    if colored {
+      return png.Encode(file, mapData.ColorImage())
+    }
+    return png.Encode(file, mapData.GrayImage())
+  case ".pgm":
+    if colored {
+      return fmt.Errorf("pgm does not support colors")
+    }
+    return writePGM(file, mapData.GrayImage())
+  default:
+    return fmt.Errorf("unsupported image format: %s", filename)
+  }
+}
+
+func writePGM(w io.Writer, img *image.Gray16) error {
+  bounds := img.Bounds()
+  writer := bufio.NewWriter(w)
+  fmt.Fprintf(writer, "P5\n%d %d\n65535\n", bounds.Dx(), bounds.Dy())
+  for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+      if err := binary.Write(writer, binary.BigEndian, img.Gray16At(x, y).Y); err != nil {
+        return err
+      }
+    }
+  }
+  return writer.Flush()
+}
+
+// decoded image as luminance in [0, 1]
+type grayField struct {
+  width  int
+  height int
+  values []float64
+}
+
+func (field *grayField) at(x, y int) float64 {
+  return field.values[y*field.width+x]
+}
+
+func readHeightmapImage(filename string) (*grayField, error) {
+  file, err := os.Open(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error opening files: %w", err)
+  }
+  defer file.Close()
+
+  switch strings.ToLower(filepath.Ext(filename)) {
+  case ".png":
+    img, err := png.Decode(file)
+    if err != nil {
+      return nil, err
+    }
+    return grayFieldFromImage(img), nil
+  case ".pgm":
+    return readPGM(bufio.NewReader(file))
+  default:
+    return nil, fmt.Errorf("unsupported image format: %s", filename)
+  }
+}
+
+func grayFieldFromImage(img image.Image) *grayField {
+  bounds := img.Bounds()
+  field := &grayField{
+    width:  bounds.Dx(),
+    height: bounds.Dy(),
+    values: make([]float64, bounds.Dx()*bounds.Dy()),
+  }
+  for y := 0; y < field.height; y++ {
+    for x := 0; x < field.width; x++ {
+      gray := color.Gray16Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray16)
+      field.values[y*field.width+x] = float64(gray.Y) / 65535
+    }
+  }
+  return field
+}
+
+// supports binary (P5) and ascii (P2) graymaps, 8 or 16 bit
+func readPGM(r *bufio.Reader) (*grayField, error) {
+  var magic string
+  var width, height, maxGray int
+  if _, err := fmt.Fscan(r, &magic); err != nil {
+    return nil, err
+  }
+  if magic != "P5" && magic != "P2" {
+    return nil, fmt.Errorf("unsupported pgm type: %s", magic)
+  }
+  for _, dst := range []*int{&width, &height, &maxGray} {
+    if err := scanPGMInt(r, dst); err != nil {
+      return nil, err
+    }
+  }
+  if width <= 0 || height <= 0 || maxGray <= 0 || maxGray > 65535 {
+    return nil, fmt.Errorf("invalid pgm header: %dx%d max %d", width, height, maxGray)
+  }
+
+  field := &grayField{
+    width:  width,
+    height: height,
+    values: make([]float64, width*height),
+  }
+
+  if magic == "P2" {
+    for i := range field.values {
+      var v int
+      if err := scanPGMInt(r, &v); err != nil {
+        return nil, err
+      }
+      field.values[i] = float64(v) / float64(maxGray)
+    }
+    return field, nil
+  }
+
+  // single whitespace between header and raster
+  if _, err := r.ReadByte(); err != nil {
+    return nil, err
+  }
+  for i := range field.values {
+    var v int
+    if maxGray < 256 {
+      b, err := r.ReadByte()
+      if err != nil {
+        return nil, err
+      }
+      v = int(b)
+    } else {
+      var w uint16
+      if err := binary.Read(r, binary.BigEndian, &w); err != nil {
+        return nil, err
+      }
+      v = int(w)
+    }
+    field.values[i] = float64(v) / float64(maxGray)
+  }
+  return field, nil
+}
+
+// reads the next integer, skipping whitespace and # comments
+func scanPGMInt(r *bufio.Reader, dst *int) error {
+  for {
+    b, err := r.ReadByte()
+    if err != nil {
+      return err
+    }
+    if b == '#' {
+      if _, err := r.ReadString('\n'); err != nil {
+        return err
+      }
+      continue
+    }
+    if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+      continue
+    }
+    r.UnreadByte()
+    _, err = fmt.Fscan(r, dst)
+    return err
+  }
+}
+
+// bilinear sample at a fractional pixel position
+func (field *grayField) sample(x, y float64) float64 {
+  x = max(0, min(float64(field.width-1), x))
+  y = max(0, min(float64(field.height-1), y))
+  x0, y0 := int(x), int(y)
+  x1 := min(x0+1, field.width-1)
+  y1 := min(y0+1, field.height-1)
+  tx, ty := x-float64(x0), y-float64(y0)
+
+  top := field.at(x0, y0) + (field.at(x1, y0)-field.at(x0, y0))*tx
+  bottom := field.at(x0, y1) + (field.at(x1, y1)-field.at(x0, y1))*tx
+  return top + (bottom-top)*ty
+}
+
+// Scale is the height of a white pixel and defaults to MaxVal. Cells below
+// SeaLevel (in height units) are flattened to it and become water. A zero
+// Width or Height keeps the image size.
+type HeightmapImport struct {
+  MaxVal   int
+  Scale    float32
+  SeaLevel float32
+  Width    int
+  Height   int
+}
+
+func ImportHeightmap(filename string, options HeightmapImport) (*MapData, error) {
+  field, err := readHeightmapImage(filename)
+  if err != nil {
+    return nil, err
+  }
+  if options.MaxVal <= 0 {
+    return nil, fmt.Errorf("max height must be positive")
+  }
+  if options.Width < 0 || options.Height < 0 {
+    return nil, fmt.Errorf("invalid target size: %dx%d", options.Width, options.Height)
+  }
+
+  scale := options.Scale
+  if scale <= 0 {
+    scale = float32(options.MaxVal)
+  }
+  width, height := field.width, field.height
+  if options.Width > 0 {
+    width = options.Width
+  }
+  if options.Height > 0 {
+    height = options.Height
+  }
+  if int64(width)*int64(height) > maxMapCells {
+    return nil, fmt.Errorf("map of %dx%d is larger than %d cells", width, height, maxMapCells)
+  }
+
+  // pixel centers of the image span the whole map
+  stepX, stepY := 0.0, 0.0
+  if width > 1 {
+    stepX = float64(field.width-1) / float64(width-1)
+  }
+  if height > 1 {
+    stepY = float64(field.height-1) / float64(height-1)
+  }
+
+  data := make([][]float32, height)
+  for y := 0; y < height; y++ {
+    data[y] = make([]float32, width)
+    for x := 0; x < width; x++ {
+      h := float32(field.sample(float64(x)*stepX, float64(y)*stepY)) * scale
+      data[y][x] = max(h, options.SeaLevel)
+    }
+  }
+
+  mapData := &MapData{
+    Width:  width,
+    Height: height,
+    MaxVal: options.MaxVal,
+    Data:   data,
+    Meta:   MapMeta{Name: strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)), SeaLevel: options.SeaLevel},
+  }
+  clampHeights(mapData)
+  return mapData, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+  "path/filepath"
+  "testing"
+)
+
+// heights rise along x and z up to MaxVal
+func slopeMap() *MapData {
+  mapData := flatMap(17, 9, 0)
+  for z := range mapData.Data {
+    for x := range mapData.Data[z] {
+      mapData.Data[z][x] = float32(x + 2*z)
+    }
+  }
+  return mapData
+}
+
+func TestHeightmapImageRoundTrip(t *testing.T) {
+  mapData := slopeMap()
+  for _, name := range []string{"map.png", "map.pgm"} {
+    filename := filepath.Join(t.TempDir(), name)
+    if err := SaveHeightmapImage(mapData, filename, false); err != nil {
+      t.Fatal(err)
+    }
+
+    imported, err := ImportHeightmap(filename, HeightmapImport{MaxVal: 32})
+    if err != nil {
+      t.Fatalf("%s: %v", name, err)
+    }
+    if imported.Width != 17 || imported.Height != 9 || imported.Meta.Name != "map" {
+      t.Fatalf("%s: imported %dx%d named %q", name, imported.Width, imported.Height, imported.Meta.Name)
+    }
+    for z := range mapData.Data {
+      for x, want := range mapData.Data[z] {
+        if got := imported.Data[z][x]; !near(got, want, 0.01) {
+          t.Fatalf("%s: height %g at %d,%d, saved %g", name, got, x, z, want)
+        }
+      }
+    }
+
+    // half the scale, under the sea level flattened, a third of the size
+    imported, err = ImportHeightmap(filename, HeightmapImport{MaxVal: 32, Scale: 16, SeaLevel: 4, Width: 9, Height: 5})
+    if err != nil {
+      t.Fatal(err)
+    }
+    if imported.Width != 9 || imported.Height != 5 {
+      t.Fatalf("%s: resized to %dx%d", name, imported.Width, imported.Height)
+    }
+    if got := imported.Data[0][0]; got != 4 {
+      t.Fatalf("%s: height %g under the sea level", name, got)
+    }
+    if got := imported.Data[4][8]; !near(got, 16, 0.01) {
+      t.Fatalf("%s: height %g of the highest corner, expected the scale", name, got)
+    }
+    if got := imported.Data[2][4]; !near(got, 8, 0.01) {
+      t.Fatalf("%s: height %g at the center", name, got)
+    }
+  }
+}
+
+func TestImportHeightmapRejectsOptions(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "map.png")
+  if err := SaveHeightmapImage(slopeMap(), filename, false); err != nil {
+    t.Fatal(err)
+  }
+  for _, options := range []HeightmapImport{{}, {MaxVal: 32, Width: -1}, {MaxVal: 32, Width: 1 << 15, Height: 1 << 15}} {
+    if _, err := ImportHeightmap(filename, options); err == nil {
+      t.Errorf("import with %+v accepted", options)
+    }
+  }
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+const (
+  LogText = "text"
+  LogJSON = "json"
+)
+
+// every log record carries one of these as its component attribute
+var logComponentNames = []string{"net", "world", "map", "events"}
+
+type logComponent struct {
+  name  string
+  level slog.LevelVar
+}
+
+var logComponents = func() map[string]*logComponent {
+  components := make(map[string]*logComponent)
+  for _, name := range logComponentNames {
+    components[name] = &logComponent{name: name}
+  }
+  return components
+}()
+
+var (
+  netLog    = newComponentLogger("net")
+  worldLog  = newComponentLogger("world")
+  mapLog    = newComponentLogger("map")
+  eventsLog = newComponentLogger("events")
+)
+
+// output shared by the component loggers, swapped by SetupLogging
+var logOutput atomic.Pointer[slog.Handler]
+
+var logLimiter = &rateLimiter{}
+
+func init() {
+  var handler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+  logOutput.Store(&handler)
+}
+
+func parseLogLevel(value string) (slog.Level, error) {
+  var level slog.Level
+  if err := level.UnmarshalText([]byte(value)); err != nil {
+    return level, fmt.Errorf("unknown log level %q", value)
+  }
+  return level, nil
+}
+
+// "net=debug,map=warn", components left out keep the default level
+func parseComponentLevels(value string) (map[string]string, error) {
+  levels := make(map[string]string)
+  for _, item := range strings.Split(value, ",") {
+    item = strings.TrimSpace(item)
+    if item == "" {
+      continue
+    }
+    name, level, ok := strings.Cut(item, "=")
+    if !ok {
+      return nil, fmt.Errorf("expected component=level, got %q", item)
+    }
+    levels[strings.TrimSpace(name)] = strings.TrimSpace(level)
+  }
+  return levels, nil
+}
+
+func validateLogConfig(format, level string, levels map[string]string) []string {
+  var problems []string
+  if format != LogText && format != LogJSON {
+    problems = append(problems, fmt.Sprintf("log_format must be %s or %s", LogText, LogJSON))
+  }
+  if _, err := parseLogLevel(level); err != nil {
+    problems = append(problems, "log_level: "+err.Error())
+  }
+  for name, value := range levels {
+    if _, ok := logComponents[name]; !ok {
+      problems = append(problems, fmt.Sprintf("log_levels: unknown component %q (%s)", name, strings.Join(logComponentNames, ", ")))
+    }
+    if _, err := parseLogLevel(value); err != nil {
+      problems = append(problems, fmt.Sprintf("log_levels: %s: %v", name, err))
+    }
+  }
+  return problems
+}
+
+// the config is validated before, errors here are programming mistakes
+func SetupLogging(w io.Writer, config Config) error {
+  options := &slog.HandlerOptions{Level: slog.LevelDebug}
+  var handler slog.Handler
+  if config.LogFormat == LogJSON {
+    handler = slog.NewJSONHandler(w, options)
+  } else {
+    handler = slog.NewTextHandler(w, options)
+  }
+  logOutput.Store(&handler)
+  logLimiter.setLimit(config.LogRateLimit)
+
+  for _, name := range logComponentNames {
+    value := config.LogLevel
+    if componentLevel, ok := config.LogLevels[name]; ok {
+      value = componentLevel
+    }
+    if err := SetLogLevel(name, value); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// can be called at any time, e.g. to debug the network of a running server
+func SetLogLevel(component, value string) error {
+  target, ok := logComponents[component]
+  if !ok {
+    return fmt.Errorf("unknown log component %q", component)
+  }
+  level, err := parseLogLevel(value)
+  if err != nil {
+    return err
+  }
+  target.level.Set(level)
+  return nil
+}
+
+func LogLevels() map[string]string {
+  levels := make(map[string]string)
+  for name, component := range logComponents {
+    levels[name] = strings.ToLower(component.level.Level().String())
+  }
+  return levels
+}
+
+func newComponentLogger(name string) *slog.Logger {
+  return slog.New(&componentHandler{component: logComponents[name]})
+}
+
+// filters records on the component level then writes them to the current
+// output with the component attribute
+type componentHandler struct {
+  component *logComponent
+  // WithAttrs and WithGroup calls, replayed on the current output
+  wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+  return level >= h.component.level.Level()
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+  allowed, suppressed := logLimiter.allow(h.component.name, record.Message)
+  if !allowed {
+    return nil
+  }
+  if suppressed > 0 {
+    record = record.Clone()
+    record.AddAttrs(slog.Int("suppressed", suppressed))
+  }
+
+  handler := (*logOutput.Load()).WithAttrs([]slog.Attr{slog.String("component", h.component.name)})
+  for _, wrap := range h.wrap {
+    handler = wrap(handler)
+  }
+  return handler.Handle(ctx, record)
+}
+
+func (h *componentHandler) with(wrap func(slog.Handler) slog.Handler) *componentHandler {
+  return &componentHandler{
+    component: h.component,
+    wrap:      append(append([]func(slog.Handler) slog.Handler(nil), h.wrap...), wrap),
+  }
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+  return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+// lets at most limit records with the same component and message through
+// each second, the first record of the next second reports how many were
+// dropped. A zero limit disables it.
+type rateLimiter struct {
+  mu      sync.Mutex
+  limit   int
+  windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+  start      time.Time
+  count      int
+  suppressed int
+}
+
+func (limiter *rateLimiter) setLimit(limit int) {
+  limiter.mu.Lock()
+  defer limiter.mu.Unlock()
+  limiter.limit = limit
+  limiter.windows = nil
+}
+
+func (limiter *rateLimiter) allow(component, message string) (bool, int) {
+  limiter.mu.Lock()
+  defer limiter.mu.Unlock()
+  if limiter.limit <= 0 {
+    return true, 0
+  }
+  if limiter.windows == nil {
+    limiter.windows = make(map[string]*rateWindow)
+  }
+
+  now := time.Now()
+  key := component + "\x00" + message
+  window, ok := limiter.windows[key]
+  if !ok {
+    window = &rateWindow{start: now}
+    limiter.windows[key] = window
+  }
+
+  suppressed := 0
+  if now.Sub(window.start) >= time.Second {
+    suppressed = window.suppressed
+    window.start, window.count, window.suppressed = now, 0, 0
+  }
+  if window.count >= limiter.limit {
+    window.suppressed++
+    return false, 0
+  }
+  window.count++
+  return true, suppressed
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// goroutines left by earlier tests may still log
+type logBuffer struct {
+  mu  sync.Mutex
+  buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.String()
+}
+
+func (b *logBuffer) Reset() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  b.buf.Reset()
+}
+
+func TestComponentLogLevels(t *testing.T) {
+  var out logBuffer
+  config := DefaultConfig()
+  config.LogFormat = LogJSON
+  config.LogLevel = "warn"
+  config.LogLevels = map[string]string{"net": "debug"}
+  if err := SetupLogging(&out, config); err != nil {
+    t.Fatal(err)
+  }
+  defer SetupLogging(io.Discard, DefaultConfig())
+
+  netLog.Debug("net debug")
+  mapLog.Info("map info")
+  mapLog.Warn("map warn", "map", "hills")
+  if err := SetLogLevel("map", "debug"); err != nil {
+    t.Fatal(err)
+  }
+  mapLog.Debug("map debug")
+  if err := SetLogLevel("physics", "debug"); err == nil {
+    t.Error("level of an unknown component set")
+  }
+
+  var messages []string
+  for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+    var record map[string]interface{}
+    if err := json.Unmarshal([]byte(line), &record); err != nil {
+      t.Fatalf("record %q is not json: %v", line, err)
+    }
+    messages = append(messages, record["component"].(string)+": "+record["msg"].(string))
+  }
+  want := []string{"net: net debug", "map: map warn", "map: map debug"}
+  if strings.Join(messages, "\n") != strings.Join(want, "\n") {
+    t.Fatalf("logged %q, expected %q", messages, want)
+  }
+  if levels := LogLevels(); levels["net"] != "debug" || levels["world"] != "warn" || levels["map"] != "debug" {
+    t.Fatalf("levels %v", levels)
+  }
+}
+
+func TestLogRateLimit(t *testing.T) {
+  var out logBuffer
+  config := DefaultConfig()
+  config.LogLevel = "info"
+  config.LogRateLimit = 3
+  if err := SetupLogging(&out, config); err != nil {
+    t.Fatal(err)
+  }
+  defer SetupLogging(io.Discard, DefaultConfig())
+
+  for i := 0; i < 10; i++ {
+    netLog.Info("datagram refused", "i", i)
+  }
+  worldLog.Info("datagram refused")
+  if lines := strings.Count(out.String(), "\n"); lines != 4 {
+    t.Fatalf("%d records let through, expected 3 of net and 1 of world:\n%s", lines, out.String())
+  }
+
+  // the next second reports the dropped records
+  logLimiter.mu.Lock()
+  logLimiter.windows["net\x00datagram refused"].start = time.Now().Add(-time.Second)
+  logLimiter.mu.Unlock()
+  out.Reset()
+  netLog.Info("datagram refused")
+  if !strings.Contains(out.String(), "suppressed=7") {
+    t.Fatalf("record after the dropped ones: %s", out.String())
+  }
+}
+
+func TestValidateLogConfig(t *testing.T) {
+  problems := validateLogConfig("xml", "loud", map[string]string{"physics": "debug", "net": "chatty"})
+  if len(problems) != 4 {
+    t.Fatalf("problems %q, expected 4", problems)
+  }
+  if _, err := parseComponentLevels("net=debug,map"); err == nil {
+    t.Fatal("component without a level parsed")
+  }
+}
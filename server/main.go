@@ -1,18 +1,50 @@
+//go:build !rtgsmap && !rtgsreplay
+
 package main
 
 import (
+  "flag"
   "fmt"
+  "os"
+  "os/signal"
+  "syscall"
 )
 
 func main() {
-  fmt.Println("=== RTGS Server ===")
+  config, err := LoadConfig(os.Args[1:])
+  if err == flag.ErrHelp {
+    return
+  }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "Error on config: %v\n", err)
+    os.Exit(2)
+  }
+  if err := SetupLogging(os.Stdout, config); err != nil {
+    fmt.Fprintf(os.Stderr, "Error on logging setup: %v\n", err)
+    os.Exit(2)
+  }
   
-  server, err := NewServer(8888)
+  worldLog.Info("rtgs server starting")
+  config.Print()
+  
+  server, err := NewServer(config)
   if err != nil {
-    fmt.Printf("Error on create: %v\n", err)
-    return
+    netLog.Error("server not created", "err", err)
+    os.Exit(1)
+  }
+  
+  if err := server.LoadWorld(); err != nil {
+    mapLog.Error("world not loaded", "err", err)
+    os.Exit(1)
   }
   
+  // the console may have changed the terminal mode, stop cleanly to restore it
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+  go func() {
+    <-signals
+    server.Shutdown()
+  }()
+  
   server.Start()
 }
-
@@ -0,0 +1,390 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "compress/flate"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "io"
+  "math"
+)
+
+// File layout (little endian):
+//   magic "RTGM", version uint16
+//   width, height, maxVal int32
+//   quantization uint8 (0 float32, 8 or 16 bit), compression uint8
+//   scale, offset float32
+//   heights, row major, deflated when compression is set
+//   version >= 3, in the same deflate stream: layers flag uint8, when set
+//   moisture, temperature, biome, material uint8 per cell, row major
+//   version >= 2: metadata length uint32 followed by MapMeta json
+// Files without the magic are the legacy raw layout: width, height,
+// maxVal int32 followed by float32 heights.
+// Maps have at most maxMapCells cells and maxMapMetaSize bytes of metadata,
+// larger files are refused before anything is allocated.
+
+const (
+  mapMagic   = "RTGM"
+  mapVersion = 3
+
+  // 4096x4096, 64MB of float32 heights
+  maxMapCells    = 1 << 24
+  maxMapMetaSize = 1 << 24
+)
+
+const (
+  CompressionNone    uint8 = 0
+  CompressionDeflate uint8 = 1
+)
+
+type MapEncoding struct {
+  Quantization uint8
+  Compression  uint8
+}
+
+var (
+  EncodingRaw        = MapEncoding{Quantization: 0, Compression: CompressionNone}
+  EncodingCompressed = MapEncoding{Quantization: 16, Compression: CompressionDeflate}
+)
+
+func (encoding MapEncoding) String() string {
+  name := "float32"
+  if encoding.Quantization != 0 {
+    name = fmt.Sprintf("q%d", encoding.Quantization)
+  }
+  if encoding.Compression == CompressionDeflate {
+    name += "+deflate"
+  }
+  return name
+}
+
+func ParseMapEncoding(name string) (MapEncoding, error) {
+  switch name {
+  case "raw", "float32":
+    return EncodingRaw, nil
+  case "deflate", "float32+deflate":
+    return MapEncoding{Quantization: 0, Compression: CompressionDeflate}, nil
+  case "q8":
+    return MapEncoding{Quantization: 8, Compression: CompressionNone}, nil
+  case "q8+deflate":
+    return MapEncoding{Quantization: 8, Compression: CompressionDeflate}, nil
+  case "q16":
+    return MapEncoding{Quantization: 16, Compression: CompressionNone}, nil
+  case "q16+deflate":
+    return EncodingCompressed, nil
+  default:
+    return MapEncoding{}, fmt.Errorf("unknown map encoding: %s", name)
+  }
+}
+
+type mapHeader struct {
+  Version      uint16
+  Width        int32
+  Height       int32
+  MaxVal       int32
+  Quantization uint8
+  Compression  uint8
+  Scale        float32
+  Offset       float32
+}
+
+func quantizationLevels(bits uint8) (float64, error) {
+  switch bits {
+  case 8:
+    return math.MaxUint8, nil
+  case 16:
+    return math.MaxUint16, nil
+  default:
+    return 0, fmt.Errorf("unsupported quantization: %d bits", bits)
+  }
+}
+
+func EncodeMap(w io.Writer, mapData *MapData, encoding MapEncoding) error {
+  header := mapHeader{
+    Version:      mapVersion,
+    Width:        int32(mapData.Width),
+    Height:       int32(mapData.Height),
+    MaxVal:       int32(mapData.MaxVal),
+    Quantization: encoding.Quantization,
+    Compression:  encoding.Compression,
+    Scale:        1,
+  }
+
+  var levels float64
+  if encoding.Quantization != 0 {
+    var err error
+    if levels, err = quantizationLevels(encoding.Quantization); err != nil {
+      return err
+    }
+    stats := mapData.Stats()
+    header.Offset = stats.Min
+    header.Scale = float32(float64(stats.Max-stats.Min) / levels)
+  }
+
+  if _, err := io.WriteString(w, mapMagic); err != nil {
+    return err
+  }
+  if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+    return err
+  }
+
+  var payload io.Writer = w
+  var compressor *flate.Writer
+  if encoding.Compression == CompressionDeflate {
+    var err error
+    if compressor, err = flate.NewWriter(w, flate.BestCompression); err != nil {
+      return err
+    }
+    payload = compressor
+  } else if encoding.Compression != CompressionNone {
+    return fmt.Errorf("unsupported compression: %d", encoding.Compression)
+  }
+
+  for y := 0; y < mapData.Height; y++ {
+    row := mapData.Data[y]
+    var err error
+    switch encoding.Quantization {
+    case 0:
+      err = binary.Write(payload, binary.LittleEndian, row)
+    case 8:
+      q := make([]uint8, len(row))
+      for x, val := range row {
+        q[x] = uint8(quantize(val, header.Offset, header.Scale, levels))
+      }
+      err = binary.Write(payload, binary.LittleEndian, q)
+    case 16:
+      q := make([]uint16, len(row))
+      for x, val := range row {
+        q[x] = uint16(quantize(val, header.Offset, header.Scale, levels))
+      }
+      err = binary.Write(payload, binary.LittleEndian, q)
+    }
+    if err != nil {
+      return err
+    }
+  }
+
+  if err := encodeLayers(payload, mapData); err != nil {
+    return err
+  }
+
+  if compressor != nil {
+    if err := compressor.Close(); err != nil {
+      return err
+    }
+  }
+
+  meta, err := json.Marshal(mapData.Meta)
+  if err != nil {
+    return err
+  }
+  if err := binary.Write(w, binary.LittleEndian, uint32(len(meta))); err != nil {
+    return err
+  }
+  _, err = w.Write(meta)
+  return err
+}
+
+func encodeLayers(w io.Writer, mapData *MapData) error {
+  if mapData.Layers == nil {
+    return binary.Write(w, binary.LittleEndian, uint8(0))
+  }
+  if err := binary.Write(w, binary.LittleEndian, uint8(1)); err != nil {
+    return err
+  }
+  for y := 0; y < mapData.Height; y++ {
+    if err := binary.Write(w, binary.LittleEndian, mapData.Layers[y]); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func decodeLayers(r io.Reader, width, height int) ([][]CellLayers, error) {
+  var flag uint8
+  if err := binary.Read(r, binary.LittleEndian, &flag); err != nil {
+    return nil, err
+  }
+  if flag == 0 {
+    return nil, nil
+  }
+  layers := make([][]CellLayers, height)
+  for y := range layers {
+    layers[y] = make([]CellLayers, width)
+    if err := binary.Read(r, binary.LittleEndian, layers[y]); err != nil {
+      return nil, err
+    }
+  }
+  return layers, nil
+}
+
+func quantize(val, offset, scale float32, levels float64) float64 {
+  if scale == 0 {
+    return 0
+  }
+  q := math.Round(float64(val-offset) / float64(scale))
+  return max(0, min(levels, q))
+}
+
+func EncodeMapBytes(mapData *MapData, encoding MapEncoding) ([]byte, error) {
+  var buffer bytes.Buffer
+  if err := EncodeMap(&buffer, mapData, encoding); err != nil {
+    return nil, err
+  }
+  return buffer.Bytes(), nil
+}
+
+// each side is capped on its own, an empty map may not have a huge side
+func checkMapSize(width, height int32) error {
+  if width < 0 || height < 0 || width > maxMapCells || height > maxMapCells || int64(width)*int64(height) > maxMapCells {
+    return fmt.Errorf("invalid map size: %dx%d", width, height)
+  }
+  return nil
+}
+
+func DecodeMap(r io.Reader) (*MapData, error) {
+  reader := bufio.NewReader(r)
+
+  magic, err := reader.Peek(len(mapMagic))
+  if err != nil {
+    return nil, err
+  }
+  if string(magic) != mapMagic {
+    return decodeLegacyMap(reader)
+  }
+  reader.Discard(len(mapMagic))
+
+  var header mapHeader
+  if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+    return nil, err
+  }
+  if header.Version > mapVersion {
+    return nil, fmt.Errorf("unsupported map version: %d", header.Version)
+  }
+  if err := checkMapSize(header.Width, header.Height); err != nil {
+    return nil, err
+  }
+
+  var payload io.Reader = reader
+  var decompressor io.ReadCloser
+  switch header.Compression {
+  case CompressionNone:
+  case CompressionDeflate:
+    decompressor = flate.NewReader(reader)
+    defer decompressor.Close()
+    payload = decompressor
+  default:
+    return nil, fmt.Errorf("unsupported compression: %d", header.Compression)
+  }
+
+  data := make([][]float32, header.Height)
+  for y := range data {
+    data[y] = make([]float32, header.Width)
+    switch header.Quantization {
+    case 0:
+      err = binary.Read(payload, binary.LittleEndian, data[y])
+    case 8:
+      q := make([]uint8, header.Width)
+      if err = binary.Read(payload, binary.LittleEndian, q); err == nil {
+        for x, v := range q {
+          data[y][x] = header.Offset + float32(v)*header.Scale
+        }
+      }
+    case 16:
+      q := make([]uint16, header.Width)
+      if err = binary.Read(payload, binary.LittleEndian, q); err == nil {
+        for x, v := range q {
+          data[y][x] = header.Offset + float32(v)*header.Scale
+        }
+      }
+    default:
+      return nil, fmt.Errorf("unsupported quantization: %d bits", header.Quantization)
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  var layers [][]CellLayers
+  if header.Version >= 3 {
+    if layers, err = decodeLayers(payload, int(header.Width), int(header.Height)); err != nil {
+      return nil, err
+    }
+  }
+
+  // consume the end of the deflate stream so the metadata is next
+  if decompressor != nil {
+    if _, err := io.Copy(io.Discard, decompressor); err != nil {
+      return nil, err
+    }
+  }
+
+  var meta MapMeta
+  if header.Version >= 2 {
+    var length uint32
+    if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
+      return nil, err
+    }
+    if length > maxMapMetaSize {
+      return nil, fmt.Errorf("invalid metadata length: %d", length)
+    }
+    raw := make([]byte, length)
+    if _, err := io.ReadFull(reader, raw); err != nil {
+      return nil, err
+    }
+    if err := json.Unmarshal(raw, &meta); err != nil {
+      return nil, fmt.Errorf("invalid map metadata: %v", err)
+    }
+  }
+
+  return &MapData{
+    Width:  int(header.Width),
+    Height: int(header.Height),
+    MaxVal: int(header.MaxVal),
+    Data:   data,
+    Layers: layers,
+    Meta:   meta,
+    // encoding the file was read from, informational only
+    Encoding: MapEncoding{
+      Quantization: header.Quantization,
+      Compression:  header.Compression,
+    },
+    hash: &mapHash{},
+  }, nil
+}
+
+func decodeLegacyMap(r io.Reader) (*MapData, error) {
+  var width, height, maxVal int32
+
+  if err := binary.Read(r, binary.LittleEndian, &width); err != nil {
+    return nil, err
+  }
+  if err := binary.Read(r, binary.LittleEndian, &height); err != nil {
+    return nil, err
+  }
+  if err := binary.Read(r, binary.LittleEndian, &maxVal); err != nil {
+    return nil, err
+  }
+  if err := checkMapSize(width, height); err != nil {
+    return nil, err
+  }
+
+  data := make([][]float32, height)
+  for y := int32(0); y < height; y++ {
+    data[y] = make([]float32, width)
+    if err := binary.Read(r, binary.LittleEndian, data[y]); err != nil {
+      return nil, err
+    }
+  }
+
+  return &MapData{
+    Width:    int(width),
+    Height:   int(height),
+    MaxVal:   int(maxVal),
+    Data:     data,
+    Encoding: EncodingRaw,
+    hash:     &mapHash{},
+  }, nil
+}
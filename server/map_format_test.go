@@ -0,0 +1,85 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "testing"
+)
+
+func TestMapRoundTrip(t *testing.T) {
+  mapData := flatMap(5, 3, 0)
+  mapData.Data[1][2] = 7
+  mapData.Meta.Objects = []MapObject{{Kind: "rock", X: 2, Y: 7, Z: 1, Radius: 0.5}}
+
+  for _, encoding := range []MapEncoding{EncodingRaw, EncodingCompressed, {Quantization: 8}} {
+    data, err := EncodeMapBytes(mapData, encoding)
+    if err != nil {
+      t.Fatal(err)
+    }
+    decoded, err := DecodeMap(bytes.NewReader(data))
+    if err != nil {
+      t.Fatalf("%s: %v", encoding, err)
+    }
+    if decoded.Width != 5 || decoded.Height != 3 || !near(decoded.Data[1][2], 7, 0.03) || len(decoded.Meta.Objects) != 1 {
+      t.Fatalf("%s: decoded %+v", encoding, decoded)
+    }
+  }
+}
+
+func TestDecodeMapRefusesLargeMaps(t *testing.T) {
+  var header bytes.Buffer
+  header.WriteString(mapMagic)
+  binary.Write(&header, binary.LittleEndian, mapHeader{Version: mapVersion, Width: 1 << 13, Height: 1 << 12, Scale: 1})
+  if _, err := DecodeMap(bytes.NewReader(header.Bytes())); err == nil {
+    t.Fatal("map larger than maxMapCells decoded")
+  }
+
+  var legacy bytes.Buffer
+  binary.Write(&legacy, binary.LittleEndian, []int32{1 << 30, 1 << 30, 32})
+  if _, err := DecodeMap(bytes.NewReader(legacy.Bytes())); err == nil {
+    t.Fatal("legacy map larger than maxMapCells decoded")
+  }
+
+  var empty bytes.Buffer
+  empty.WriteString(mapMagic)
+  binary.Write(&empty, binary.LittleEndian, mapHeader{Version: mapVersion, Width: 0, Height: 1 << 30, Scale: 1})
+  if _, err := DecodeMap(bytes.NewReader(empty.Bytes())); err == nil {
+    t.Fatal("empty map with a huge side decoded")
+  }
+
+  var emptyLegacy bytes.Buffer
+  binary.Write(&emptyLegacy, binary.LittleEndian, []int32{0, 1 << 30, 32})
+  if _, err := DecodeMap(bytes.NewReader(emptyLegacy.Bytes())); err == nil {
+    t.Fatal("empty legacy map with a huge side decoded")
+  }
+
+  var future bytes.Buffer
+  future.WriteString(mapMagic)
+  binary.Write(&future, binary.LittleEndian, mapHeader{Version: mapVersion + 1, Width: 2, Height: 2, Scale: 1})
+  if _, err := DecodeMap(bytes.NewReader(future.Bytes())); err == nil {
+    t.Fatal("map of a newer version decoded")
+  }
+}
+
+func TestLoadedMapHashCached(t *testing.T) {
+  data, err := EncodeMapBytes(flatMap(4, 4, 1), EncodingRaw)
+  if err != nil {
+    t.Fatal(err)
+  }
+  mapData, err := DecodeMap(bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  hash := mapData.Hash()
+  if mapData.hash == nil || mapData.hash.value != hash {
+    t.Fatal("hash of the loaded map not cached")
+  }
+
+  edited, changed := mapData.withEdit(TerrainEdit{Op: EditRaise, X: 1, Z: 1, Radius: 1, Strength: 1}, 0, 0, mapData.sampleCell)
+  if !changed || edited.Hash() == hash || edited.Hash() != edited.computeHash() {
+    t.Fatal("edited map kept the hash of the loaded map")
+  }
+  if mapData.Hash() != hash {
+    t.Fatal("edit changed the hash of the loaded map")
+  }
+}
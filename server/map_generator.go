@@ -1,7 +1,8 @@
 package main
 
 import (
-  "encoding/binary"
+  "bufio"
+  "bytes"
   "fmt"
   "math/rand"
   "os"
@@ -11,10 +12,15 @@ import (
 )
 
 type MapData struct {
-  Width  int
-  Height int
-  MaxVal int
-  Data   [][]float32
+  Width    int
+  Height   int
+  MaxVal   int
+  Data     [][]float32
+  Layers   [][]CellLayers
+  Meta     MapMeta
+  Encoding MapEncoding
+  // cache of Hash, nil for maps still being built
+  hash *mapHash
 }
 
 type MapGenerator struct {
@@ -22,35 +28,152 @@ type MapGenerator struct {
   currentMap   *MapData
   mu           sync.RWMutex
   lastFilename string
+  encoding     MapEncoding
+  stages       []MapStage
+  placement    []PlacementRule
+  editMu       sync.Mutex
+  // replays read and save the map files in memory
+  files *MapFiles
+  // called before a map file is written
+  onSave func(filename string)
 }
 
 func NewMapGenerator(eventManager *EventManager) *MapGenerator {
   return &MapGenerator{
     eventManager: eventManager,
+    encoding:     EncodingCompressed,
+    placement:    DefaultPlacementRules,
   }
 }
 
+// nil disables object placement
+func (mg *MapGenerator) SetPlacementRules(rules []PlacementRule) {
+  mg.mu.Lock()
+  defer mg.mu.Unlock()
+  mg.placement = rules
+}
+
+func (mg *MapGenerator) SetEncoding(encoding MapEncoding) {
+  mg.mu.Lock()
+  defer mg.mu.Unlock()
+  mg.encoding = encoding
+}
+
+// maps and chunks are read from files and saved to it instead of the disk
+func (mg *MapGenerator) UseMapFiles(files *MapFiles) {
+  mg.mu.Lock()
+  defer mg.mu.Unlock()
+  mg.files = files
+}
+
+func (mg *MapGenerator) SetStages(stages []MapStage) error {
+  resolved := make([]MapStage, 0, len(stages))
+  for _, stage := range stages {
+    r, err := stage.resolve()
+    if err != nil {
+      return err
+    }
+    resolved = append(resolved, r)
+  }
+  
+  mg.mu.Lock()
+  defer mg.mu.Unlock()
+  mg.stages = resolved
+  return nil
+}
+
 func (mg *MapGenerator) Generate(width, height, maxVal int) *MapData {
-  rand.Seed(time.Now().UnixNano())
+  return mg.GenerateWithSeed(width, height, maxVal, time.Now().UnixNano())
+}
+
+func (mg *MapGenerator) GenerateWithSeed(width, height, maxVal int, seed int64) *MapData {
+  defer mapGenerationDuration.With("map").ObserveSince(time.Now())
+  
+  rng := rand.New(rand.NewSource(seed))
   
   data := make([][]float32, height)
   for y := 0; y < height; y++ {
     data[y] = make([]float32, width)
     for x := 0; x < width; x++ {
-      val := float32(rand.Intn(maxVal + 1))
+      val := float32(rng.Intn(maxVal + 1))
       data[y][x] = val
     }
   }
   
-  return &MapData{
+  mapData := &MapData{
     Width:  width,
     Height: height,
     MaxVal: maxVal,
     Data:   data,
+    Meta:   MapMeta{Seed: seed},
+  }
+  
+  mg.mu.RLock()
+  stages := mg.stages
+  placement := mg.placement
+  mg.mu.RUnlock()
+  
+  if err := ApplyMapStages(mapData, stages, seed); err != nil {
+    mapLog.Error("map post-processing failed", "err", err)
+  }
+  GenerateLayers(mapData, seed, 0, 0)
+  mapData.Meta.Objects = PlaceObjects(mapData, placement, seed, 0, 0)
+  
+  return mapData
+}
+
+// generates the (ChunkSize+1)² samples of a chunk, the last row and column
+// overlap with the next chunks so terrain is continuous across borders
+func (mg *MapGenerator) GenerateChunk(seed int64, coord ChunkCoord, maxVal int) *MapData {
+  defer mapGenerationDuration.With("chunk").ObserveSince(time.Now())
+  
+  size := ChunkSize + 1
+  originX := int64(coord.X) * ChunkSize
+  originZ := int64(coord.Z) * ChunkSize
+  
+  data := make([][]float32, size)
+  for y := 0; y < size; y++ {
+    data[y] = make([]float32, size)
+    for x := 0; x < size; x++ {
+      n := fractalNoise(seed, float64(originX+int64(x)), float64(originZ+int64(y)), 4, 48)
+      data[y][x] = float32(n * float64(maxVal))
+    }
+  }
+  
+  mapData := &MapData{
+    Width:  size,
+    Height: size,
+    MaxVal: maxVal,
+    Data:   data,
   }
+  GenerateLayers(mapData, seed, originX, originZ)
+  
+  mg.mu.RLock()
+  placement := mg.placement
+  mg.mu.RUnlock()
+  
+  chunkSeed := int64(hashLattice(seed, int64(coord.X), int64(coord.Z)))
+  mapData.Meta.Objects = PlaceObjects(mapData, placement, chunkSeed, float32(originX), float32(originZ))
+  
+  return mapData
 }
 
 func (mg *MapGenerator) SaveToFile(mapData *MapData, filename string) error {
+  mg.mu.RLock()
+  encoding, files, onSave := mg.encoding, mg.files, mg.onSave
+  mg.mu.RUnlock()
+  if files != nil {
+    var buffer bytes.Buffer
+    if err := EncodeMap(&buffer, mapData, encoding); err != nil {
+      return err
+    }
+    files.Write(filename, buffer.Bytes())
+    return nil
+  }
+  if onSave != nil {
+    onSave(filename)
+  }
+  
   dir := filepath.Dir(filename)
   if err := os.MkdirAll(dir, 0755); err != nil {
     return fmt.Errorf("error while creating folder: %v", err)
@@ -62,94 +185,200 @@ func (mg *MapGenerator) SaveToFile(mapData *MapData, filename string) error {
   }
   defer file.Close()
   
-  if err := binary.Write(file, binary.LittleEndian, int32(mapData.Width)); err != nil {
-    return err
-  }
-  if err := binary.Write(file, binary.LittleEndian, int32(mapData.Height)); err != nil {
+  writer := bufio.NewWriter(file)
+  if err := EncodeMap(writer, mapData, encoding); err != nil {
     return err
   }
-  if err := binary.Write(file, binary.LittleEndian, int32(mapData.MaxVal)); err != nil {
+  return writer.Flush()
+}
+
+func (mg *MapGenerator) GenerateAndSave(width, height, maxVal int, filename string) error {
+  mapData, err := mg.generateAndSave(width, height, maxVal, filename)
+  if err != nil {
     return err
   }
+  mg.use(mapData, filename)
+  return nil
+}
+
+// the saved map is not used
+func (mg *MapGenerator) generateAndSave(width, height, maxVal int, filename string) (*MapData, error) {
+  mapLog.Info("generating map", "width", width, "height", height, "max", maxVal)
   
-  for y := 0; y < mapData.Height; y++ {
-    for x := 0; x < mapData.Width; x++ {
-      if err := binary.Write(file, binary.LittleEndian, mapData.Data[y][x]); err != nil {
-        return err
-      }
-    }
+  mapData, err := mg.saveAndReload(mg.Generate(width, height, maxVal), filename)
+  if err != nil {
+    return nil, err
   }
   
-  return nil
+  mapLog.Info("map saved", "file", filename)
+  
+  mg.eventManager.DispatchAsync(Event{
+    Type: EventMapGenerated,
+    Data: MapGeneratedData{
+      Filename: filename,
+      Seed:     mapData.Meta.Seed,
+      Width:    width,
+      Height:   height,
+      MaxVal:   maxVal,
+    },
+  })
+  
+  return mapData, nil
 }
 
-
-func (mg *MapGenerator) GenerateAndSave(width, height, maxVal int, filename string) error {
-  fmt.Printf("Generates map %dx%d (max: %d)...\n", width, height, maxVal)
+// builds a map from a grayscale image, layers and objects are generated
+// from the seed like for generated maps
+func (mg *MapGenerator) Import(image string, options HeightmapImport, seed int64) (*MapData, error) {
+  defer mapGenerationDuration.With("import").ObserveSince(time.Now())
+  
+  mapData, err := ImportHeightmap(image, options)
+  if err != nil {
+    return nil, err
+  }
+  mapData.Meta.Seed = seed
   
-  mapData := mg.Generate(width, height, maxVal)
+  mg.mu.RLock()
+  placement := mg.placement
+  mg.mu.RUnlock()
   
-  if err := mg.SaveToFile(mapData, filename); err != nil {
+  GenerateLayers(mapData, seed, 0, 0)
+  mapData.Meta.Objects = PlaceObjects(mapData, placement, seed, 0, 0)
+  return mapData, nil
+}
+
+func (mg *MapGenerator) ImportAndSave(image string, options HeightmapImport, seed int64, filename string) error {
+  mapLog.Info("importing map", "image", image)
+  
+  mapData, err := mg.Import(image, options, seed)
+  if err != nil {
     return err
   }
   
-  mg.mu.Lock()
-  mg.currentMap = mapData
-  mg.lastFilename = filename
-  mg.mu.Unlock()
+  if mapData, err = mg.saveAndUse(mapData, filename); err != nil {
+    return err
+  }
   
-  fmt.Printf("Map saved at %s\n", filename)
+  mapLog.Info("map saved", "file", filename, "width", mapData.Width, "height", mapData.Height)
   
-  event := Event{
+  mg.eventManager.DispatchAsync(Event{
     Type: EventMapGenerated,
-    Data: map[string]interface{}{
-      "filename": filename,
-      "width":    width,
-      "height":   height,
-      "maxVal":   maxVal,
+    Data: MapGeneratedData{
+      Filename: filename,
+      Source:   image,
+      Seed:     seed,
+      Width:    mapData.Width,
+      Height:   mapData.Height,
+      MaxVal:   mapData.MaxVal,
     },
-  }
-  
-  mg.eventManager.DispatchAsync(event)
+  })
   
   return nil
 }
 
-func LoadMapFromFile(filename string) (*MapData, error) {
-  file, err := os.Open(filename)
+// replaces the current map with a new one of the same size, saved over the
+// current file when there is one
+func (mg *MapGenerator) Regenerate(seed int64) error {
+  current, err := mg.GetMapData()
   if err != nil {
-    return nil, fmt.Errorf("error opening files: %v", err)
+    return err
   }
-  defer file.Close()
+  filename := mg.Filename()
+  mapLog.Info("regenerating map", "seed", seed, "width", current.Width, "height", current.Height, "max", current.MaxVal)
   
-  var width, height, maxVal int32
+  mapData := mg.GenerateWithSeed(current.Width, current.Height, current.MaxVal, seed)
+  if filename != "" {
+    if mapData, err = mg.saveAndUse(mapData, filename); err != nil {
+      return err
+    }
+    mapLog.Info("map saved", "file", filename)
+  } else {
+    mg.mu.Lock()
+    mg.currentMap = mapData
+    mg.mu.Unlock()
+  }
   
-  if err := binary.Read(file, binary.LittleEndian, &width); err != nil {
+  mg.eventManager.DispatchAsync(Event{
+    Type: EventMapGenerated,
+    Data: MapGeneratedData{
+      Filename: filename,
+      Seed:     seed,
+      Width:    mapData.Width,
+      Height:   mapData.Height,
+      MaxVal:   mapData.MaxVal,
+    },
+  })
+  return nil
+}
+
+// keeps what was saved so the map and its hash match the file after a restart
+func (mg *MapGenerator) saveAndUse(mapData *MapData, filename string) (*MapData, error) {
+  mapData, err := mg.saveAndReload(mapData, filename)
+  if err != nil {
     return nil, err
   }
-  if err := binary.Read(file, binary.LittleEndian, &height); err != nil {
+  mg.use(mapData, filename)
+  return mapData, nil
+}
+
+// makes mapData, read from filename, the current map
+func (mg *MapGenerator) use(mapData *MapData, filename string) {
+  mg.mu.Lock()
+  mg.currentMap = mapData
+  mg.lastFilename = filename
+  mg.mu.Unlock()
+}
+
+// returns the map as read back from filename
+func (mg *MapGenerator) saveAndReload(mapData *MapData, filename string) (*MapData, error) {
+  if err := mg.SaveToFile(mapData, filename); err != nil {
     return nil, err
   }
-  if err := binary.Read(file, binary.LittleEndian, &maxVal); err != nil {
-    return nil, err
+  saved, err := mg.readFile(filename)
+  if err != nil {
+    mapLog.Warn("saved map not read back", "file", filename, "err", err)
+    return mapData, nil
+  }
+  return saved, nil
+}
+
+func (mg *MapGenerator) readFile(filename string) (*MapData, error) {
+  mg.mu.RLock()
+  files := mg.files
+  mg.mu.RUnlock()
+  if files == nil {
+    return LoadMapFromFile(filename)
   }
   
-  data := make([][]float32, height)
-  for y := int32(0); y < height; y++ {
-    data[y] = make([]float32, width)
-    for x := int32(0); x < width; x++ {
-      if err := binary.Read(file, binary.LittleEndian, &data[y][x]); err != nil {
-        return nil, err
-      }
-    }
+  data, err := files.Read(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error opening files: %w", err)
   }
+  return DecodeMap(bytes.NewReader(data))
+}
+
+func LoadMapFromFile(filename string) (*MapData, error) {
+  file, err := os.Open(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error opening files: %w", err)
+  }
+  defer file.Close()
   
-  return &MapData{
-    Width:  int(width),
-    Height: int(height),
-    MaxVal: int(maxVal),
-    Data:   data,
-  }, nil
+  return DecodeMap(file)
+}
+
+func (mg *MapGenerator) LoadFromFile(filename string) error {
+  mapData, err := mg.readFile(filename)
+  if err != nil {
+    return err
+  }
+  mg.use(mapData, filename)
+  return nil
+}
+
+func (mg *MapGenerator) Filename() string {
+  mg.mu.RLock()
+  defer mg.mu.RUnlock()
+  return mg.lastFilename
 }
 
 // todo review
@@ -166,7 +395,7 @@ func (mg *MapGenerator) GetMapData() (*MapData, error) {
     return nil, fmt.Errorf("no map found in memory")
   }
   
-  mapData, err := LoadMapFromFile(lastFile)
+  mapData, err := mg.readFile(lastFile)
   if err != nil {
     return nil, err
   }
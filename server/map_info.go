@@ -0,0 +1,108 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+  "fmt"
+  "math"
+  "sync"
+)
+
+type MapStats struct {
+  Min  float32 `json:"min"`
+  Max  float32 `json:"max"`
+  Mean float64 `json:"mean"`
+}
+
+type MapDiff struct {
+  Cells        int
+  ChangedCells int
+  MaxAbsDiff   float32
+  MeanAbsDiff  float64
+}
+
+func (mapData *MapData) Stats() MapStats {
+  stats := MapStats{
+    Min: float32(math.Inf(1)),
+    Max: float32(math.Inf(-1)),
+  }
+
+  total := 0.0
+  for y := 0; y < mapData.Height; y++ {
+    for x := 0; x < mapData.Width; x++ {
+      val := mapData.Data[y][x]
+      stats.Min = min(stats.Min, val)
+      stats.Max = max(stats.Max, val)
+      total += float64(val)
+    }
+  }
+
+  if cells := mapData.Width * mapData.Height; cells > 0 {
+    stats.Mean = total / float64(cells)
+  } else {
+    stats.Min, stats.Max = 0, 0
+  }
+  return stats
+}
+
+type mapHash struct {
+  once  sync.Once
+  value string
+}
+
+// sha256 over the dimensions and heights, independent of the file encoding.
+// Loaded maps compute it once, their edits are new maps and maps changed in
+// place must call resetHash.
+func (mapData *MapData) Hash() string {
+  if mapData.hash == nil {
+    return mapData.computeHash()
+  }
+  mapData.hash.once.Do(func() {
+    mapData.hash.value = mapData.computeHash()
+  })
+  return mapData.hash.value
+}
+
+// starts an empty cache, the next Hash is computed and cached in it
+func (mapData *MapData) resetHash() {
+  mapData.hash = &mapHash{}
+}
+
+func (mapData *MapData) computeHash() string {
+  h := sha256.New()
+  binary.Write(h, binary.LittleEndian, int32(mapData.Width))
+  binary.Write(h, binary.LittleEndian, int32(mapData.Height))
+  binary.Write(h, binary.LittleEndian, int32(mapData.MaxVal))
+  for y := 0; y < mapData.Height; y++ {
+    binary.Write(h, binary.LittleEndian, mapData.Data[y])
+  }
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+func DiffMaps(a, b *MapData, epsilon float32) (*MapDiff, error) {
+  if a.Width != b.Width || a.Height != b.Height {
+    return nil, fmt.Errorf("size mismatch: %dx%d vs %dx%d", a.Width, a.Height, b.Width, b.Height)
+  }
+
+  diff := &MapDiff{Cells: a.Width * a.Height}
+  total := 0.0
+  for y := 0; y < a.Height; y++ {
+    for x := 0; x < a.Width; x++ {
+      d := a.Data[y][x] - b.Data[y][x]
+      if d < 0 {
+        d = -d
+      }
+      if d > epsilon {
+        diff.ChangedCells++
+      }
+      diff.MaxAbsDiff = max(diff.MaxAbsDiff, d)
+      total += float64(d)
+    }
+  }
+
+  if diff.Cells > 0 {
+    diff.MeanAbsDiff = total / float64(diff.Cells)
+  }
+  return diff, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+// biome ids, 0 is left for maps without layers
+const (
+  BiomeNone uint8 = iota
+  BiomeWater
+  BiomeBeach
+  BiomeDesert
+  BiomeGrassland
+  BiomeForest
+  BiomeTundra
+  BiomeMountain
+  BiomeSnow
+)
+
+const (
+  MaterialNone uint8 = iota
+  MaterialWater
+  MaterialSand
+  MaterialGrass
+  MaterialDirt
+  MaterialRock
+  MaterialSnow
+)
+
+var biomeNames = []string{"none", "water", "beach", "desert", "grassland", "forest", "tundra", "mountain", "snow"}
+var materialNames = []string{"none", "water", "sand", "grass", "dirt", "rock", "snow"}
+
+// movement speed multiplier per material
+var materialSpeed = []float32{1, 0.5, 0.8, 1, 1, 0.9, 0.7}
+
+const (
+  layerSeedMoisture    = 1013
+  layerSeedTemperature = 2027
+  layerNoiseScale      = 64
+
+  // relative heights of the biome bands
+  waterLevel    = 0.25
+  beachLevel    = 0.3
+  mountainLevel = 0.8
+)
+
+// moisture and temperature in [0, 255] map to [0, 1]
+type CellLayers struct {
+  Moisture    uint8
+  Temperature uint8
+  Biome       uint8
+  Material    uint8
+}
+
+func BiomeName(biome uint8) string {
+  if int(biome) < len(biomeNames) {
+    return biomeNames[biome]
+  }
+  return fmt.Sprintf("biome%d", biome)
+}
+
+func MaterialName(material uint8) string {
+  if int(material) < len(materialNames) {
+    return materialNames[material]
+  }
+  return fmt.Sprintf("material%d", material)
+}
+
+func MaterialSpeed(material uint8) float32 {
+  if int(material) < len(materialSpeed) {
+    return materialSpeed[material]
+  }
+  return 1
+}
+
+func classifyBiome(height, water, moisture, temperature float64) uint8 {
+  switch {
+  case height <= water:
+    return BiomeWater
+  case height < water+beachLevel-waterLevel:
+    return BiomeBeach
+  case height > mountainLevel:
+    if temperature < 0.4 {
+      return BiomeSnow
+    }
+    return BiomeMountain
+  case temperature < 0.25:
+    return BiomeTundra
+  case moisture < 0.35:
+    if temperature > 0.55 {
+      return BiomeDesert
+    }
+    return BiomeGrassland
+  case moisture > 0.55:
+    return BiomeForest
+  default:
+    return BiomeGrassland
+  }
+}
+
+func surfaceMaterial(biome uint8, slope float32) uint8 {
+  if biome != BiomeWater && slope > maxWalkableSlope*0.7 {
+    return MaterialRock
+  }
+  switch biome {
+  case BiomeWater:
+    return MaterialWater
+  case BiomeBeach, BiomeDesert:
+    return MaterialSand
+  case BiomeGrassland:
+    return MaterialGrass
+  case BiomeForest, BiomeTundra:
+    return MaterialDirt
+  case BiomeMountain:
+    return MaterialRock
+  case BiomeSnow:
+    return MaterialSnow
+  }
+  return MaterialNone
+}
+
+func unitByte(v float64) uint8 {
+  return uint8(math.Round(max(0, min(1, v)) * 255))
+}
+
+// moisture and temperature come from world space noise so chunks match at
+// their borders, temperature drops with height
+func GenerateLayers(mapData *MapData, seed int64, originX, originZ int64) {
+  if mapData.MaxVal <= 0 {
+    return
+  }
+  water := waterLevel
+  if mapData.Meta.SeaLevel > 0 {
+    water = float64(mapData.Meta.SeaLevel) / float64(mapData.MaxVal)
+  }
+
+  layers := make([][]CellLayers, mapData.Height)
+  for z := 0; z < mapData.Height; z++ {
+    layers[z] = make([]CellLayers, mapData.Width)
+    for x := 0; x < mapData.Width; x++ {
+      wx, wz := float64(originX+int64(x)), float64(originZ+int64(z))
+      height := max(0, min(1, float64(mapData.Data[z][x])/float64(mapData.MaxVal)))
+      moisture := fractalNoise(seed+layerSeedMoisture, wx, wz, 3, layerNoiseScale)
+      temperature := fractalNoise(seed+layerSeedTemperature, wx, wz, 3, layerNoiseScale*2) - 0.5*height + 0.25
+
+      biome := classifyBiome(height, water, moisture, temperature)
+      layers[z][x] = CellLayers{
+        Moisture:    unitByte(moisture),
+        Temperature: unitByte(temperature),
+        Biome:       biome,
+        Material:    surfaceMaterial(biome, slopeAt(mapData, float32(x), float32(z))),
+      }
+    }
+  }
+  mapData.Layers = layers
+}
+
+// nearest cell, false outside of the map or when the map has no layers
+func (mapData *MapData) LayersAt(x, z float32) (CellLayers, bool) {
+  if mapData.Layers == nil || !mapData.InBounds(x, z) {
+    return CellLayers{}, false
+  }
+  cx := int(math.Round(float64(x)))
+  cz := int(math.Round(float64(z)))
+  return mapData.Layers[cz][cx], true
+}
+
+// speed multiplier of the ground at a position, 1 without layers
+func MovementSpeedAt(terrain Terrain, x, z float32) float32 {
+  if terrain == nil {
+    return 1
+  }
+  if layers, ok := terrain.LayersAt(x, z); ok {
+    return MaterialSpeed(layers.Material)
+  }
+  return 1
+}
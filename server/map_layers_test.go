@@ -0,0 +1,55 @@
+package main
+
+import (
+  "bytes"
+  "reflect"
+  "testing"
+)
+
+func TestLayersRoundTrip(t *testing.T) {
+  mapData := NewMapGenerator(nil).GenerateWithSeed(17, 9, 32, 5)
+  if mapData.Layers == nil {
+    t.Fatal("generated map has no layers")
+  }
+
+  for _, encoding := range []MapEncoding{EncodingRaw, EncodingCompressed, {Quantization: 8}} {
+    data, err := EncodeMapBytes(mapData, encoding)
+    if err != nil {
+      t.Fatal(err)
+    }
+    decoded, err := DecodeMap(bytes.NewReader(data))
+    if err != nil {
+      t.Fatalf("%s: %v", encoding, err)
+    }
+    if !reflect.DeepEqual(decoded.Layers, mapData.Layers) {
+      t.Fatalf("%s: layers changed by the round trip", encoding)
+    }
+  }
+
+  data, err := EncodeMapBytes(flatMap(4, 4, 1), EncodingCompressed)
+  if err != nil {
+    t.Fatal(err)
+  }
+  decoded, err := DecodeMap(bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := decoded.LayersAt(1, 1); ok || decoded.Layers != nil {
+    t.Fatal("layers decoded for a map saved without them")
+  }
+}
+
+func TestLayersSlowUsersInWater(t *testing.T) {
+  mapData := flatMap(16, 16, 2)
+  GenerateLayers(mapData, 1, 0, 0)
+  layers, ok := mapData.LayersAt(8, 8)
+  if !ok || layers.Biome != BiomeWater || layers.Material != MaterialWater {
+    t.Fatalf("ground under the water level has layers %+v", layers)
+  }
+  if speed := MovementSpeedAt(mapData, 8, 8); speed != MaterialSpeed(MaterialWater) || speed >= 1 {
+    t.Fatalf("speed %g in water", speed)
+  }
+  if speed := MovementSpeedAt(flatMap(16, 16, 2), 8, 8); speed != 1 {
+    t.Fatalf("speed %g on a map without layers", speed)
+  }
+}
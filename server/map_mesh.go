@@ -0,0 +1,110 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "math"
+  "os"
+  "path/filepath"
+)
+
+// Step keeps every Step-th sample (the last row and column are always
+// kept), Colors adds vertex colors by height after the positions
+type MeshExport struct {
+  Step   int
+  Colors bool
+}
+
+// sample positions along one axis, downsampled but ending on the border
+func meshSamples(size, step int) []int {
+  var samples []int
+  for i := 0; i < size; i += step {
+    samples = append(samples, i)
+  }
+  if size > 0 && samples[len(samples)-1] != size-1 {
+    samples = append(samples, size-1)
+  }
+  return samples
+}
+
+// central differences on the full resolution map so the normals do not
+// depend on the downsampling
+func (mapData *MapData) normalAt(x, z int) [3]float64 {
+  x0, x1 := max(0, x-1), min(mapData.Width-1, x+1)
+  z0, z1 := max(0, z-1), min(mapData.Height-1, z+1)
+  dx := float64(mapData.Data[z][x1]-mapData.Data[z][x0]) / float64(max(1, x1-x0))
+  dz := float64(mapData.Data[z1][x]-mapData.Data[z0][x]) / float64(max(1, z1-z0))
+
+  nx, ny, nz := -dx, 1.0, -dz
+  length := math.Sqrt(nx*nx + ny*ny + nz*nz)
+  return [3]float64{nx / length, ny / length, nz / length}
+}
+
+// writes a Wavefront OBJ in world coordinates: x is the column, y the
+// height and z the row, like the server and the client terrain
+func ExportOBJ(w io.Writer, mapData *MapData, options MeshExport) error {
+  if mapData.Width < 2 || mapData.Height < 2 {
+    return fmt.Errorf("map too small for a mesh: %dx%d", mapData.Width, mapData.Height)
+  }
+  step := max(1, options.Step)
+  columns := meshSamples(mapData.Width, step)
+  rows := meshSamples(mapData.Height, step)
+
+  writer := bufio.NewWriter(w)
+  fmt.Fprintf(writer, "# rtgs map %dx%d, step %d\n", mapData.Width, mapData.Height, step)
+  if mapData.Meta.Name != "" {
+    fmt.Fprintf(writer, "o %s\n", mapData.Meta.Name)
+  } else {
+    fmt.Fprintf(writer, "o terrain\n")
+  }
+
+  for _, z := range rows {
+    for _, x := range columns {
+      h := mapData.Data[z][x]
+      if options.Colors {
+        c := heightColor(normalizedHeight(mapData, h))
+        fmt.Fprintf(writer, "v %d %g %d %.3f %.3f %.3f\n", x, h, z,
+          float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+      } else {
+        fmt.Fprintf(writer, "v %d %g %d\n", x, h, z)
+      }
+    }
+  }
+
+  for _, z := range rows {
+    for _, x := range columns {
+      n := mapData.normalAt(x, z)
+      fmt.Fprintf(writer, "vn %.4f %.4f %.4f\n", n[0], n[1], n[2])
+    }
+  }
+
+  // obj indices start at 1, normals share the vertex indices, faces are
+  // wound so their normal points up
+  for j := 0; j+1 < len(rows); j++ {
+    for i := 0; i+1 < len(columns); i++ {
+      a := j*len(columns) + i + 1
+      b := a + 1
+      c := a + len(columns)
+      d := c + 1
+      fmt.Fprintf(writer, "f %d//%d %d//%d %d//%d\n", a, a, c, c, b, b)
+      fmt.Fprintf(writer, "f %d//%d %d//%d %d//%d\n", b, b, c, c, d, d)
+    }
+  }
+
+  return writer.Flush()
+}
+
+func SaveMeshOBJ(mapData *MapData, filename string, options MeshExport) error {
+  if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+    return fmt.Errorf("error while creating folder: %v", err)
+  }
+
+  file, err := os.Create(filename)
+  if err != nil {
+    return fmt.Errorf("error while creating file: %v", err)
+  }
+  defer file.Close()
+
+  return ExportOBJ(file, mapData, options)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+  "bytes"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+type objMesh struct {
+  vertices [][3]float64
+  normals  int
+  faces    [][3]int
+  fields   int
+}
+
+func exportMesh(t *testing.T, mapData *MapData, options MeshExport) objMesh {
+  t.Helper()
+  var out bytes.Buffer
+  if err := ExportOBJ(&out, mapData, options); err != nil {
+    t.Fatal(err)
+  }
+
+  var mesh objMesh
+  for _, line := range strings.Split(out.String(), "\n") {
+    fields := strings.Fields(line)
+    if len(fields) == 0 {
+      continue
+    }
+    switch fields[0] {
+    case "v":
+      var vertex [3]float64
+      for i := range vertex {
+        vertex[i], _ = strconv.ParseFloat(fields[i+1], 64)
+      }
+      mesh.vertices = append(mesh.vertices, vertex)
+      mesh.fields = len(fields) - 1
+    case "vn":
+      mesh.normals++
+    case "f":
+      var face [3]int
+      for i := range face {
+        index, _, _ := strings.Cut(fields[i+1], "//")
+        face[i], _ = strconv.Atoi(index)
+      }
+      mesh.faces = append(mesh.faces, face)
+    }
+  }
+  return mesh
+}
+
+func TestExportOBJCounts(t *testing.T) {
+  mapData := slopeMap()
+  for _, test := range []struct {
+    step, columns, rows int
+  }{
+    {1, 17, 9},
+    {4, 5, 3},
+    // the last row and column are kept off the step
+    {5, 5, 3},
+  } {
+    mesh := exportMesh(t, mapData, MeshExport{Step: test.step})
+    vertices := test.columns * test.rows
+    faces := 2 * (test.columns - 1) * (test.rows - 1)
+    if len(mesh.vertices) != vertices || mesh.normals != vertices || len(mesh.faces) != faces {
+      t.Fatalf("step %d: %d vertices, %d normals, %d faces, expected %d, %d, %d", test.step,
+        len(mesh.vertices), mesh.normals, len(mesh.faces), vertices, vertices, faces)
+    }
+    if last := mesh.vertices[len(mesh.vertices)-1]; last != [3]float64{16, 32, 8} {
+      t.Fatalf("step %d: last vertex %v, expected the far corner", test.step, last)
+    }
+
+    for _, face := range mesh.faces {
+      var corners [3][3]float64
+      for i, index := range face {
+        if index < 1 || index > vertices {
+          t.Fatalf("step %d: face %v indexes outside of the vertices", test.step, face)
+        }
+        corners[i] = mesh.vertices[index-1]
+      }
+      // y of (c1-c0) x (c2-c0)
+      u := [3]float64{corners[1][0] - corners[0][0], 0, corners[1][2] - corners[0][2]}
+      v := [3]float64{corners[2][0] - corners[0][0], 0, corners[2][2] - corners[0][2]}
+      if u[2]*v[0]-u[0]*v[2] <= 0 {
+        t.Fatalf("step %d: face %v faces down", test.step, face)
+      }
+    }
+  }
+
+  if mesh := exportMesh(t, mapData, MeshExport{Step: 4, Colors: true}); mesh.fields != 6 {
+    t.Fatalf("%d values per colored vertex, expected 6", mesh.fields)
+  }
+  if err := ExportOBJ(&bytes.Buffer{}, flatMap(1, 5, 0), MeshExport{}); err == nil {
+    t.Fatal("mesh exported for a map one sample wide")
+  }
+}
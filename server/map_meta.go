@@ -0,0 +1,31 @@
+package main
+
+// free-form map metadata stored after the heights in the map file
+type MapMeta struct {
+  Name     string      `json:"name,omitempty"`
+  Seed     int64       `json:"seed,omitempty"`
+  Stages   []MapStage  `json:"stages,omitempty"`
+  Portals  []Portal    `json:"portals,omitempty"`
+  Objects  []MapObject `json:"objects,omitempty"`
+  Triggers []Trigger   `json:"triggers,omitempty"`
+
+  // height of the water surface, 0 uses the default biome bands
+  SeaLevel float32 `json:"sea_level,omitempty"`
+}
+
+// a portal moves users standing within Radius of (X, Z) to Target in
+// TargetZone
+type Portal struct {
+  Name       string     `json:"name"`
+  X          float32    `json:"x"`
+  Z          float32    `json:"z"`
+  Radius     float32    `json:"radius"`
+  TargetZone string     `json:"target_zone"`
+  Target     [3]float32 `json:"target"`
+}
+
+func (portal *Portal) contains(location Vector3) bool {
+  dx := location.x - portal.X
+  dz := location.z - portal.Z
+  return dx*dx+dz*dz <= portal.Radius*portal.Radius
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+  "math"
+  "math/rand"
+)
+
+const (
+  // user footprint used for object collisions
+  userRadius      = 0.4
+  maxObjectRadius = 3
+)
+
+// static entity placed on the map, coordinates are world coordinates
+type MapObject struct {
+  Kind     string  `json:"kind"`
+  X        float32 `json:"x"`
+  Y        float32 `json:"y"`
+  Z        float32 `json:"z"`
+  Radius   float32 `json:"radius"`
+  Rotation float32 `json:"rotation"`
+}
+
+// heights are relative to MaxVal, slope is rise over run
+type PlacementRule struct {
+  Kind        string
+  MinDistance float32
+  MinHeight   float32
+  MaxHeight   float32
+  MaxSlope    float32
+  Chance      float32
+  Radius      float32
+  // any biome when empty or when the map has no layers
+  Biomes []uint8
+}
+
+var DefaultPlacementRules = []PlacementRule{
+  {Kind: "structure", MinDistance: 40, MinHeight: 0.35, MaxHeight: 0.55, MaxSlope: 0.15, Chance: 0.5, Radius: 3,
+    Biomes: []uint8{BiomeGrassland, BiomeDesert}},
+  {Kind: "tree", MinDistance: 4, MinHeight: 0.32, MaxHeight: 0.65, MaxSlope: 0.6, Chance: 0.8, Radius: 0.5,
+    Biomes: []uint8{BiomeForest, BiomeGrassland, BiomeTundra}},
+  {Kind: "rock", MinDistance: 7, MinHeight: 0.2, MaxHeight: 1, MaxSlope: 1.5, Chance: 0.6, Radius: 0.8},
+}
+
+func (rule PlacementRule) allowsBiome(mapData *MapData, x, z float32) bool {
+  if len(rule.Biomes) == 0 {
+    return true
+  }
+  layers, ok := mapData.LayersAt(x, z)
+  if !ok {
+    return true
+  }
+  for _, biome := range rule.Biomes {
+    if layers.Biome == biome {
+      return true
+    }
+  }
+  return false
+}
+
+// slope around a point from central differences
+func slopeAt(mapData *MapData, x, z float32) float32 {
+  hx0, _ := mapData.HeightAt(max(0, x-1), z)
+  hx1, _ := mapData.HeightAt(min(float32(mapData.Width-1), x+1), z)
+  hz0, _ := mapData.HeightAt(x, max(0, z-1))
+  hz1, _ := mapData.HeightAt(x, min(float32(mapData.Height-1), z+1))
+  return float32(math.Hypot(float64(hx1-hx0)/2, float64(hz1-hz0)/2))
+}
+
+// Bridson poisson-disk samples in [0, width) x [0, height)
+func poissonDisk(rng *rand.Rand, width, height, minDistance float32) [][2]float32 {
+  const attempts = 30
+  cellSize := minDistance / float32(math.Sqrt2)
+  gridW := int(math.Ceil(float64(width/cellSize)))
+  gridH := int(math.Ceil(float64(height/cellSize)))
+  if gridW <= 0 || gridH <= 0 {
+    return nil
+  }
+  grid := make([]int, gridW*gridH)
+  for i := range grid {
+    grid[i] = -1
+  }
+
+  var points [][2]float32
+  var active []int
+  insert := func(p [2]float32) {
+    points = append(points, p)
+    active = append(active, len(points)-1)
+    grid[int(p[1]/cellSize)*gridW+int(p[0]/cellSize)] = len(points) - 1
+  }
+  fits := func(p [2]float32) bool {
+    if p[0] < 0 || p[1] < 0 || p[0] >= width || p[1] >= height {
+      return false
+    }
+    gx, gz := int(p[0]/cellSize), int(p[1]/cellSize)
+    for z := max(0, gz-2); z <= min(gridH-1, gz+2); z++ {
+      for x := max(0, gx-2); x <= min(gridW-1, gx+2); x++ {
+        if i := grid[z*gridW+x]; i >= 0 {
+          dx, dz := points[i][0]-p[0], points[i][1]-p[1]
+          if dx*dx+dz*dz < minDistance*minDistance {
+            return false
+          }
+        }
+      }
+    }
+    return true
+  }
+
+  insert([2]float32{rng.Float32() * width, rng.Float32() * height})
+  for len(active) > 0 {
+    slot := rng.Intn(len(active))
+    origin := points[active[slot]]
+    found := false
+    for i := 0; i < attempts; i++ {
+      angle := rng.Float64() * 2 * math.Pi
+      dist := float64(minDistance) * (1 + rng.Float64())
+      candidate := [2]float32{
+        origin[0] + float32(math.Cos(angle)*dist),
+        origin[1] + float32(math.Sin(angle)*dist),
+      }
+      if fits(candidate) {
+        insert(candidate)
+        found = true
+        break
+      }
+    }
+    if !found {
+      active[slot] = active[len(active)-1]
+      active = active[:len(active)-1]
+    }
+  }
+  return points
+}
+
+func objectsOverlap(objects []MapObject, x, z, radius float32) bool {
+  for _, object := range objects {
+    dx, dz := object.X-x, object.Z-z
+    reach := object.Radius + radius
+    if dx*dx+dz*dz < reach*reach {
+      return true
+    }
+  }
+  return false
+}
+
+// rules are applied in order, later rules skip spots taken by earlier ones.
+// originX/Z offset the samples to world coordinates for chunks.
+func PlaceObjects(mapData *MapData, rules []PlacementRule, seed int64, originX, originZ float32) []MapObject {
+  var objects []MapObject
+  if mapData.Width < 2 || mapData.Height < 2 || mapData.MaxVal <= 0 {
+    return objects
+  }
+
+  // chunks overlap their neighbours by one sample, keep the last one out
+  width := float32(mapData.Width - 1)
+  height := float32(mapData.Height - 1)
+
+  for i, rule := range rules {
+    rng := rand.New(rand.NewSource(seed + int64(i+1)*104729))
+    for _, p := range poissonDisk(rng, width, height, rule.MinDistance) {
+      if rng.Float32() > rule.Chance {
+        continue
+      }
+      h, ok := mapData.HeightAt(p[0], p[1])
+      if !ok {
+        continue
+      }
+      relative := h / float32(mapData.MaxVal)
+      if relative < rule.MinHeight || relative > rule.MaxHeight {
+        continue
+      }
+      if slopeAt(mapData, p[0], p[1]) > rule.MaxSlope || !rule.allowsBiome(mapData, p[0], p[1]) {
+        continue
+      }
+      x, z := originX+p[0], originZ+p[1]
+      if objectsOverlap(objects, x, z, rule.Radius) {
+        continue
+      }
+      objects = append(objects, MapObject{
+        Kind:     rule.Kind,
+        X:        x,
+        Y:        h,
+        Z:        z,
+        Radius:   rule.Radius,
+        Rotation: rng.Float32() * 360,
+      })
+    }
+  }
+  return objects
+}
+
+func (mapData *MapData) ObstacleAt(x, z, radius float32) bool {
+  return objectsOverlap(mapData.Meta.Objects, x, z, radius)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+  "math"
+  "slices"
+  "testing"
+)
+
+// low ground on the left half, a plateau on the right one
+func stepMap() *MapData {
+  mapData := flatMap(65, 65, 10)
+  for z := range mapData.Data {
+    for x := 33; x < 65; x++ {
+      mapData.Data[z][x] = 16
+    }
+  }
+  return mapData
+}
+
+func TestPlaceObjectsFollowsRules(t *testing.T) {
+  rules := []PlacementRule{{Kind: "tree", MinDistance: 4, MinHeight: 0.4, MaxHeight: 0.6, MaxSlope: 0.1, Chance: 1, Radius: 0.5}}
+  objects := PlaceObjects(stepMap(), rules, 7, 0, 0)
+  if len(objects) == 0 {
+    t.Fatal("no objects placed on the plateau")
+  }
+  if again := PlaceObjects(stepMap(), rules, 7, 0, 0); !slices.Equal(objects, again) {
+    t.Fatal("the same seed placed different objects")
+  }
+  if other := PlaceObjects(stepMap(), rules, 8, 0, 0); slices.Equal(objects, other) {
+    t.Fatal("another seed placed the same objects")
+  }
+
+  for i, object := range objects {
+    // the low ground is under MinHeight and the step is too steep
+    if object.X <= 33 || object.Y != 16 {
+      t.Errorf("%s at %g,%g height %g, outside the plateau", object.Kind, object.X, object.Z, object.Y)
+    }
+    for _, other := range objects[:i] {
+      if distance := math.Hypot(float64(object.X-other.X), float64(object.Z-other.Z)); distance < 4 {
+        t.Errorf("objects at %g,%g and %g,%g only %.2f apart", object.X, object.Z, other.X, other.Z, distance)
+      }
+    }
+  }
+}
+
+func TestPlaceObjectsSkipsTakenSpots(t *testing.T) {
+  rules := []PlacementRule{
+    {Kind: "structure", MinDistance: 10, MaxHeight: 1, MaxSlope: 1, Chance: 1, Radius: 3},
+    {Kind: "rock", MinDistance: 2, MaxHeight: 1, MaxSlope: 1, Chance: 1, Radius: 0.5},
+  }
+  objects := PlaceObjects(flatMap(33, 33, 8), rules, 3, 0, 0)
+  if !slices.ContainsFunc(objects, func(object MapObject) bool { return object.Kind == "rock" }) {
+    t.Fatal("no rocks placed between the structures")
+  }
+  for i, object := range objects {
+    if objectsOverlap(objects[:i], object.X, object.Z, object.Radius) {
+      t.Errorf("%s at %g,%g overlaps an earlier object", object.Kind, object.X, object.Z)
+    }
+  }
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+  "errors"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  defaultMapDir  = "data/maps"
+  defaultMapName = "map0"
+
+  generatedMapSize   = 128
+  generatedMapMaxVal = 32
+)
+
+// named maps of a directory played in order by the main zone
+type MapRotation struct {
+  dir        string
+  names      []string
+  regenerate bool
+  // 0 rotates only on admin request
+  interval time.Duration
+  // size of the maps generated when missing
+  width, height, maxVal int
+
+  mu    sync.Mutex
+  index int
+}
+
+// an empty names list plays every map of dir, or a single new map when the
+// directory is empty
+func NewMapRotation(dir string, names []string, regenerate bool) *MapRotation {
+  if len(names) == 0 {
+    files, _ := filepath.Glob(filepath.Join(dir, "*.bin"))
+    for _, file := range files {
+      names = append(names, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)))
+    }
+    sort.Strings(names)
+  }
+  if len(names) == 0 {
+    names = []string{defaultMapName}
+  }
+  return &MapRotation{
+    dir:        dir,
+    names:      names,
+    regenerate: regenerate,
+    width:      generatedMapSize,
+    height:     generatedMapSize,
+    maxVal:     generatedMapMaxVal,
+  }
+}
+
+func (rotation *MapRotation) SetInterval(interval time.Duration) {
+  rotation.interval = interval
+}
+
+func (rotation *MapRotation) SetGeneratedSize(width, height, maxVal int) {
+  rotation.width = width
+  rotation.height = height
+  rotation.maxVal = maxVal
+}
+
+func (rotation *MapRotation) filename(name string) string {
+  return filepath.Join(rotation.dir, name+".bin")
+}
+
+func (rotation *MapRotation) Current() string {
+  rotation.mu.Lock()
+  defer rotation.mu.Unlock()
+  return rotation.names[rotation.index]
+}
+
+func (rotation *MapRotation) Names() []string {
+  return append([]string(nil), rotation.names...)
+}
+
+func (rotation *MapRotation) advance() string {
+  rotation.mu.Lock()
+  defer rotation.mu.Unlock()
+  rotation.index = (rotation.index + 1) % len(rotation.names)
+  return rotation.names[rotation.index]
+}
+
+// false when name is not in the rotation
+func (rotation *MapRotation) setCurrent(name string) bool {
+  rotation.mu.Lock()
+  defer rotation.mu.Unlock()
+  for i, other := range rotation.names {
+    if other == name {
+      rotation.index = i
+      return true
+    }
+  }
+  return false
+}
+
+// the map file is kept across restarts, it is only generated when missing
+// or when regeneration was asked for
+func (rotation *MapRotation) load(mg *MapGenerator, name string, regenerate bool) error {
+  mapData, err := rotation.read(mg, name, regenerate)
+  if err != nil {
+    return err
+  }
+  mg.use(mapData, rotation.filename(name))
+  return nil
+}
+
+// the map of name without using it, generated and saved like by load
+func (rotation *MapRotation) read(mg *MapGenerator, name string, regenerate bool) (*MapData, error) {
+  filename := rotation.filename(name)
+  if !regenerate {
+    mapData, err := mg.readFile(filename)
+    if err == nil {
+      mapLog.Info("map loaded", "map", name, "file", filename)
+      return mapData, nil
+    }
+    if !errors.Is(err, os.ErrNotExist) {
+      return nil, err
+    }
+  }
+  return mg.generateAndSave(rotation.width, rotation.height, rotation.maxVal, filename)
+}
+
+// the main zone plays the maps of the rotation, starting with the first one.
+// regeneration only applies to that first map.
+func (server *Server) UseMapRotation(rotation *MapRotation) error {
+  mapGenerator := server.newMapGenerator()
+  if err := rotation.load(mapGenerator, rotation.Current(), rotation.regenerate); err != nil {
+    return err
+  }
+
+  server.mu.Lock()
+  server.rotation = rotation
+  server.mu.Unlock()
+  server.AddZone(NewZone(defaultZoneName, mapGenerator))
+  return nil
+}
+
+var errNoRotation = errors.New("no map rotation configured")
+
+// loads the next map of the rotation in the main zone, clients of the zone
+// stay in place and get the terrain of the new map
+func (server *Server) RotateMap() error {
+  server.mu.RLock()
+  rotation := server.rotation
+  zone := server.zones[defaultZoneName]
+  server.mu.RUnlock()
+  if rotation == nil || zone == nil || zone.mapGenerator == nil {
+    return errNoRotation
+  }
+
+  name := rotation.advance()
+  if err := rotation.load(zone.mapGenerator, name, false); err != nil {
+    return err
+  }
+
+  server.refreshZone(zone, adminChange{Op: "map_rotate"})
+  mapLog.Info("map rotated", "map", name, "hash", zone.mapHash())
+  return nil
+}
+
+func (server *Server) startMapRotation() {
+  if server.rotation == nil || server.rotation.interval <= 0 {
+    return
+  }
+  go func() {
+    ticker := time.NewTicker(server.rotation.interval)
+    defer ticker.Stop()
+    for range ticker.C {
+      if err := server.RotateMap(); err != nil {
+        mapLog.Error("map rotation failed", "err", err)
+      }
+    }
+  }()
+}
+
+// must be called with server.mu held
+func (server *Server) sendMapInfo(client *Client) {
+  info := MapInfo{
+    Type:    "map_info",
+    Zone:    client.zone.name,
+    MapID:   client.zone.mapID(),
+    MapHash: client.zone.mapHash(),
+  }
+  if server.rotation != nil && client.zone.name == defaultZoneName {
+    info.Rotation = server.rotation.Names()
+  }
+  server.sendJSON(client.addr, info)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "math/rand"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// post-processing stage applied after generation, Params holds the effective
+// parameters so the saved metadata is enough to reproduce the map
+type MapStage struct {
+  Name   string             `json:"name"`
+  Params map[string]float64 `json:"params,omitempty"`
+}
+
+type stageFunc func(mapData *MapData, params map[string]float64, rng *rand.Rand)
+
+type stageDefinition struct {
+  defaults map[string]float64
+  apply    stageFunc
+}
+
+var mapStages = map[string]stageDefinition{
+  "hydraulic": {
+    defaults: map[string]float64{
+      "droplets":    20000,
+      "lifetime":    30,
+      "inertia":     0.05,
+      "capacity":    4,
+      "minCapacity": 0.01,
+      "erode":       0.3,
+      "deposit":     0.3,
+      "evaporate":   0.01,
+      "gravity":     4,
+    },
+    apply: hydraulicErosion,
+  },
+  "thermal": {
+    defaults: map[string]float64{
+      "iterations": 20,
+      "talus":      1.0,
+      "rate":       0.5,
+    },
+    apply: thermalErosion,
+  },
+  "smooth": {
+    defaults: map[string]float64{
+      "iterations": 1,
+      "strength":   0.5,
+    },
+    apply: smoothMap,
+  },
+  "terrace": {
+    defaults: map[string]float64{
+      "levels":   8,
+      "strength": 0.7,
+    },
+    apply: terraceMap,
+  },
+}
+
+// fills missing parameters with defaults and rejects unknown ones
+func (stage MapStage) resolve() (MapStage, error) {
+  definition, ok := mapStages[stage.Name]
+  if !ok {
+    return stage, fmt.Errorf("unknown map stage: %s", stage.Name)
+  }
+
+  params := make(map[string]float64, len(definition.defaults))
+  for key, val := range definition.defaults {
+    params[key] = val
+  }
+  for key, val := range stage.Params {
+    if _, ok := definition.defaults[key]; !ok {
+      return stage, fmt.Errorf("unknown parameter %s for stage %s", key, stage.Name)
+    }
+    params[key] = val
+  }
+
+  return MapStage{Name: stage.Name, Params: params}, nil
+}
+
+// parses "hydraulic:droplets=50000,lifetime=40;thermal;smooth:strength=0.3"
+func ParseMapStages(spec string) ([]MapStage, error) {
+  var stages []MapStage
+  for _, part := range strings.Split(spec, ";") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+
+    name, rawParams, _ := strings.Cut(part, ":")
+    stage := MapStage{Name: strings.TrimSpace(name), Params: map[string]float64{}}
+    if rawParams != "" {
+      for _, rawParam := range strings.Split(rawParams, ",") {
+        key, rawVal, ok := strings.Cut(rawParam, "=")
+        if !ok {
+          return nil, fmt.Errorf("invalid stage parameter: %s", rawParam)
+        }
+        val, err := strconv.ParseFloat(strings.TrimSpace(rawVal), 64)
+        if err != nil {
+          return nil, fmt.Errorf("invalid value for %s: %v", key, err)
+        }
+        stage.Params[strings.TrimSpace(key)] = val
+      }
+    }
+
+    resolved, err := stage.resolve()
+    if err != nil {
+      return nil, err
+    }
+    stages = append(stages, resolved)
+  }
+  return stages, nil
+}
+
+func (stage MapStage) String() string {
+  keys := make([]string, 0, len(stage.Params))
+  for key := range stage.Params {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+
+  params := make([]string, 0, len(keys))
+  for _, key := range keys {
+    params = append(params, fmt.Sprintf("%s=%g", key, stage.Params[key]))
+  }
+  return stage.Name + ":" + strings.Join(params, ",")
+}
+
+// each stage gets its own rng derived from the seed and its position so
+// adding a stage does not change the output of the previous ones
+func ApplyMapStages(mapData *MapData, stages []MapStage, seed int64) error {
+  for i, stage := range stages {
+    resolved, err := stage.resolve()
+    if err != nil {
+      return err
+    }
+    rng := rand.New(rand.NewSource(seed + int64(i+1)*7919))
+    mapStages[resolved.Name].apply(mapData, resolved.Params, rng)
+    mapData.Meta.Stages = append(mapData.Meta.Stages, resolved)
+  }
+  clampHeights(mapData)
+  mapData.resetHash()
+  return nil
+}
+
+func clampHeights(mapData *MapData) {
+  for y := 0; y < mapData.Height; y++ {
+    for x := 0; x < mapData.Width; x++ {
+      mapData.Data[y][x] = max(0, min(float32(mapData.MaxVal), mapData.Data[y][x]))
+    }
+  }
+}
+
+// height and gradient at a fractional position inside the map
+func heightAndGradient(mapData *MapData, x, z float64) (float64, float64, float64) {
+  cx, cz := int(x), int(z)
+  tx, tz := x-float64(cx), z-float64(cz)
+
+  h00 := float64(mapData.Data[cz][cx])
+  h10 := float64(mapData.Data[cz][cx+1])
+  h01 := float64(mapData.Data[cz+1][cx])
+  h11 := float64(mapData.Data[cz+1][cx+1])
+
+  gradX := (h10-h00)*(1-tz) + (h11-h01)*tz
+  gradZ := (h01-h00)*(1-tx) + (h11-h10)*tx
+  height := h00*(1-tx)*(1-tz) + h10*tx*(1-tz) + h01*(1-tx)*tz + h11*tx*tz
+  return height, gradX, gradZ
+}
+
+func depositAt(mapData *MapData, x, z float64, amount float64) {
+  cx, cz := int(x), int(z)
+  tx, tz := x-float64(cx), z-float64(cz)
+  mapData.Data[cz][cx] += float32(amount * (1 - tx) * (1 - tz))
+  mapData.Data[cz][cx+1] += float32(amount * tx * (1 - tz))
+  mapData.Data[cz+1][cx] += float32(amount * (1 - tx) * tz)
+  mapData.Data[cz+1][cx+1] += float32(amount * tx * tz)
+}
+
+// droplet simulation: water runs downhill, picks up sediment when it
+// accelerates and drops it when it slows down or runs uphill
+func hydraulicErosion(mapData *MapData, params map[string]float64, rng *rand.Rand) {
+  if mapData.Width < 3 || mapData.Height < 3 {
+    return
+  }
+  maxX := float64(mapData.Width - 2)
+  maxZ := float64(mapData.Height - 2)
+
+  for droplet := 0; droplet < int(params["droplets"]); droplet++ {
+    x := rng.Float64() * maxX
+    z := rng.Float64() * maxZ
+    dirX, dirZ := 0.0, 0.0
+    speed, water, sediment := 1.0, 1.0, 0.0
+
+    for step := 0; step < int(params["lifetime"]); step++ {
+      height, gradX, gradZ := heightAndGradient(mapData, x, z)
+
+      dirX = dirX*params["inertia"] - gradX*(1-params["inertia"])
+      dirZ = dirZ*params["inertia"] - gradZ*(1-params["inertia"])
+      length := math.Hypot(dirX, dirZ)
+      if length == 0 {
+        break
+      }
+      dirX /= length
+      dirZ /= length
+
+      oldX, oldZ := x, z
+      x += dirX
+      z += dirZ
+      if x < 0 || z < 0 || x >= maxX || z >= maxZ {
+        break
+      }
+
+      newHeight, _, _ := heightAndGradient(mapData, x, z)
+      deltaHeight := newHeight - height
+
+      capacity := max(-deltaHeight*speed*water*params["capacity"], params["minCapacity"])
+      if sediment > capacity || deltaHeight > 0 {
+        amount := (sediment - capacity) * params["deposit"]
+        if deltaHeight > 0 {
+          amount = min(deltaHeight, sediment)
+        }
+        sediment -= amount
+        depositAt(mapData, oldX, oldZ, amount)
+      } else {
+        amount := min((capacity-sediment)*params["erode"], -deltaHeight)
+        sediment += amount
+        depositAt(mapData, oldX, oldZ, -amount)
+      }
+
+      speed = math.Sqrt(max(0, speed*speed+deltaHeight*params["gravity"]))
+      water *= 1 - params["evaporate"]
+    }
+  }
+}
+
+// material slides to lower neighbours while the slope exceeds the talus
+func thermalErosion(mapData *MapData, params map[string]float64, rng *rand.Rand) {
+  talus := float32(params["talus"])
+  rate := float32(params["rate"])
+  offsets := [4][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+
+  delta := make([][]float32, mapData.Height)
+  for y := range delta {
+    delta[y] = make([]float32, mapData.Width)
+  }
+
+  for iteration := 0; iteration < int(params["iterations"]); iteration++ {
+    for y := 0; y < mapData.Height; y++ {
+      for x := 0; x < mapData.Width; x++ {
+        h := mapData.Data[y][x]
+        for _, offset := range offsets {
+          nx, ny := x+offset[0], y+offset[1]
+          if nx < 0 || ny < 0 || nx >= mapData.Width || ny >= mapData.Height {
+            continue
+          }
+          diff := h - mapData.Data[ny][nx]
+          if diff > talus {
+            moved := rate * (diff - talus) / 4
+            delta[y][x] -= moved
+            delta[ny][nx] += moved
+          }
+        }
+      }
+    }
+
+    for y := 0; y < mapData.Height; y++ {
+      for x := 0; x < mapData.Width; x++ {
+        mapData.Data[y][x] += delta[y][x]
+        delta[y][x] = 0
+      }
+    }
+  }
+}
+
+func smoothMap(mapData *MapData, params map[string]float64, rng *rand.Rand) {
+  strength := float32(params["strength"])
+  for iteration := 0; iteration < int(params["iterations"]); iteration++ {
+    smoothed := make([][]float32, mapData.Height)
+    for y := 0; y < mapData.Height; y++ {
+      smoothed[y] = make([]float32, mapData.Width)
+      for x := 0; x < mapData.Width; x++ {
+        var total float32
+        var count float32
+        for dy := -1; dy <= 1; dy++ {
+          for dx := -1; dx <= 1; dx++ {
+            nx, ny := x+dx, y+dy
+            if nx < 0 || ny < 0 || nx >= mapData.Width || ny >= mapData.Height {
+              continue
+            }
+            total += mapData.Data[ny][nx]
+            count++
+          }
+        }
+        h := mapData.Data[y][x]
+        smoothed[y][x] = h + (total/count-h)*strength
+      }
+    }
+    mapData.Data = smoothed
+  }
+}
+
+func terraceMap(mapData *MapData, params map[string]float64, rng *rand.Rand) {
+  levels := params["levels"]
+  if levels < 1 || mapData.MaxVal <= 0 {
+    return
+  }
+  step := float32(float64(mapData.MaxVal) / levels)
+  strength := float32(params["strength"])
+
+  for y := 0; y < mapData.Height; y++ {
+    for x := 0; x < mapData.Width; x++ {
+      h := mapData.Data[y][x]
+      terraced := float32(math.Floor(float64(h/step))) * step
+      mapData.Data[y][x] = h + (terraced-h)*strength
+    }
+  }
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func stagedMap(t *testing.T, seed int64) *MapData {
+  t.Helper()
+  stages, err := ParseMapStages("hydraulic:droplets=500;thermal:iterations=5;smooth;terrace:levels=4")
+  if err != nil {
+    t.Fatal(err)
+  }
+  mapData := NewMapGenerator(nil).GenerateWithSeed(33, 33, 32, 1)
+  if err := ApplyMapStages(mapData, stages, seed); err != nil {
+    t.Fatal(err)
+  }
+  return mapData
+}
+
+func TestMapStagesDeterministicPerSeed(t *testing.T) {
+  first, again := stagedMap(t, 42), stagedMap(t, 42)
+  if first.Hash() != again.Hash() {
+    t.Fatal("the same seed gave different maps")
+  }
+  if other := stagedMap(t, 43); other.Hash() == first.Hash() {
+    t.Fatal("another seed gave the same map")
+  }
+  if len(first.Meta.Stages) != 4 || first.Meta.Stages[0].Params["droplets"] != 500 || first.Meta.Stages[0].Params["lifetime"] != 30 {
+    t.Fatalf("stages saved as %v, expected the effective parameters", first.Meta.Stages)
+  }
+}
+
+func TestParseMapStagesRejectsUnknown(t *testing.T) {
+  for _, spec := range []string{"melt", "smooth:radius=2", "smooth:strength", "terrace:levels=many"} {
+    if _, err := ParseMapStages(spec); err == nil {
+      t.Errorf("stages %q accepted", spec)
+    }
+  }
+}
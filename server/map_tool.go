@@ -0,0 +1,478 @@
+//go:build rtgsmap
+
+package main
+
+import (
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+const mapToolUsage = `Usage: rtgs-map <command> [options]
+
+Commands:
+  generate -seed N -width W -height H -max M [-encoding E] [-stages S] [-objects=false] -out FILE
+  info     FILE
+  preview  [-color] FILE OUT.png
+  diff     [-epsilon E] FILE_A FILE_B
+  convert  [-max M] [-encoding E] IN OUT   (.bin <-> .png/.pgm, .bin -> .bin)
+  mesh     [-step N] [-colors] FILE OUT.obj
+  import   [-max M] [-scale S] [-sea L] [-width W] [-height H] [-seed N] [-encoding E] [-objects=false] IMAGE OUT
+  portal   -name N -x X -z Z -radius R -zone TARGET -target X,Y,Z FILE
+  trigger  -name N [-kind K] -shape box|sphere -center X,Y,Z [-size X,Y,Z] [-radius R] FILE
+  trigger  -name N -remove FILE
+
+Encodings: raw, deflate, q8, q8+deflate, q16, q16+deflate (default)
+Stages:    hydraulic, thermal, smooth, terrace with optional parameters,
+           e.g. "hydraulic:droplets=50000;thermal:talus=0.8;smooth"
+`
+
+// returned by diff when the maps differ, the tool exits with 1 like diff(1)
+var errMapsDiffer = errors.New("maps differ")
+
+func main() {
+  if len(os.Args) < 2 {
+    fmt.Print(mapToolUsage)
+    os.Exit(2)
+  }
+
+  var err error
+  switch os.Args[1] {
+  case "generate":
+    err = runGenerate(os.Args[2:])
+  case "info":
+    err = runInfo(os.Args[2:])
+  case "preview":
+    err = runPreview(os.Args[2:])
+  case "diff":
+    err = runDiff(os.Args[2:])
+  case "convert":
+    err = runConvert(os.Args[2:])
+  case "mesh":
+    err = runMesh(os.Args[2:])
+  case "import":
+    err = runImport(os.Args[2:])
+  case "portal":
+    err = runPortal(os.Args[2:])
+  case "trigger":
+    err = runTrigger(os.Args[2:])
+  case "help", "-h", "--help":
+    fmt.Print(mapToolUsage)
+    return
+  default:
+    fmt.Printf("Unknown command: %s\n\n", os.Args[1])
+    fmt.Print(mapToolUsage)
+    os.Exit(2)
+  }
+
+  if errors.Is(err, errMapsDiffer) {
+    os.Exit(1)
+  }
+  if err != nil {
+    fmt.Printf("Error: %v\n", err)
+    os.Exit(1)
+  }
+}
+
+func parseArgs(flags *flag.FlagSet, args []string, count int) ([]string, error) {
+  if err := flags.Parse(args); err != nil {
+    return nil, err
+  }
+  if flags.NArg() != count {
+    return nil, fmt.Errorf("%s expects %d argument(s), got %d", flags.Name(), count, flags.NArg())
+  }
+  return flags.Args(), nil
+}
+
+func runGenerate(args []string) error {
+  flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+  seed := flags.Int64("seed", 1, "generator seed")
+  width := flags.Int("width", 128, "map width")
+  height := flags.Int("height", 128, "map height")
+  maxVal := flags.Int("max", 32, "maximum height")
+  out := flags.String("out", "data/map0.bin", "output file")
+  encodingName := flags.String("encoding", EncodingCompressed.String(), "map file encoding")
+  stagesSpec := flags.String("stages", "", "post-processing stages")
+  objects := flags.Bool("objects", true, "place trees, rocks and structures")
+  if _, err := parseArgs(flags, args, 0); err != nil {
+    return err
+  }
+
+  mg, err := newToolGenerator(*encodingName)
+  if err != nil {
+    return err
+  }
+  stages, err := ParseMapStages(*stagesSpec)
+  if err != nil {
+    return err
+  }
+  if err := mg.SetStages(stages); err != nil {
+    return err
+  }
+  if !*objects {
+    mg.SetPlacementRules(nil)
+  }
+  mapData := mg.GenerateWithSeed(*width, *height, *maxVal, *seed)
+  if err := mg.SaveToFile(mapData, *out); err != nil {
+    return err
+  }
+
+  fmt.Printf("Map %dx%d (seed: %d) saved at %s\n", *width, *height, *seed, *out)
+  return nil
+}
+
+func newToolGenerator(encodingName string) (*MapGenerator, error) {
+  encoding, err := ParseMapEncoding(encodingName)
+  if err != nil {
+    return nil, err
+  }
+  mg := NewMapGenerator(NewEventManager())
+  mg.SetEncoding(encoding)
+  return mg, nil
+}
+
+func runInfo(args []string) error {
+  flags := flag.NewFlagSet("info", flag.ContinueOnError)
+  files, err := parseArgs(flags, args, 1)
+  if err != nil {
+    return err
+  }
+
+  mapData, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+
+  stats := mapData.Stats()
+  fmt.Printf("File:     %s\n", files[0])
+  fmt.Printf("Encoding: %s\n", mapData.Encoding)
+  fmt.Printf("Size:     %dx%d\n", mapData.Width, mapData.Height)
+  fmt.Printf("MaxVal:   %d\n", mapData.MaxVal)
+  fmt.Printf("Min:      %.3f\n", stats.Min)
+  fmt.Printf("Max:      %.3f\n", stats.Max)
+  fmt.Printf("Mean:     %.3f\n", stats.Mean)
+  fmt.Printf("Checksum: %s\n", mapData.Hash())
+  if mapData.Meta.Seed != 0 {
+    fmt.Printf("Seed:     %d\n", mapData.Meta.Seed)
+  }
+  for _, stage := range mapData.Meta.Stages {
+    fmt.Printf("Stage:    %s\n", stage)
+  }
+  if mapData.Layers != nil {
+    counts := map[string]int{}
+    for _, row := range mapData.Layers {
+      for _, cell := range row {
+        counts[BiomeName(cell.Biome)]++
+      }
+    }
+    fmt.Printf("Biomes:   %v\n", counts)
+  }
+  if len(mapData.Meta.Objects) > 0 {
+    counts := map[string]int{}
+    for _, object := range mapData.Meta.Objects {
+      counts[object.Kind]++
+    }
+    fmt.Printf("Objects:  %d %v\n", len(mapData.Meta.Objects), counts)
+  }
+  for _, portal := range mapData.Meta.Portals {
+    fmt.Printf("Portal:   %s at (%.1f, %.1f) r=%.1f -> %s (%.1f, %.1f, %.1f)\n",
+      portal.Name, portal.X, portal.Z, portal.Radius, portal.TargetZone,
+      portal.Target[0], portal.Target[1], portal.Target[2])
+  }
+  for _, trigger := range mapData.Meta.Triggers {
+    fmt.Printf("Trigger:  %s (%s) %s at (%.1f, %.1f, %.1f)\n", trigger.Name, trigger.Kind, trigger.Shape,
+      trigger.Center[0], trigger.Center[1], trigger.Center[2])
+  }
+  return nil
+}
+
+func runPreview(args []string) error {
+  flags := flag.NewFlagSet("preview", flag.ContinueOnError)
+  colored := flags.Bool("color", false, "color by biome or height instead of grayscale")
+  files, err := parseArgs(flags, args, 2)
+  if err != nil {
+    return err
+  }
+
+  mapData, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+
+  if strings.ToLower(filepath.Ext(files[1])) != ".png" {
+    return fmt.Errorf("preview output must be a .png file")
+  }
+  if err := SaveHeightmapImage(mapData, files[1], *colored); err != nil {
+    return err
+  }
+
+  fmt.Printf("Preview saved at %s\n", files[1])
+  return nil
+}
+
+func runDiff(args []string) error {
+  flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+  epsilon := flags.Float64("epsilon", 0, "ignore differences up to this value")
+  files, err := parseArgs(flags, args, 2)
+  if err != nil {
+    return err
+  }
+
+  a, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+  b, err := LoadMapFromFile(files[1])
+  if err != nil {
+    return err
+  }
+
+  diff, err := DiffMaps(a, b, float32(*epsilon))
+  if err != nil {
+    return err
+  }
+
+  fmt.Printf("Changed cells: %d / %d\n", diff.ChangedCells, diff.Cells)
+  fmt.Printf("Max diff:      %.3f\n", diff.MaxAbsDiff)
+  fmt.Printf("Mean diff:     %.3f\n", diff.MeanAbsDiff)
+  if diff.ChangedCells > 0 {
+    return errMapsDiffer
+  }
+  return nil
+}
+
+func runConvert(args []string) error {
+  flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+  maxVal := flags.Int("max", 32, "maximum height when importing an image")
+  encodingName := flags.String("encoding", EncodingCompressed.String(), "map file encoding")
+  files, err := parseArgs(flags, args, 2)
+  if err != nil {
+    return err
+  }
+  in, out := files[0], files[1]
+
+  inBin := strings.ToLower(filepath.Ext(in)) == ".bin"
+  outBin := strings.ToLower(filepath.Ext(out)) == ".bin"
+
+  mg, err := newToolGenerator(*encodingName)
+  if err != nil {
+    return err
+  }
+
+  switch {
+  case inBin && outBin:
+    mapData, err := LoadMapFromFile(in)
+    if err != nil {
+      return err
+    }
+    if err := mg.SaveToFile(mapData, out); err != nil {
+      return err
+    }
+  case inBin && !outBin:
+    mapData, err := LoadMapFromFile(in)
+    if err != nil {
+      return err
+    }
+    if err := SaveHeightmapImage(mapData, out, false); err != nil {
+      return err
+    }
+  case !inBin && outBin:
+    mapData, err := ImportHeightmap(in, HeightmapImport{MaxVal: *maxVal})
+    if err != nil {
+      return err
+    }
+    if err := mg.SaveToFile(mapData, out); err != nil {
+      return err
+    }
+  default:
+    return fmt.Errorf("convert needs at least one .bin file")
+  }
+
+  fmt.Printf("Converted %s to %s\n", in, out)
+  return nil
+}
+
+func runMesh(args []string) error {
+  flags := flag.NewFlagSet("mesh", flag.ContinueOnError)
+  step := flags.Int("step", 1, "keep every n-th sample")
+  colors := flags.Bool("colors", false, "add vertex colors by height")
+  files, err := parseArgs(flags, args, 2)
+  if err != nil {
+    return err
+  }
+
+  mapData, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+  if strings.ToLower(filepath.Ext(files[1])) != ".obj" {
+    return fmt.Errorf("mesh output must be a .obj file")
+  }
+  if err := SaveMeshOBJ(mapData, files[1], MeshExport{Step: *step, Colors: *colors}); err != nil {
+    return err
+  }
+
+  fmt.Printf("Mesh saved at %s\n", files[1])
+  return nil
+}
+
+// unlike convert, imported maps get layers and objects like generated ones
+func runImport(args []string) error {
+  flags := flag.NewFlagSet("import", flag.ContinueOnError)
+  maxVal := flags.Int("max", 32, "maximum height")
+  scale := flags.Float64("scale", 0, "height of a white pixel, defaults to -max")
+  seaLevel := flags.Float64("sea", 0, "cells below this height become water")
+  width := flags.Int("width", 0, "resample to this width")
+  height := flags.Int("height", 0, "resample to this height")
+  seed := flags.Int64("seed", 0, "seed of the layers and objects")
+  encodingName := flags.String("encoding", EncodingCompressed.String(), "map file encoding")
+  objects := flags.Bool("objects", true, "place trees, rocks and structures")
+  files, err := parseArgs(flags, args, 2)
+  if err != nil {
+    return err
+  }
+
+  mg, err := newToolGenerator(*encodingName)
+  if err != nil {
+    return err
+  }
+  if !*objects {
+    mg.SetPlacementRules(nil)
+  }
+
+  mapData, err := mg.Import(files[0], HeightmapImport{
+    MaxVal:   *maxVal,
+    Scale:    float32(*scale),
+    SeaLevel: float32(*seaLevel),
+    Width:    *width,
+    Height:   *height,
+  }, *seed)
+  if err != nil {
+    return err
+  }
+  if err := mg.SaveToFile(mapData, files[1]); err != nil {
+    return err
+  }
+
+  fmt.Printf("Imported %s (%dx%d) to %s\n", files[0], mapData.Width, mapData.Height, files[1])
+  return nil
+}
+
+// adds or replaces a portal in the map metadata, keeping the file encoding
+func runPortal(args []string) error {
+  flags := flag.NewFlagSet("portal", flag.ContinueOnError)
+  name := flags.String("name", "", "portal name")
+  x := flags.Float64("x", 0, "portal center x")
+  z := flags.Float64("z", 0, "portal center z")
+  radius := flags.Float64("radius", 1, "portal radius")
+  zone := flags.String("zone", "", "target zone")
+  target := flags.String("target", "0,0,0", "target location x,y,z")
+  files, err := parseArgs(flags, args, 1)
+  if err != nil {
+    return err
+  }
+  if *name == "" || *zone == "" {
+    return fmt.Errorf("portal needs -name and -zone")
+  }
+
+  portal := Portal{
+    Name:       *name,
+    X:          float32(*x),
+    Z:          float32(*z),
+    Radius:     float32(*radius),
+    TargetZone: *zone,
+  }
+  if _, err := fmt.Sscanf(*target, "%f,%f,%f", &portal.Target[0], &portal.Target[1], &portal.Target[2]); err != nil {
+    return fmt.Errorf("invalid target %q: %v", *target, err)
+  }
+
+  mapData, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+
+  portals := mapData.Meta.Portals[:0]
+  for _, existing := range mapData.Meta.Portals {
+    if existing.Name != portal.Name {
+      portals = append(portals, existing)
+    }
+  }
+  mapData.Meta.Portals = append(portals, portal)
+
+  mg := NewMapGenerator(NewEventManager())
+  mg.SetEncoding(mapData.Encoding)
+  if err := mg.SaveToFile(mapData, files[0]); err != nil {
+    return err
+  }
+
+  fmt.Printf("Portal %s saved in %s\n", portal.Name, files[0])
+  return nil
+}
+
+// adds, replaces or removes a trigger volume in the map metadata
+func runTrigger(args []string) error {
+  flags := flag.NewFlagSet("trigger", flag.ContinueOnError)
+  name := flags.String("name", "", "trigger name")
+  kind := flags.String("kind", "", "gameplay kind, e.g. spawn, safe, goal, kill")
+  shape := flags.String("shape", TriggerBox, "box or sphere")
+  center := flags.String("center", "0,0,0", "center x,y,z")
+  size := flags.String("size", "1,1,1", "box size x,y,z")
+  radius := flags.Float64("radius", 1, "sphere radius")
+  remove := flags.Bool("remove", false, "remove the trigger instead")
+  files, err := parseArgs(flags, args, 1)
+  if err != nil {
+    return err
+  }
+
+  trigger := Trigger{Name: *name, Kind: *kind, Shape: *shape}
+  if !*remove {
+    if _, err := fmt.Sscanf(*center, "%f,%f,%f", &trigger.Center[0], &trigger.Center[1], &trigger.Center[2]); err != nil {
+      return fmt.Errorf("invalid center %q: %v", *center, err)
+    }
+    switch trigger.Shape {
+    case TriggerBox:
+      if _, err := fmt.Sscanf(*size, "%f,%f,%f", &trigger.Size[0], &trigger.Size[1], &trigger.Size[2]); err != nil {
+        return fmt.Errorf("invalid size %q: %v", *size, err)
+      }
+    case TriggerSphere:
+      trigger.Radius = float32(*radius)
+    }
+    if err := trigger.validate(); err != nil {
+      return err
+    }
+  } else if *name == "" {
+    return fmt.Errorf("trigger needs -name")
+  }
+
+  mapData, err := LoadMapFromFile(files[0])
+  if err != nil {
+    return err
+  }
+
+  triggers := mapData.Meta.Triggers[:0]
+  for _, existing := range mapData.Meta.Triggers {
+    if existing.Name != trigger.Name {
+      triggers = append(triggers, existing)
+    }
+  }
+  if !*remove {
+    triggers = append(triggers, trigger)
+  }
+  mapData.Meta.Triggers = triggers
+
+  mg := NewMapGenerator(NewEventManager())
+  mg.SetEncoding(mapData.Encoding)
+  if err := mg.SaveToFile(mapData, files[0]); err != nil {
+    return err
+  }
+
+  if *remove {
+    fmt.Printf("Trigger %s removed from %s\n", trigger.Name, files[0])
+  } else {
+    fmt.Printf("Trigger %s saved in %s\n", trigger.Name, files[0])
+  }
+  return nil
+}
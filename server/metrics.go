@@ -0,0 +1,273 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "math"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// metrics in the prometheus text exposition format, without the client
+// library: counters and histograms with at most one label are all we need
+
+type Counter struct {
+  value atomic.Uint64
+}
+
+func (counter *Counter) Add(n int) {
+  counter.value.Add(uint64(n))
+}
+
+func (counter *Counter) Inc() {
+  counter.Add(1)
+}
+
+type CounterVec struct {
+  mu       sync.Mutex
+  counters map[string]*Counter
+}
+
+func (vec *CounterVec) With(label string) *Counter {
+  vec.mu.Lock()
+  defer vec.mu.Unlock()
+  if vec.counters == nil {
+    vec.counters = make(map[string]*Counter)
+  }
+  counter, ok := vec.counters[label]
+  if !ok {
+    counter = &Counter{}
+    vec.counters[label] = counter
+  }
+  return counter
+}
+
+// seconds
+var defaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type Histogram struct {
+  mu      sync.Mutex
+  buckets []float64
+  counts  []uint64
+  sum     float64
+  count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+  return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+  histogram.mu.Lock()
+  defer histogram.mu.Unlock()
+  for i, bound := range histogram.buckets {
+    if value <= bound {
+      histogram.counts[i]++
+    }
+  }
+  histogram.sum += value
+  histogram.count++
+}
+
+func (histogram *Histogram) ObserveSince(start time.Time) {
+  histogram.Observe(time.Since(start).Seconds())
+}
+
+type HistogramVec struct {
+  buckets []float64
+
+  mu         sync.Mutex
+  histograms map[string]*Histogram
+}
+
+func (vec *HistogramVec) With(label string) *Histogram {
+  vec.mu.Lock()
+  defer vec.mu.Unlock()
+  if vec.histograms == nil {
+    vec.histograms = make(map[string]*Histogram)
+  }
+  histogram, ok := vec.histograms[label]
+  if !ok {
+    histogram = newHistogram(vec.buckets)
+    vec.histograms[label] = histogram
+  }
+  return histogram
+}
+
+var (
+  packetsIn        = &Counter{}
+  packetsOut       = &Counter{}
+  bytesIn          = &Counter{}
+  bytesOut         = &Counter{}
+  malformedPackets = &Counter{}
+  sendErrors       = &Counter{}
+
+  // label: task (portals, triggers)
+  tickDuration      = &HistogramVec{buckets: defaultBuckets}
+  broadcastDuration = newHistogram(defaultBuckets)
+  // label: event type
+  eventsDispatched = &CounterVec{}
+  // label: event type
+  eventHandlerPanics = &CounterVec{}
+  // label: event type
+  eventsDropped = &CounterVec{}
+  // label: kind (map, chunk, import)
+  mapGenerationDuration = &HistogramVec{buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30}}
+)
+
+type metricsWriter struct {
+  w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+  fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw metricsWriter) sample(name, labels string, value float64) {
+  if labels != "" {
+    labels = "{" + labels + "}"
+  }
+  fmt.Fprintf(mw.w, "%s%s %s\n", name, labels, formatMetricValue(value))
+}
+
+func formatMetricValue(value float64) string {
+  if math.IsInf(value, 1) {
+    return "+Inf"
+  }
+  return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func labelPair(name, value string) string {
+  value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+  return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+func (mw metricsWriter) counter(name, help string, counter *Counter) {
+  mw.header(name, "counter", help)
+  mw.sample(name, "", float64(counter.value.Load()))
+}
+
+func (mw metricsWriter) counterVec(name, help, label string, vec *CounterVec) {
+  mw.header(name, "counter", help)
+  vec.mu.Lock()
+  defer vec.mu.Unlock()
+  for _, key := range sortedKeys(vec.counters) {
+    mw.sample(name, labelPair(label, key), float64(vec.counters[key].value.Load()))
+  }
+}
+
+func (mw metricsWriter) histogramSamples(name, labels string, histogram *Histogram) {
+  histogram.mu.Lock()
+  defer histogram.mu.Unlock()
+  prefix := labels
+  if prefix != "" {
+    prefix += ","
+  }
+  for i, bound := range histogram.buckets {
+    mw.sample(name+"_bucket", prefix+labelPair("le", formatMetricValue(bound)), float64(histogram.counts[i]))
+  }
+  mw.sample(name+"_bucket", prefix+labelPair("le", "+Inf"), float64(histogram.count))
+  mw.sample(name+"_sum", labels, histogram.sum)
+  mw.sample(name+"_count", labels, float64(histogram.count))
+}
+
+func (mw metricsWriter) histogram(name, help string, histogram *Histogram) {
+  mw.header(name, "histogram", help)
+  mw.histogramSamples(name, "", histogram)
+}
+
+func (mw metricsWriter) histogramVec(name, help, label string, vec *HistogramVec) {
+  mw.header(name, "histogram", help)
+  vec.mu.Lock()
+  defer vec.mu.Unlock()
+  for _, key := range sortedKeys(vec.histograms) {
+    mw.histogramSamples(name, labelPair(label, key), vec.histograms[key])
+  }
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+  keys := make([]string, 0, len(values))
+  for key := range values {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+func (server *Server) clientsByType() map[string]int {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  counts := map[string]int{string(UserTypePlayer): 0, string(UserTypeBot): 0, string(UserTypeAdmin): 0}
+  for _, client := range server.clients {
+    if client.user != nil {
+      counts[string(client.user.userType)]++
+    }
+  }
+  return counts
+}
+
+func (server *Server) WriteMetrics(w io.Writer) error {
+  mw := metricsWriter{bufio.NewWriter(w)}
+
+  mw.header("rtgs_clients", "gauge", "Connected clients by user type.")
+  clients := server.clientsByType()
+  for _, userType := range sortedKeys(clients) {
+    mw.sample("rtgs_clients", labelPair("user_type", userType), float64(clients[userType]))
+  }
+
+  mw.counter("rtgs_packets_received_total", "Datagrams received.", packetsIn)
+  mw.counter("rtgs_packets_sent_total", "Datagrams sent.", packetsOut)
+  mw.counter("rtgs_bytes_received_total", "Bytes received.", bytesIn)
+  mw.counter("rtgs_bytes_sent_total", "Bytes sent.", bytesOut)
+  mw.counter("rtgs_malformed_packets_total", "Datagrams that are not valid JSON messages.", malformedPackets)
+  mw.counter("rtgs_send_errors_total", "Datagrams that could not be sent.", sendErrors)
+  mw.histogramVec("rtgs_tick_duration_seconds", "Duration of the game tick tasks.", "task", tickDuration)
+  mw.histogram("rtgs_broadcast_duration_seconds", "Duration of the world state broadcasts.", broadcastDuration)
+  mw.counterVec("rtgs_events_dispatched_total", "Events dispatched by type.", "type", eventsDispatched)
+  mw.counterVec("rtgs_event_handler_panics_total", "Event handlers that panicked, by event type.", "type", eventHandlerPanics)
+  mw.counterVec("rtgs_events_dropped_total", "Events dropped because the queues were full or closed.", "type", eventsDropped)
+  mw.header("rtgs_event_queue_depth", "gauge", "Events waiting in each event worker queue.")
+  depths := server.eventManager.QueueDepths()
+  for _, worker := range sortedKeys(depths) {
+    mw.sample("rtgs_event_queue_depth", labelPair("worker", worker), float64(depths[worker]))
+  }
+  mw.histogramVec("rtgs_map_generation_seconds", "Duration of map, chunk and import generation.", "kind", mapGenerationDuration)
+
+  return mw.w.Flush()
+}
+
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  if err := server.WriteMetrics(w); err != nil {
+    netLog.Warn("metrics not written", "err", err)
+  }
+}
+
+// serves /metrics on the configured address, an empty address disables it
+func (server *Server) startMetrics() {
+  if server.config.MetricsAddress == "" {
+    return
+  }
+  listener, err := net.Listen("tcp", server.config.MetricsAddress)
+  if err != nil {
+    netLog.Error("metrics listener not started", "addr", server.config.MetricsAddress, "err", err)
+    return
+  }
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", server.handleMetrics)
+  netLog.Info("metrics listening", "addr", listener.Addr().String())
+  go func() {
+    if err := http.Serve(listener, mux); err != nil {
+      netLog.Error("metrics listener stopped", "err", err)
+    }
+  }()
+}
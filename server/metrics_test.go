@@ -0,0 +1,88 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "net"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+// samples by name and labels, e.g. rtgs_clients{user_type="bot"}
+func scrapeMetrics(t *testing.T, server *Server) map[string]float64 {
+  t.Helper()
+  recorder := httptest.NewRecorder()
+  server.handleMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+  if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+    t.Fatalf("content type %q", contentType)
+  }
+
+  samples := make(map[string]float64)
+  for _, line := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n") {
+    if strings.HasPrefix(line, "#") {
+      continue
+    }
+    cut := strings.LastIndex(line, " ")
+    value, err := strconv.ParseFloat(line[cut+1:], 64)
+    if err != nil {
+      t.Fatalf("sample %q: %v", line, err)
+    }
+    samples[line[:cut]] = value
+  }
+  return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+  server := newTestServer(t)
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  server.SpawnBot()
+
+  before := scrapeMetrics(t, server)
+  server.handleDatagram(addr, []byte(`not json`))
+  server.runTick()
+  after := scrapeMetrics(t, server)
+
+  for userType, want := range map[string]float64{"player": 1, "bot": 1, "admin": 0} {
+    if got := after[`rtgs_clients{user_type="`+userType+`"}`]; got != want {
+      t.Errorf("%g %s clients, expected %g", got, userType, want)
+    }
+  }
+  for name, want := range map[string]float64{
+    "rtgs_malformed_packets_total":                             1,
+    `rtgs_tick_duration_seconds_count{task="portals"}`:         1,
+    `rtgs_tick_duration_seconds_bucket{task="bots",le="+Inf"}`: 1,
+  } {
+    if got := after[name] - before[name]; got != want {
+      t.Errorf("%s went up by %g, expected %g", name, got, want)
+    }
+  }
+}
+
+func TestHistogramBucketsCumulative(t *testing.T) {
+  histogram := newHistogram([]float64{0.1, 1})
+  for _, value := range []float64{0.05, 0.5, 0.5, 3} {
+    histogram.Observe(value)
+  }
+  var out bytes.Buffer
+  mw := metricsWriter{bufio.NewWriter(&out)}
+  mw.histogram("rtgs_test_seconds", "Test \"durations\".", histogram)
+  mw.w.Flush()
+
+  want := `# HELP rtgs_test_seconds Test "durations".
+# TYPE rtgs_test_seconds histogram
+rtgs_test_seconds_bucket{le="0.1"} 1
+rtgs_test_seconds_bucket{le="1"} 3
+rtgs_test_seconds_bucket{le="+Inf"} 4
+rtgs_test_seconds_sum 4.05
+rtgs_test_seconds_count 4
+`
+  if out.String() != want {
+    t.Fatalf("histogram written as\n%s\nexpected\n%s", out.String(), want)
+  }
+  if pair := labelPair("map", "a\"b\\c\nd"); pair != `map="a\"b\\c\nd"` {
+    t.Fatalf("label written as %s", pair)
+  }
+}
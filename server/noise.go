@@ -0,0 +1,54 @@
+package main
+
+import (
+  "math"
+)
+
+func hashLattice(seed int64, x, z int64) uint64 {
+  h := uint64(seed)*0x9E3779B97F4A7C15 ^ uint64(x)*0xBF58476D1CE4E5B9 ^ uint64(z)*0x94D049BB133111EB
+  h ^= h >> 31
+  h *= 0xD6E8FEB86659FD93
+  h ^= h >> 32
+  return h
+}
+
+func latticeValue(seed int64, x, z int64) float64 {
+  return float64(hashLattice(seed, x, z)>>11) / float64(1<<53)
+}
+
+func smoothstep(t float64) float64 {
+  return t * t * (3 - 2*t)
+}
+
+// value noise in [0, 1]
+func valueNoise(seed int64, x, z float64) float64 {
+  x0 := math.Floor(x)
+  z0 := math.Floor(z)
+  tx := smoothstep(x - x0)
+  tz := smoothstep(z - z0)
+  ix, iz := int64(x0), int64(z0)
+
+  v00 := latticeValue(seed, ix, iz)
+  v10 := latticeValue(seed, ix+1, iz)
+  v01 := latticeValue(seed, ix, iz+1)
+  v11 := latticeValue(seed, ix+1, iz+1)
+
+  top := v00 + (v10-v00)*tx
+  bottom := v01 + (v11-v01)*tx
+  return top + (bottom-top)*tz
+}
+
+// fractal sum of value noise octaves, in [0, 1]
+func fractalNoise(seed int64, x, z float64, octaves int, scale float64) float64 {
+  total := 0.0
+  amplitude := 1.0
+  norm := 0.0
+  frequency := 1.0 / scale
+  for i := 0; i < octaves; i++ {
+    total += valueNoise(seed+int64(i), x*frequency, z*frequency) * amplitude
+    norm += amplitude
+    amplitude *= 0.5
+    frequency *= 2
+  }
+  return total / norm
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+  "container/heap"
+  "errors"
+  "math"
+  "sync"
+)
+
+const (
+  // extra cost per unit of slope, steeper paths are longer
+  slopeCostWeight  = 2.0
+  maxSearchNodes   = 200000
+  maxCachedPaths   = 1024
+  smoothSampleStep = 0.5
+)
+
+var (
+  ErrNoMap       = errors.New("no map to search")
+  ErrOutOfMap    = errors.New("start or goal outside of the map")
+  ErrNoPath      = errors.New("no path found")
+  ErrPathTooLong = errors.New("path longer than the allowed length")
+)
+
+type gridCell struct {
+  x int
+  z int
+}
+
+type pathKey struct {
+  from      gridCell
+  to        gridCell
+  maxLength float32
+}
+
+// A* over the cells of a map, safe for concurrent use, results are cached
+// until the map of the source changes
+type Pathfinder struct {
+  source func() (*MapData, error)
+
+  mu      sync.Mutex
+  mapData *MapData
+  blocked map[gridCell]bool
+  cache   map[pathKey][]Vector3
+}
+
+func NewPathfinder(source func() (*MapData, error)) *Pathfinder {
+  return &Pathfinder{
+    source: source,
+    cache:  make(map[pathKey][]Vector3),
+  }
+}
+
+func (pf *Pathfinder) Invalidate() {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  pf.cache = make(map[pathKey][]Vector3)
+}
+
+// current map and its cells covered by objects, the cache is dropped when
+// the map was replaced
+func (pf *Pathfinder) currentMap() (*MapData, map[gridCell]bool, error) {
+  mapData, err := pf.source()
+  if err != nil || mapData == nil {
+    return nil, nil, ErrNoMap
+  }
+
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  if pf.mapData != mapData {
+    pf.mapData = mapData
+    pf.blocked = blockedCells(mapData)
+    pf.cache = make(map[pathKey][]Vector3)
+  }
+  return mapData, pf.blocked, nil
+}
+
+func blockedCells(mapData *MapData) map[gridCell]bool {
+  blocked := map[gridCell]bool{}
+  for _, object := range mapData.Meta.Objects {
+    reach := object.Radius + userRadius
+    for z := int(math.Floor(float64(object.Z - reach))); z <= int(math.Ceil(float64(object.Z+reach))); z++ {
+      for x := int(math.Floor(float64(object.X - reach))); x <= int(math.Ceil(float64(object.X+reach))); x++ {
+        dx, dz := float32(x)-object.X, float32(z)-object.Z
+        if dx*dx+dz*dz < reach*reach {
+          blocked[gridCell{x: x, z: z}] = true
+        }
+      }
+    }
+  }
+  return blocked
+}
+
+// maxLength <= 0 means unlimited, the returned waypoints are on the ground
+func (pf *Pathfinder) FindPath(from, to Vector3, maxLength float32) ([]Vector3, error) {
+  mapData, blocked, err := pf.currentMap()
+  if err != nil {
+    return nil, err
+  }
+
+  start := gridCell{x: int(math.Round(float64(from.x))), z: int(math.Round(float64(from.z)))}
+  goal := gridCell{x: int(math.Round(float64(to.x))), z: int(math.Round(float64(to.z)))}
+  if !mapData.cellInBounds(start) || !mapData.cellInBounds(goal) {
+    return nil, ErrOutOfMap
+  }
+
+  key := pathKey{from: start, to: goal, maxLength: maxLength}
+  pf.mu.Lock()
+  cached, ok := pf.cache[key]
+  pf.mu.Unlock()
+  if ok {
+    return append([]Vector3(nil), cached...), nil
+  }
+
+  cells, err := searchPath(mapData, blocked, start, goal, maxLength)
+  if err != nil {
+    return nil, err
+  }
+  path := smoothPath(mapData, cells)
+
+  pf.mu.Lock()
+  if pf.mapData == mapData {
+    if len(pf.cache) >= maxCachedPaths {
+      pf.cache = make(map[pathKey][]Vector3)
+    }
+    pf.cache[key] = path
+  }
+  pf.mu.Unlock()
+
+  return append([]Vector3(nil), path...), nil
+}
+
+func (mapData *MapData) cellInBounds(cell gridCell) bool {
+  return cell.x >= 0 && cell.z >= 0 && cell.x < mapData.Width && cell.z < mapData.Height
+}
+
+func (mapData *MapData) cellHeight(cell gridCell) float32 {
+  return mapData.Data[cell.z][cell.x]
+}
+
+// cost of a step between two neighbour cells, slower ground costs more,
+// false when too steep
+func stepCost(mapData *MapData, from, to gridCell) (float64, bool) {
+  dist := math.Hypot(float64(to.x-from.x), float64(to.z-from.z))
+  slope := math.Abs(float64(mapData.cellHeight(to)-mapData.cellHeight(from))) / dist
+  if slope > maxWalkableSlope {
+    return 0, false
+  }
+  speed := float64(1)
+  if mapData.Layers != nil {
+    speed = float64(MaterialSpeed(mapData.Layers[to.z][to.x].Material))
+  }
+  return dist * (1 + slopeCostWeight*slope) / speed, true
+}
+
+type searchNode struct {
+  cell  gridCell
+  g     float64
+  f     float64
+  index int
+}
+
+type openSet []*searchNode
+
+func (set openSet) Len() int           { return len(set) }
+func (set openSet) Less(i, j int) bool { return set[i].f < set[j].f }
+func (set openSet) Swap(i, j int) {
+  set[i], set[j] = set[j], set[i]
+  set[i].index = i
+  set[j].index = j
+}
+func (set *openSet) Push(x interface{}) {
+  node := x.(*searchNode)
+  node.index = len(*set)
+  *set = append(*set, node)
+}
+func (set *openSet) Pop() interface{} {
+  old := *set
+  node := old[len(old)-1]
+  *set = old[:len(old)-1]
+  return node
+}
+
+var neighbourOffsets = [8]gridCell{
+  {1, 0}, {-1, 0}, {0, 1}, {0, -1},
+  {1, 1}, {1, -1}, {-1, 1}, {-1, -1},
+}
+
+func searchPath(mapData *MapData, blocked map[gridCell]bool, start, goal gridCell, maxLength float32) ([]gridCell, error) {
+  heuristic := func(cell gridCell) float64 {
+    return math.Hypot(float64(goal.x-cell.x), float64(goal.z-cell.z))
+  }
+
+  if maxLength > 0 && heuristic(start) > float64(maxLength) {
+    return nil, ErrPathTooLong
+  }
+
+  nodes := map[gridCell]*searchNode{}
+  cameFrom := map[gridCell]gridCell{}
+  closed := map[gridCell]bool{}
+
+  startNode := &searchNode{cell: start, g: 0, f: heuristic(start)}
+  nodes[start] = startNode
+  open := &openSet{}
+  heap.Push(open, startNode)
+
+  pruned := false
+  for open.Len() > 0 {
+    current := heap.Pop(open).(*searchNode)
+    if current.cell == goal {
+      return rebuildPath(cameFrom, start, goal), nil
+    }
+    closed[current.cell] = true
+    if len(closed) > maxSearchNodes {
+      break
+    }
+
+    for _, offset := range neighbourOffsets {
+      next := gridCell{x: current.cell.x + offset.x, z: current.cell.z + offset.z}
+      if !mapData.cellInBounds(next) || closed[next] || blocked[next] {
+        continue
+      }
+      cost, ok := stepCost(mapData, current.cell, next)
+      if !ok || !cornerWalkable(mapData, blocked, current.cell, offset) {
+        continue
+      }
+
+      g := current.g + cost
+      if maxLength > 0 && g > float64(maxLength) {
+        pruned = true
+        continue
+      }
+
+      node, seen := nodes[next]
+      if seen && g >= node.g {
+        continue
+      }
+      cameFrom[next] = current.cell
+      if !seen {
+        node = &searchNode{cell: next}
+        nodes[next] = node
+        node.g = g
+        node.f = g + heuristic(next)
+        heap.Push(open, node)
+      } else {
+        node.g = g
+        node.f = g + heuristic(next)
+        heap.Fix(open, node.index)
+      }
+    }
+  }
+
+  if pruned {
+    return nil, ErrPathTooLong
+  }
+  return nil, ErrNoPath
+}
+
+// diagonal steps cross the terrain between both side cells, they must be
+// walkable too
+func cornerWalkable(mapData *MapData, blocked map[gridCell]bool, from, offset gridCell) bool {
+  if offset.x == 0 || offset.z == 0 {
+    return true
+  }
+  for _, side := range [2]gridCell{{x: from.x + offset.x, z: from.z}, {x: from.x, z: from.z + offset.z}} {
+    if !mapData.cellInBounds(side) || blocked[side] {
+      return false
+    }
+    if _, ok := stepCost(mapData, from, side); !ok {
+      return false
+    }
+  }
+  return true
+}
+
+func rebuildPath(cameFrom map[gridCell]gridCell, start, goal gridCell) []gridCell {
+  path := []gridCell{goal}
+  for cell := goal; cell != start; {
+    cell = cameFrom[cell]
+    path = append(path, cell)
+  }
+  for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+    path[i], path[j] = path[j], path[i]
+  }
+  return path
+}
+
+// true when walking the straight segment never crosses a too steep slope
+func straightWalkable(mapData *MapData, from, to gridCell) bool {
+  dx := float64(to.x - from.x)
+  dz := float64(to.z - from.z)
+  length := math.Hypot(dx, dz)
+  steps := int(math.Ceil(length / smoothSampleStep))
+  if steps == 0 {
+    return true
+  }
+
+  prevX, prevZ := float32(from.x), float32(from.z)
+  prevH := mapData.cellHeight(from)
+  for i := 1; i <= steps; i++ {
+    t := float64(i) / float64(steps)
+    x := float32(float64(from.x) + dx*t)
+    z := float32(float64(from.z) + dz*t)
+    h, ok := mapData.HeightAt(x, z)
+    if !ok {
+      return false
+    }
+    run := math.Hypot(float64(x-prevX), float64(z-prevZ))
+    if run > 0 && math.Abs(float64(h-prevH))/run > maxWalkableSlope {
+      return false
+    }
+    prevX, prevZ, prevH = x, z, h
+  }
+  return true
+}
+
+// string pulling: keep only the waypoints needed to stay on walkable ground
+func smoothPath(mapData *MapData, cells []gridCell) []Vector3 {
+  if len(cells) == 0 {
+    return nil
+  }
+
+  kept := []gridCell{cells[0]}
+  anchor := 0
+  for anchor < len(cells)-1 {
+    next := anchor + 1
+    for candidate := len(cells) - 1; candidate > anchor+1; candidate-- {
+      if straightWalkable(mapData, cells[anchor], cells[candidate]) {
+        next = candidate
+        break
+      }
+    }
+    kept = append(kept, cells[next])
+    anchor = next
+  }
+
+  path := make([]Vector3, len(kept))
+  for i, cell := range kept {
+    path[i] = Vector3{x: float32(cell.x), y: mapData.cellHeight(cell), z: float32(cell.z)}
+  }
+  return path
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+  "errors"
+  "testing"
+)
+
+// flat ground cut by a ridge at x 16 with a gap at z 30
+func ridgeMap() *MapData {
+  mapData := flatMap(33, 33, 0)
+  for z := 0; z < 30; z++ {
+    mapData.Data[z][16] = 20
+  }
+  return mapData
+}
+
+func TestFindPathAroundRidge(t *testing.T) {
+  mapData := ridgeMap()
+  pathfinder := NewPathfinder(func() (*MapData, error) { return mapData, nil })
+
+  path, err := pathfinder.FindPath(Vector3{x: 4, z: 4}, Vector3{x: 28, z: 4}, 0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  last := path[len(path)-1]
+  if last.x != 28 || last.z != 4 {
+    t.Fatalf("path ends at %v", last)
+  }
+  through := false
+  for _, waypoint := range path {
+    if waypoint.y != 0 {
+      t.Fatalf("waypoint %v on the ridge", waypoint)
+    }
+    through = through || waypoint.z >= 30
+  }
+  if !through {
+    t.Fatalf("path %v does not go through the gap", path)
+  }
+
+  if _, err := pathfinder.FindPath(Vector3{x: 4, z: 4}, Vector3{x: 28, z: 4}, 30); !errors.Is(err, ErrPathTooLong) {
+    t.Fatalf("path around the ridge within 30 units: %v", err)
+  }
+  if _, err := pathfinder.FindPath(Vector3{x: 4, z: 4}, Vector3{x: 40, z: 4}, 0); !errors.Is(err, ErrOutOfMap) {
+    t.Fatalf("path out of the map: %v", err)
+  }
+
+  pathfinder.Invalidate()
+  if len(pathfinder.cache) != 0 {
+    t.Fatal("paths still cached")
+  }
+}
+
+func TestChunkedZoneRefusesPaths(t *testing.T) {
+  zone := NewChunkedZone("world", nil)
+  if _, err := zone.FindPath(Vector3{}, Vector3{x: 4}, 0); !errors.Is(err, errNoPathfinding) {
+    t.Fatalf("chunked zone path: %v", err)
+  }
+}
+
+func TestBotWalksAroundRidge(t *testing.T) {
+  server := newTestServer(t)
+  zone := server.zones[defaultZoneName]
+  if _, err := zone.mapGenerator.saveAndUse(ridgeMap(), zone.mapGenerator.Filename()); err != nil {
+    t.Fatal(err)
+  }
+  server.refreshZone(zone, adminChange{Op: "map_load"})
+
+  id := server.SpawnBot()
+  if err := server.Teleport(id, Vector3{x: 4, z: 4}); err != nil {
+    t.Fatal(err)
+  }
+  if err := server.WalkBot(id, Vector3{x: 28, z: 4}); err != nil {
+    t.Fatal(err)
+  }
+  bot := server.clients[id]
+  for i := 0; i < 10000 && len(bot.path) > 0; i++ {
+    server.runTick()
+    if bot.user.location.y != 0 {
+      t.Fatalf("bot climbed the ridge at %v", bot.user.location)
+    }
+  }
+  if location := bot.user.location; !near(location.x, 28, 0.01) || !near(location.z, 4, 0.01) {
+    t.Fatalf("bot stopped at %v", location)
+  }
+
+  if err := server.WalkBot(id, Vector3{x: 40, z: 4}); !errors.Is(err, ErrOutOfMap) {
+    t.Fatalf("walk out of the map: %v", err)
+  }
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "maps"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+// state of an identified player, saved when it leaves and every
+// player_save_interval, restored when it comes back
+type PlayerState struct {
+  Player      string     `json:"player"`
+  Zone        string     `json:"zone"`
+  Location    [3]float32 `json:"location"`
+  Orientation float32    `json:"orientation"`
+  // gameplay counters, kept as they are by the server
+  Stats   map[string]float64 `json:"stats,omitempty"`
+  SavedAt time.Time          `json:"saved_at"`
+  // hash of the secret given to the player with its first session, the
+  // state is only restored to an identify carrying the secret
+  SecretHash string `json:"secret_hash,omitempty"`
+}
+
+type PlayerStore interface {
+  // ok is false for a player never saved
+  Load(player string) (state PlayerState, ok bool, err error)
+  Save(state PlayerState) error
+}
+
+// one json file per player, named after a hash of its identity
+type FilePlayerStore struct {
+  dir string
+
+  mu sync.Mutex
+  // SavedAt of the last write per player, saves finishing out of order
+  // never replace a newer state
+  saved map[string]time.Time
+}
+
+func NewFilePlayerStore(dir string) (*FilePlayerStore, error) {
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return nil, err
+  }
+  return &FilePlayerStore{dir: dir, saved: make(map[string]time.Time)}, nil
+}
+
+func (store *FilePlayerStore) filename(player string) string {
+  sum := sha256.Sum256([]byte(player))
+  return filepath.Join(store.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (store *FilePlayerStore) Load(player string) (PlayerState, bool, error) {
+  data, err := os.ReadFile(store.filename(player))
+  if errors.Is(err, os.ErrNotExist) {
+    return PlayerState{}, false, nil
+  }
+  if err != nil {
+    return PlayerState{}, false, err
+  }
+  var state PlayerState
+  if err := json.Unmarshal(data, &state); err != nil {
+    return PlayerState{}, false, fmt.Errorf("invalid player file %s: %v", store.filename(player), err)
+  }
+  if state.Player != player {
+    return PlayerState{}, false, fmt.Errorf("player file %s belongs to another player", store.filename(player))
+  }
+  return state, true, nil
+}
+
+func (store *FilePlayerStore) Save(state PlayerState) error {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+
+  if last, ok := store.saved[state.Player]; ok && state.SavedAt.Before(last) {
+    return nil
+  }
+  data, err := json.MarshalIndent(state, "", "  ")
+  if err != nil {
+    return err
+  }
+  if err := writeFileAtomic(store.filename(state.Player), data); err != nil {
+    return err
+  }
+  store.saved[state.Player] = state.SavedAt
+  return nil
+}
+
+// must be called with server.mu held
+func (client *Client) playerState() PlayerState {
+  user := client.user
+  return PlayerState{
+    Player:      client.player,
+    Zone:        client.zone.name,
+    Location:    [3]float32{user.location.x, user.location.y, user.location.z},
+    Orientation: user.orientation,
+    Stats:       maps.Clone(user.stats),
+    SavedAt:     time.Now(),
+    SecretHash:  client.secretHash,
+  }
+}
+
+// writes in the background, must be called with server.mu held
+func (server *Server) savePlayer(client *Client) {
+  if server.players == nil || client.player == "" {
+    return
+  }
+  state, players := client.playerState(), server.players
+  server.saving.Add(1)
+  go func() {
+    defer server.saving.Done()
+    if err := players.Save(state); err != nil {
+      worldLog.Warn("player not saved", "player", state.Player, "err", err)
+    }
+  }()
+}
+
+func (server *Server) saveAllPlayers() {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+  for _, client := range server.clients {
+    server.savePlayer(client)
+  }
+}
+
+// saves the connected players and waits for every write
+func (server *Server) stopPlayers() {
+  server.saveAllPlayers()
+  server.saving.Wait()
+}
+
+var (
+  errPlayerConnected = errors.New("player is connected from another address")
+  errPlayerSecret    = errors.New("player secret does not match")
+)
+
+func hashSecret(secret string) string {
+  sum := sha256.Sum256([]byte(secret))
+  return hex.EncodeToString(sum[:])
+}
+
+// players saved before secrets existed have no hash and need none
+func secretMatches(hash, secret string) bool {
+  if hash == "" {
+    return true
+  }
+  return secret != "" && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hash)) == 1
+}
+
+// the state to spawn a player with: the state of its session still open
+// from another address, which is closed, or the stored state. An open
+// session is taken over with its token, or with the player secret once it
+// was silent for client_timeout. The stored state needs the secret.
+// must be called with server.mu held
+func (server *Server) takeOverPlayer(player, session, secret string) (*PlayerState, error) {
+  for key, other := range server.clients {
+    if other.player != player {
+      continue
+    }
+    silent := server.clock.Now().Sub(other.lastSeen) >= server.config.ClientTimeout.Std()
+    switch {
+    case session != "" && subtle.ConstantTimeCompare([]byte(session), []byte(other.session)) == 1:
+    case !silent:
+      return nil, errPlayerConnected
+    case !secretMatches(other.secretHash, secret):
+      return nil, errPlayerSecret
+    }
+    state := other.playerState()
+    server.sendJSON(other.addr, AdminNotice{Type: "kicked", Message: "connected from another address"})
+    server.removeClient(key, other)
+    netLog.Info("player session replaced", "player", player, "old", key)
+    return &state, nil
+  }
+  if server.players == nil {
+    return nil, nil
+  }
+  state, ok, err := server.players.Load(player)
+  if err != nil {
+    worldLog.Warn("player not loaded", "player", player, "err", err)
+    return nil, nil
+  }
+  if !ok {
+    return nil, nil
+  }
+  if !secretMatches(state.SecretHash, secret) {
+    return nil, errPlayerSecret
+  }
+  return &state, nil
+}
+
+func randomSessionToken(player string) string {
+  token := make([]byte, 16)
+  rand.Read(token)
+  return hex.EncodeToString(token)
+}
+
+// gives the identified client a new session token, and a secret when the
+// player has none yet. The player is saved at once so the secret claims
+// its name. must be called with server.mu held
+func (server *Server) startSession(client *Client) {
+  client.session = server.sessionToken(client.player)
+  notice := SessionNotice{Type: "session", Player: client.player, Session: client.session}
+  if client.secretHash == "" {
+    notice.Secret = server.sessionToken(client.player)
+    client.secretHash = hashSecret(notice.Secret)
+    server.savePlayer(client)
+  }
+  server.sendJSON(client.addr, notice)
+}
+
+// a client identifying after it spawned is moved to its stored state.
+// must be called with server.mu held
+func (server *Server) identify(client *Client, player, session, secret string) {
+  if client.player == player {
+    return
+  }
+  if client.player != "" || client.addr == nil {
+    netLog.Warn("identity change refused", "id", client.user.id, "player", client.player)
+    return
+  }
+  state, err := server.takeOverPlayer(player, session, secret)
+  if err != nil {
+    // identify is resent until the other session times out
+    netLog.Debug("identify refused", "id", client.user.id, "player", player, "err", err)
+    server.sendJSON(client.addr, AdminNotice{Type: "identify_refused", Message: err.Error()})
+    return
+  }
+  client.player = player
+  if state != nil {
+    client.secretHash = state.SecretHash
+  }
+  server.startSession(client)
+  if state == nil {
+    return
+  }
+
+  location := Vector3{x: state.Location[0], y: state.Location[1], z: state.Location[2]}
+  if zone := server.zone(state.Zone); zone != client.zone {
+    server.moveToZone(client, zone, location, "restore")
+  } else {
+    from := client.user.location
+    client.user.updatePosition(zone.groundAt(location))
+    server.dispatchUserMoved(client, from, "restore")
+  }
+  client.user.orientation = state.Orientation
+  client.user.stats = maps.Clone(state.Stats)
+  worldLog.Info("player restored", "player", player, "id", client.user.id, "zone", client.zone.name)
+}
+
+// the player, session and secret of an identify message, empty for other
+// messages
+func identifiedPlayer(data []byte) (string, string, string) {
+  var msg ClientMessage
+  if json.Unmarshal(data, &msg) != nil || msg.Type != "identify" {
+    return "", "", ""
+  }
+  return msg.Player, msg.Session, msg.Secret
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+  "fmt"
+  "net"
+  "strings"
+  "testing"
+  "time"
+)
+
+// the session tokens and secrets the server hands out, in order
+func issuedTokens(server *Server) *[]string {
+  tokens := new([]string)
+  server.sessionToken = func(player string) string {
+    token := fmt.Sprintf("%s-token-%d", player, len(*tokens)+1)
+    *tokens = append(*tokens, token)
+    return token
+  }
+  return tokens
+}
+
+func TestPlayerSessionTakeOver(t *testing.T) {
+  server := newTestServer(t)
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+  tokens := issuedTokens(server)
+
+  first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+  second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40002}
+  third := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 40003}
+
+  server.handleDatagram(first, []byte(`{"type":"identify","player":"alice"}`))
+  owner := server.clients[first.String()]
+  if owner == nil || owner.player != "alice" || owner.session == "" || len(*tokens) != 2 {
+    t.Fatal("first identify did not open a session with a secret")
+  }
+  secret := (*tokens)[1]
+
+  // another address without the token waits for the session to time out
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice"}`))
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice","session":"guess"}`))
+  if server.clients[second.String()] != nil || server.clients[first.String()] == nil {
+    t.Fatal("active session taken over without its token")
+  }
+
+  // the token moves the session at once, with a new token
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice","session":"`+owner.session+`"}`))
+  moved := server.clients[second.String()]
+  if moved == nil || server.clients[first.String()] != nil {
+    t.Fatal("session not taken over with its token")
+  }
+  if moved.player != "alice" || moved.session == owner.session {
+    t.Fatalf("taken over session has player %q and session %q", moved.player, moved.session)
+  }
+
+  // a guest identifying later is refused the same way until the session is silent
+  server.handleDatagram(third, []byte(`{"type":"map_info"}`))
+  server.handleDatagram(third, []byte(`{"type":"identify","player":"alice"}`))
+  if server.clients[third.String()].player != "" {
+    t.Fatal("guest took an active session over")
+  }
+  // then only with the player secret
+  clock.Set(clock.Now().Add(server.config.ClientTimeout.Std()))
+  server.handleDatagram(third, []byte(`{"type":"identify","player":"alice"}`))
+  if server.clients[third.String()].player != "" {
+    t.Fatal("silent session taken over without the secret")
+  }
+  server.handleDatagram(third, []byte(`{"type":"identify","player":"alice","secret":"`+secret+`"}`))
+  if server.clients[third.String()].player != "alice" || server.clients[second.String()] != nil {
+    t.Fatal("silent session not taken over")
+  }
+}
+
+func TestStoredPlayerNeedsSecret(t *testing.T) {
+  server := newTestServer(t)
+  store, err := NewFilePlayerStore(t.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+  server.SetPlayerStore(store)
+  tokens := issuedTokens(server)
+
+  first := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+  server.handleDatagram(first, []byte(`{"type":"identify","player":"alice"}`))
+  owner := server.clients[first.String()]
+  secret := (*tokens)[1]
+  owner.user.stats = map[string]float64{"kills": 3}
+  if err := server.Kick(owner.user.id); err != nil {
+    t.Fatal(err)
+  }
+  server.saving.Wait()
+  state, ok, err := store.Load("alice")
+  if err != nil || !ok {
+    t.Fatalf("alice not saved: %v", err)
+  }
+  if state.SecretHash == "" || state.SecretHash == secret || strings.Contains(state.SecretHash, secret) {
+    t.Fatalf("secret saved as %q", state.SecretHash)
+  }
+
+  // the name alone, or a wrong secret, spawns nobody
+  second := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40002}
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice"}`))
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice","secret":"guess"}`))
+  if server.clients[second.String()] != nil {
+    t.Fatal("stored player restored without its secret")
+  }
+
+  server.handleDatagram(second, []byte(`{"type":"identify","player":"alice","secret":"`+secret+`"}`))
+  restored := server.clients[second.String()]
+  if restored == nil || restored.player != "alice" || restored.user.stats["kills"] != 3 {
+    t.Fatal("stored player not restored with its secret")
+  }
+  if len(*tokens) != 3 {
+    t.Fatalf("%d tokens issued, a restored player keeps its secret", len(*tokens))
+  }
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+  "math"
+)
+
+const (
+  // users are boxes of userRadius around their location, from the ground up
+  userHeight    = 1.0
+  userEyeHeight = 0.8
+
+  raycastStep       = 0.25
+  raycastRefinement = 12
+)
+
+func (v Vector3) add(o Vector3) Vector3 {
+  return Vector3{x: v.x + o.x, y: v.y + o.y, z: v.z + o.z}
+}
+
+func (v Vector3) sub(o Vector3) Vector3 {
+  return Vector3{x: v.x - o.x, y: v.y - o.y, z: v.z - o.z}
+}
+
+func (v Vector3) scale(s float32) Vector3 {
+  return Vector3{x: v.x * s, y: v.y * s, z: v.z * s}
+}
+
+func (v Vector3) length() float32 {
+  return float32(math.Sqrt(float64(v.x*v.x + v.y*v.y + v.z*v.z)))
+}
+
+// distance above the ground, false outside of the terrain
+func heightAbove(terrain Terrain, point Vector3) (float32, bool) {
+  ground, ok := terrain.HeightAt(point.x, point.z)
+  if !ok {
+    return 0, false
+  }
+  return point.y - ground, true
+}
+
+// marches along the ray in fixed steps and refines the first crossing of the
+// ground by bisection, the result only depends on the inputs. Rays starting
+// below the ground hit at their origin, rays leaving the terrain miss.
+func Raycast(terrain Terrain, origin, direction Vector3, maxDistance float32) (Vector3, float32, bool) {
+  length := direction.length()
+  if terrain == nil || length == 0 || maxDistance <= 0 {
+    return Vector3{}, 0, false
+  }
+  direction = direction.scale(1 / length)
+
+  above, ok := heightAbove(terrain, origin)
+  if !ok {
+    return Vector3{}, 0, false
+  }
+  if above <= 0 {
+    return origin, 0, true
+  }
+
+  steps := int(math.Ceil(float64(maxDistance / raycastStep)))
+  prev := float32(0)
+  for i := 1; i <= steps; i++ {
+    dist := min(float32(i)*raycastStep, maxDistance)
+    above, ok := heightAbove(terrain, origin.add(direction.scale(dist)))
+    if !ok {
+      return Vector3{}, 0, false
+    }
+    if above > 0 {
+      prev = dist
+      continue
+    }
+
+    low, high := prev, dist
+    for j := 0; j < raycastRefinement; j++ {
+      mid := (low + high) / 2
+      if above, ok := heightAbove(terrain, origin.add(direction.scale(mid))); ok && above > 0 {
+        low = mid
+      } else {
+        high = mid
+      }
+    }
+    return origin.add(direction.scale(high)), high, true
+  }
+  return Vector3{}, 0, false
+}
+
+// true when the straight segment stays above the ground
+func LineOfSight(terrain Terrain, from, to Vector3) bool {
+  dist := to.sub(from).length()
+  if dist == 0 {
+    return true
+  }
+  _, _, hit := Raycast(terrain, from, to.sub(from), dist)
+  return !hit
+}
+
+func (user *User) eye() Vector3 {
+  return Vector3{x: user.location.x, y: user.location.y + userEyeHeight, z: user.location.z}
+}
+
+func (user *User) box() (Vector3, Vector3) {
+  return Vector3{x: user.location.x - userRadius, y: user.location.y, z: user.location.z - userRadius},
+    Vector3{x: user.location.x + userRadius, y: user.location.y + userHeight, z: user.location.z + userRadius}
+}
+
+// slab test, returns the fraction of the segment where it enters the box
+func segmentHitsBox(from, to, boxMin, boxMax Vector3) (float32, bool) {
+  delta := to.sub(from)
+  enter, exit := float32(0), float32(1)
+
+  axes := [3][4]float32{
+    {from.x, delta.x, boxMin.x, boxMax.x},
+    {from.y, delta.y, boxMin.y, boxMax.y},
+    {from.z, delta.z, boxMin.z, boxMax.z},
+  }
+  for _, axis := range axes {
+    start, d, low, high := axis[0], axis[1], axis[2], axis[3]
+    if d == 0 {
+      if start < low || start > high {
+        return 0, false
+      }
+      continue
+    }
+    t0 := (low - start) / d
+    t1 := (high - start) / d
+    if t0 > t1 {
+      t0, t1 = t1, t0
+    }
+    enter = max(enter, t0)
+    exit = min(exit, t1)
+    if enter > exit {
+      return 0, false
+    }
+  }
+  return enter, true
+}
+
+func (user *User) hitBySegment(from, to Vector3) (float32, bool) {
+  boxMin, boxMax := user.box()
+  return segmentHitsBox(from, to, boxMin, boxMax)
+}
+
+// eye to eye visibility, either eye or the top of the target box is enough
+func CanSee(terrain Terrain, viewer, target *User) bool {
+  eye := viewer.eye()
+  if LineOfSight(terrain, eye, target.eye()) {
+    return true
+  }
+  top := target.location
+  top.y += userHeight
+  return LineOfSight(terrain, eye, top)
+}
+
+// first user of the zone hit by the ray before the ground, ignore is skipped.
+// must be called with server.mu held
+func (zone *Zone) RaycastUsers(origin, direction Vector3, maxDistance float32, ignore *User) (*User, float32, bool) {
+  length := direction.length()
+  if length == 0 || maxDistance <= 0 {
+    return nil, 0, false
+  }
+  end := origin.add(direction.scale(maxDistance / length))
+  if _, dist, hit := Raycast(zone.terrain(), origin, direction, maxDistance); hit {
+    end = origin.add(direction.scale(dist / length))
+    maxDistance = dist
+  }
+
+  var closest *User
+  closestDist := float32(math.MaxFloat32)
+  for _, client := range zone.clients {
+    user := client.user
+    if user == nil || user == ignore || !user.isActive {
+      continue
+    }
+    if t, ok := user.hitBySegment(origin, end); ok && t*maxDistance < closestDist {
+      closest = user
+      closestDist = t * maxDistance
+    }
+  }
+  return closest, closestDist, closest != nil
+}
+
+func (zone *Zone) CanSee(viewer, target *User) bool {
+  return CanSee(zone.terrain(), viewer, target)
+}
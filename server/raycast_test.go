@@ -0,0 +1,90 @@
+package main
+
+import (
+  "math"
+  "testing"
+)
+
+// a width x height grid of cells at height
+func flatMap(width, height int, ground float32) *MapData {
+  data := make([][]float32, height)
+  for z := range data {
+    data[z] = make([]float32, width)
+    for x := range data[z] {
+      data[z][x] = ground
+    }
+  }
+  return &MapData{Width: width, Height: height, MaxVal: 32, Data: data}
+}
+
+func near(a, b, tolerance float32) bool {
+  return math.Abs(float64(a-b)) <= float64(tolerance)
+}
+
+func TestRaycastHitsSlope(t *testing.T) {
+  // the ground rises by one per column
+  mapData := flatMap(16, 16, 0)
+  for z := range mapData.Data {
+    for x := range mapData.Data[z] {
+      mapData.Data[z][x] = float32(x)
+    }
+  }
+
+  point, dist, hit := Raycast(mapData, Vector3{x: 1, y: 5, z: 8}, Vector3{x: 1}, 10)
+  if !hit {
+    t.Fatal("ray along the slope missed")
+  }
+  if !near(point.x, 5, 0.01) || !near(dist, 4, 0.01) {
+    t.Fatalf("hit at x %.3f distance %.3f, expected x 5 distance 4", point.x, dist)
+  }
+  if ground, _ := mapData.HeightAt(point.x, point.z); !near(point.y, ground, 0.01) {
+    t.Fatalf("hit at height %.3f, the ground is at %.3f", point.y, ground)
+  }
+}
+
+func TestRaycastMissesFlatGround(t *testing.T) {
+  mapData := flatMap(16, 16, 2)
+
+  if _, _, hit := Raycast(mapData, Vector3{x: 2, y: 3, z: 2}, Vector3{x: 1, z: 1}, 10); hit {
+    t.Fatal("level ray above flat ground hit")
+  }
+  // going down but stopping above the ground
+  if _, _, hit := Raycast(mapData, Vector3{x: 2, y: 3, z: 2}, Vector3{x: 1, y: -0.1}, 5); hit {
+    t.Fatal("short ray hit before reaching the ground")
+  }
+  if !LineOfSight(mapData, Vector3{x: 1, y: 3, z: 1}, Vector3{x: 14, y: 3, z: 14}) {
+    t.Fatal("no line of sight over flat ground")
+  }
+}
+
+func TestRaycastLeavingMap(t *testing.T) {
+  mapData := flatMap(16, 16, 0)
+
+  if _, _, hit := Raycast(mapData, Vector3{x: 8, y: 1, z: 8}, Vector3{x: 1}, 100); hit {
+    t.Fatal("ray leaving the map hit")
+  }
+  if _, _, hit := Raycast(mapData, Vector3{x: -4, y: -1, z: 8}, Vector3{x: 1}, 10); hit {
+    t.Fatal("ray starting outside of the map hit")
+  }
+}
+
+func TestRaycastHitsObstacleCell(t *testing.T) {
+  // a single raised cell on flat ground
+  mapData := flatMap(16, 16, 0)
+  mapData.Data[8][10] = 5
+
+  point, dist, hit := Raycast(mapData, Vector3{x: 2, y: 1, z: 8}, Vector3{x: 1}, 12)
+  if !hit {
+    t.Fatal("ray through the raised cell missed")
+  }
+  // the ground reaches 1 a fifth of the way up to the cell
+  if !near(point.x, 9.2, 0.01) || !near(dist, 7.2, 0.01) {
+    t.Fatalf("hit at x %.3f distance %.3f, expected x 9.2 distance 7.2", point.x, dist)
+  }
+  if LineOfSight(mapData, Vector3{x: 2, y: 1, z: 8}, Vector3{x: 14, y: 1, z: 8}) {
+    t.Fatal("line of sight through the raised cell")
+  }
+  if !LineOfSight(mapData, Vector3{x: 2, y: 1, z: 12}, Vector3{x: 14, y: 1, z: 12}) {
+    t.Fatal("no line of sight beside the raised cell")
+  }
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+// a clock only moving when it is set
+type ManualClock struct {
+  mu  sync.Mutex
+  now time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+  return &ManualClock{now: now}
+}
+
+func (clock *ManualClock) Now() time.Time {
+  clock.mu.Lock()
+  defer clock.mu.Unlock()
+  return clock.now
+}
+
+func (clock *ManualClock) Set(now time.Time) {
+  clock.mu.Lock()
+  defer clock.mu.Unlock()
+  clock.now = now
+}
+
+// a socket counting what the server sends, nothing is ever read from it
+type ReplaySocket struct {
+  addr *net.UDPAddr
+
+  mu    sync.Mutex
+  sent  int
+  bytes int
+}
+
+func NewReplaySocket(port int) *ReplaySocket {
+  return &ReplaySocket{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func (socket *ReplaySocket) ReadFromUDP(buffer []byte) (int, *net.UDPAddr, error) {
+  return 0, nil, net.ErrClosed
+}
+
+func (socket *ReplaySocket) WriteToUDP(data []byte, addr *net.UDPAddr) (int, error) {
+  socket.mu.Lock()
+  defer socket.mu.Unlock()
+  socket.sent++
+  socket.bytes += len(data)
+  return len(data), nil
+}
+
+func (socket *ReplaySocket) LocalAddr() net.Addr {
+  return socket.addr
+}
+
+func (socket *ReplaySocket) Close() error {
+  return nil
+}
+
+// datagrams and bytes sent
+func (socket *ReplaySocket) Sent() (int, int) {
+  socket.mu.Lock()
+  defer socket.mu.Unlock()
+  return socket.sent, socket.bytes
+}
+
+// answers the loads with the recorded ones, in order, and saves nothing
+type replayPlayerStore struct {
+  mu    sync.Mutex
+  loads map[string][]TrafficRecord
+}
+
+func newReplayPlayerStore(records []TrafficRecord) *replayPlayerStore {
+  store := &replayPlayerStore{loads: make(map[string][]TrafficRecord)}
+  for _, record := range records {
+    if record.Kind == RecordPlayerLoad {
+      store.loads[record.Player] = append(store.loads[record.Player], record)
+    }
+  }
+  return store
+}
+
+func (store *replayPlayerStore) Load(player string) (PlayerState, bool, error) {
+  store.mu.Lock()
+  defer store.mu.Unlock()
+
+  loads := store.loads[player]
+  if len(loads) == 0 {
+    return PlayerState{}, false, fmt.Errorf("player %s was not loaded in the recording", player)
+  }
+  store.loads[player] = loads[1:]
+  record := loads[0]
+  if record.Err != "" {
+    return PlayerState{}, false, errors.New(record.Err)
+  }
+  if record.State == nil {
+    return PlayerState{}, false, nil
+  }
+  return *record.State, true, nil
+}
+
+func (store *replayPlayerStore) Save(state PlayerState) error {
+  return nil
+}
+
+// the recorded session tokens of each player, in order
+func replaySessionTokens(records []TrafficRecord) func(player string) string {
+  tokens := make(map[string][]string)
+  for _, record := range records {
+    if record.Kind == RecordSession {
+      tokens[record.Player] = append(tokens[record.Player], record.Token)
+    }
+  }
+  // called with server.mu held
+  return func(player string) string {
+    if len(tokens[player]) == 0 {
+      worldLog.Warn("player session not in the recording", "player", player)
+      return randomSessionToken(player)
+    }
+    token := tokens[player][0]
+    tokens[player] = tokens[player][1:]
+    return token
+  }
+}
+
+// map and chunk files of a replay, saved in memory. The files are read
+// as they were when the recording started, from the recording when it
+// changed them and from the disk otherwise.
+type MapFiles struct {
+  mu    sync.Mutex
+  files map[string][]byte
+  // missing when the recording started
+  missing map[string]bool
+}
+
+func newReplayMapFiles(records []TrafficRecord) *MapFiles {
+  files := &MapFiles{files: make(map[string][]byte), missing: make(map[string]bool)}
+  for _, record := range records {
+    if record.Kind != RecordMapFile {
+      continue
+    }
+    if record.Missing {
+      files.missing[record.File] = true
+    } else {
+      files.files[record.File] = record.Data
+    }
+  }
+  return files
+}
+
+func (files *MapFiles) Write(filename string, data []byte) {
+  files.mu.Lock()
+  defer files.mu.Unlock()
+  files.files[filename] = append([]byte(nil), data...)
+  delete(files.missing, filename)
+}
+
+func (files *MapFiles) Read(filename string) ([]byte, error) {
+  files.mu.Lock()
+  data, ok := files.files[filename]
+  missing := files.missing[filename]
+  files.mu.Unlock()
+  if ok {
+    return data, nil
+  }
+  if missing {
+    return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+  }
+  return os.ReadFile(filename)
+}
+
+// a server fed with a recording on a fake socket and clock. The world is
+// the recorded snapshot on the maps of the recording, nothing is written.
+type Replay struct {
+  Server *Server
+  Clock  *ManualClock
+  Socket *ReplaySocket
+
+  // datagrams applied so far
+  Datagrams int
+
+  records []TrafficRecord
+  next    int
+}
+
+// the recorded config without consoles, listeners, player files or world
+// snapshots. Map and chunk files are saved to MapFiles.
+func replayConfig(config Config) Config {
+  config.Console = false
+  config.ConsoleSocket = ""
+  config.APIAddress = ""
+  config.MetricsAddress = ""
+  config.PlayerDir = ""
+  config.WorldFile = ""
+  config.RestoreWorld = false
+  config.RecordFile = ""
+  config.RegenerateMap = false
+  return config
+}
+
+func NewReplay(recording *Recording) (*Replay, error) {
+  config := replayConfig(recording.Header.Config)
+  clock := NewManualClock(recording.Header.StartedAt)
+  socket := NewReplaySocket(config.Port)
+
+  server, err := newServer(config, socket)
+  if err != nil {
+    return nil, err
+  }
+  server.clock = clock
+  server.replaying = true
+  server.mapFiles = newReplayMapFiles(recording.Records)
+  server.mapGenerator = server.newMapGenerator()
+  server.players = newReplayPlayerStore(recording.Records)
+  server.sessionToken = replaySessionTokens(recording.Records)
+  if err := server.LoadWorld(); err != nil {
+    return nil, err
+  }
+  server.prepareZones()
+
+  snapshot := recording.Header.Snapshot
+  if err := server.RestoreWorld(snapshot); err != nil {
+    return nil, err
+  }
+  server.mu.Lock()
+  for _, saved := range snapshot.Clients {
+    if client, ok := server.clients[saved.ID]; ok {
+      client.lastSeen = saved.LastSeen
+    }
+  }
+  server.mu.Unlock()
+
+  return &Replay{Server: server, Clock: clock, Socket: socket, records: recording.Records}, nil
+}
+
+// applies the records up to the next tick boundary and returns it, ok is
+// false at the end of the recording. The world state after the tick is
+// the recorded one when StateHash equals the tick StateHash.
+func (replay *Replay) Step() (tick TrafficRecord, ok bool) {
+  server := replay.Server
+  for replay.next < len(replay.records) {
+    record := replay.records[replay.next]
+    replay.next++
+    // read from MapFiles and the session tokens
+    if record.Kind == RecordMapFile || record.Kind == RecordSession {
+      continue
+    }
+    replay.Clock.Set(record.At)
+
+    switch record.Kind {
+    case RecordDatagram:
+      addr, err := net.ResolveUDPAddr("udp", record.Addr)
+      if err != nil {
+        netLog.Warn("recorded datagram skipped", "addr", record.Addr, "err", err)
+        continue
+      }
+      server.handleDatagram(addr, record.Data)
+      replay.Datagrams++
+    case RecordCleanup:
+      server.cleanInactiveClients(server.config.ClientTimeout.Std())
+    case RecordAdmin:
+      if err := server.applyAdminChange(*record.Change); err != nil {
+        worldLog.Warn("recorded admin change failed", "op", record.Change.Op, "err", err)
+      }
+    case RecordTick:
+      server.runTick()
+      return record, true
+    }
+  }
+  return TrafficRecord{}, false
+}
+
+// runs the admin operation again, the map operations load the map files
+// of the recording again
+func (server *Server) applyAdminChange(change adminChange) error {
+  var err error
+  switch change.Op {
+  case "kick":
+    err = server.Kick(change.ID)
+  case "ban":
+    _, err = server.Ban(change.ID, change.Duration.Std(), change.Reason)
+  case "unban":
+    err = server.Unban(change.IP)
+  case "teleport":
+    if change.Location == nil {
+      return errors.New("teleport without location")
+    }
+    err = server.Teleport(change.ID, vector3(*change.Location))
+  case "spawn_bot":
+    server.SpawnBot()
+  case "walk":
+    if change.Location == nil {
+      return errors.New("walk without location")
+    }
+    err = server.WalkBot(change.ID, vector3(*change.Location))
+  case "map_regenerate":
+    err = server.RegenerateMap(change.Seed)
+  case "map_load":
+    err = server.LoadMap(change.File)
+  case "map_rotate":
+    err = server.RotateMap()
+  default:
+    err = fmt.Errorf("unknown admin change %s", change.Op)
+  }
+  return err
+}
+
+// records applied and records in the recording
+func (replay *Replay) Progress() (int, int) {
+  return replay.next, len(replay.records)
+}
+
+// waits for the queued events
+func (replay *Replay) Close() {
+  replay.Server.eventManager.Close(eventDrainTimeout)
+}
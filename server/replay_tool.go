@@ -0,0 +1,130 @@
+//go:build rtgsreplay
+
+package main
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+)
+
+const replayToolUsage = `Usage: rtgs-replay [options] FILE
+
+Replays a recording of the server (-record FILE) on a fake socket and
+clock, tick by tick, and checks the world state of each tick against the
+recorded one.
+
+Options:
+`
+
+func main() {
+  os.Exit(replayTool(os.Args[1:]))
+}
+
+// returns the exit code, so the deferred cleanups run before the exit
+func replayTool(args []string) int {
+  flags := flag.NewFlagSet("rtgs-replay", flag.ExitOnError)
+  flags.Usage = func() {
+    fmt.Fprint(os.Stderr, replayToolUsage)
+    flags.PrintDefaults()
+  }
+  from := flags.Uint64("from", 0, "first tick printed")
+  to := flags.Uint64("to", 0, "last tick replayed, 0 for the whole recording")
+  step := flags.Bool("step", false, "wait for enter after each printed tick, c continues, q quits")
+  users := flags.Bool("users", false, "print the users after each printed tick")
+  logLevel := flags.String("log-level", "warn", "server log level")
+  flags.Parse(args)
+  if flags.NArg() != 1 {
+    flags.Usage()
+    return 2
+  }
+
+  recording, err := ReadRecording(flags.Arg(0))
+  if err != nil {
+    fmt.Printf("Error: %v\n", err)
+    return 1
+  }
+  config := recording.Header.Config
+  config.LogLevel, config.LogLevels = *logLevel, nil
+  if err := SetupLogging(os.Stderr, config); err != nil {
+    fmt.Printf("Error: %v\n", err)
+    return 2
+  }
+
+  replay, err := NewReplay(recording)
+  if err != nil {
+    fmt.Printf("Error: %v\n", err)
+    return 1
+  }
+  defer replay.Close()
+  fmt.Printf("recording of %s, world %s seed %d, %d clients at tick %d, %d records\n",
+    recording.Header.StartedAt.Format("2006-01-02 15:04:05"), config.World, config.Seed,
+    len(recording.Header.Snapshot.Clients), recording.Header.Snapshot.Tick, len(recording.Records))
+
+  input := bufio.NewScanner(os.Stdin)
+  ticks, datagrams := 0, 0
+  var diverged uint64
+  for {
+    tick, ok := replay.Step()
+    if !ok {
+      break
+    }
+    ticks++
+    hash := replay.Server.StateHash()
+    if hash != tick.StateHash && diverged == 0 {
+      diverged = tick.Tick
+    }
+
+    if tick.Tick >= *from {
+      status := "ok"
+      if hash != tick.StateHash {
+        status = fmt.Sprintf("DIVERGED, recorded %016x", tick.StateHash)
+      }
+      fmt.Printf("tick %d  +%.3fs  datagrams %d  state %016x  %s\n", tick.Tick,
+        tick.At.Sub(recording.Header.StartedAt).Seconds(), replay.Datagrams-datagrams, hash, status)
+      if *users {
+        printReplayUsers(replay.Server)
+      }
+      if *step {
+        fmt.Print("> ")
+        if !input.Scan() {
+          *step = false
+        }
+        switch strings.TrimSpace(input.Text()) {
+        case "c":
+          *step = false
+        case "q":
+          return 0
+        }
+      }
+    }
+    datagrams = replay.Datagrams
+    if *to > 0 && tick.Tick >= *to {
+      break
+    }
+  }
+
+  sent, bytes := replay.Socket.Sent()
+  applied, total := replay.Progress()
+  fmt.Printf("replayed %d ticks, %d datagrams received, %d sent (%d bytes), %d/%d records\n",
+    ticks, replay.Datagrams, sent, bytes, applied, total)
+  if diverged != 0 {
+    fmt.Printf("world state diverged at tick %d\n", diverged)
+    return 1
+  }
+  fmt.Println("world states match the recording")
+  return 0
+}
+
+func printReplayUsers(server *Server) {
+  for _, client := range server.Clients() {
+    name := client.ID
+    if client.Player != "" {
+      name += " (" + client.Player + ")"
+    }
+    fmt.Printf("  %-28s %-6s %-6s %7.2f %7.2f %7.2f  %6.1f\n", name, client.Zone, client.Type,
+      client.Location[0], client.Location[1], client.Location[2], client.Orientation)
+  }
+}
@@ -1,87 +1,294 @@
 package main
 
 import (
+  "crypto/subtle"
   "encoding/json"
   "fmt"
+  "io"
+  "maps"
+  "math"
+  "math/rand/v2"
   "net"
+  "net/http"
+  "path/filepath"
+  "strings"
   "time"
   "sync"
 )
 
 type Server struct {
-  conn          *net.UDPConn
+  conn          PacketConn
+  // read by the game logic instead of time.Now, replays set it
+  clock         Clock
   clients       map[string]*Client
   mu            sync.RWMutex
   eventManager  *EventManager
+  mapGenerator  *MapGenerator
+  zones         map[string]*Zone
+  adminToken    string
+  rotation      *MapRotation
+  config        Config
+  startedAt     time.Time
+  // closed by Shutdown
+  done          chan struct{}
+  shutdownOnce  sync.Once
+  // closed when the server stops
+  consoles      []io.Closer
+  // open connections of the console socket, nil once the consoles stopped
+  consoleConns  map[net.Conn]bool
+  botCount      int
+  // by ip
+  bans          map[string]Ban
+  // by address, until when kicked clients are ignored
+  kicked        map[string]time.Time
+  // nil when player persistence is disabled
+  players       PlayerStore
+  saving        sync.WaitGroup
+  pingCount     uint64
+  api           *http.Server
+  // game ticks since the world started, kept by world snapshots
+  tick          uint64
+  // spawn positions, seeded by the world seed
+  spawnSource   *rand.PCG
+  spawnRNG      *rand.Rand
+  // nil unless record_file is set
+  recorder      *TrafficRecorder
+  // token of each new player session, recorded and replayed
+  sessionToken  func(player string) string
+  // set by replays, they apply the recorded rotations instead of those
+  // asked by admin clients
+  replaying     bool
+  // set by replays, the maps are read from the recording and saved in
+  // memory
+  mapFiles      *MapFiles
 }
 
-func NewServer(port int) (*Server, error) {
-  fmt.Println("Creating UDP address...")
+// interval between the pings measuring the round trip to each client
+const pingInterval = 2 * time.Second
+
+// time given to the queued events when the server stops
+const eventDrainTimeout = 5 * time.Second
+
+// units per second of walking bots
+const botSpeed = 4
+
+func NewServer(config Config) (*Server, error) {
   addr := net.UDPAddr{
-    Port: port,
-    IP:   net.ParseIP("0.0.0.0"),
+    Port: config.Port,
+    IP:   net.ParseIP(config.BindAddress),
   }
   
-  fmt.Printf("Binding to %s:%d...\n", addr.IP, addr.Port)
   conn, err := net.ListenUDP("udp", &addr)
   if err != nil {
     return nil, err
   }
   
-  fmt.Println("UDP socket bound successfully")
+  netLog.Info("udp socket bound", "addr", conn.LocalAddr().String())
+  
+  server, err := newServer(config, conn)
+  if err != nil {
+    conn.Close()
+    return nil, err
+  }
+  return server, nil
+}
+
+// a server reading and writing its datagrams on conn
+func newServer(config Config, conn PacketConn) (*Server, error) {
+  eventManager := NewEventManager()
+  eventManager.SetPool(config.EventWorkers, config.EventQueueSize)
+  for _, name := range config.OrderedEvents {
+    eventManager.SetDelivery(EventType(name), DeliveryOrdered)
+  }
+  
+  var players PlayerStore
+  if config.PlayerDir != "" {
+    var err error
+    if players, err = NewFilePlayerStore(config.PlayerDir); err != nil {
+      return nil, err
+    }
+  }
+  
+  spawnSource := rand.NewPCG(uint64(config.Seed), 0)
   
-  return &Server{
+  server := &Server{
+    spawnSource:  spawnSource,
+    spawnRNG:     rand.New(spawnSource),
+    players:      players,
     conn:         conn,
+    clock:        systemClock{},
     clients:      make(map[string]*Client),
-    eventManager: NewEventManager(),
-  }, nil
+    eventManager: eventManager,
+    zones:        make(map[string]*Zone),
+    adminToken:   config.AdminToken,
+    config:       config,
+    startedAt:    time.Now(),
+    done:         make(chan struct{}),
+    bans:         make(map[string]Ban),
+    kicked:       make(map[string]time.Time),
+    consoleConns: make(map[net.Conn]bool),
+    sessionToken: randomSessionToken,
+  }
+  server.mapGenerator = server.newMapGenerator()
+  return server, nil
+}
+
+// every map generator of the server, recordings keep the map files they
+// change and replays never write them
+func (server *Server) newMapGenerator() *MapGenerator {
+  mapGenerator := NewMapGenerator(server.eventManager)
+  mapGenerator.onSave = server.recordMapFile
+  if server.mapFiles != nil {
+    mapGenerator.UseMapFiles(server.mapFiles)
+  }
+  return mapGenerator
+}
+
+// the main zone uses a map imported from an image instead of a generated one
+func (server *Server) ImportWorld(image string, options HeightmapImport, seed int64, filename string) error {
+  if err := server.mapGenerator.ImportAndSave(image, options, seed, filename); err != nil {
+    return err
+  }
+  server.AddZone(NewZone(defaultZoneName, server.mapGenerator))
+  return nil
+}
+
+func (server *Server) EnableChunkedWorld(seed int64, dir string, capacity int) {
+  chunks := NewChunkManager(server.mapGenerator, seed, dir, capacity)
+  server.AddZone(NewChunkedZone(defaultZoneName, chunks))
+  worldLog.Info("chunked world enabled", "seed", seed, "cache", capacity)
+}
+
+// sets up the main zone of the configured world
+func (server *Server) LoadWorld() error {
+  config := server.config
+  switch config.World {
+  case WorldHeightmap:
+    options := HeightmapImport{
+      MaxVal:   config.Heightmap.MaxVal,
+      Scale:    float32(config.Heightmap.Scale),
+      SeaLevel: float32(config.Heightmap.SeaLevel),
+      Width:    config.Heightmap.Width,
+      Height:   config.Heightmap.Height,
+    }
+    file := config.Heightmap.File
+    name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+    if err := server.ImportWorld(file, options, config.Seed, filepath.Join(config.MapDir, name+".bin")); err != nil {
+      return fmt.Errorf("heightmap import failed: %w", err)
+    }
+  case WorldMaps:
+    rotation := NewMapRotation(config.MapDir, config.Maps, config.RegenerateMap)
+    rotation.SetInterval(config.RotateEvery.Std())
+    rotation.SetGeneratedSize(config.MapWidth, config.MapHeight, config.MapMaxVal)
+    if err := server.UseMapRotation(rotation); err != nil {
+      return fmt.Errorf("map loading failed: %w", err)
+    }
+  default:
+    server.EnableChunkedWorld(config.Seed, config.ChunkDir, config.ChunkCacheSize)
+  }
+  return nil
+}
+
+// replaces the player store, nil disables persistence. Must be called
+// before Start.
+func (server *Server) SetPlayerStore(store PlayerStore) {
+  server.players = store
+}
+
+// an empty token disables admin logins
+func (server *Server) SetAdminToken(token string) {
+  server.adminToken = token
+}
+
+func (server *Server) sendJSON(addr *net.UDPAddr, msg interface{}) {
+  data, err := json.Marshal(msg)
+  if err != nil {
+    netLog.Error("json marshal failed", "err", err)
+    return
+  }
+  
+  if err := server.writeTo(data, addr); err != nil {
+    netLog.Warn("send failed", "addr", addr.String(), "err", err)
+  }
+}
+
+// every outgoing datagram goes through here so it is counted
+func (server *Server) writeTo(data []byte, addr *net.UDPAddr) error {
+  // bots have no address
+  if addr == nil {
+    return nil
+  }
+  n, err := server.conn.WriteToUDP(data, addr)
+  if err != nil {
+    sendErrors.Inc()
+    return err
+  }
+  packetsOut.Inc()
+  bytesOut.Add(n)
+  return nil
 }
 
 func (server *Server) listClients() {
   server.mu.RLock()
   defer server.mu.RUnlock()
   
-  fmt.Println("\n=== Clients list ===")
-  if len(server.clients) == 0 {
-    fmt.Println("No connected client")
-  } else {
-    for key, client := range server.clients {
-      fmt.Printf("- %s\n", key)
-      fmt.Printf("  Type: %s\n", client.user.userType)
-      fmt.Printf("  Location: (%.2f, %.2f, %.2f)\n", 
-        client.user.location.x, client.user.location.y, client.user.location.z)
-      fmt.Printf("  Orientation: %.2f°\n", client.user.orientation)
-      fmt.Printf("  Active: %t\n", client.user.isActive)
-      fmt.Printf("  Last activity: %s\n", time.Since(client.lastSeen).Round(time.Second))
-    }
+  worldLog.Info("clients", "count", len(server.clients), "zones", len(server.zones))
+  for key, client := range server.clients {
+    worldLog.Debug("client",
+      "id", key,
+      "zone", client.zone.name,
+      "type", client.user.userType,
+      "location", [3]float32{client.user.location.x, client.user.location.y, client.user.location.z},
+      "orientation", client.user.orientation,
+      "active", client.user.isActive,
+      "idle", time.Since(client.lastSeen).Round(time.Second))
   }
-  fmt.Println("========================\n")
 }
 
 func (server *Server) cleanInactiveClients(timeout time.Duration) {
   server.mu.Lock()
   defer server.mu.Unlock()
   
-  now := time.Now()
+  now := server.clock.Now()
+  server.recordCleanup(now)
+  for key, until := range server.kicked {
+    if !now.Before(until) {
+      delete(server.kicked, key)
+    }
+  }
   for key, client := range server.clients {
-    if now.Sub(client.lastSeen) > timeout {
-      fmt.Printf("x Client timeout: %s\n", key)
-      delete(server.clients, key)
+    if client.addr != nil && now.Sub(client.lastSeen) > timeout {
+      netLog.Info("client timed out", "id", key)
+      server.removeClient(key, client)
+      server.eventManager.DispatchAsync(Event{Type: EventClientTimedOut, Data: ClientData{ID: key, Zone: client.zone.name}})
     }
   }
 }
 
 func (server *Server) broadcastWorldState() {
   server.mu.RLock()
+  zones := make([]*Zone, 0, len(server.zones))
+  for _, zone := range server.zones {
+    zones = append(zones, zone)
+  }
+  server.mu.RUnlock()
+  
+  for _, zone := range zones {
+    server.broadcastZoneState(zone)
+  }
+}
+
+func (server *Server) broadcastZoneState(zone *Zone) {
+  server.mu.RLock()
   
   worldUpdate := WorldUpdate{
     Type:  "world_update",
-    Users: make([]UserData, 0, len(server.clients)),
+    Users: make([]UserData, 0, len(zone.clients)),
   }
   
-  for _, client := range server.clients {
+  for _, client := range zone.clients {
     if client.user == nil {
-      fmt.Printf("WARNING: Client %s has NIL user!\n", client.addr.String())
+      worldLog.Warn("client without user", "addr", client.addr.String())
       continue
     }
     worldUpdate.Users = append(worldUpdate.Users, UserData{
@@ -95,17 +302,20 @@ func (server *Server) broadcastWorldState() {
   
   server.mu.RUnlock()
   
+  if len(worldUpdate.Users) == 0 {
+    return
+  }
+  
   data, err := json.Marshal(worldUpdate)
   if err != nil {
-    fmt.Printf("JSON marshal error: %v\n", err)
+    netLog.Error("json marshal failed", "type", worldUpdate.Type, "err", err)
     return
   }
   
   server.mu.RLock()
-  for _, client := range server.clients {
-    _, err := server.conn.WriteToUDP(data, client.addr)
-    if err != nil {
-      fmt.Printf("x Broadcast error to %s: %v\n", client.addr.String(), err)
+  for _, client := range zone.clients {
+    if err := server.writeTo(data, client.addr); err != nil {
+      netLog.Warn("broadcast failed", "addr", client.addr.String(), "err", err)
     }
   }
   server.mu.RUnlock()
@@ -119,31 +329,30 @@ func (server *Server) sendConnectionConfirm(addr *net.UDPAddr, clientID string)
   
   confirmData, err := json.Marshal(confirmMsg)
   if err != nil {
-    fmt.Printf("JSON marshal error for connection_confirm: %v\n", err)
+    netLog.Error("json marshal failed", "type", confirmMsg.Type, "err", err)
     return
   }
   
-  _, err = server.conn.WriteToUDP(confirmData, addr)
-  if err != nil {
-    fmt.Printf("x Failed to send connection_confirm to %s: %v\n", addr.String(), err)
+  if err := server.writeTo(confirmData, addr); err != nil {
+    netLog.Warn("send failed", "type", confirmMsg.Type, "addr", addr.String(), "err", err)
   } else {
-    fmt.Printf("+ Sent connection_confirm to %s (ID: %s)\n", addr.String(), clientID)
+    netLog.Debug("connection confirmed", "addr", addr.String(), "id", clientID)
   }
 }
 
 func (server *Server) startBackgroundTasks() {
   // Clean inactive clients
   go func() {
-    ticker := time.NewTicker(time.Second)
+    ticker := time.NewTicker(server.config.CleanupEvery.Std())
     defer ticker.Stop()
     for range ticker.C {
-      server.cleanInactiveClients(10 * time.Second)
+      server.cleanInactiveClients(server.config.ClientTimeout.Std())
     }
   }()
   
   // Display client list periodically
   go func() {
-    ticker := time.NewTicker(15 * time.Second)
+    ticker := time.NewTicker(server.config.ListEvery.Std())
     defer ticker.Stop()
     for range ticker.C {
       server.listClients()
@@ -152,42 +361,235 @@ func (server *Server) startBackgroundTasks() {
   
   // Broadcast world state
   go func() {
-    ticker := time.NewTicker(100 * time.Millisecond)
+    ticker := time.NewTicker(server.config.SnapshotInterval())
     defer ticker.Stop()
     for range ticker.C {
+      start := time.Now()
       server.broadcastWorldState()
+      broadcastDuration.ObserveSince(start)
+    }
+  }()
+  
+  // Move users standing in portals, then fire trigger enter and exit events
+  go func() {
+    ticker := time.NewTicker(server.config.TickInterval())
+    defer ticker.Stop()
+    for range ticker.C {
+      server.runTick()
+    }
+  }()
+  
+  // Send terrain chunks near each client
+  go func() {
+    ticker := time.NewTicker(server.config.StreamInterval.Std())
+    defer ticker.Stop()
+    for range ticker.C {
+      server.streamChunks()
+    }
+  }()
+  
+  // Save the identified players
+  go func() {
+    ticker := time.NewTicker(server.config.PlayerSaveEvery.Std())
+    defer ticker.Stop()
+    for range ticker.C {
+      server.saveAllPlayers()
+    }
+  }()
+  
+  // Snapshot the world, a crash loses at most one interval
+  go func() {
+    if server.config.WorldFile == "" {
+      return
+    }
+    ticker := time.NewTicker(server.config.WorldSaveEvery.Std())
+    defer ticker.Stop()
+    for range ticker.C {
+      server.saveWorldFile()
+    }
+  }()
+  
+  // Measure the round trip to each client
+  go func() {
+    ticker := time.NewTicker(pingInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+      server.pingClients()
     }
   }()
 }
 
-func (server *Server) handleNewClient(addr *net.UDPAddr, clientKey string) {
-  user := randomSpawn(clientKey, UserTypePlayer, server.conn, 0, 10, 0, 0, 0, 10)
+// one game tick, replays run the recorded ticks through it
+func (server *Server) runTick() {
+  server.mu.Lock()
+  defer server.mu.Unlock()
   
-  client := &Client{
-    addr:     addr,
-    lastSeen: time.Now(),
-    user:     user,
-  }
+  server.tick++
+  now := server.clock.Now()
+  
+  start := time.Now()
+  server.checkPortals(now)
+  tickDuration.With("portals").ObserveSince(start)
   
-  server.clients[clientKey] = client
+  start = time.Now()
+  server.checkTriggers()
+  tickDuration.With("triggers").ObserveSince(start)
   
-  fmt.Printf("+ new client spawned at (%.2f, %.2f, %.2f) orientation: %.2f\n",
-    user.location.x, user.location.y, user.location.z, user.orientation)
+  start = time.Now()
+  server.moveBots()
+  tickDuration.With("bots").ObserveSince(start)
+  
+  server.recordTick(now)
+}
+
+// walking bots move toward their next waypoint, a bot the terrain stops
+// drops its path
+// must be called with server.mu held
+func (server *Server) moveBots() {
+  step := min(botSpeed*float32(server.config.TickInterval().Seconds()), maxMoveStep)
+  for _, key := range sortedKeys(server.clients) {
+    client := server.clients[key]
+    if len(client.path) == 0 {
+      continue
+    }
+    user := client.user
+    waypoint := client.path[0]
+    dx, dz := waypoint.x-user.location.x, waypoint.z-user.location.z
+    dist := float32(math.Hypot(float64(dx), float64(dz)))
+    target := waypoint
+    if dist > step {
+      target = Vector3{x: user.location.x + dx*step/dist, y: user.location.y, z: user.location.z + dz*step/dist}
+    } else {
+      client.path = client.path[1:]
+    }
+    
+    terrain := client.zone.terrain()
+    from := user.location
+    if !user.moveTo(terrain, snapToGround(terrain, target)) {
+      worldLog.Debug("bot stopped", "id", user.id, "location", [3]float32{from.x, from.y, from.z})
+      client.path = nil
+    }
+    if user.location != from {
+      server.dispatchUserMoved(client, from, "walk")
+    }
+  }
+}
+
+// a ping still unanswered at the next one is lost, the last measured
+// round trip is kept
+func (server *Server) pingClients() {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+  
+  now := server.clock.Now()
+  for _, client := range server.clients {
+    if client.addr == nil {
+      continue
+    }
+    server.pingCount++
+    client.pingNonce, client.pingSentAt = server.pingCount, now
+    server.sendJSON(client.addr, Ping{Type: "ping", Nonce: client.pingNonce})
+  }
+}
+
+// a first message identifying the player spawns it where it left
+func (server *Server) handleNewClient(addr *net.UDPAddr, clientKey string, data []byte) bool {
+  if ban, ok := server.activeBan(addr.IP.String()); ok {
+    netLog.Debug("banned client ignored", "addr", clientKey, "reason", ban.Reason)
+    return false
+  }
+  if until, ok := server.kicked[clientKey]; ok {
+    if server.clock.Now().Before(until) {
+      netLog.Debug("kicked client ignored", "addr", clientKey, "until", until)
+      return false
+    }
+    delete(server.kicked, clientKey)
+  }
+  if server.config.MaxClients > 0 && len(server.clients) >= server.config.MaxClients {
+    netLog.Warn("server full, client ignored", "clients", len(server.clients), "addr", clientKey)
+    return false
+  }
+  var state *PlayerState
+  player, session, secret := identifiedPlayer(data)
+  if player != "" {
+    var err error
+    if state, err = server.takeOverPlayer(player, session, secret); err != nil {
+      netLog.Debug("identify refused", "addr", clientKey, "player", player, "err", err)
+      server.sendJSON(addr, AdminNotice{Type: "identify_refused", Message: err.Error()})
+      return false
+    }
+  }
+  client := server.spawnClient(addr, clientKey, UserTypePlayer, state)
+  client.player = player
+  if player != "" {
+    if state != nil {
+      client.secretHash = state.SecretHash
+    }
+    server.startSession(client)
+  }
+  user := client.user
+  netLog.Info("client connected", "id", clientKey, "player", player, "restored", state != nil, "zone", client.zone.name,
+    "location", [3]float32{user.location.x, user.location.y, user.location.z}, "orientation", user.orientation)
   
   server.sendConnectionConfirm(addr, clientKey)
+  server.sendZoneChange(client)
+  server.eventManager.DispatchAsync(Event{Type: EventClientConnected, Data: ClientData{ID: clientKey, Zone: client.zone.name}})
+  return true
+}
+
+// adds a user where state left it, or at a random spot of the main zone
+// without state. must be called with server.mu held
+func (server *Server) spawnClient(addr *net.UDPAddr, key string, userType UserType, state *PlayerState) *Client {
+  zone := server.zone(defaultZoneName)
+  
+  user := randomSpawn(server.spawnRNG, key, userType, server.conn, 0, 10, 0, 0, 0, 10)
+  if state != nil {
+    zone = server.zone(state.Zone)
+    user.location = Vector3{x: state.Location[0], y: state.Location[1], z: state.Location[2]}
+    user.orientation = state.Orientation
+    user.stats = maps.Clone(state.Stats)
+  }
+  user.location = zone.groundAt(user.location)
+  
+  client := &Client{
+    addr:       addr,
+    lastSeen:   server.clock.Now(),
+    user:       user,
+    sentChunks: make(map[ChunkCoord]time.Time),
+    zone:       zone,
+  }
+  
+  server.clients[key] = client
+  zone.clients[key] = client
+  server.eventManager.DispatchAsync(Event{
+    Type: EventUserSpawned,
+    Data: UserSpawnedData{ID: key, Type: userType, Zone: zone.name, Location: user.location},
+  })
+  return client
 }
 
 func (server *Server) Start() {
   defer server.conn.Close()
+  // after the api and consoles, handlers may still send to clients
+  defer server.eventManager.Close(eventDrainTimeout)
+  defer server.stopRecording()
+  defer server.stopPlayers()
+  // once the consoles and the api can no longer change the world
+  defer server.saveWorldFile()
+  defer server.stopConsoles()
+  defer server.stopAPI()
   
-  fmt.Printf("UDP server started on port %d\n", server.conn.LocalAddr().(*net.UDPAddr).Port)
-  
-  server.startBackgroundTasks()
+  netLog.Info("udp server started", "port", server.conn.LocalAddr().(*net.UDPAddr).Port)
   
-  mapGenerator := NewMapGenerator(server.eventManager);
+  On(server.eventManager, EventTerrainEdited, server.sendTerrainDelta)
+  On(server.eventManager, EventTriggerEnter, logTriggerEvent(EventTriggerEnter))
+  On(server.eventManager, EventTriggerExit, logTriggerEvent(EventTriggerExit))
+  for _, eventType := range []EventType{EventClientConnected, EventClientTimedOut, EventUserSpawned, EventServerStarted, EventServerStopping} {
+    server.eventManager.Subscribe(eventType, logEvent)
+  }
   
   server.eventManager.Subscribe(EventMapGenerated, func(event Event) {
-    fmt.Println("generate map generation status to be sent to client...")
+    eventsLog.Debug("map generated, status not sent to clients yet")
     
     /*
     // todo send check artefacts
@@ -200,33 +602,217 @@ func (server *Server) Start() {
     */
   })
 
-  // tmp
-  err := mapGenerator.GenerateAndSave(128.0, 128.0, 32.0, "data/map0.bin")
-  if (err != nil) {
-    fmt.Printf("Read error %v\n", err)
+  server.prepareZones()
+  if server.config.RestoreWorld {
+    server.restoreWorldFile()
   }
+  // the recording starts with a snapshot of the restored world
+  server.startRecording()
+  
+  server.startBackgroundTasks()
+  server.startMapRotation()
+  server.startMetrics()
+  server.startConsoles()
+  server.startAPI()
+  
+  server.eventManager.DispatchAsync(Event{
+    Type: EventServerStarted,
+    Data: ServerData{Port: server.conn.LocalAddr().(*net.UDPAddr).Port, World: server.config.World},
+  })
   
   buffer := make([]byte, 1024)
   
   for {
     nByte, addr, err := server.conn.ReadFromUDP(buffer)
     if err != nil {
-      fmt.Printf("Read error %v\n", err)
+      select {
+      case <-server.done:
+        netLog.Info("udp server stopped")
+        return
+      default:
+      }
+      netLog.Warn("read failed", "err", err)
       continue
     }
-    
-    clientKey := addr.String()
-    
-    server.mu.Lock()
-    client, exists := server.clients[clientKey]
-    if !exists {
-      server.handleNewClient(addr, clientKey)
-    } else {
-      client.lastSeen = time.Now()
+    packetsIn.Inc()
+    bytesIn.Add(nByte)
+    server.handleDatagram(addr, buffer[:nByte])
+  }
+}
+
+// the main zone falls back to a generated map when no world was set up
+func (server *Server) prepareZones() {
+  if _, ok := server.zones[defaultZoneName]; !ok {
+    if err := server.UseMapRotation(NewMapRotation(server.config.MapDir, nil, false)); err != nil {
+      mapLog.Error("map loading failed", "err", err)
+      server.AddZone(NewZone(defaultZoneName, server.mapGenerator))
     }
-    server.mu.Unlock()
-    
-    message := string(buffer[:nByte])
-    fmt.Printf("+ received from %s: %s\n", addr.String(), message)
+  }
+  
+  if err := server.LoadZones(server.config.ZoneDir); err != nil {
+    worldLog.Error("zones loading failed", "err", err)
+  }
+  server.validatePortals()
+  server.validateTriggers()
+}
+
+// replays feed the recorded datagrams through here
+func (server *Server) handleDatagram(addr *net.UDPAddr, data []byte) {
+  clientKey := addr.String()
+  
+  server.mu.Lock()
+  defer server.mu.Unlock()
+  
+  now := server.clock.Now()
+  server.recordDatagram(now, addr, data)
+  client, exists := server.clients[clientKey]
+  if !exists {
+    if !server.handleNewClient(addr, clientKey, data) {
+      return
+    }
+    client = server.clients[clientKey]
+  } else {
+    client.lastSeen = now
+  }
+  server.handleMessage(client, data)
+}
+
+// must be called with server.mu held
+func (server *Server) handleMessage(client *Client, data []byte) {
+  var msg ClientMessage
+  if err := json.Unmarshal(data, &msg); err != nil {
+    malformedPackets.Inc()
+    netLog.Debug("non json datagram", "addr", client.addr.String(), "data", string(data))
+    return
+  }
+  
+  switch msg.Type {
+  case "move":
+    from := client.user.location
+    target := Vector3{x: msg.Location[0], y: msg.Location[1], z: msg.Location[2]}
+    accepted := client.user.moveTo(client.zone.terrain(), target)
+    if client.user.location != from {
+      server.dispatchUserMoved(client, from, "move")
+    }
+    if !accepted {
+      worldLog.Debug("move corrected", "id", client.user.id,
+        "location", [3]float32{client.user.location.x, client.user.location.y, client.user.location.z})
+    }
+    client.user.orientation = msg.Orientation
+  case "admin_login":
+    if server.adminToken == "" || subtle.ConstantTimeCompare([]byte(msg.Token), []byte(server.adminToken)) != 1 {
+      netLog.Warn("admin login refused", "id", client.user.id)
+      return
+    }
+    client.user.userType = UserTypeAdmin
+    netLog.Info("admin logged in", "id", client.user.id)
+  case "identify":
+    if msg.Player != "" {
+      server.identify(client, msg.Player, msg.Session, msg.Secret)
+    }
+  case "pong":
+    if msg.Nonce != 0 && msg.Nonce == client.pingNonce {
+      client.rtt = server.clock.Now().Sub(client.pingSentAt)
+      client.pingNonce = 0
+    }
+  case "chunk_ack":
+    coord := ChunkCoord{X: msg.X, Z: msg.Z}
+    if _, sent := client.sentChunks[coord]; sent {
+      client.sentChunks[coord] = time.Time{}
+    }
+  case "terrain_edit":
+    server.editTerrain(client, msg.Edit)
+  case "map_info":
+    server.sendMapInfo(client)
+  case "map_rotate":
+    if client.user.userType != UserTypeAdmin {
+      netLog.Warn("map rotation refused for non admin", "id", client.user.id)
+      return
+    }
+    if server.replaying {
+      return
+    }
+    // loading the map takes a while, do not hold the server lock
+    go func() {
+      if err := server.RotateMap(); err != nil {
+        mapLog.Error("map rotation failed", "err", err)
+      }
+    }()
+  default:
+    netLog.Debug("unknown message type", "addr", client.addr.String(), "type", msg.Type)
+  }
+}
+
+func logEvent(event Event) {
+  eventsLog.Debug(string(event.Type), "data", fmt.Sprintf("%+v", event.Data))
+}
+
+// must be called with server.mu held
+func (server *Server) dispatchUserMoved(client *Client, from Vector3, cause string) {
+  server.eventManager.DispatchAsync(Event{
+    Type: EventUserMoved,
+    Data: UserMovedData{ID: client.user.id, Zone: client.zone.name, From: from, To: client.user.location, Cause: cause},
+  })
+}
+
+// must be called with server.mu held
+func (server *Server) editTerrain(client *Client, edit *TerrainEdit) {
+  if client.user.userType != UserTypeAdmin {
+    netLog.Warn("terrain edit refused for non admin", "id", client.user.id)
+    return
+  }
+  if edit == nil {
+    return
+  }
+  
+  region, delta, err := client.zone.ApplyEdit(*edit)
+  if err != nil {
+    mapLog.Warn("terrain edit failed", "id", client.user.id, "err", err)
+    return
+  }
+  // a lost delta is made up for by streaming the edited chunks again
+  for _, other := range client.zone.clients {
+    for _, coord := range region.chunks() {
+      delete(other.sentChunks, coord)
+    }
+  }
+  
+  server.eventManager.DispatchAsync(Event{
+    Type: EventTerrainEdited,
+    Data: TerrainEditedData{
+      Zone:   client.zone.name,
+      User:   client.user.id,
+      Edit:   *edit,
+      Region: region,
+      Delta:  delta,
+    },
+  })
+}
+
+func (server *Server) sendTerrainDelta(data TerrainEditedData) {
+  region := data.Region
+  
+  encoded, err := EncodeMapBytes(data.Delta, EncodingCompressed)
+  if err != nil {
+    mapLog.Error("terrain delta encoding failed", "err", err)
+    return
+  }
+  
+  delta := TerrainDelta{
+    Type: "terrain_delta",
+    X:    region.X,
+    Z:    region.Z,
+    Data: encoded,
+  }
+  
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+  
+  zone, ok := server.zones[data.Zone]
+  if !ok {
+    return
+  }
+  for _, client := range zone.clients {
+    server.sendJSON(client.addr, delta)
   }
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+  "math"
+)
+
+// rise over run, 1.0 is a 45° slope
+const maxWalkableSlope = 1.0
+
+type Terrain interface {
+  HeightAt(x, z float32) (float32, bool)
+  ObstacleAt(x, z, radius float32) bool
+  LayersAt(x, z float32) (CellLayers, bool)
+}
+
+func (mapData *MapData) InBounds(x, z float32) bool {
+  return x >= 0 && z >= 0 &&
+    x <= float32(mapData.Width-1) && z <= float32(mapData.Height-1)
+}
+
+// bilinear sample, x maps to columns and z to rows of Data
+func (mapData *MapData) HeightAt(x, z float32) (float32, bool) {
+  if mapData.Width == 0 || mapData.Height == 0 || !mapData.InBounds(x, z) {
+    return 0, false
+  }
+
+  x0 := int(math.Floor(float64(x)))
+  z0 := int(math.Floor(float64(z)))
+  x1 := min(x0+1, mapData.Width-1)
+  z1 := min(z0+1, mapData.Height-1)
+
+  tx := x - float32(x0)
+  tz := z - float32(z0)
+
+  h00 := mapData.Data[z0][x0]
+  h10 := mapData.Data[z0][x1]
+  h01 := mapData.Data[z1][x0]
+  h11 := mapData.Data[z1][x1]
+
+  top := h00 + (h10-h00)*tx
+  bottom := h01 + (h11-h01)*tx
+
+  return top + (bottom-top)*tz, true
+}
+
+// the longest move a single message may make, faster clients are pulled back
+const maxMoveStep = 5
+
+// spacing of the terrain samples checked along a move
+const moveSampleStep = 0.5
+
+// returns the position the server accepts for a move from -> to
+// and whether the requested move was accepted as is
+func resolveMove(terrain Terrain, from, to Vector3) (Vector3, bool) {
+  if terrain == nil {
+    return to, true
+  }
+
+  dx := float64(to.x - from.x)
+  dz := float64(to.z - from.z)
+  length := math.Hypot(dx, dz)
+  if length > maxMoveStep {
+    return from, false
+  }
+
+  groundTo, ok := terrain.HeightAt(to.x, to.z)
+  if !ok {
+    return from, false
+  }
+
+  // the path is walked in small steps so a move cannot jump over a ridge
+  // or an object. users stuck in an object may still walk out of it
+  if groundFrom, ok := terrain.HeightAt(from.x, from.z); ok {
+    steps := int(math.Ceil(length / moveSampleStep))
+    prevX, prevZ, prevH := from.x, from.z, groundFrom
+    blocked := terrain.ObstacleAt(from.x, from.z, userRadius)
+    for i := 1; i <= steps; i++ {
+      t := float64(i) / float64(steps)
+      x := float32(float64(from.x) + dx*t)
+      z := float32(float64(from.z) + dz*t)
+      h, ok := terrain.HeightAt(x, z)
+      if !ok {
+        return from, false
+      }
+      run := math.Hypot(float64(x-prevX), float64(z-prevZ))
+      if run > 0 && math.Abs(float64(h-prevH))/run > maxWalkableSlope {
+        return from, false
+      }
+      obstacle := terrain.ObstacleAt(x, z, userRadius)
+      if obstacle && !blocked {
+        return from, false
+      }
+      blocked = obstacle
+      prevX, prevZ, prevH = x, z, h
+    }
+  } else if terrain.ObstacleAt(to.x, to.z, userRadius) {
+    return from, false
+  }
+
+  if to.y < groundTo {
+    to.y = groundTo
+    return to, false
+  }
+
+  return to, true
+}
+
+func snapToGround(terrain Terrain, location Vector3) Vector3 {
+  if terrain == nil {
+    return location
+  }
+
+  if ground, ok := terrain.HeightAt(location.x, location.z); ok {
+    location.y = ground
+  }
+  return location
+}
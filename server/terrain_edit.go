@@ -0,0 +1,267 @@
+package main
+
+import (
+  "fmt"
+  "math"
+)
+
+const (
+  EditRaise   = "raise"
+  EditLower   = "lower"
+  EditFlatten = "flatten"
+  EditSmooth  = "smooth"
+)
+
+const maxEditRadius = 32
+
+// brush edit, raise and lower move heights by up to Strength units,
+// flatten and smooth blend by Strength in [0, 1]
+type TerrainEdit struct {
+  Op       string  `json:"op"`
+  X        float32 `json:"x"`
+  Z        float32 `json:"z"`
+  Radius   float32 `json:"radius"`
+  Strength float32 `json:"strength"`
+  Height   float32 `json:"height,omitempty"`
+}
+
+// cells in [X, X+Width) x [Z, Z+Height)
+type MapRegion struct {
+  X      int `json:"x"`
+  Z      int `json:"z"`
+  Width  int `json:"width"`
+  Height int `json:"height"`
+}
+
+type heightSampler func(x, z int) (float32, bool)
+
+func (edit TerrainEdit) validate() error {
+  switch edit.Op {
+  case EditRaise, EditLower, EditFlatten, EditSmooth:
+  default:
+    return fmt.Errorf("unknown edit operation: %s", edit.Op)
+  }
+  if edit.Radius <= 0 || edit.Radius > maxEditRadius {
+    return fmt.Errorf("edit radius must be in (0, %d]", maxEditRadius)
+  }
+  if edit.Strength <= 0 {
+    return fmt.Errorf("edit strength must be positive")
+  }
+  return nil
+}
+
+func (edit TerrainEdit) region() MapRegion {
+  x0 := int(math.Floor(float64(edit.X - edit.Radius)))
+  z0 := int(math.Floor(float64(edit.Z - edit.Radius)))
+  x1 := int(math.Ceil(float64(edit.X + edit.Radius)))
+  z1 := int(math.Ceil(float64(edit.Z + edit.Radius)))
+  return MapRegion{X: x0, Z: z0, Width: x1 - x0 + 1, Height: z1 - z0 + 1}
+}
+
+func (region MapRegion) clip(width, height int) MapRegion {
+  x0 := max(region.X, 0)
+  z0 := max(region.Z, 0)
+  x1 := min(region.X+region.Width, width)
+  z1 := min(region.Z+region.Height, height)
+  return MapRegion{X: x0, Z: z0, Width: max(0, x1-x0), Height: max(0, z1-z0)}
+}
+
+// chunks holding cells of the region, the cells on a chunk border belong
+// to both chunks
+func (region MapRegion) chunks() []ChunkCoord {
+  first := chunkCoordAt(float32(region.X-1), float32(region.Z-1))
+  last := chunkCoordAt(float32(region.X+region.Width), float32(region.Z+region.Height))
+  var coords []ChunkCoord
+  for cz := first.Z; cz <= last.Z; cz++ {
+    for cx := first.X; cx <= last.X; cx++ {
+      coords = append(coords, ChunkCoord{X: cx, Z: cz})
+    }
+  }
+  return coords
+}
+
+// new height of the cell at (x, z), reading the heights before the edit
+func (edit TerrainEdit) heightAt(x, z int, sample heightSampler) (float32, bool) {
+  h, ok := sample(x, z)
+  if !ok {
+    return 0, false
+  }
+
+  dist := math.Hypot(float64(float32(x)-edit.X), float64(float32(z)-edit.Z))
+  if dist >= float64(edit.Radius) {
+    return h, false
+  }
+  weight := float32(1 - dist/float64(edit.Radius))
+
+  switch edit.Op {
+  case EditRaise:
+    return h + edit.Strength*weight, true
+  case EditLower:
+    return h - edit.Strength*weight, true
+  case EditFlatten:
+    return h + (edit.Height-h)*min(1, edit.Strength*weight), true
+  case EditSmooth:
+    var total, count float32
+    for dz := -1; dz <= 1; dz++ {
+      for dx := -1; dx <= 1; dx++ {
+        if nh, ok := sample(x+dx, z+dz); ok {
+          total += nh
+          count++
+        }
+      }
+    }
+    return h + (total/count-h)*min(1, edit.Strength*weight), true
+  }
+  return h, false
+}
+
+func (mapData *MapData) sampleCell(x, z int) (float32, bool) {
+  if x < 0 || z < 0 || x >= mapData.Width || z >= mapData.Height {
+    return 0, false
+  }
+  return mapData.Data[z][x], true
+}
+
+// copy on write: only the edited rows are copied, readers holding the
+// previous map keep a consistent view
+func (mapData *MapData) withEdit(edit TerrainEdit, originX, originZ int, sample heightSampler) (*MapData, bool) {
+  region := edit.region()
+  region.X -= originX
+  region.Z -= originZ
+  region = region.clip(mapData.Width, mapData.Height)
+  if region.Width == 0 || region.Height == 0 {
+    return mapData, false
+  }
+
+  edited := *mapData
+  edited.resetHash()
+  edited.Data = append([][]float32(nil), mapData.Data...)
+  changed := false
+  for z := region.Z; z < region.Z+region.Height; z++ {
+    row := append([]float32(nil), mapData.Data[z]...)
+    for x := region.X; x < region.X+region.Width; x++ {
+      if h, ok := edit.heightAt(originX+x, originZ+z, sample); ok {
+        row[x] = max(0, h)
+        changed = true
+      }
+    }
+    edited.Data[z] = row
+  }
+
+  // keep objects standing on the edited ground
+  if changed && len(mapData.Meta.Objects) > 0 {
+    edited.Meta.Objects = append([]MapObject(nil), mapData.Meta.Objects...)
+    for i := range edited.Meta.Objects {
+      object := &edited.Meta.Objects[i]
+      if h, ok := edited.HeightAt(object.X-float32(originX), object.Z-float32(originZ)); ok {
+        object.Y = h
+      }
+    }
+  }
+  return &edited, changed
+}
+
+// heights of a region in world cells, sent to clients as a small map blob
+func regionDelta(region MapRegion, maxVal int, sample heightSampler) *MapData {
+  data := make([][]float32, region.Height)
+  for z := 0; z < region.Height; z++ {
+    data[z] = make([]float32, region.Width)
+    for x := 0; x < region.Width; x++ {
+      data[z][x], _ = sample(region.X+x, region.Z+z)
+    }
+  }
+  return &MapData{
+    Width:  region.Width,
+    Height: region.Height,
+    MaxVal: maxVal,
+    Data:   data,
+  }
+}
+
+func (mg *MapGenerator) ApplyEdit(edit TerrainEdit) (MapRegion, *MapData, error) {
+  if err := edit.validate(); err != nil {
+    return MapRegion{}, nil, err
+  }
+
+  // serializes edits and their saves
+  mg.editMu.Lock()
+  defer mg.editMu.Unlock()
+
+  mg.mu.Lock()
+  current := mg.currentMap
+  if current == nil {
+    mg.mu.Unlock()
+    return MapRegion{}, nil, fmt.Errorf("no map loaded")
+  }
+  edited, changed := current.withEdit(edit, 0, 0, current.sampleCell)
+  if !changed {
+    mg.mu.Unlock()
+    return MapRegion{}, nil, fmt.Errorf("edit outside of the map")
+  }
+  mg.currentMap = edited
+  filename := mg.lastFilename
+  mg.mu.Unlock()
+
+  // the map and its hash match the file, like saveAndUse
+  if filename != "" {
+    if saved, err := mg.saveAndReload(edited, filename); err != nil {
+      mapLog.Error("edited map not saved", "err", err)
+    } else {
+      mg.mu.Lock()
+      if mg.currentMap == edited {
+        mg.currentMap = saved
+      }
+      mg.mu.Unlock()
+      edited = saved
+    }
+  }
+
+  region := edit.region().clip(edited.Width, edited.Height)
+  return region, regionDelta(region, edited.MaxVal, edited.sampleCell), nil
+}
+
+// must be called with cm.mu held
+func (cm *ChunkManager) sampleLocked(x, z int) (float32, bool) {
+  coord := chunkCoordAt(float32(x), float32(z))
+  chunk, err := cm.chunkLocked(coord)
+  if err != nil {
+    return 0, false
+  }
+  return chunk.sampleCell(x-int(coord.X)*ChunkSize, z-int(coord.Z)*ChunkSize)
+}
+
+// edits every chunk under the brush, including the overlapping borders,
+// and swaps them all at once
+func (cm *ChunkManager) ApplyEdit(edit TerrainEdit) (MapRegion, *MapData, error) {
+  if err := edit.validate(); err != nil {
+    return MapRegion{}, nil, err
+  }
+
+  cm.editMu.Lock()
+  defer cm.editMu.Unlock()
+  cm.mu.Lock()
+  defer cm.mu.Unlock()
+
+  region := edit.region()
+  edited := map[ChunkCoord]*MapData{}
+  for _, coord := range region.chunks() {
+    chunk, err := cm.chunkLocked(coord)
+    if err != nil {
+      return MapRegion{}, nil, err
+    }
+    if updated, changed := chunk.withEdit(edit, int(coord.X)*ChunkSize, int(coord.Z)*ChunkSize, cm.sampleLocked); changed {
+      edited[coord] = updated
+    }
+  }
+
+  for coord, chunk := range edited {
+    saved, err := cm.generator.saveAndReload(chunk, cm.chunkFilename(coord))
+    if err != nil {
+      mapLog.Error("edited chunk not saved", "x", coord.X, "z", coord.Z, "err", err)
+      saved = chunk
+    }
+    cm.storeLocked(coord, saved)
+  }
+
+  return region, regionDelta(region, chunkMaxVal, cm.sampleLocked), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+  "net"
+  "testing"
+  "time"
+)
+
+func TestEditedMapMatchesItsFile(t *testing.T) {
+  server := newTestServer(t)
+  zone := server.zones[defaultZoneName]
+
+  edit := TerrainEdit{Op: EditRaise, X: 10, Z: 12, Radius: 3, Strength: 1.37}
+  if _, _, err := zone.ApplyEdit(edit); err != nil {
+    t.Fatal(err)
+  }
+  saved, err := LoadMapFromFile(zone.mapGenerator.Filename())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if hash := zone.mapHash(); hash != saved.Hash() {
+    t.Fatalf("map hash %s after the edit, the file has %s", hash, saved.Hash())
+  }
+}
+
+func TestRegionChunks(t *testing.T) {
+  // cells 30..34 cross the border column 32 shared by chunks 0 and 1
+  coords := MapRegion{X: 30, Z: 4, Width: 5, Height: 3}.chunks()
+  found := map[ChunkCoord]bool{}
+  for _, coord := range coords {
+    found[coord] = true
+  }
+  for _, coord := range []ChunkCoord{{0, 0}, {1, 0}} {
+    if !found[coord] {
+      t.Fatalf("chunk %v missing from %v", coord, coords)
+    }
+  }
+}
+
+func TestTerrainEditResendsChunks(t *testing.T) {
+  server := newTestServer(t)
+  server.adminToken = "admin"
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"admin_login","token":"admin"}`))
+  client := server.clients[addr.String()]
+  if client.user.userType != UserTypeAdmin {
+    t.Fatal("admin login refused")
+  }
+  client.sentChunks[ChunkCoord{0, 0}] = time.Time{}
+  client.sentChunks[ChunkCoord{5, 5}] = time.Time{}
+
+  server.handleDatagram(addr, []byte(`{"type":"terrain_edit","edit":{"op":"raise","x":10,"z":10,"radius":2,"strength":1}}`))
+  if _, sent := client.sentChunks[ChunkCoord{0, 0}]; sent {
+    t.Fatal("edited chunk still marked as sent")
+  }
+  if _, sent := client.sentChunks[ChunkCoord{5, 5}]; !sent {
+    t.Fatal("chunk away from the edit marked as unsent")
+  }
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestResolveMoveOnFlatGround(t *testing.T) {
+  mapData := flatMap(16, 16, 2)
+  to := Vector3{x: 5, y: 2, z: 4}
+  if resolved, accepted := resolveMove(mapData, Vector3{x: 4, y: 2, z: 4}, to); !accepted || resolved != to {
+    t.Fatalf("flat move resolved to %v accepted %v", resolved, accepted)
+  }
+}
+
+func TestResolveMoveRefusesSteepSlopes(t *testing.T) {
+  // a one cell ridge between two flat areas at the same height
+  mapData := flatMap(16, 16, 0)
+  for z := range mapData.Data {
+    mapData.Data[z][8] = 10
+  }
+  from := Vector3{x: 6, z: 4}
+  if resolved, accepted := resolveMove(mapData, from, Vector3{x: 10, z: 4}); accepted || resolved != from {
+    t.Fatalf("move over the ridge resolved to %v accepted %v", resolved, accepted)
+  }
+
+  // steep on the way down as well
+  top := Vector3{x: 8, y: 10, z: 4}
+  if resolved, accepted := resolveMove(mapData, top, Vector3{x: 9, z: 4}); accepted || resolved != top {
+    t.Fatalf("move down the cliff resolved to %v accepted %v", resolved, accepted)
+  }
+}
+
+func TestResolveMoveRefusesObstacles(t *testing.T) {
+  mapData := flatMap(16, 16, 0)
+  mapData.Meta.Objects = []MapObject{{Kind: "rock", X: 6, Z: 4, Radius: 0.5}}
+  from := Vector3{x: 4, z: 4}
+  if resolved, accepted := resolveMove(mapData, from, Vector3{x: 8, z: 4}); accepted || resolved != from {
+    t.Fatalf("move through the rock resolved to %v accepted %v", resolved, accepted)
+  }
+
+  // a user stuck in the rock walks out of it
+  inside := Vector3{x: 6, z: 4}
+  out := Vector3{x: 6, z: 7}
+  if resolved, accepted := resolveMove(mapData, inside, out); !accepted || resolved != out {
+    t.Fatalf("move out of the rock resolved to %v accepted %v", resolved, accepted)
+  }
+}
+
+func TestResolveMoveRefusesLongJumps(t *testing.T) {
+  mapData := flatMap(64, 64, 0)
+  from := Vector3{x: 4, z: 4}
+  to := Vector3{x: 4 + maxMoveStep + 1, z: 4}
+  if resolved, accepted := resolveMove(mapData, from, to); accepted || resolved != from {
+    t.Fatalf("jump of %v resolved to %v accepted %v", maxMoveStep+1, resolved, accepted)
+  }
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "hash/fnv"
+  "io"
+  "math"
+  "net"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+  "time"
+)
+
+// the udp socket of the server, replays use a fake one
+type PacketConn interface {
+  ReadFromUDP(buffer []byte) (int, *net.UDPAddr, error)
+  WriteToUDP(data []byte, addr *net.UDPAddr) (int, error)
+  LocalAddr() net.Addr
+  Close() error
+}
+
+type Clock interface {
+  Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+  return time.Now()
+}
+
+// A recording is everything the world depends on: a snapshot of the world
+// when it starts, then each inbound datagram, each inactive client check,
+// each player loaded from the player store and session token given to a
+// player, each change made by an admin
+// and each tick boundary with a hash of the world state, in the order the
+// server applied them. Map and chunk files are kept as they were before
+// their first save of the recording.
+//
+// Recordings go with bug reports, so they hold no secret: the tokens of the
+// config are redacted, and the admin tokens, session tokens and player
+// secrets are replaced by placeholders in the records, the secret hashes by
+// the hashes of the placeholders. They are replaced consistently, so a
+// replay still accepts the same logins and refuses the same ones.
+//
+// The file starts with recordingMagic and the length prefixed json header.
+// Each record is its kind, the nanoseconds since the previous record as a
+// varint, then the fields of its kind, strings and bytes length prefixed.
+const recordingMagic = "RTGSREC\x01"
+
+type RecordKind byte
+
+const (
+  RecordDatagram RecordKind = iota + 1
+  RecordCleanup
+  RecordTick
+  RecordPlayerLoad
+  RecordAdmin
+  RecordMapFile
+  RecordSession
+)
+
+func (kind RecordKind) String() string {
+  switch kind {
+  case RecordDatagram:
+    return "datagram"
+  case RecordCleanup:
+    return "cleanup"
+  case RecordTick:
+    return "tick"
+  case RecordPlayerLoad:
+    return "player_load"
+  case RecordAdmin:
+    return "admin"
+  case RecordMapFile:
+    return "map_file"
+  case RecordSession:
+    return "session"
+  }
+  return fmt.Sprintf("record(%d)", kind)
+}
+
+type RecordingHeader struct {
+  StartedAt time.Time `json:"started_at"`
+  // redacted, the admin token is the placeholder of the recorded logins
+  Config   Config        `json:"config"`
+  Snapshot WorldSnapshot `json:"snapshot"`
+}
+
+// the fields of Kind are set, the others are zero
+type TrafficRecord struct {
+  Kind RecordKind
+  At   time.Time
+  // RecordDatagram, and RecordMapFile with File
+  Addr string
+  Data []byte
+  // RecordTick
+  Tick      uint64
+  StateHash uint64
+  // RecordPlayerLoad, State is nil for a player never saved, and
+  // RecordSession with Token
+  Player string
+  State  *PlayerState
+  Err    string
+  // RecordAdmin
+  Change *adminChange
+  Token  string
+  // RecordMapFile, Missing when the file did not exist yet
+  File    string
+  Missing bool
+}
+
+// a change of the world by an admin, from the console, the api or an admin
+// client. Op is the admin operation, the other fields its arguments.
+type adminChange struct {
+  Op       string     `json:"op"`
+  ID       string     `json:"id,omitempty"`
+  IP       string     `json:"ip,omitempty"`
+  Duration Duration   `json:"duration,omitempty"`
+  Reason   string     `json:"reason,omitempty"`
+  Location *[3]float32 `json:"location,omitempty"`
+  Seed     int64      `json:"seed,omitempty"`
+  File     string     `json:"file,omitempty"`
+}
+
+type TrafficRecorder struct {
+  mu       sync.Mutex
+  file     *os.File
+  writer   *bufio.Writer
+  previous time.Time
+  buffer   []byte
+  // map files already kept
+  files map[string]bool
+  // the secrets replaced by their placeholders, by hash for the session
+  // tokens and player secrets
+  adminToken string
+  tokens     map[string]string
+  // the first write error stops the recording
+  err error
+}
+
+// adminToken is the token of the server, the header holds it redacted. The
+// sessions and secret hashes of the snapshot are redacted too.
+func NewTrafficRecorder(filename string, header RecordingHeader, adminToken string) (*TrafficRecorder, error) {
+  recorder := &TrafficRecorder{
+    previous:   header.StartedAt,
+    files:      make(map[string]bool),
+    adminToken: adminToken,
+    tokens:     make(map[string]string),
+  }
+  header.Snapshot.Clients = slices.Clone(header.Snapshot.Clients)
+  for i := range header.Snapshot.Clients {
+    client := &header.Snapshot.Clients[i]
+    client.Session = recorder.redactToken(client.Session)
+    client.SecretHash = recorder.redactHash(client.SecretHash)
+  }
+  data, err := json.Marshal(header)
+  if err != nil {
+    return nil, err
+  }
+  if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+    return nil, err
+  }
+  file, err := os.Create(filename)
+  if err != nil {
+    return nil, err
+  }
+  recorder.file, recorder.writer = file, bufio.NewWriter(file)
+  recorder.buffer = append([]byte(recordingMagic), binary.AppendUvarint(nil, uint64(len(data)))...)
+  recorder.buffer = append(recorder.buffer, data...)
+  if _, err := recorder.writer.Write(recorder.buffer); err != nil {
+    file.Close()
+    return nil, err
+  }
+  return recorder, nil
+}
+
+func appendBytes(buffer, data []byte) []byte {
+  return append(binary.AppendUvarint(buffer, uint64(len(data))), data...)
+}
+
+func (recorder *TrafficRecorder) Write(record TrafficRecord) {
+  recorder.mu.Lock()
+  defer recorder.mu.Unlock()
+  if recorder.err != nil {
+    return
+  }
+
+  buffer := append(recorder.buffer[:0], byte(record.Kind))
+  buffer = binary.AppendVarint(buffer, int64(record.At.Sub(recorder.previous)))
+  recorder.previous = record.At
+  switch record.Kind {
+  case RecordDatagram:
+    buffer = appendBytes(buffer, []byte(record.Addr))
+    buffer = appendBytes(buffer, recorder.redactDatagram(record.Data))
+  case RecordTick:
+    buffer = binary.AppendUvarint(buffer, record.Tick)
+    buffer = binary.BigEndian.AppendUint64(buffer, record.StateHash)
+  case RecordPlayerLoad:
+    var state []byte
+    if record.State != nil {
+      redacted := *record.State
+      redacted.SecretHash = recorder.redactHash(redacted.SecretHash)
+      state, _ = json.Marshal(redacted)
+    }
+    buffer = appendBytes(buffer, []byte(record.Player))
+    buffer = appendBytes(buffer, state)
+    buffer = appendBytes(buffer, []byte(record.Err))
+  case RecordAdmin:
+    change, _ := json.Marshal(record.Change)
+    buffer = appendBytes(buffer, change)
+  case RecordSession:
+    buffer = appendBytes(buffer, []byte(record.Player))
+    buffer = appendBytes(buffer, []byte(recorder.redactToken(record.Token)))
+  case RecordMapFile:
+    buffer = appendBytes(buffer, []byte(record.File))
+    if record.Missing {
+      buffer = append(buffer, 1)
+    } else {
+      buffer = append(buffer, 0)
+    }
+    buffer = appendBytes(buffer, record.Data)
+  }
+  recorder.buffer = buffer
+
+  if _, err := recorder.writer.Write(buffer); err != nil {
+    recorder.fail(err)
+    return
+  }
+  // a crash loses at most the records of the current tick
+  if record.Kind == RecordTick {
+    if err := recorder.writer.Flush(); err != nil {
+      recorder.fail(err)
+    }
+  }
+}
+
+// the placeholder of the token or secret of this hash. A secret and its
+// hash get the same one, the hash is often recorded before the secret.
+// must be called with recorder.mu held
+func (recorder *TrafficRecorder) placeholder(hash string) string {
+  placeholder, ok := recorder.tokens[hash]
+  if !ok {
+    placeholder = fmt.Sprintf("token-%d", len(recorder.tokens)+1)
+    recorder.tokens[hash] = placeholder
+  }
+  return placeholder
+}
+
+// session tokens and player secrets, empty stays empty
+// must be called with recorder.mu held
+func (recorder *TrafficRecorder) redactToken(token string) string {
+  if token == "" {
+    return ""
+  }
+  return recorder.placeholder(hashSecret(token))
+}
+
+// must be called with recorder.mu held
+func (recorder *TrafficRecorder) redactHash(hash string) string {
+  if hash == "" {
+    return ""
+  }
+  return hashSecret(recorder.placeholder(hash))
+}
+
+// the datagram with its secrets replaced: the admin token by its
+// placeholder and any other token by nothing, the session tokens and
+// player secrets by theirs. Field names match without case like they do
+// for the server.
+// must be called with recorder.mu held
+func (recorder *TrafficRecorder) redactDatagram(data []byte) []byte {
+  var fields map[string]json.RawMessage
+  if err := json.Unmarshal(data, &fields); err != nil {
+    // the server ignores it as well, whatever it held
+    return []byte("redacted")
+  }
+  redacted := false
+  for name, value := range fields {
+    var secret, placeholder string
+    json.Unmarshal(value, &secret)
+    switch {
+    case strings.EqualFold(name, "token"):
+      if recorder.adminToken != "" && secret == recorder.adminToken {
+        placeholder = redactedSecret
+      }
+    case strings.EqualFold(name, "session"), strings.EqualFold(name, "secret"):
+      placeholder = recorder.redactToken(secret)
+    default:
+      continue
+    }
+    fields[name], _ = json.Marshal(placeholder)
+    redacted = true
+  }
+  if !redacted {
+    return data
+  }
+  data, _ = json.Marshal(fields)
+  return data
+}
+
+// records the content of filename the first time it is about to be saved
+func (recorder *TrafficRecorder) WriteMapFile(filename string, at time.Time) {
+  recorder.mu.Lock()
+  kept := recorder.files[filename]
+  recorder.files[filename] = true
+  recorder.mu.Unlock()
+  if kept {
+    return
+  }
+
+  record := TrafficRecord{Kind: RecordMapFile, At: at, File: filename}
+  data, err := os.ReadFile(filename)
+  switch {
+  case errors.Is(err, os.ErrNotExist):
+    record.Missing = true
+  case err != nil:
+    netLog.Warn("map file not recorded", "file", filename, "err", err)
+    return
+  }
+  record.Data = data
+  recorder.Write(record)
+}
+
+// must be called with recorder.mu held
+func (recorder *TrafficRecorder) fail(err error) {
+  recorder.err = err
+  netLog.Error("recording stopped", "file", recorder.file.Name(), "err", err)
+}
+
+// later records are ignored
+func (recorder *TrafficRecorder) Close() error {
+  recorder.mu.Lock()
+  defer recorder.mu.Unlock()
+  if recorder.err != nil {
+    return recorder.err
+  }
+  recorder.err = os.ErrClosed
+  if err := recorder.writer.Flush(); err != nil {
+    recorder.file.Close()
+    return err
+  }
+  return recorder.file.Close()
+}
+
+type Recording struct {
+  Header  RecordingHeader
+  Records []TrafficRecord
+}
+
+// a recording cut by a crash is read up to its last complete record
+func ReadRecording(filename string) (*Recording, error) {
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    return nil, err
+  }
+  if !bytes.HasPrefix(data, []byte(recordingMagic)) {
+    return nil, fmt.Errorf("%s is not a recording", filename)
+  }
+  reader := bytes.NewReader(data[len(recordingMagic):])
+
+  recording := &Recording{}
+  header, err := readBytes(reader)
+  if err != nil {
+    return nil, fmt.Errorf("invalid recording header: %v", err)
+  }
+  if err := json.Unmarshal(header, &recording.Header); err != nil {
+    return nil, fmt.Errorf("invalid recording header: %v", err)
+  }
+
+  at := recording.Header.StartedAt
+  for reader.Len() > 0 {
+    record, err := readRecord(reader, at)
+    if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+      netLog.Warn("recording truncated", "file", filename, "records", len(recording.Records))
+      break
+    }
+    if err != nil {
+      return nil, fmt.Errorf("invalid record %d: %v", len(recording.Records), err)
+    }
+    at = record.At
+    recording.Records = append(recording.Records, record)
+  }
+  return recording, nil
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+  size, err := binary.ReadUvarint(reader)
+  if err != nil {
+    return nil, err
+  }
+  if size > uint64(reader.Len()) {
+    return nil, io.ErrUnexpectedEOF
+  }
+  data := make([]byte, size)
+  reader.Read(data)
+  return data, nil
+}
+
+func readRecord(reader *bytes.Reader, previous time.Time) (TrafficRecord, error) {
+  var record TrafficRecord
+  kind, err := reader.ReadByte()
+  if err != nil {
+    return record, err
+  }
+  record.Kind = RecordKind(kind)
+  delta, err := binary.ReadVarint(reader)
+  if err != nil {
+    return record, io.ErrUnexpectedEOF
+  }
+  record.At = previous.Add(time.Duration(delta))
+
+  var addr, state, message []byte
+  switch record.Kind {
+  case RecordDatagram:
+    if addr, err = readBytes(reader); err == nil {
+      record.Data, err = readBytes(reader)
+    }
+    record.Addr = string(addr)
+  case RecordCleanup:
+  case RecordTick:
+    if record.Tick, err = binary.ReadUvarint(reader); err == nil {
+      err = binary.Read(reader, binary.BigEndian, &record.StateHash)
+    }
+  case RecordPlayerLoad:
+    var player []byte
+    if player, err = readBytes(reader); err == nil {
+      if state, err = readBytes(reader); err == nil {
+        message, err = readBytes(reader)
+      }
+    }
+    record.Player, record.Err = string(player), string(message)
+    if err == nil && len(state) > 0 {
+      record.State = &PlayerState{}
+      if err := json.Unmarshal(state, record.State); err != nil {
+        return record, err
+      }
+    }
+  case RecordAdmin:
+    var change []byte
+    if change, err = readBytes(reader); err == nil {
+      record.Change = &adminChange{}
+      if err := json.Unmarshal(change, record.Change); err != nil {
+        return record, err
+      }
+    }
+  case RecordSession:
+    var player, token []byte
+    if player, err = readBytes(reader); err == nil {
+      token, err = readBytes(reader)
+    }
+    record.Player, record.Token = string(player), string(token)
+  case RecordMapFile:
+    var file []byte
+    var missing byte
+    if file, err = readBytes(reader); err == nil {
+      if missing, err = reader.ReadByte(); err == nil {
+        record.Data, err = readBytes(reader)
+      }
+    }
+    record.File, record.Missing = string(file), missing == 1
+  default:
+    return record, fmt.Errorf("unknown record kind %d", kind)
+  }
+  if err != nil {
+    return record, io.ErrUnexpectedEOF
+  }
+  return record, nil
+}
+
+// loads from the store go to the recording, a replay answers them from it
+type recordingPlayerStore struct {
+  PlayerStore
+  recorder *TrafficRecorder
+  clock    Clock
+}
+
+func (store recordingPlayerStore) Load(player string) (PlayerState, bool, error) {
+  state, ok, err := store.PlayerStore.Load(player)
+  record := TrafficRecord{Kind: RecordPlayerLoad, At: store.clock.Now(), Player: player}
+  if ok {
+    record.State = &state
+  }
+  if err != nil {
+    record.Err = err.Error()
+  }
+  store.recorder.Write(record)
+  return state, ok, err
+}
+
+// hash of what the clients see of the world: the users, their zone and
+// position, in id order. Must be called with server.mu held.
+func (server *Server) stateHash() uint64 {
+  h := fnv.New64a()
+  buffer := make([]byte, 0, 64)
+  for _, key := range sortedKeys(server.clients) {
+    client := server.clients[key]
+    user := client.user
+    buffer = appendBytes(buffer[:0], []byte(key))
+    buffer = appendBytes(buffer, []byte(client.zone.name))
+    buffer = appendBytes(buffer, []byte(user.userType))
+    for _, value := range []float32{user.location.x, user.location.y, user.location.z, user.orientation} {
+      buffer = binary.BigEndian.AppendUint32(buffer, math.Float32bits(value))
+    }
+    if user.isActive {
+      buffer = append(buffer, 1)
+    } else {
+      buffer = append(buffer, 0)
+    }
+    h.Write(buffer)
+  }
+  return h.Sum64()
+}
+
+// StateHash for callers without the lock
+func (server *Server) StateHash() uint64 {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+  return server.stateHash()
+}
+
+// starts recording to record_file, the player store loads are recorded
+// too. Must be called before the datagrams and the background tasks start.
+func (server *Server) startRecording() {
+  if server.config.RecordFile == "" {
+    return
+  }
+  snapshot, err := server.SnapshotWorld()
+  if err != nil {
+    netLog.Error("recording not started", "err", err)
+    return
+  }
+  config := server.config
+  config.AdminToken = server.adminToken
+  header := RecordingHeader{StartedAt: server.clock.Now(), Config: config.Redacted(), Snapshot: snapshot}
+  recorder, err := NewTrafficRecorder(server.config.RecordFile, header, server.adminToken)
+  if err != nil {
+    netLog.Error("recording not started", "file", server.config.RecordFile, "err", err)
+    return
+  }
+
+  server.mu.Lock()
+  server.recorder = recorder
+  if server.players != nil {
+    server.players = recordingPlayerStore{PlayerStore: server.players, recorder: recorder, clock: server.clock}
+  }
+  sessionToken := server.sessionToken
+  server.sessionToken = func(player string) string {
+    token := sessionToken(player)
+    recorder.Write(TrafficRecord{Kind: RecordSession, At: server.clock.Now(), Player: player, Token: token})
+    return token
+  }
+  server.mu.Unlock()
+  netLog.Info("recording traffic", "file", server.config.RecordFile, "clients", len(snapshot.Clients))
+}
+
+func (server *Server) stopRecording() {
+  if server.recorder == nil {
+    return
+  }
+  if err := server.recorder.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+    netLog.Warn("recording not closed cleanly", "file", server.config.RecordFile, "err", err)
+  }
+}
+
+// the record functions must be called with server.mu held, in the order
+// the world changes
+func (server *Server) recordDatagram(now time.Time, addr *net.UDPAddr, data []byte) {
+  if server.recorder != nil {
+    server.recorder.Write(TrafficRecord{Kind: RecordDatagram, At: now, Addr: addr.String(), Data: data})
+  }
+}
+
+func (server *Server) recordCleanup(now time.Time) {
+  if server.recorder != nil {
+    server.recorder.Write(TrafficRecord{Kind: RecordCleanup, At: now})
+  }
+}
+
+func (server *Server) recordAdmin(change adminChange) {
+  if server.recorder != nil {
+    server.recorder.Write(TrafficRecord{Kind: RecordAdmin, At: server.clock.Now(), Change: &change})
+  }
+}
+
+// called by the map generators before they save a file, with or without
+// server.mu held. The recorder is set before the datagrams and the
+// background tasks start and is never unset.
+func (server *Server) recordMapFile(filename string) {
+  if server.recorder != nil {
+    server.recorder.WriteMapFile(filename, server.clock.Now())
+  }
+}
+
+func (server *Server) recordTick(now time.Time) {
+  if server.recorder != nil {
+    server.recorder.Write(TrafficRecord{Kind: RecordTick, At: now, Tick: server.tick, StateHash: server.stateHash()})
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "net"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "testing"
+  "time"
+)
+
+// records a short session and replays it
+func recordTestSession(t *testing.T) (string, []string) {
+  t.Helper()
+  server := newTestWorld(t, WorldMaps)
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+  server.SetAdminToken("admin-secret")
+  server.config.APIToken = "api-secret"
+  store, err := NewFilePlayerStore(t.TempDir())
+  if err != nil {
+    t.Fatal(err)
+  }
+  server.SetPlayerStore(store)
+  tokens := issuedTokens(server)
+  // carol's session and secret are in the snapshot the recording starts with
+  carol := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40003}
+  server.handleDatagram(carol, []byte(`{"type":"identify","player":"carol"}`))
+  server.config.RecordFile = filepath.Join(t.TempDir(), "session.rec")
+  server.startRecording()
+  if server.recorder == nil {
+    t.Fatal("recording not started")
+  }
+
+  step := func() {
+    clock.Set(clock.Now().Add(100 * time.Millisecond))
+    server.runTick()
+  }
+  alice := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  admin := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}
+  server.handleDatagram(alice, []byte(`{"type":"identify","player":"alice"}`))
+  server.handleDatagram(admin, []byte(`{"type":"map_info"}`))
+  step()
+  server.handleDatagram(admin, []byte(`{"type":"admin_login","token":"admin-secret"}`))
+  server.handleDatagram(alice, []byte(`{"type":"admin_login","token":"wrong"}`))
+  location := server.clients[alice.String()].user.location
+  for i := 1; i <= 5; i++ {
+    server.handleDatagram(alice, []byte(fmt.Sprintf(`{"type":"move","location":[%g,%g,%g],"orientation":%d}`,
+      location.x+float32(i)*0.2, location.y, location.z, i)))
+    step()
+  }
+  server.SpawnBot()
+  step()
+
+  // both come back from other addresses with their sessions
+  for i, player := range []string{"alice", "carol"} {
+    addr := map[string]*net.UDPAddr{"alice": alice, "carol": carol}[player]
+    session := server.clients[addr.String()].session
+    moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40010 + i}
+    server.handleDatagram(moved, []byte(fmt.Sprintf(`{"type":"identify","player":%q,"session":%q}`, player, session)))
+    if _, ok := server.clients[moved.String()]; !ok {
+      t.Fatalf("session of %s not taken over", player)
+    }
+  }
+  step()
+
+  // alice leaves and comes back with her secret
+  alice = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40010}
+  if err := server.Kick(alice.String()); err != nil {
+    t.Fatal(err)
+  }
+  server.saving.Wait()
+  // her first session and secret were the first tokens given to her
+  first := slices.IndexFunc(*tokens, func(token string) bool { return strings.HasPrefix(token, "alice-") })
+  secret := (*tokens)[first+1]
+  back := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40020}
+  server.handleDatagram(back, []byte(fmt.Sprintf(`{"type":"identify","player":"alice","secret":%q}`, secret)))
+  if server.clients[back.String()] == nil {
+    t.Fatal("alice not restored with her secret")
+  }
+  step()
+  server.stopRecording()
+
+  secrets := slices.Clone(*tokens)
+  for _, token := range *tokens {
+    secrets = append(secrets, hashSecret(token))
+  }
+  return server.config.RecordFile, secrets
+}
+
+func TestRecordingHoldsNoSecrets(t *testing.T) {
+  filename, secrets := recordTestSession(t)
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, secret := range append([]string{"admin-secret", "api-secret"}, secrets...) {
+    if bytes.Contains(data, []byte(secret)) {
+      t.Errorf("recording holds the secret %q", secret)
+    }
+  }
+}
+
+func TestReplayMatchesRecording(t *testing.T) {
+  filename, _ := recordTestSession(t)
+  recording, err := ReadRecording(filename)
+  if err != nil {
+    t.Fatal(err)
+  }
+  replay, err := NewReplay(recording)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer replay.Close()
+
+  ticks := 0
+  for tick, ok := replay.Step(); ok; tick, ok = replay.Step() {
+    ticks++
+    if hash := replay.Server.StateHash(); hash != tick.StateHash {
+      t.Fatalf("tick %d state %016x, recorded %016x", tick.Tick, hash, tick.StateHash)
+    }
+  }
+  if ticks != 9 {
+    t.Fatalf("%d ticks replayed, 9 recorded", ticks)
+  }
+  var admins int
+  for _, client := range replay.Server.Clients() {
+    if client.Type == UserTypeAdmin {
+      admins++
+    }
+  }
+  if admins != 1 {
+    t.Fatalf("%d admins after the replay, expected 1", admins)
+  }
+}
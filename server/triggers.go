@@ -0,0 +1,135 @@
+package main
+
+import (
+  "fmt"
+)
+
+const (
+  TriggerBox    = "box"
+  TriggerSphere = "sphere"
+)
+
+// named volume of the map, Kind is free-form for gameplay rules
+// (spawn, safe, goal, kill...). Boxes use Size as full extents around
+// Center, spheres use Radius.
+type Trigger struct {
+  Name   string     `json:"name"`
+  Kind   string     `json:"kind,omitempty"`
+  Shape  string     `json:"shape"`
+  Center [3]float32 `json:"center"`
+  Size   [3]float32 `json:"size,omitempty"`
+  Radius float32    `json:"radius,omitempty"`
+}
+
+func (trigger *Trigger) validate() error {
+  if trigger.Name == "" {
+    return fmt.Errorf("trigger needs a name")
+  }
+  switch trigger.Shape {
+  case TriggerBox:
+    if trigger.Size[0] <= 0 || trigger.Size[1] <= 0 || trigger.Size[2] <= 0 {
+      return fmt.Errorf("box trigger %s needs a positive size", trigger.Name)
+    }
+  case TriggerSphere:
+    if trigger.Radius <= 0 {
+      return fmt.Errorf("sphere trigger %s needs a positive radius", trigger.Name)
+    }
+  default:
+    return fmt.Errorf("unknown trigger shape: %s", trigger.Shape)
+  }
+  return nil
+}
+
+func (trigger *Trigger) contains(location Vector3) bool {
+  dx := location.x - trigger.Center[0]
+  dy := location.y - trigger.Center[1]
+  dz := location.z - trigger.Center[2]
+  switch trigger.Shape {
+  case TriggerBox:
+    return abs(dx) <= trigger.Size[0]/2 && abs(dy) <= trigger.Size[1]/2 && abs(dz) <= trigger.Size[2]/2
+  case TriggerSphere:
+    return dx*dx+dy*dy+dz*dz <= trigger.Radius*trigger.Radius
+  }
+  return false
+}
+
+func abs(v float32) float32 {
+  if v < 0 {
+    return -v
+  }
+  return v
+}
+
+func (server *Server) dispatchTrigger(eventType EventType, zone *Zone, client *Client, trigger Trigger) {
+  server.eventManager.DispatchAsync(Event{
+    Type: eventType,
+    Data: TriggerData{
+      Zone:     zone.name,
+      User:     client.user.id,
+      Trigger:  trigger,
+      Location: client.user.location,
+    },
+  })
+}
+
+func logTriggerEvent(eventType EventType) func(data TriggerData) {
+  return func(data TriggerData) {
+    eventsLog.Info(string(eventType), "user", data.User, "trigger", data.Trigger.Name, "kind", data.Trigger.Kind, "zone", data.Zone)
+  }
+}
+
+// compares the triggers each user stands in with the previous tick
+// must be called with server.mu held
+func (server *Server) checkTriggers() {
+  for _, zone := range server.zones {
+    triggers := zone.meta().Triggers
+    for _, client := range zone.clients {
+      if client.user == nil || (len(triggers) == 0 && len(client.triggers) == 0) {
+        continue
+      }
+
+      inside := make(map[string]Trigger)
+      for _, trigger := range triggers {
+        if trigger.contains(client.user.location) {
+          inside[trigger.Name] = trigger
+        }
+      }
+      for name, trigger := range client.triggers {
+        if _, ok := inside[name]; !ok {
+          server.dispatchTrigger(EventTriggerExit, zone, client, trigger)
+        }
+      }
+      for name, trigger := range inside {
+        if _, ok := client.triggers[name]; !ok {
+          server.dispatchTrigger(EventTriggerEnter, zone, client, trigger)
+        }
+      }
+      client.triggers = inside
+    }
+  }
+}
+
+// users leaving a zone or the server leave its triggers too.
+// must be called with server.mu held
+func (server *Server) exitTriggers(client *Client) {
+  if client.zone == nil || client.user == nil {
+    return
+  }
+  for _, trigger := range client.triggers {
+    server.dispatchTrigger(EventTriggerExit, client.zone, client, trigger)
+  }
+  client.triggers = nil
+}
+
+func (server *Server) validateTriggers() {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  for _, zone := range server.zones {
+    for _, trigger := range zone.meta().Triggers {
+      if err := trigger.validate(); err != nil {
+        worldLog.Warn("invalid trigger", "zone", zone.name, "err", err)
+      }
+    }
+  }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+  "net"
+  "slices"
+  "testing"
+  "time"
+)
+
+func TestTriggerEnterAndExit(t *testing.T) {
+  server := newTestServer(t)
+  start := server.zones[defaultZoneName]
+  mapData := flatMap(33, 33, 0)
+  mapData.Meta.Triggers = []Trigger{
+    {Name: "goal", Kind: "goal", Shape: TriggerBox, Center: [3]float32{20, 0, 20}, Size: [3]float32{4, 4, 4}},
+    {Name: "pool", Shape: TriggerSphere, Center: [3]float32{8, 0, 8}, Radius: 2},
+  }
+  if _, err := start.mapGenerator.saveAndUse(mapData, start.mapGenerator.Filename()); err != nil {
+    t.Fatal(err)
+  }
+
+  events := make(chan string, 10)
+  for _, eventType := range []EventType{EventTriggerEnter, EventTriggerExit} {
+    On(server.eventManager, eventType, func(data TriggerData) {
+      events <- string(eventType) + " " + data.Trigger.Name
+    })
+  }
+  // events of a tick are handled asynchronously, in any order
+  expect := func(want ...string) {
+    t.Helper()
+    var got []string
+    for range want {
+      select {
+      case event := <-events:
+        got = append(got, event)
+      case <-time.After(time.Second):
+        t.Fatalf("events %v, expected %v", got, want)
+      }
+    }
+    slices.Sort(got)
+    slices.Sort(want)
+    if !slices.Equal(got, want) {
+      t.Fatalf("events %v, expected %v", got, want)
+    }
+  }
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  id := server.clients[addr.String()].user.id
+  moveTo := func(x, z float32) {
+    t.Helper()
+    if err := server.Teleport(id, Vector3{x: x, z: z}); err != nil {
+      t.Fatal(err)
+    }
+    server.runTick()
+  }
+
+  moveTo(20, 21)
+  expect("trigger_enter goal")
+  // still inside, nothing new
+  moveTo(21, 20)
+  moveTo(8, 9)
+  expect("trigger_exit goal", "trigger_enter pool")
+
+  // leaving the server leaves the triggers
+  if err := server.Kick(addr.String()); err != nil {
+    t.Fatal(err)
+  }
+  expect("trigger_exit pool")
+  select {
+  case event := <-events:
+    t.Fatalf("unexpected %s", event)
+  case <-time.After(50 * time.Millisecond):
+  }
+}
+
+func TestTriggerValidate(t *testing.T) {
+  for _, trigger := range []Trigger{
+    {Shape: TriggerSphere, Radius: 1},
+    {Name: "box", Shape: TriggerBox, Size: [3]float32{1, 0, 1}},
+    {Name: "ball", Shape: TriggerSphere},
+    {Name: "cone", Shape: "cone", Radius: 1},
+  } {
+    if err := trigger.validate(); err == nil {
+      t.Errorf("trigger %+v accepted", trigger)
+    }
+  }
+}
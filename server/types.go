@@ -11,6 +11,15 @@ type Vector3 struct {
   z float32
 }
 
+// x, y, z as saved in json files
+func (v Vector3) Array() [3]float32 {
+  return [3]float32{v.x, v.y, v.z}
+}
+
+func vector3(a [3]float32) Vector3 {
+  return Vector3{x: a[0], y: a[1], z: a[2]}
+}
+
 type WorldUpdate struct {
   Type  string     `json:"type"`
   Users []UserData `json:"users"`
@@ -29,8 +38,99 @@ type ConnectionConfirm struct {
   LocalUserID string `json:"user_id"`
 }
 
+// Data is the chunk in the map file format, base64 in json
+type ChunkUpdate struct {
+  Type string `json:"type"`
+  X    int32  `json:"x"`
+  Z    int32  `json:"z"`
+  Data []byte `json:"data"`
+}
+
+// heights of the cells of an edited region, Data is in the map file format
+type TerrainDelta struct {
+  Type string `json:"type"`
+  X    int    `json:"x"`
+  Z    int    `json:"z"`
+  Data []byte `json:"data"`
+}
+
+type ZoneChange struct {
+  Type    string `json:"type"`
+  Zone    string `json:"zone"`
+  MapID   string `json:"map_id"`
+  MapHash string `json:"map_hash,omitempty"`
+}
+
+// the client answers with a pong carrying the same nonce
+type Ping struct {
+  Type  string `json:"type"`
+  Nonce uint64 `json:"nonce"`
+}
+
+// kicked, banned and broadcast messages
+type AdminNotice struct {
+  Type    string `json:"type"`
+  Message string `json:"message"`
+}
+
+// sent to a player when it identifies, an identify from another address
+// takes the session over only with this token
+type SessionNotice struct {
+  Type    string `json:"type"`
+  Player  string `json:"player"`
+  Session string `json:"session"`
+  // only for a player without one yet, the client keeps it
+  Secret string `json:"secret,omitempty"`
+}
+
+type MapInfo struct {
+  Type     string   `json:"type"`
+  Zone     string   `json:"zone"`
+  MapID    string   `json:"map_id"`
+  MapHash  string   `json:"map_hash,omitempty"`
+  Rotation []string `json:"rotation,omitempty"`
+}
+
 type Client struct {
-  addr     *net.UDPAddr
-  lastSeen time.Time
-  user     *User
+  addr           *net.UDPAddr
+  lastSeen       time.Time
+  user           *User
+  // chunks sent by the time they were sent, zero once the client
+  // acknowledged them
+  sentChunks     map[ChunkCoord]time.Time
+  zone           *Zone
+  portalCooldown time.Time
+  // triggers the user stood in at the last check, by name
+  triggers map[string]Trigger
+  // identity sent by the client, empty until it identifies. Only
+  // identified players are persisted.
+  player string
+  // token of the player session, see SessionNotice
+  session string
+  // hash of the player secret, see PlayerState
+  secretHash string
+  // waypoints left to the target of a walking bot
+  path []Vector3
+  // last ping sent and the round trip of the last answered one
+  pingNonce  uint64
+  pingSentAt time.Time
+  rtt        time.Duration
+}
+
+type ClientMessage struct {
+  Type        string       `json:"type"`
+  Location    [3]float32   `json:"location"`
+  Orientation float32      `json:"orientation"`
+  Token       string       `json:"token,omitempty"`
+  Edit        *TerrainEdit `json:"edit,omitempty"`
+  // pong
+  Nonce uint64 `json:"nonce,omitempty"`
+  // identify, session is the token of a session open from another address
+  // and secret the one the player got with its first session
+  Player  string `json:"player,omitempty"`
+  Session string `json:"session,omitempty"`
+  Secret  string `json:"secret,omitempty"`
+  // chunk_ack
+  X int32 `json:"x,omitempty"`
+  Z int32 `json:"z,omitempty"`
 }
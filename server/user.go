@@ -1,7 +1,6 @@
 package main
 
 import (
-  "net"
   "time"
 )
 
@@ -21,10 +20,12 @@ type User struct {
   orientation      float32
   isActive         bool
   lastUpdate       time.Time
-  conn             *net.UDPConn
+  conn             PacketConn
+  // gameplay counters, persisted with the player
+  stats map[string]float64
 }
 
-func NewUser(id string, userType UserType, conn *net.UDPConn) *User {
+func NewUser(id string, userType UserType, conn PacketConn) *User {
   return &User{
     id:          id,
     userType:    userType,
@@ -49,3 +50,11 @@ func (user *User) updatePosition(newLocation Vector3) {
   user.location = newLocation
   user.lastUpdate = time.Now()
 }
+
+func (user *User) moveTo(terrain Terrain, newLocation Vector3) bool {
+  resolved, accepted := resolveMove(terrain, user.location, newLocation)
+  if resolved != user.location {
+    user.updatePosition(resolved)
+  }
+  return accepted
+}
@@ -2,20 +2,21 @@ package main
 
 import (
   "math"
-  "math/rand"
-  "net"
+  "math/rand/v2"
+  "os"
+  "path/filepath"
 )
 
-func randomSpawn(id string, userType UserType, conn *net.UDPConn,
+func randomSpawn(rng *rand.Rand, id string, userType UserType, conn PacketConn,
   minX, maxX, minY, maxY, minZ, maxZ float32) *User {
   
   var location Vector3
   
-  location.x = float32(math.Round(float64(minX + rand.Float32()*(maxX-minX))))
-  location.y = float32(math.Round(float64(minY + rand.Float32()*(maxY-minY))))
-  location.z = float32(math.Round(float64(minZ + rand.Float32()*(maxZ-minZ))))
+  location.x = float32(math.Round(float64(minX + rng.Float32()*(maxX-minX))))
+  location.y = float32(math.Round(float64(minY + rng.Float32()*(maxY-minY))))
+  location.z = float32(math.Round(float64(minZ + rng.Float32()*(maxZ-minZ))))
   
-  orientation := rand.Float32() * 360.0
+  orientation := rng.Float32() * 360.0
   
   user := NewUser(id, userType, conn)
   user.location = location
@@ -24,3 +25,36 @@ func randomSpawn(id string, userType UserType, conn *net.UDPConn,
   return user
 }
 
+
+// the file holds either its previous or its new content, even when the
+// process or the machine stops while writing: the data goes to a temporary
+// file of the same directory which is synced and renamed over the file
+func writeFileAtomic(filename string, data []byte) error {
+  dir := filepath.Dir(filename)
+  tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(tmp.Name())
+
+  if _, err := tmp.Write(data); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Sync(); err != nil {
+    tmp.Close()
+    return err
+  }
+  if err := tmp.Close(); err != nil {
+    return err
+  }
+  if err := os.Rename(tmp.Name(), filename); err != nil {
+    return err
+  }
+  // the rename itself is durable once the directory is synced
+  if d, err := os.Open(dir); err == nil {
+    d.Sync()
+    d.Close()
+  }
+  return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "maps"
+  "math/rand/v2"
+  "net"
+  "os"
+  "path/filepath"
+  "slices"
+  "time"
+)
+
+// everything needed to bring a stopped server back as it was, except the
+// maps themselves: zones reference their map file and hash, edits are
+// already saved to the map and chunk files
+const worldSnapshotVersion = 1
+
+type WorldSnapshot struct {
+  Version int       `json:"version"`
+  SavedAt time.Time `json:"saved_at"`
+  Tick    uint64    `json:"tick"`
+  World   string    `json:"world"`
+  Seed    int64     `json:"seed"`
+  // state of the spawn random generator
+  SpawnRNG []byte           `json:"spawn_rng"`
+  BotCount int              `json:"bot_count"`
+  Zones    []ZoneSnapshot   `json:"zones"`
+  Clients  []ClientSnapshot `json:"clients"`
+  Bans     []Ban            `json:"bans,omitempty"`
+}
+
+type ZoneSnapshot struct {
+  Name    string `json:"name"`
+  MapID   string `json:"map_id"`
+  MapFile string `json:"map_file,omitempty"`
+  MapHash string `json:"map_hash,omitempty"`
+  // the main zone of a map rotation
+  RotationMap string `json:"rotation_map,omitempty"`
+  // the chunked world, it may have been regenerated with another seed
+  ChunkSeed *int64 `json:"chunk_seed,omitempty"`
+}
+
+// players have an address, bots do not
+type ClientSnapshot struct {
+  ID               string             `json:"id"`
+  Addr             string             `json:"addr,omitempty"`
+  Player           string             `json:"player,omitempty"`
+  Session          string             `json:"session,omitempty"`
+  SecretHash       string             `json:"secret_hash,omitempty"`
+  Zone             string             `json:"zone"`
+  Type             UserType           `json:"type"`
+  Location         [3]float32         `json:"location"`
+  PreviousLocation [3]float32         `json:"previous_location"`
+  Orientation      float32            `json:"orientation"`
+  Active           bool               `json:"active"`
+  LastUpdate       time.Time          `json:"last_update"`
+  PortalCooldown   *time.Time         `json:"portal_cooldown,omitempty"`
+  // a restarted server gives every client a full client_timeout, replays
+  // put it back
+  LastSeen time.Time `json:"last_seen"`
+  // names of the triggers the user stands in
+  Triggers []string          `json:"triggers,omitempty"`
+  Stats    map[string]float64 `json:"stats,omitempty"`
+  // waypoints left to a walking bot
+  Path [][3]float32 `json:"path,omitempty"`
+}
+
+func (server *Server) SnapshotWorld() (WorldSnapshot, error) {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+  return server.snapshotWorld()
+}
+
+// the snapshot shares nothing with the server
+// must be called with server.mu held
+func (server *Server) snapshotWorld() (WorldSnapshot, error) {
+  rng, err := server.spawnSource.MarshalBinary()
+  if err != nil {
+    return WorldSnapshot{}, err
+  }
+  snapshot := WorldSnapshot{
+    Version:  worldSnapshotVersion,
+    SavedAt:  server.clock.Now(),
+    Tick:     server.tick,
+    World:    server.config.World,
+    Seed:     server.config.Seed,
+    SpawnRNG: rng,
+    BotCount: server.botCount,
+  }
+
+  for _, name := range sortedKeys(server.zones) {
+    zone := server.zones[name]
+    zoneSnapshot := ZoneSnapshot{Name: name, MapID: zone.mapID(), MapHash: zone.mapHash()}
+    if zone.mapGenerator != nil {
+      zoneSnapshot.MapFile = zone.mapGenerator.Filename()
+    }
+    if zone.chunks != nil {
+      seed := zone.chunks.Seed()
+      zoneSnapshot.ChunkSeed = &seed
+    }
+    if name == defaultZoneName && server.rotation != nil {
+      zoneSnapshot.RotationMap = server.rotation.Current()
+    }
+    snapshot.Zones = append(snapshot.Zones, zoneSnapshot)
+  }
+
+  for _, key := range sortedKeys(server.clients) {
+    client := server.clients[key]
+    user := client.user
+    clientSnapshot := ClientSnapshot{
+      ID:               key,
+      Player:           client.player,
+      Session:          client.session,
+      SecretHash:       client.secretHash,
+      Zone:             client.zone.name,
+      Type:             user.userType,
+      Location:         user.location.Array(),
+      PreviousLocation: user.previousLocation.Array(),
+      Orientation:      user.orientation,
+      Active:           user.isActive,
+      LastUpdate:       user.lastUpdate,
+      LastSeen:         client.lastSeen,
+      Triggers:         sortedKeys(client.triggers),
+      Stats:            maps.Clone(user.stats),
+    }
+    if client.addr != nil {
+      clientSnapshot.Addr = client.addr.String()
+    }
+    for _, waypoint := range client.path {
+      clientSnapshot.Path = append(clientSnapshot.Path, waypoint.Array())
+    }
+    if !client.portalCooldown.IsZero() {
+      cooldown := client.portalCooldown
+      clientSnapshot.PortalCooldown = &cooldown
+    }
+    snapshot.Clients = append(snapshot.Clients, clientSnapshot)
+  }
+
+  for _, ban := range server.bans {
+    if ban.Until == nil || server.clock.Now().Before(*ban.Until) {
+      snapshot.Bans = append(snapshot.Bans, ban)
+    }
+  }
+  return snapshot, nil
+}
+
+// written to a temporary file renamed over the previous snapshot. The
+// snapshot is encoded under the server lock, the file written without it.
+func (server *Server) SaveWorld(filename string) error {
+  server.mu.RLock()
+  snapshot, err := server.snapshotWorld()
+  var data []byte
+  if err == nil {
+    data, err = json.MarshalIndent(snapshot, "", "  ")
+  }
+  server.mu.RUnlock()
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+    return err
+  }
+  if err := writeFileAtomic(filename, data); err != nil {
+    return err
+  }
+  worldLog.Debug("world saved", "file", filename, "tick", snapshot.Tick, "clients", len(snapshot.Clients))
+  return nil
+}
+
+func (server *Server) saveWorldFile() {
+  if server.config.WorldFile == "" {
+    return
+  }
+  if err := server.SaveWorld(server.config.WorldFile); err != nil {
+    worldLog.Error("world not saved", "file", server.config.WorldFile, "err", err)
+  }
+}
+
+func LoadWorldSnapshot(filename string) (WorldSnapshot, error) {
+  var snapshot WorldSnapshot
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    return snapshot, err
+  }
+  if err := json.Unmarshal(data, &snapshot); err != nil {
+    return snapshot, fmt.Errorf("invalid world snapshot %s: %v", filename, err)
+  }
+  if snapshot.Version != worldSnapshotVersion {
+    return snapshot, fmt.Errorf("world snapshot %s has version %d, expected %d", filename, snapshot.Version, worldSnapshotVersion)
+  }
+  return snapshot, nil
+}
+
+// puts the maps, users, bans, tick and random generator of the snapshot
+// back. Zones must be loaded. Every zone map is read and checked before
+// anything changes, an invalid snapshot leaves the server as it was.
+// Restored players get a full client_timeout to send again before they
+// are dropped.
+func (server *Server) RestoreWorld(snapshot WorldSnapshot) error {
+  if snapshot.World != server.config.World || snapshot.Seed != server.config.Seed {
+    return fmt.Errorf("snapshot of world %s seed %d, the server runs world %s seed %d",
+      snapshot.World, snapshot.Seed, server.config.World, server.config.Seed)
+  }
+  if err := new(rand.PCG).UnmarshalBinary(snapshot.SpawnRNG); err != nil {
+    return fmt.Errorf("invalid spawn random generator state: %v", err)
+  }
+  restores := make([]zoneRestore, 0, len(snapshot.Zones))
+  for _, zoneSnapshot := range snapshot.Zones {
+    restore, err := server.prepareZoneMap(zoneSnapshot)
+    if err != nil {
+      return err
+    }
+    restores = append(restores, restore)
+  }
+  for _, restore := range restores {
+    server.restoreZoneMap(restore)
+  }
+
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  // checked above
+  server.spawnSource.UnmarshalBinary(snapshot.SpawnRNG)
+  server.tick = snapshot.Tick
+  server.botCount = snapshot.BotCount
+  for _, ban := range snapshot.Bans {
+    server.bans[ban.IP] = ban
+  }
+
+  now := server.clock.Now()
+  for _, saved := range snapshot.Clients {
+    var addr *net.UDPAddr
+    if saved.Addr != "" {
+      var err error
+      if addr, err = net.ResolveUDPAddr("udp", saved.Addr); err != nil {
+        worldLog.Warn("client not restored", "id", saved.ID, "err", err)
+        continue
+      }
+    }
+    zone := server.zone(saved.Zone)
+    user := NewUser(saved.ID, saved.Type, server.conn)
+    user.location = vector3(saved.Location)
+    user.previousLocation = vector3(saved.PreviousLocation)
+    user.orientation = saved.Orientation
+    user.isActive = saved.Active
+    user.lastUpdate = saved.LastUpdate
+    user.stats = saved.Stats
+
+    client := &Client{
+      addr:           addr,
+      lastSeen:       now,
+      user:           user,
+      sentChunks:     make(map[ChunkCoord]time.Time),
+      zone:           zone,
+      player:         saved.Player,
+      session:        saved.Session,
+      secretHash:     saved.SecretHash,
+      triggers:       make(map[string]Trigger),
+    }
+    if saved.PortalCooldown != nil {
+      client.portalCooldown = *saved.PortalCooldown
+    }
+    for _, waypoint := range saved.Path {
+      client.path = append(client.path, vector3(waypoint))
+    }
+    // triggers gone from the map are left without an exit event
+    for _, trigger := range zone.meta().Triggers {
+      for _, name := range saved.Triggers {
+        if trigger.Name == name {
+          client.triggers[name] = trigger
+        }
+      }
+    }
+    server.clients[saved.ID] = client
+    zone.clients[saved.ID] = client
+  }
+  worldLog.Info("world restored", "saved_at", snapshot.SavedAt, "tick", snapshot.Tick,
+    "clients", len(snapshot.Clients), "bans", len(snapshot.Bans))
+  return nil
+}
+
+// a zone map of the snapshot, read but not used yet
+type zoneRestore struct {
+  saved ZoneSnapshot
+  zone  *Zone
+  // nil keeps the current map
+  mapData  *MapData
+  filename string
+  // set when mapData is a map of the rotation
+  rotation *MapRotation
+  // nil keeps the chunks of the current seed
+  chunkSeed *int64
+}
+
+// the main zone of a rotation goes back to the map it played, other zones
+// to their map file
+func (server *Server) prepareZoneMap(saved ZoneSnapshot) (zoneRestore, error) {
+  server.mu.RLock()
+  zone := server.zones[saved.Name]
+  rotation := server.rotation
+  server.mu.RUnlock()
+  restore := zoneRestore{saved: saved, zone: zone}
+  if zone == nil {
+    return restore, fmt.Errorf("zone %s of the snapshot does not exist", saved.Name)
+  }
+
+  if zone.chunks != nil && saved.ChunkSeed != nil && *saved.ChunkSeed != zone.chunks.Seed() {
+    restore.chunkSeed = saved.ChunkSeed
+  }
+  var err error
+  if saved.RotationMap != "" && rotation != nil && zone.mapGenerator != nil && rotation.Current() != saved.RotationMap {
+    if !slices.Contains(rotation.Names(), saved.RotationMap) {
+      return restore, fmt.Errorf("map %s of the snapshot is not in the rotation", saved.RotationMap)
+    }
+    restore.filename, restore.rotation = rotation.filename(saved.RotationMap), rotation
+    restore.mapData, err = rotation.read(zone.mapGenerator, saved.RotationMap, false)
+  } else if saved.MapFile != "" && zone.mapGenerator != nil && zone.mapGenerator.Filename() != saved.MapFile {
+    restore.filename = saved.MapFile
+    restore.mapData, err = zone.mapGenerator.readFile(saved.MapFile)
+  }
+  return restore, err
+}
+
+// a map whose heights changed since the snapshot is kept with a warning
+func (server *Server) restoreZoneMap(restore zoneRestore) {
+  saved, zone := restore.saved, restore.zone
+  if restore.mapData != nil {
+    if restore.rotation != nil {
+      restore.rotation.setCurrent(saved.RotationMap)
+    }
+    zone.mapGenerator.use(restore.mapData, restore.filename)
+    zone.invalidatePaths()
+  }
+  if restore.chunkSeed != nil {
+    zone.chunks.Reseed(*restore.chunkSeed)
+  }
+
+  if hash := zone.mapHash(); hash != saved.MapHash {
+    worldLog.Warn("map changed since the snapshot", "zone", saved.Name, "map", zone.mapID(),
+      "saved_hash", saved.MapHash, "hash", hash)
+  }
+}
+
+// called by Start when restore is set, a missing snapshot starts a new world
+func (server *Server) restoreWorldFile() {
+  snapshot, err := LoadWorldSnapshot(server.config.WorldFile)
+  if errors.Is(err, os.ErrNotExist) {
+    worldLog.Info("no world snapshot, starting a new world", "file", server.config.WorldFile)
+    return
+  }
+  if err == nil {
+    err = server.RestoreWorld(snapshot)
+  }
+  if err != nil {
+    worldLog.Error("world not restored, starting a new world", "file", server.config.WorldFile, "err", err)
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "net"
+  "path/filepath"
+  "slices"
+  "testing"
+  "time"
+)
+
+func TestRestoreWorldChecksEveryZoneFirst(t *testing.T) {
+  server := newTestServer(t)
+  main := server.zones[defaultZoneName]
+  other := server.newMapGenerator()
+  if _, err := other.saveAndUse(flatMap(9, 9, 1), filepath.Join(server.config.MapDir, "other.bin")); err != nil {
+    t.Fatal(err)
+  }
+  server.AddZone(NewZone("other", other))
+  alternate := filepath.Join(server.config.MapDir, "alternate.bin")
+  if err := server.newMapGenerator().SaveToFile(flatMap(9, 9, 2), alternate); err != nil {
+    t.Fatal(err)
+  }
+
+  snapshot, err := server.SnapshotWorld()
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the main zone comes first and has a valid map, the other one does not
+  snapshot.Zones[0].MapFile = alternate
+  snapshot.Zones[1].MapFile = filepath.Join(server.config.MapDir, "missing.bin")
+  filename := main.mapGenerator.Filename()
+  if err := server.RestoreWorld(snapshot); err == nil {
+    t.Fatal("snapshot with a missing map restored")
+  }
+  if main.mapGenerator.Filename() != filename {
+    t.Fatalf("main zone plays %s after a failed restore", main.mapGenerator.Filename())
+  }
+
+  snapshot.Zones[1].MapFile = other.Filename()
+  if err := server.RestoreWorld(snapshot); err != nil {
+    t.Fatal(err)
+  }
+  if main.mapGenerator.Filename() != alternate {
+    t.Fatalf("main zone plays %s after the restore", main.mapGenerator.Filename())
+  }
+}
+
+func TestSnapshotCopiesStats(t *testing.T) {
+  server := newTestServer(t)
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  user := server.clients[addr.String()].user
+  user.stats = map[string]float64{"kills": 1}
+
+  snapshot, err := server.SnapshotWorld()
+  if err != nil {
+    t.Fatal(err)
+  }
+  user.stats["kills"] = 2
+  if kills := snapshot.Clients[0].Stats["kills"]; kills != 1 {
+    t.Fatalf("snapshot stats changed with the user, %v kills", kills)
+  }
+}
+
+func TestRestoreChunkSeed(t *testing.T) {
+  server := newTestWorld(t, WorldChunked)
+  chunks := server.zones[defaultZoneName].chunks
+  chunks.Reseed(9)
+  snapshot, err := server.SnapshotWorld()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  chunks.Reseed(server.config.Seed)
+  if err := server.RestoreWorld(snapshot); err != nil {
+    t.Fatal(err)
+  }
+  if seed := chunks.Seed(); seed != 9 {
+    t.Fatalf("chunked world restored with seed %d", seed)
+  }
+}
+
+func TestRestoreKeepsBotPaths(t *testing.T) {
+  server := newTestServer(t)
+  zone := server.zones[defaultZoneName]
+  if _, err := zone.mapGenerator.saveAndUse(ridgeMap(), zone.mapGenerator.Filename()); err != nil {
+    t.Fatal(err)
+  }
+  server.refreshZone(zone, adminChange{Op: "map_load"})
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+
+  id := server.SpawnBot()
+  if err := server.Teleport(id, Vector3{x: 4, z: 4}); err != nil {
+    t.Fatal(err)
+  }
+  if err := server.WalkBot(id, Vector3{x: 28, z: 4}); err != nil {
+    t.Fatal(err)
+  }
+  path := slices.Clone(server.clients[id].path)
+  if len(path) == 0 {
+    t.Fatal("bot has no path to walk")
+  }
+  snapshot, err := server.SnapshotWorld()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !snapshot.SavedAt.Equal(clock.Now()) {
+    t.Fatalf("snapshot saved at %v, server clock at %v", snapshot.SavedAt, clock.Now())
+  }
+
+  if err := server.RestoreWorld(snapshot); err != nil {
+    t.Fatal(err)
+  }
+  if restored := server.clients[id].path; !slices.Equal(restored, path) {
+    t.Fatalf("bot path %v restored as %v", path, restored)
+  }
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+const (
+  defaultZoneName = "main"
+  portalCooldown  = 2 * time.Second
+)
+
+// a named area with its own map and user set, users only see the users
+// of their zone
+type Zone struct {
+  name         string
+  mapGenerator *MapGenerator
+  chunks       *ChunkManager
+  clients      map[string]*Client
+  pathfinder   *Pathfinder
+}
+
+func NewZone(name string, mapGenerator *MapGenerator) *Zone {
+  return &Zone{
+    name:         name,
+    mapGenerator: mapGenerator,
+    clients:      make(map[string]*Client),
+    pathfinder:   NewPathfinder(mapGenerator.GetMapData),
+  }
+}
+
+func NewChunkedZone(name string, chunks *ChunkManager) *Zone {
+  return &Zone{
+    name:    name,
+    chunks:  chunks,
+    clients: make(map[string]*Client),
+  }
+}
+
+func (zone *Zone) terrain() Terrain {
+  if zone.chunks != nil {
+    return zone.chunks
+  }
+  mapData, err := zone.mapGenerator.GetMapData()
+  if err != nil {
+    return nil
+  }
+  return mapData
+}
+
+// chunked terrain only answers for the chunks in memory, the server places
+// users through it so the chunk under them is there
+func (zone *Zone) loadTerrainAt(location Vector3) {
+  if zone.chunks != nil {
+    zone.chunks.LoadAt(location.x, location.z)
+  }
+}
+
+func (zone *Zone) groundAt(location Vector3) Vector3 {
+  zone.loadTerrainAt(location)
+  return snapToGround(zone.terrain(), location)
+}
+
+func (zone *Zone) chunkSource() ChunkSource {
+  if zone.chunks != nil {
+    return zone.chunks
+  }
+  mapData, err := zone.mapGenerator.GetMapData()
+  if err != nil {
+    return nil
+  }
+  return mapData
+}
+
+func (zone *Zone) meta() MapMeta {
+  if zone.chunks != nil {
+    return zone.chunks.Meta()
+  }
+  mapData, err := zone.mapGenerator.GetMapData()
+  if err != nil {
+    return MapMeta{}
+  }
+  return mapData.Meta
+}
+
+var errNoPathfinding = errors.New("pathfinding needs a bounded map")
+
+// the chunked world has no bounds for the search, its zones refuse paths
+func (zone *Zone) FindPath(from, to Vector3, maxLength float32) ([]Vector3, error) {
+  if zone.pathfinder == nil {
+    return nil, fmt.Errorf("%w, zone %s is chunked", errNoPathfinding, zone.name)
+  }
+  return zone.pathfinder.FindPath(from, to, maxLength)
+}
+
+// cached paths may cross terrain that changed
+func (zone *Zone) invalidatePaths() {
+  if zone.pathfinder != nil {
+    zone.pathfinder.Invalidate()
+  }
+}
+
+func (zone *Zone) ApplyEdit(edit TerrainEdit) (MapRegion, *MapData, error) {
+  if zone.chunks != nil {
+    return zone.chunks.ApplyEdit(edit)
+  }
+  region, delta, err := zone.mapGenerator.ApplyEdit(edit)
+  if err == nil {
+    zone.invalidatePaths()
+  }
+  return region, delta, err
+}
+
+// name of the map file for fixed maps
+func (zone *Zone) mapID() string {
+  if zone.chunks != nil {
+    return fmt.Sprintf("chunks:%d", zone.chunks.Seed())
+  }
+  filename := zone.mapGenerator.Filename()
+  return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
+
+// checksum of the current heights, empty for the chunked world
+func (zone *Zone) mapHash() string {
+  if zone.chunks != nil {
+    return ""
+  }
+  mapData, err := zone.mapGenerator.GetMapData()
+  if err != nil {
+    return ""
+  }
+  return mapData.Hash()
+}
+
+func (server *Server) AddZone(zone *Zone) {
+  server.mu.Lock()
+  defer server.mu.Unlock()
+
+  server.zones[zone.name] = zone
+  worldLog.Info("zone added", "zone", zone.name, "map", zone.mapID(), "hash", zone.mapHash())
+}
+
+// loads every map file of dir as a zone named after the file
+func (server *Server) LoadZones(dir string) error {
+  files, err := filepath.Glob(filepath.Join(dir, "*.bin"))
+  if err != nil {
+    return err
+  }
+
+  for _, filename := range files {
+    name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+    mapGenerator := server.newMapGenerator()
+    if err := mapGenerator.LoadFromFile(filename); err != nil {
+      worldLog.Error("zone not loaded", "zone", name, "err", err)
+      continue
+    }
+    server.AddZone(NewZone(name, mapGenerator))
+  }
+  return nil
+}
+
+func (server *Server) zone(name string) *Zone {
+  if zone, ok := server.zones[name]; ok {
+    return zone
+  }
+  return server.zones[defaultZoneName]
+}
+
+// must be called with server.mu held
+func (server *Server) moveToZone(client *Client, target *Zone, location Vector3, cause string) {
+  server.exitTriggers(client)
+  if client.zone != nil {
+    delete(client.zone.clients, client.user.id)
+  }
+
+  client.zone = target
+  target.clients[client.user.id] = client
+  client.sentChunks = make(map[ChunkCoord]time.Time)
+  client.path = nil
+  client.portalCooldown = server.clock.Now().Add(portalCooldown)
+  from := client.user.location
+  client.user.updatePosition(target.groundAt(location))
+  server.dispatchUserMoved(client, from, cause)
+
+  server.sendZoneChange(client)
+}
+
+func (server *Server) sendZoneChange(client *Client) {
+  server.sendJSON(client.addr, ZoneChange{
+    Type:    "zone_change",
+    Zone:    client.zone.name,
+    MapID:   client.zone.mapID(),
+    MapHash: client.zone.mapHash(),
+  })
+}
+
+// must be called with server.mu held
+func (server *Server) checkPortals(now time.Time) {
+  for _, zone := range server.zones {
+    portals := zone.meta().Portals
+    if len(portals) == 0 {
+      continue
+    }
+
+    for _, client := range zone.clients {
+      if client.user == nil || now.Before(client.portalCooldown) {
+        continue
+      }
+      for i := range portals {
+        portal := &portals[i]
+        if !portal.contains(client.user.location) {
+          continue
+        }
+        target, ok := server.zones[portal.TargetZone]
+        if !ok {
+          continue
+        }
+        worldLog.Info("portal taken", "id", client.user.id, "portal", portal.Name, "from", zone.name, "to", target.name)
+        server.moveToZone(client, target, Vector3{x: portal.Target[0], y: portal.Target[1], z: portal.Target[2]}, "portal")
+        break
+      }
+    }
+  }
+}
+
+func (server *Server) validatePortals() {
+  server.mu.RLock()
+  defer server.mu.RUnlock()
+
+  for _, zone := range server.zones {
+    for _, portal := range zone.meta().Portals {
+      if _, ok := server.zones[portal.TargetZone]; !ok {
+        worldLog.Warn("portal leads to unknown zone", "portal", portal.Name, "zone", zone.name, "target", portal.TargetZone)
+      }
+    }
+  }
+}
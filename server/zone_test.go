@@ -0,0 +1,45 @@
+package main
+
+import (
+  "net"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestPortalMovesUserToZone(t *testing.T) {
+  server := newTestServer(t)
+  clock := NewManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+  server.clock = clock
+
+  cave := server.newMapGenerator()
+  if _, err := cave.saveAndUse(flatMap(17, 17, 3), filepath.Join(server.config.MapDir, "cave.bin")); err != nil {
+    t.Fatal(err)
+  }
+  server.AddZone(NewZone("cave", cave))
+  start := server.zones[defaultZoneName]
+  mapData := flatMap(33, 33, 0)
+  mapData.Meta.Portals = []Portal{{Name: "door", X: 20, Z: 20, Radius: 2, TargetZone: "cave", Target: [3]float32{8, 0, 8}}}
+  if _, err := start.mapGenerator.saveAndUse(mapData, start.mapGenerator.Filename()); err != nil {
+    t.Fatal(err)
+  }
+
+  addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+  server.handleDatagram(addr, []byte(`{"type":"map_info"}`))
+  client := server.clients[addr.String()]
+  if err := server.Teleport(client.user.id, Vector3{x: 20, z: 20}); err != nil {
+    t.Fatal(err)
+  }
+  clock.Set(clock.Now().Add(portalCooldown))
+  server.runTick()
+
+  if client.zone.name != "cave" {
+    t.Fatalf("user in zone %s after the portal, expected cave", client.zone.name)
+  }
+  if _, ok := start.clients[client.user.id]; ok {
+    t.Fatal("user still listed in the main zone")
+  }
+  if location := client.user.location; location != (Vector3{x: 8, y: 3, z: 8}) {
+    t.Fatalf("user at %v, expected on the ground at the portal target", location)
+  }
+}